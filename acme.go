@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupACME 通过ACME（Let's Encrypt）自动申请和续期证书
+// 证书保存在ACMECacheDir中，重启后无需重新申请；HTTP-01验证由ACMEHTTPPort上的辅助监听处理，
+// 该端口上的其他请求会被重定向到HTTPS
+func (ps *ProxyServer) setupACME() {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(ps.config.ACMEDomains...),
+		Cache:      autocert.DirCache(ps.config.ACMECacheDir),
+		Email:      ps.config.ACMEEmail,
+	}
+
+	ps.httpServer.TLSConfig = manager.TLSConfig()
+	ps.challengeServer = &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", ps.config.Host, ps.config.ACMEHTTPPort),
+		Handler:           manager.HTTPHandler(nil),
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("✓ 已启用ACME自动证书，域名: %v，证书缓存: %s", ps.config.ACMEDomains, ps.config.ACMECacheDir)
+}
+
+// runChallengeServer 在已建立的监听上运行HTTP-01验证服务
+func (ps *ProxyServer) runChallengeServer(listener net.Listener) {
+	log.Printf("📡 ACME验证监听地址: %s", ps.challengeServer.Addr)
+	if err := ps.challengeServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("ACME验证监听异常退出: %v", err)
+	}
+}
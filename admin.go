@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// setupAdminRoutes 注册管理接口
+// 管理接口使用独立的ADMIN_API_KEY认证，未配置时不注册任何管理路由
+func (ps *ProxyServer) setupAdminRoutes() {
+	if ps.config.AdminAPIKey == "" {
+		return
+	}
+
+	ps.handleAdmin("/admin/stats", "GET", ps.handleAdminStats)
+	ps.handleAdmin("/admin/streams", "GET", ps.handleAdminStreams)
+	ps.handleAdmin("/admin/users", "GET", ps.handleAdminUsers)
+	ps.handleAdmin("/admin/usage/export", "GET", ps.handleAdminUsageExport)
+	ps.handleAdmin("/admin/report", "", ps.handleAdminReport)
+	ps.handleAdmin("/admin/cache/flush", "POST", ps.handleAdminFlushCache)
+	ps.handleAdmin("/admin/reload", "POST", ps.handleAdminReload)
+	ps.handleAdmin("/admin/debug", "", ps.handleAdminDebug)
+	ps.handleAdmin("/admin/canary", "", ps.handleAdminCanary)
+	ps.handleAdmin("/admin/dashboard", "GET", ps.handleAdminDashboardData)
+	ps.handleAdmin("/dashboard/", "GET", ps.handleDashboardAssets)
+
+	log.Printf("✓ 管理接口已启用: /admin/*")
+}
+
+// handleAdmin 注册需要管理密钥的路由，并校验请求方法，method为空时不限制方法
+func (ps *ProxyServer) handleAdmin(pattern, method string, handler http.HandlerFunc) {
+	ps.handle(route{pattern: pattern, auth: authAdmin, timeout: true}, func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+			return
+		}
+
+		log.Printf("管理操作: %s %s (来自 %s)", r.Method, r.URL.Path, getClientIP(r))
+		// 只读的查询不写审计日志，仪表盘会频繁轮询
+		if r.Method != "GET" && r.Method != "HEAD" {
+			ps.audit.Record(requestAuditEntry("admin_action", r, map[string]string{"method": r.Method, "path": r.URL.Path}))
+		}
+		handler(w, r)
+	})
+}
+
+// checkAdminAuth 校验管理密钥，失败时写出401并返回false
+// 同时接受Bearer令牌和HTTP Basic认证（用户名任意，密码为管理密钥），后者便于浏览器访问仪表盘
+func (ps *ProxyServer) checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(ps.config.AdminAPIKey)) == 1 {
+		return true
+	}
+
+	log.Printf("管理接口认证失败: %s %s (来自 %s)", r.Method, r.URL.Path, getClientIP(r))
+	ps.audit.Record(requestAuditEntry("admin_auth_failure", r, map[string]string{"method": r.Method, "path": r.URL.Path}))
+	w.Header().Set("WWW-Authenticate", `Basic realm="deepseek-proxy admin", charset="UTF-8"`)
+	writeAPIError(w, &apiError{
+		StatusCode: http.StatusUnauthorized,
+		Type:       errTypeAuthentication,
+		Message:    "管理密钥无效",
+		Code:       "invalid_admin_key",
+	})
+	return false
+}
+
+// handleAdminStats 返回实时统计
+func (ps *ProxyServer) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{
+		"pid":            os.Getpid(),
+		"uptime_seconds": time.Since(startTime).Seconds(),
+		"draining":       ps.draining.Load(),
+		"debug_logging":  debugLogging.Load(),
+		"requests":       ps.stats.Snapshot(),
+		"breaker":        ps.breaker.Snapshot(),
+		"upstream":       ps.prober.Status(),
+	}
+	if ps.cache != nil {
+		stats["cache"] = ps.cache.Stats()
+	}
+	if ps.scheduler != nil {
+		stats["scheduler"] = ps.scheduler.Snapshot()
+	}
+	if ps.shadow != nil {
+		stats["shadow"] = ps.shadow.Stats()
+	}
+	if ps.tenants != nil {
+		stats["tenants"] = ps.tenants.Stats()
+	}
+	if ps.quotas != nil {
+		stats["quotas"] = ps.quotas.Stats()
+	}
+	if ps.upstreams != nil {
+		stats["upstream_pool"] = ps.upstreams.Snapshot()
+	}
+	if ps.keyBudget != nil {
+		stats["upstream_budget"] = ps.keyBudget.Snapshot(r.Context(), ps.upstreamKeys())
+	}
+	if ps.cassettes != nil {
+		stats["cassettes"] = ps.cassettes.Stats()
+	}
+	if ps.chaos != nil {
+		stats["chaos"] = ps.chaos.Stats()
+	}
+	if ps.modelSplits != nil {
+		stats["model_splits"] = ps.modelSplits.Snapshot()
+	}
+	if ps.offPeak != nil {
+		stats["off_peak"] = ps.offPeak.Snapshot()
+	}
+	if ps.semanticCache != nil {
+		stats["semantic_cache"] = ps.semanticCache.Stats()
+	}
+	if ps.coalescer != nil {
+		stats["coalescing"] = ps.coalescer.Stats()
+	}
+	if logSampling != nil {
+		stats["log_sampling"] = logSampling.Stats()
+	}
+	if ps.audit != nil {
+		stats["audit"] = ps.audit.Stats()
+	}
+
+	if err := writeJSONResponse(w, stats); err != nil {
+		log.Printf("写入管理统计响应失败: %v", err)
+	}
+}
+
+// handleAdminStreams 列出进行中的流式响应
+func (ps *ProxyServer) handleAdminStreams(w http.ResponseWriter, r *http.Request) {
+	streams := ps.stats.Streams()
+	if err := writeJSONResponse(w, map[string]interface{}{
+		"object": "list",
+		"data":   streams,
+	}); err != nil {
+		log.Printf("写入流列表响应失败: %v", err)
+	}
+}
+
+// handleAdminFlushCache 清空响应缓存和语义缓存
+func (ps *ProxyServer) handleAdminFlushCache(w http.ResponseWriter, r *http.Request) {
+	flushed := map[string]int{}
+	if ps.cache != nil {
+		flushed["cache"] = ps.cache.Flush(r.Context())
+	}
+	if ps.semanticCache != nil {
+		flushed["semantic_cache"] = ps.semanticCache.Flush()
+	}
+	log.Printf("缓存已清空: %v", flushed)
+
+	if err := writeJSONResponse(w, map[string]interface{}{"flushed": flushed}); err != nil {
+		log.Printf("写入清空缓存响应失败: %v", err)
+	}
+}
+
+// handleAdminReload 重新加载配置
+// 配置在进程启动时读取，重新加载通过热升级完成：新进程读取最新的.env和环境变量并接管监听，
+// 当前进程处理完进行中的请求后退出，客户端连接不会中断
+func (ps *ProxyServer) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if upgradeSignal == nil {
+		handleError(w, fmt.Errorf("当前平台不支持热升级，请重启进程以加载新配置"), http.StatusNotImplemented, "重新加载配置")
+		return
+	}
+
+	process, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = process.Signal(upgradeSignal)
+	}
+	if err != nil {
+		handleError(w, fmt.Errorf("触发热升级失败: %w", err), http.StatusInternalServerError, "重新加载配置")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if err := writeJSONResponse(w, map[string]interface{}{
+		"status":  "reloading",
+		"message": "正在启动加载新配置的进程，当前进程将在请求处理完后退出",
+	}); err != nil {
+		log.Printf("写入重新加载响应失败: %v", err)
+	}
+}
+
+// handleAdminDebug 查看或切换调试日志
+// POST {"enabled": true} 开启，{"enabled": false} 关闭
+func (ps *ProxyServer) handleAdminDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			handleError(w, fmt.Errorf("请求体应为 {\"enabled\": true|false}"), http.StatusBadRequest, "切换调试日志")
+			return
+		}
+		debugLogging.Store(*body.Enabled)
+		log.Printf("调试日志已%s", map[bool]string{true: "开启", false: "关闭"}[*body.Enabled])
+	default:
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	if err := writeJSONResponse(w, map[string]interface{}{"debug_logging": debugLogging.Load()}); err != nil {
+		log.Printf("写入调试日志状态失败: %v", err)
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Anthropic Messages API兼容层
+// /v1/messages接收Anthropic格式的请求（system字段、内容块、tool_use/tool_result），
+// 转换为ChatRequest后与/v1/chat/completions共用同一套处理流程，
+// 再把DeepSeek的响应转换回Anthropic格式，流式响应按message_start、content_block_delta等事件发送
+
+// anthropicRequest Anthropic格式的请求
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	System        json.RawMessage      `json:"system,omitempty"` // 字符串或文本块数组
+	Messages      []anthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Thinking      *struct {
+		Type string `json:"type"`
+	} `json:"thinking,omitempty"`
+	Metadata *struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // 字符串或内容块数组
+}
+
+// anthropicContentBlock 请求中的内容块，不同类型使用不同的字段
+type anthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // tool_result的内容：字符串或内容块数组
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+type anthropicTool struct {
+	Type        string          `json:"type,omitempty"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"` // auto、any、tool或none
+	Name string `json:"name,omitempty"`
+}
+
+// thinkingEnabled 客户端是否请求返回思考过程
+func (req *anthropicRequest) thinkingEnabled() bool {
+	return req.Thinking != nil && req.Thinking.Type == "enabled"
+}
+
+// anthropicText 解析字符串或内容块数组形式的内容
+// 返回文本块拼接后的文本，图片等无法转发的块替换为占位说明
+func anthropicText(raw json.RawMessage) (string, []anthropicContentBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", nil, fmt.Errorf("必须是字符串或内容块数组")
+	}
+	var parts []string
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, block.Text)
+		case "image", "document":
+			parts = append(parts, fmt.Sprintf("[%s内容已省略：上游模型不支持]", block.Type))
+		}
+	}
+	return strings.Join(parts, "\n"), blocks, nil
+}
+
+// toChatRequest 把Anthropic请求转换为OpenAI格式的ChatRequest
+func (req *anthropicRequest) toChatRequest(requestID string) (*ChatRequest, error) {
+	chatReq := &ChatRequest{
+		Model:       req.Model,
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+	}
+	if req.MaxTokens > 0 {
+		maxTokens := req.MaxTokens
+		chatReq.MaxTokens = &maxTokens
+	}
+	if req.Metadata != nil {
+		chatReq.User = req.Metadata.UserID
+	}
+	if len(req.StopSequences) > 0 {
+		log.Printf("[%s] 忽略stop_sequences：上游不支持", requestID)
+	}
+
+	system, _, err := anthropicText(req.System)
+	if err != nil {
+		return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "system" + err.Error(), Param: "system"}
+	}
+	if system != "" {
+		chatReq.Messages = append(chatReq.Messages, Message{Role: "system", Content: system})
+	}
+
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+				Message: fmt.Sprintf("messages[%d].role只能是user或assistant", i), Param: "messages"}
+		}
+		text, blocks, err := anthropicText(msg.Content)
+		if err != nil {
+			return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+				Message: fmt.Sprintf("messages[%d].content%v", i, err), Param: "messages"}
+		}
+
+		if msg.Role == "assistant" {
+			reply := Message{Role: "assistant", Content: text}
+			for _, block := range blocks {
+				if block.Type != "tool_use" {
+					continue
+				}
+				call := ToolCall{ID: block.ID, Type: "function"}
+				call.Function.Name = block.Name
+				call.Function.Arguments = string(block.Input)
+				if len(block.Input) == 0 {
+					call.Function.Arguments = "{}"
+				}
+				reply.ToolCalls = append(reply.ToolCalls, call)
+			}
+			chatReq.Messages = append(chatReq.Messages, reply)
+			continue
+		}
+
+		// tool_result块转换为tool消息，必须紧跟在对应的assistant消息之后，
+		// 因此先于同一条user消息中的文本输出
+		hasText := len(blocks) == 0
+		for _, block := range blocks {
+			switch block.Type {
+			case "tool_result":
+				content, _, err := anthropicText(block.Content)
+				if err != nil {
+					return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+						Message: fmt.Sprintf("messages[%d]中tool_result的content%v", i, err), Param: "messages"}
+				}
+				if block.IsError {
+					content = "[工具执行出错] " + content
+				}
+				chatReq.Messages = append(chatReq.Messages, Message{Role: "tool", ToolCallID: block.ToolUseID, Content: content})
+			case "text", "image", "document":
+				hasText = true
+			}
+		}
+		if hasText {
+			chatReq.Messages = append(chatReq.Messages, Message{Role: "user", Content: text})
+		}
+	}
+
+	for _, tool := range req.Tools {
+		// web_search等服务端工具没有input_schema，上游无法执行
+		if len(tool.InputSchema) == 0 {
+			log.Printf("[%s] 忽略不支持的服务端工具: %s (%s)", requestID, tool.Name, tool.Type)
+			continue
+		}
+		var schema interface{}
+		if err := json.Unmarshal(tool.InputSchema, &schema); err != nil {
+			return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+				Message: fmt.Sprintf("工具 %s 的input_schema无效", tool.Name), Param: "tools"}
+		}
+		chatReq.Tools = append(chatReq.Tools, Tool{
+			Type:     "function",
+			Function: Function{Name: tool.Name, Description: tool.Description, Parameters: schema},
+		})
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto", "none":
+			chatReq.ToolChoice = req.ToolChoice.Type
+		case "any":
+			chatReq.ToolChoice = "required"
+		case "tool":
+			chatReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": req.ToolChoice.Name},
+			}
+		}
+	}
+	return chatReq, nil
+}
+
+// anthropicStopReason 将finish_reason映射为Anthropic的stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicErrorType 将HTTP状态码映射为Anthropic错误类型
+func anthropicErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// writeAnthropicError 输出Anthropic格式的错误响应 {"type":"error","error":{"type","message"}}
+// 带状态码的apiError和上游错误沿用其状态码，其他错误使用statusCode
+func (ps *ProxyServer) writeAnthropicError(w http.ResponseWriter, err error, statusCode int, context string) {
+	log.Printf("错误 [%s]: %v", context, err)
+
+	message := err.Error()
+	if apiErr, ok := asAPIError(err); ok {
+		statusCode, message = apiErr.StatusCode, apiErr.Message
+	}
+	var upstreamErr *upstreamError
+	var saturated *saturatedError
+	switch {
+	case errors.As(err, &upstreamErr):
+		apiErr := upstreamAPIError(upstreamErr)
+		statusCode, message = apiErr.StatusCode, apiErr.Message
+		if upstreamErr.StatusCode == http.StatusTooManyRequests {
+			setRateLimitHeaders(w, upstreamErr.Header, ps.config)
+		}
+	case errors.Is(err, errCircuitOpen):
+		statusCode = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(int(ps.breaker.RetryAfter().Seconds())+1))
+	case errors.As(err, &saturated):
+		statusCode, message = saturated.StatusCode, saturated.Message
+		saturated.setHeaders(w, ps.config)
+	}
+
+	body := map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": anthropicErrorType(statusCode), "message": message},
+	}
+	if requestID := w.Header().Get("X-Request-ID"); requestID != "" {
+		body["request_id"] = requestID
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := writeJSONResponse(w, body); err != nil {
+		log.Printf("写入错误响应失败: %v", err)
+	}
+}
+
+// handleAnthropicMessages 处理Anthropic Messages API请求
+func (ps *ProxyServer) handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		ps.writeAnthropicError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var req anthropicRequest
+	if err := readJSONRequest(r, &req); err != nil {
+		ps.writeAnthropicError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	if version := r.Header.Get("anthropic-version"); version != "" {
+		debugf("[%s] anthropic-version: %s", requestID, version)
+	}
+	if req.MaxTokens <= 0 {
+		ps.writeAnthropicError(w, fmt.Errorf("max_tokens是必填项且必须大于0"), http.StatusBadRequest, "请求检查")
+		return
+	}
+
+	chatReq, err := req.toChatRequest(requestID)
+	if err != nil {
+		ps.writeAnthropicError(w, err, http.StatusBadRequest, "请求转换")
+		return
+	}
+	log.Printf("[%s] Anthropic请求: 模型 %s，%d 条消息，%d 个工具", requestID, req.Model, len(chatReq.Messages), len(chatReq.Tools))
+
+	if blocked, err := ps.screenInput(chatReq, requestID); err != nil {
+		ps.writeAnthropicError(w, err, http.StatusBadRequest, "凭据检查")
+		return
+	} else if blocked != "" {
+		w.Header().Set("X-Proxy-Guardrail", blocked)
+		ps.writeAnthropicMessage(w, req.Stream, &DeepSeekResponse{
+			Choices: []DeepSeekChoice{{Message: Message{Role: "assistant"}, FinishReason: "content_filter"}},
+		}, &req, requestID)
+		return
+	}
+
+	deepseekReq, err := ps.buildUpstreamRequest(r, chatReq, requestID)
+	if err != nil {
+		ps.writeAnthropicError(w, err, http.StatusInternalServerError, "请求转换")
+		return
+	}
+
+	if req.Stream {
+		defer ps.stats.BeginStream(requestID, req.Model, getClientIP(r))()
+		ps.streamAnthropicResponse(w, r, deepseekReq, &req, requestID)
+		return
+	}
+
+	deepseekResp, err := ps.fetchCompletion(w, r.Context(), deepseekReq, requestID)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+			return
+		}
+		ps.writeAnthropicError(w, fmt.Errorf("DeepSeek请求失败: %w", err), http.StatusBadGateway, "DeepSeek通信")
+		return
+	}
+	recordUsage(r.Context(), deepseekResp.Usage)
+	deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+	ps.writeAnthropicMessage(w, false, deepseekResp, &req, requestID)
+}
+
+// 响应中的内容块。content_block_start中的文本字段即使为空也要输出，客户端在此基础上累加增量
+func anthropicThinkingBlock(thinking string) map[string]interface{} {
+	return map[string]interface{}{"type": "thinking", "thinking": thinking, "signature": ""}
+}
+
+func anthropicTextBlock(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "text", "text": text}
+}
+
+func anthropicToolUseBlock(id, name string, input json.RawMessage) map[string]interface{} {
+	return map[string]interface{}{"type": "tool_use", "id": id, "name": name, "input": input}
+}
+
+// anthropicResponseContent 把DeepSeek的回复转换为Anthropic内容块
+func anthropicResponseContent(msg Message, thinking bool, requestID string) []map[string]interface{} {
+	content := []map[string]interface{}{}
+	if thinking && msg.ReasoningContent != "" {
+		content = append(content, anthropicThinkingBlock(msg.ReasoningContent))
+	}
+	if msg.Content != "" {
+		content = append(content, anthropicTextBlock(msg.Content))
+	}
+	for _, call := range msg.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			log.Printf("[%s] 工具 %s 的参数不是有效的JSON，按空对象返回", requestID, call.Function.Name)
+			input = json.RawMessage("{}")
+		}
+		content = append(content, anthropicToolUseBlock(call.ID, call.Function.Name, input))
+	}
+	return content
+}
+
+// anthropicUsage Anthropic格式的用量
+func anthropicUsage(usage Usage) map[string]interface{} {
+	return map[string]interface{}{
+		"input_tokens":            usage.PromptTokens,
+		"output_tokens":           usage.CompletionTokens,
+		"cache_read_input_tokens": usage.PromptCacheHitTokens,
+	}
+}
+
+// writeAnthropicMessage 以Anthropic格式输出完整响应，stream为true时按事件序列发送
+func (ps *ProxyServer) writeAnthropicMessage(w http.ResponseWriter, stream bool, resp *DeepSeekResponse, req *anthropicRequest, requestID string) {
+	var choice DeepSeekChoice
+	if len(resp.Choices) > 0 {
+		choice = resp.Choices[0]
+	}
+	content := anthropicResponseContent(choice.Message, req.thinkingEnabled(), requestID)
+	stopReason := anthropicStopReason(choice.FinishReason)
+
+	if !stream {
+		if err := writeJSONResponse(w, map[string]interface{}{
+			"id":            "msg_" + requestID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         req.Model,
+			"content":       content,
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+			"usage":         anthropicUsage(resp.Usage),
+		}); err != nil {
+			log.Printf("[%s] 写入响应失败: %v", requestID, err)
+		}
+		return
+	}
+
+	setSSEHeaders(w)
+	s := newAnthropicStream(w, req, requestID)
+	s.start(resp.Usage.PromptTokens)
+	for _, block := range content {
+		switch block["type"] {
+		case "thinking":
+			s.block("thinking", anthropicThinkingBlock(""))
+			s.delta(map[string]interface{}{"type": "thinking_delta", "thinking": block["thinking"]})
+		case "text":
+			s.block("text", anthropicTextBlock(""))
+			s.delta(map[string]interface{}{"type": "text_delta", "text": block["text"]})
+		case "tool_use":
+			s.block("tool_use", anthropicToolUseBlock(block["id"].(string), block["name"].(string), json.RawMessage("{}")))
+			s.delta(map[string]interface{}{"type": "input_json_delta", "partial_json": string(block["input"].(json.RawMessage))})
+		}
+	}
+	s.stop(stopReason, resp.Usage.CompletionTokens)
+}
+
+// anthropicStream 按Anthropic的事件序列发送流式响应
+// 上游的推理内容、正文和工具调用依次转换为thinking、text和tool_use内容块，
+// 类型切换时结束上一个内容块并开始新的内容块
+type anthropicStream struct {
+	w         io.Writer
+	flusher   http.Flusher
+	req       *anthropicRequest
+	requestID string
+
+	index    int    // 当前内容块的序号
+	open     string // 当前内容块的类型，为空表示没有打开的内容块
+	openTool int    // 当前tool_use块对应的上游工具调用序号
+}
+
+func newAnthropicStream(w http.ResponseWriter, req *anthropicRequest, requestID string) *anthropicStream {
+	flusher, _ := w.(http.Flusher)
+	return &anthropicStream{w: w, flusher: flusher, req: req, requestID: requestID, index: -1, openTool: -1}
+}
+
+func (s *anthropicStream) event(name string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[%s] 序列化事件失败: %v", s.requestID, err)
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// start 发送message_start，此时上游还没有返回用量，input_tokens为估算值
+func (s *anthropicStream) start(inputTokens int) {
+	s.event("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            "msg_" + s.requestID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         s.req.Model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         map[string]interface{}{"input_tokens": inputTokens, "output_tokens": 0},
+		},
+	})
+}
+
+// block 确保当前打开的是指定类型的内容块，必要时结束上一个内容块
+func (s *anthropicStream) block(blockType string, contentBlock map[string]interface{}) {
+	if s.open == blockType && blockType != "tool_use" {
+		return
+	}
+	s.closeBlock()
+	s.index++
+	s.open = blockType
+	s.event("content_block_start", map[string]interface{}{"type": "content_block_start", "index": s.index, "content_block": contentBlock})
+}
+
+func (s *anthropicStream) closeBlock() {
+	if s.open == "" {
+		return
+	}
+	s.event("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": s.index})
+	s.open = ""
+}
+
+func (s *anthropicStream) delta(delta map[string]interface{}) {
+	s.event("content_block_delta", map[string]interface{}{"type": "content_block_delta", "index": s.index, "delta": delta})
+}
+
+// chunk 转换一个上游数据块
+func (s *anthropicStream) chunk(chunk *deepSeekStreamChunk) {
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		delta := choice.Delta
+		if delta.ReasoningContent != "" && s.req.thinkingEnabled() {
+			s.block("thinking", anthropicThinkingBlock(""))
+			s.delta(map[string]interface{}{"type": "thinking_delta", "thinking": delta.ReasoningContent})
+		}
+		if delta.Content != "" {
+			s.block("text", anthropicTextBlock(""))
+			s.delta(map[string]interface{}{"type": "text_delta", "text": delta.Content})
+		}
+		for _, call := range delta.ToolCalls {
+			if call.Index != s.openTool || s.open != "tool_use" {
+				s.openTool = call.Index
+				s.block("tool_use", anthropicToolUseBlock(call.ID, call.Function.Name, json.RawMessage("{}")))
+			}
+			if call.Function.Arguments != "" {
+				s.delta(map[string]interface{}{"type": "input_json_delta", "partial_json": call.Function.Arguments})
+			}
+		}
+	}
+}
+
+// stop 结束最后一个内容块并发送message_delta和message_stop
+func (s *anthropicStream) stop(stopReason string, outputTokens int) {
+	s.closeBlock()
+	s.event("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": map[string]interface{}{"output_tokens": outputTokens},
+	})
+	s.event("message_stop", map[string]interface{}{"type": "message_stop"})
+}
+
+// fail 流式响应中途出错时发送error事件
+func (s *anthropicStream) fail(err error) {
+	log.Printf("[%s] 流式响应异常终止: %v", s.requestID, err)
+	statusCode := http.StatusBadGateway
+	if apiErr, ok := asAPIError(err); ok {
+		statusCode = apiErr.StatusCode
+	}
+	s.event("error", map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": anthropicErrorType(statusCode), "message": err.Error()},
+	})
+}
+
+// streamAnthropicResponse 以流式请求上游，并把数据块转换为Anthropic事件
+func (ps *ProxyServer) streamAnthropicResponse(w http.ResponseWriter, r *http.Request,
+	deepseekReq *DeepSeekRequest, req *anthropicRequest, requestID string) {
+
+	ctx, cancel := ps.newStreamContext(r.Context())
+	defer cancel()
+
+	resp, err := ps.sendStreamingRequestToDeepSeek(ctx, deepseekReq, requestID)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("[%s] 客户端在上游响应前断开连接: %v", requestID, err)
+			return
+		}
+		ps.writeAnthropicError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err), http.StatusBadGateway, "DeepSeek流式通信")
+		return
+	}
+	defer resp.Body.Close()
+
+	setSSEHeaders(w)
+	s := newAnthropicStream(w, req, requestID)
+	s.start(countPromptTokens(deepseekReq.Messages, deepseekReq.Tools))
+
+	result := ps.consumeUpstreamStream(ctx, resp.Body, w, s.flusher, requestID, s.chunk)
+	switch {
+	case result.done:
+		s.stop(anthropicStopReason(result.finishReason), result.usage.CompletionTokens)
+		log.Printf("[%s] Anthropic流式响应完成", requestID)
+	case result.err != nil:
+		s.fail(result.err)
+	}
+}
+
+// handleAnthropicCountTokens 估算Anthropic请求的输入token数：POST /v1/messages/count_tokens
+func (ps *ProxyServer) handleAnthropicCountTokens(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		ps.writeAnthropicError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var req anthropicRequest
+	if err := readJSONRequest(r, &req); err != nil {
+		ps.writeAnthropicError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	chatReq, err := req.toChatRequest(requestID)
+	if err != nil {
+		ps.writeAnthropicError(w, err, http.StatusBadRequest, "请求转换")
+		return
+	}
+	systemRules := ps.systemPrompts.Resolve(clientAPIKey(r), req.Model, mapNewModelsToDeepSeek(req.Model))
+	messages := convertMessagesFormat(chatReq.Messages, systemRules)
+	writeJSONResponse(w, map[string]interface{}{
+		"input_tokens": countPromptTokens(messages, chatReq.Tools),
+	})
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Assistants API的最小子集：助手、线程、消息和运行
+// 运行时把助手的指令和线程中的消息转换为一次聊天完成请求，不支持工具调用、文件检索和代码解释器
+
+// 运行的状态
+const (
+	runQueued     = "queued"
+	runInProgress = "in_progress"
+	runCompleted  = "completed"
+	runFailed     = "failed"
+	runCancelled  = "cancelled"
+)
+
+// assistantObject OpenAI格式的助手
+type assistantObject struct {
+	ID           string            `json:"id"`
+	Object       string            `json:"object"`
+	CreatedAt    int64             `json:"created_at"`
+	Name         *string           `json:"name"`
+	Description  *string           `json:"description"`
+	Model        string            `json:"model"`
+	Instructions *string           `json:"instructions"`
+	Tools        []json.RawMessage `json:"tools"`
+	Metadata     map[string]string `json:"metadata"`
+	Temperature  *float64          `json:"temperature"`
+}
+
+// threadObject OpenAI格式的线程
+type threadObject struct {
+	ID        string            `json:"id"`
+	Object    string            `json:"object"`
+	CreatedAt int64             `json:"created_at"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// messageText 消息中的文本内容
+type messageText struct {
+	Type string `json:"type"`
+	Text struct {
+		Value       string        `json:"value"`
+		Annotations []interface{} `json:"annotations"`
+	} `json:"text"`
+}
+
+func newMessageText(value string) messageText {
+	content := messageText{Type: "text"}
+	content.Text.Value = value
+	content.Text.Annotations = []interface{}{}
+	return content
+}
+
+// threadMessage OpenAI格式的线程消息
+type threadMessage struct {
+	ID          string            `json:"id"`
+	Object      string            `json:"object"`
+	CreatedAt   int64             `json:"created_at"`
+	ThreadID    string            `json:"thread_id"`
+	Status      string            `json:"status"`
+	Role        string            `json:"role"`
+	Content     []messageText     `json:"content"`
+	AssistantID *string           `json:"assistant_id"`
+	RunID       *string           `json:"run_id"`
+	Attachments []interface{}     `json:"attachments"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// text 消息的全部文本
+func (m *threadMessage) text() string {
+	parts := make([]string, 0, len(m.Content))
+	for _, content := range m.Content {
+		parts = append(parts, content.Text.Value)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// runError 运行失败的原因
+type runError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// runObject OpenAI格式的运行
+type runObject struct {
+	ID                     string            `json:"id"`
+	Object                 string            `json:"object"`
+	CreatedAt              int64             `json:"created_at"`
+	ThreadID               string            `json:"thread_id"`
+	AssistantID            string            `json:"assistant_id"`
+	Status                 string            `json:"status"`
+	StartedAt              *int64            `json:"started_at"`
+	CompletedAt            *int64            `json:"completed_at"`
+	FailedAt               *int64            `json:"failed_at"`
+	CancelledAt            *int64            `json:"cancelled_at"`
+	LastError              *runError         `json:"last_error"`
+	Model                  string            `json:"model"`
+	Instructions           string            `json:"instructions"`
+	AdditionalInstructions string            `json:"-"`
+	Tools                  []json.RawMessage `json:"tools"`
+	Usage                  *Usage            `json:"usage"`
+	Temperature            *float64          `json:"temperature"`
+	Metadata               map[string]string `json:"metadata"`
+}
+
+// active 运行是否尚未结束
+func (r *runObject) active() bool {
+	return r.Status == runQueued || r.Status == runInProgress
+}
+
+// assistantRecord 保存在磁盘上的助手，Owner为创建者密钥的短哈希
+type assistantRecord struct {
+	Owner     string          `json:"owner"`
+	Assistant assistantObject `json:"assistant"`
+}
+
+// threadRecord 保存在磁盘上的线程，消息和运行随线程一起保存
+type threadRecord struct {
+	Owner    string          `json:"owner"`
+	Thread   threadObject    `json:"thread"`
+	Messages []threadMessage `json:"messages"`
+	Runs     []runObject     `json:"runs"`
+}
+
+// run 按ID查找运行，调用方持有store.mu
+func (t *threadRecord) run(id string) *runObject {
+	for i := range t.Runs {
+		if t.Runs[i].ID == id {
+			return &t.Runs[i]
+		}
+	}
+	return nil
+}
+
+// assistantStore 助手和线程的本地存储，每个助手和线程保存为一个JSON文件
+type assistantStore struct {
+	dir string
+
+	mu         sync.Mutex
+	assistants map[string]*assistantRecord
+	threads    map[string]*threadRecord
+	cancels    map[string]context.CancelFunc // 后台运行的取消函数
+}
+
+func newAssistantStore(config *ProxyConfig) (*assistantStore, error) {
+	if err := os.MkdirAll(config.AssistantsDir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建助手目录失败: %w", err)
+	}
+	s := &assistantStore{
+		dir:        config.AssistantsDir,
+		assistants: make(map[string]*assistantRecord),
+		threads:    make(map[string]*threadRecord),
+		cancels:    make(map[string]context.CancelFunc),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取助手目录失败: %w", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %w", filepath.Base(path), err)
+		}
+		switch name := filepath.Base(path); {
+		case strings.HasPrefix(name, "asst_"):
+			record := &assistantRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return nil, fmt.Errorf("解析 %s 失败: %w", name, err)
+			}
+			s.assistants[record.Assistant.ID] = record
+		case strings.HasPrefix(name, "thread_"):
+			record := &threadRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return nil, fmt.Errorf("解析 %s 失败: %w", name, err)
+			}
+			// 重启前没有结束的运行无法继续
+			for i := range record.Runs {
+				if record.Runs[i].active() {
+					now := time.Now().Unix()
+					record.Runs[i].Status, record.Runs[i].FailedAt = runFailed, &now
+					record.Runs[i].LastError = &runError{Code: "server_error", Message: "代理重启，运行已中断"}
+				}
+			}
+			s.threads[record.Thread.ID] = record
+		}
+	}
+	return s, nil
+}
+
+// save 写回一个助手或线程，调用方持有s.mu
+func (s *assistantStore) save(id string, record interface{}) {
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(s.dir, id+".json"), data)
+	}
+	if err != nil {
+		log.Printf("保存 %s 失败: %v", id, err)
+	}
+}
+
+func (s *assistantStore) remove(id string) {
+	if err := os.Remove(filepath.Join(s.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除 %s 失败: %v", id, err)
+	}
+}
+
+// assistant 返回owner可见的助手
+func (s *assistantStore) assistant(owner, id string) (*assistantObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.assistants[id]
+	if !ok || record.Owner != owner {
+		return nil, false
+	}
+	assistant := record.Assistant
+	return &assistant, true
+}
+
+// withThread 在锁内访问owner可见的线程，change返回true时写回磁盘
+func (s *assistantStore) withThread(owner, id string, change func(t *threadRecord) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.threads[id]
+	if !ok || record.Owner != owner {
+		return false
+	}
+	if change(record) {
+		s.save(id, record)
+	}
+	return true
+}
+
+// newObjectID 生成带前缀的对象ID
+func newObjectID(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+}
+
+// parseMessageContent 解析创建消息时的content：字符串或文本内容块数组
+func parseMessageContent(raw json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		apiErr := newAPIError(http.StatusBadRequest, "content必须是字符串或内容块数组")
+		apiErr.Param = "content"
+		return "", apiErr
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// messageInput 创建消息的请求体
+type messageInput struct {
+	Role     string            `json:"role"`
+	Content  json.RawMessage   `json:"content"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// toMessage 校验并转换为线程消息
+func (in *messageInput) toMessage(threadID string) (*threadMessage, error) {
+	if in.Role != "user" && in.Role != "assistant" {
+		apiErr := newAPIError(http.StatusBadRequest, "role只能是user或assistant")
+		apiErr.Param = "role"
+		return nil, apiErr
+	}
+	text, err := parseMessageContent(in.Content)
+	if err != nil {
+		return nil, err
+	}
+	return &threadMessage{
+		ID:          newObjectID("msg"),
+		Object:      "thread.message",
+		CreatedAt:   time.Now().Unix(),
+		ThreadID:    threadID,
+		Status:      "completed",
+		Role:        in.Role,
+		Content:     []messageText{newMessageText(text)},
+		Attachments: []interface{}{},
+		Metadata:    in.Metadata,
+	}, nil
+}
+
+// handleAssistants 处理助手接口：POST/GET /v1/assistants，GET/POST/DELETE /v1/assistants/{id}
+func (ps *ProxyServer) handleAssistants(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	owner := clientKeyHash(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/assistants"), "/")
+	store := ps.assistants
+
+	switch {
+	case id == "" && r.Method == "POST":
+		var assistant assistantObject
+		if err := readJSONRequest(r, &assistant); err != nil {
+			handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+			return
+		}
+		if assistant.Model == "" {
+			apiErr := newAPIError(http.StatusBadRequest, "缺少model")
+			apiErr.Param = "model"
+			handleError(w, apiErr, http.StatusBadRequest, "助手")
+			return
+		}
+		assistant.ID, assistant.Object, assistant.CreatedAt = newObjectID("asst"), "assistant", time.Now().Unix()
+		if assistant.Tools == nil {
+			assistant.Tools = []json.RawMessage{}
+		}
+		store.mu.Lock()
+		record := &assistantRecord{Owner: owner, Assistant: assistant}
+		store.assistants[assistant.ID] = record
+		store.save(assistant.ID, record)
+		store.mu.Unlock()
+		log.Printf("创建助手 %s，模型 %s", assistant.ID, assistant.Model)
+		writeJSONResponse(w, assistant)
+
+	case id == "" && r.Method == "GET":
+		store.mu.Lock()
+		assistants := make([]assistantObject, 0)
+		for _, record := range store.assistants {
+			if record.Owner == owner {
+				assistants = append(assistants, record.Assistant)
+			}
+		}
+		store.mu.Unlock()
+		sort.Slice(assistants, func(i, j int) bool { return assistants[i].ID > assistants[j].ID })
+		writeListResponse(w, r, assistants, func(i int) string { return assistants[i].ID })
+
+	case id != "":
+		assistant, ok := store.assistant(owner, id)
+		if !ok {
+			handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("助手 %s 不存在", id)), http.StatusNotFound, "助手")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			writeJSONResponse(w, assistant)
+		case "POST":
+			// 修改助手：请求中出现的字段覆盖原值
+			updated := *assistant
+			if err := readJSONRequest(r, &updated); err != nil {
+				handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+				return
+			}
+			updated.ID, updated.Object, updated.CreatedAt = assistant.ID, assistant.Object, assistant.CreatedAt
+			store.mu.Lock()
+			store.assistants[id].Assistant = updated
+			store.save(id, store.assistants[id])
+			store.mu.Unlock()
+			writeJSONResponse(w, updated)
+		case "DELETE":
+			store.mu.Lock()
+			delete(store.assistants, id)
+			store.remove(id)
+			store.mu.Unlock()
+			writeJSONResponse(w, map[string]interface{}{"id": id, "object": "assistant.deleted", "deleted": true})
+		default:
+			handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		}
+
+	default:
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+	}
+}
+
+// writeListResponse 按after和limit参数分页写出OpenAI格式的列表，items已按返回顺序排列
+func writeListResponse[T any](w http.ResponseWriter, r *http.Request, items []T, idOf func(i int) string) {
+	limit := 20
+	if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 100 {
+		limit = value
+	}
+	start := 0
+	if after := r.URL.Query().Get("after"); after != "" {
+		start = len(items)
+		for i := range items {
+			if idOf(i) == after {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	response := map[string]interface{}{
+		"object":   "list",
+		"data":     items[start:end],
+		"has_more": end < len(items),
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if end > start {
+		response["first_id"] = idOf(start)
+		response["last_id"] = idOf(end - 1)
+	}
+	writeJSONResponse(w, response)
+}
+
+// handleThreads 处理线程接口：
+// POST /v1/threads 创建线程，GET/DELETE /v1/threads/{id}，
+// POST/GET /v1/threads/{id}/messages，GET /v1/threads/{id}/messages/{message_id}，
+// POST/GET /v1/threads/{id}/runs，GET /v1/threads/{id}/runs/{run_id}，POST /v1/threads/{id}/runs/{run_id}/cancel
+func (ps *ProxyServer) handleThreads(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	owner := clientKeyHash(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/threads"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != "POST" {
+			handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+			return
+		}
+		ps.createThread(w, r, owner)
+		return
+	}
+
+	threadID := parts[0]
+	var thread threadRecord
+	if !ps.assistants.withThread(owner, threadID, func(t *threadRecord) bool {
+		thread = *t
+		return false
+	}) {
+		handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("线程 %s 不存在", threadID)), http.StatusNotFound, "线程")
+		return
+	}
+
+	resource := strings.Join(parts[1:], "/")
+	switch {
+	case resource == "" && r.Method == "GET":
+		writeJSONResponse(w, thread.Thread)
+	case resource == "" && r.Method == "DELETE":
+		store := ps.assistants
+		store.mu.Lock()
+		delete(store.threads, threadID)
+		store.remove(threadID)
+		store.mu.Unlock()
+		writeJSONResponse(w, map[string]interface{}{"id": threadID, "object": "thread.deleted", "deleted": true})
+	case resource == "messages" && r.Method == "POST":
+		ps.createThreadMessage(w, r, owner, threadID)
+	case resource == "messages" && r.Method == "GET":
+		messages := thread.Messages
+		if r.URL.Query().Get("order") != "asc" {
+			messages = make([]threadMessage, len(thread.Messages))
+			for i, message := range thread.Messages {
+				messages[len(messages)-1-i] = message
+			}
+		}
+		writeListResponse(w, r, messages, func(i int) string { return messages[i].ID })
+	case len(parts) == 3 && parts[1] == "messages" && r.Method == "GET":
+		for _, message := range thread.Messages {
+			if message.ID == parts[2] {
+				writeJSONResponse(w, message)
+				return
+			}
+		}
+		handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("消息 %s 不存在", parts[2])), http.StatusNotFound, "线程")
+	case resource == "runs" && r.Method == "POST":
+		ps.createRun(w, r, owner, threadID)
+	case resource == "runs" && r.Method == "GET":
+		runs := make([]runObject, len(thread.Runs))
+		for i, run := range thread.Runs {
+			runs[len(runs)-1-i] = run
+		}
+		writeListResponse(w, r, runs, func(i int) string { return runs[i].ID })
+	case len(parts) >= 3 && parts[1] == "runs":
+		run := thread.run(parts[2])
+		if run == nil {
+			handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("运行 %s 不存在", parts[2])), http.StatusNotFound, "线程")
+			return
+		}
+		switch {
+		case len(parts) == 3 && r.Method == "GET":
+			writeJSONResponse(w, run)
+		case len(parts) == 4 && parts[3] == "cancel" && r.Method == "POST":
+			ps.assistants.mu.Lock()
+			if cancel, ok := ps.assistants.cancels[run.ID]; ok {
+				cancel()
+				run.Status = "cancelling"
+			}
+			ps.assistants.mu.Unlock()
+			writeJSONResponse(w, run)
+		default:
+			handleError(w, fmt.Errorf("不支持的操作: %s %s", r.Method, r.URL.Path), http.StatusNotFound, "线程")
+		}
+	default:
+		handleError(w, fmt.Errorf("不支持的操作: %s %s", r.Method, r.URL.Path), http.StatusNotFound, "线程")
+	}
+}
+
+// createThread 创建线程，可以同时带上初始消息
+func (ps *ProxyServer) createThread(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		Messages []messageInput    `json:"messages"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	if r.ContentLength != 0 {
+		if err := readJSONRequest(r, &req); err != nil {
+			handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+			return
+		}
+	}
+
+	record := &threadRecord{Owner: owner, Thread: threadObject{
+		ID:        newObjectID("thread"),
+		Object:    "thread",
+		CreatedAt: time.Now().Unix(),
+		Metadata:  req.Metadata,
+	}, Messages: []threadMessage{}, Runs: []runObject{}}
+	for _, input := range req.Messages {
+		message, err := input.toMessage(record.Thread.ID)
+		if err != nil {
+			handleError(w, err, http.StatusBadRequest, "线程")
+			return
+		}
+		record.Messages = append(record.Messages, *message)
+	}
+
+	store := ps.assistants
+	store.mu.Lock()
+	store.threads[record.Thread.ID] = record
+	store.save(record.Thread.ID, record)
+	store.mu.Unlock()
+	log.Printf("创建线程 %s，%d 条初始消息", record.Thread.ID, len(record.Messages))
+	writeJSONResponse(w, record.Thread)
+}
+
+// createThreadMessage 向线程添加消息，线程有进行中的运行时拒绝
+func (ps *ProxyServer) createThreadMessage(w http.ResponseWriter, r *http.Request, owner, threadID string) {
+	var input messageInput
+	if err := readJSONRequest(r, &input); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	message, err := input.toMessage(threadID)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest, "线程")
+		return
+	}
+
+	busy := false
+	ps.assistants.withThread(owner, threadID, func(t *threadRecord) bool {
+		for _, run := range t.Runs {
+			if run.active() {
+				busy = true
+				return false
+			}
+		}
+		t.Messages = append(t.Messages, *message)
+		return true
+	})
+	if busy {
+		handleError(w, newAPIError(http.StatusBadRequest, "线程有进行中的运行，请等待运行结束后再添加消息"), http.StatusBadRequest, "线程")
+		return
+	}
+	writeJSONResponse(w, message)
+}
+
+// createRun 创建运行：stream为true时以Assistants格式的SSE事件返回，否则在后台执行，客户端轮询运行状态
+func (ps *ProxyServer) createRun(w http.ResponseWriter, r *http.Request, owner, threadID string) {
+	var req struct {
+		AssistantID            string            `json:"assistant_id"`
+		Model                  string            `json:"model"`
+		Instructions           *string           `json:"instructions"`
+		AdditionalInstructions string            `json:"additional_instructions"`
+		Temperature            *float64          `json:"temperature"`
+		Stream                 bool              `json:"stream"`
+		Metadata               map[string]string `json:"metadata"`
+	}
+	if err := readJSONRequest(r, &req); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	assistant, ok := ps.assistants.assistant(owner, req.AssistantID)
+	if !ok {
+		apiErr := newAPIError(http.StatusNotFound, fmt.Sprintf("助手 %s 不存在", req.AssistantID))
+		apiErr.Param = "assistant_id"
+		handleError(w, apiErr, http.StatusNotFound, "线程")
+		return
+	}
+
+	run := runObject{
+		ID:                     newObjectID("run"),
+		Object:                 "thread.run",
+		CreatedAt:              time.Now().Unix(),
+		ThreadID:               threadID,
+		AssistantID:            assistant.ID,
+		Status:                 runQueued,
+		Model:                  assistant.Model,
+		Tools:                  assistant.Tools,
+		AdditionalInstructions: req.AdditionalInstructions,
+		Temperature:            assistant.Temperature,
+		Metadata:               req.Metadata,
+	}
+	if assistant.Instructions != nil {
+		run.Instructions = *assistant.Instructions
+	}
+	if req.Instructions != nil {
+		run.Instructions = *req.Instructions
+	}
+	if req.Model != "" {
+		run.Model = req.Model
+	}
+	if req.Temperature != nil {
+		run.Temperature = req.Temperature
+	}
+
+	busy := false
+	ps.assistants.withThread(owner, threadID, func(t *threadRecord) bool {
+		for _, existing := range t.Runs {
+			if existing.active() {
+				busy = true
+				return false
+			}
+		}
+		t.Runs = append(t.Runs, run)
+		return true
+	})
+	if busy {
+		handleError(w, newAPIError(http.StatusBadRequest, "线程已有进行中的运行"), http.StatusBadRequest, "线程")
+		return
+	}
+	log.Printf("线程 %s 创建运行 %s，助手 %s，模型 %s", threadID, run.ID, assistant.ID, run.Model)
+
+	if req.Stream {
+		setSSEHeaders(w)
+		flusher, _ := w.(http.Flusher)
+		events := &runEvents{w: w, flusher: flusher}
+		events.send("thread.run.created", run)
+		events.send("thread.run.queued", run)
+		ctx, cancel := ps.newStreamContext(r.Context())
+		defer cancel()
+		ps.executeRun(ctx, r, owner, threadID, run.ID, events)
+		events.done()
+		return
+	}
+
+	// 后台运行不随客户端请求结束而取消，可以通过cancel接口取消；保留请求的租户，按租户的密钥和限制调用上游
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	ps.assistants.mu.Lock()
+	ps.assistants.cancels[run.ID] = cancel
+	ps.assistants.mu.Unlock()
+	background := r.Clone(ctx)
+	go func() {
+		defer func() {
+			ps.assistants.mu.Lock()
+			delete(ps.assistants.cancels, run.ID)
+			ps.assistants.mu.Unlock()
+			cancel()
+		}()
+		// 创建运行的请求已计入配额的请求数，后台产生的用量单独统计，计入配额、租户和上游预算
+		ps.withStats("/v1/threads/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ps.executeRun(r.Context(), r, owner, threadID, run.ID, nil)
+		})).ServeHTTP(httptest.NewRecorder(), background)
+	}()
+	writeJSONResponse(w, run)
+}
+
+// runEvents 以Assistants API的SSE事件格式输出运行进度，为nil时不输出
+type runEvents struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e *runEvents) send(event string, data interface{}) {
+	if e == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, payload)
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+}
+
+func (e *runEvents) done() {
+	fmt.Fprintf(e.w, "event: done\ndata: [DONE]\n\n")
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+}
+
+// updateRun 修改线程中的运行并写回，返回修改后的副本
+func (ps *ProxyServer) updateRun(owner, threadID, runID string, change func(t *threadRecord, run *runObject)) runObject {
+	var result runObject
+	ps.assistants.withThread(owner, threadID, func(t *threadRecord) bool {
+		run := t.run(runID)
+		if run == nil {
+			return false
+		}
+		change(t, run)
+		result = *run
+		return true
+	})
+	return result
+}
+
+// executeRun 把线程转换为聊天请求并执行，完成后把助手的回复追加到线程
+func (ps *ProxyServer) executeRun(ctx context.Context, r *http.Request, owner, threadID, runID string, events *runEvents) {
+	requestID := generateRequestID()
+	var messages []threadMessage
+	run := ps.updateRun(owner, threadID, runID, func(t *threadRecord, run *runObject) {
+		now := time.Now().Unix()
+		run.Status, run.StartedAt = runInProgress, &now
+		messages = append(messages, t.Messages...)
+	})
+	events.send("thread.run.in_progress", run)
+	recordRequest(r.Context(), requestID, run.Model, "")
+
+	fail := func(code string, err error) {
+		log.Printf("[%s] 运行 %s 失败: %v", requestID, runID, err)
+		run := ps.updateRun(owner, threadID, runID, func(t *threadRecord, run *runObject) {
+			now := time.Now().Unix()
+			if ctx.Err() == context.Canceled && events == nil {
+				run.Status, run.CancelledAt = runCancelled, &now
+				return
+			}
+			run.Status, run.FailedAt = runFailed, &now
+			run.LastError = &runError{Code: code, Message: err.Error()}
+		})
+		events.send("thread.run."+run.Status, run)
+	}
+
+	chatReq := &ChatRequest{Model: run.Model, Stream: events != nil, Temperature: run.Temperature}
+	if instructions := strings.TrimSpace(run.Instructions + "\n\n" + run.AdditionalInstructions); instructions != "" {
+		chatReq.Messages = append(chatReq.Messages, Message{Role: "system", Content: instructions})
+	}
+	for _, message := range messages {
+		chatReq.Messages = append(chatReq.Messages, Message{Role: message.Role, Content: message.text()})
+	}
+
+	if blocked, err := ps.screenInput(chatReq, requestID); err != nil {
+		fail("invalid_prompt", err)
+		return
+	} else if blocked != "" {
+		fail("invalid_prompt", fmt.Errorf("消息命中内容过滤规则 %s", blocked))
+		return
+	}
+	deepseekReq, err := ps.buildUpstreamRequest(r, chatReq, requestID)
+	if err != nil {
+		fail("invalid_prompt", err)
+		return
+	}
+
+	reply := threadMessage{
+		ID:          newObjectID("msg"),
+		Object:      "thread.message",
+		CreatedAt:   time.Now().Unix(),
+		ThreadID:    threadID,
+		Status:      "in_progress",
+		Role:        "assistant",
+		Content:     []messageText{},
+		AssistantID: &run.AssistantID,
+		RunID:       &run.ID,
+		Attachments: []interface{}{},
+	}
+	var text string
+	var usage Usage
+
+	if events != nil {
+		resp, err := ps.sendStreamingRequestToDeepSeek(ctx, deepseekReq, requestID)
+		if err != nil {
+			fail("server_error", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		events.send("thread.message.created", reply)
+		events.send("thread.message.in_progress", reply)
+		var content strings.Builder
+		result := ps.consumeUpstreamStream(ctx, resp.Body, events.w, events.flusher, requestID, func(chunk *deepSeekStreamChunk) {
+			for _, choice := range chunk.Choices {
+				if choice.Index != 0 || choice.Delta.Content == "" {
+					continue
+				}
+				content.WriteString(choice.Delta.Content)
+				events.send("thread.message.delta", map[string]interface{}{
+					"id":     reply.ID,
+					"object": "thread.message.delta",
+					"delta": map[string]interface{}{
+						"content": []interface{}{map[string]interface{}{
+							"index": 0,
+							"type":  "text",
+							"text":  map[string]interface{}{"value": choice.Delta.Content},
+						}},
+					},
+				})
+			}
+		})
+		if !result.done {
+			if result.err == nil {
+				result.err = fmt.Errorf("客户端已断开")
+			}
+			fail("server_error", result.err)
+			return
+		}
+		if result.blocked {
+			fail("invalid_prompt", fmt.Errorf("回复命中内容过滤规则"))
+			return
+		}
+		text, usage = content.String(), result.usage
+	} else {
+		deepseekResp, err := ps.sendRequestToDeepSeek(ctx, deepseekReq, requestID)
+		if err != nil {
+			fail("server_error", err)
+			return
+		}
+		deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+		if len(deepseekResp.Choices) > 0 {
+			if deepseekResp.Choices[0].FinishReason == "content_filter" {
+				fail("invalid_prompt", fmt.Errorf("回复命中内容过滤规则"))
+				return
+			}
+			text = deepseekResp.Choices[0].Message.Content
+		}
+		usage = deepseekResp.Usage
+		recordUsage(r.Context(), usage)
+	}
+
+	reply.Status = "completed"
+	reply.Content = []messageText{newMessageText(text)}
+	run = ps.updateRun(owner, threadID, runID, func(t *threadRecord, run *runObject) {
+		now := time.Now().Unix()
+		t.Messages = append(t.Messages, reply)
+		run.Status, run.CompletedAt, run.Usage = runCompleted, &now, &usage
+	})
+	events.send("thread.message.completed", reply)
+	events.send("thread.run.completed", run)
+	log.Printf("[%s] 运行 %s 完成，回复 %d 个字符", requestID, runID, len(text))
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 审计日志：AUDIT_LOG_FILE设置后，管理操作、配置重载、密钥变更、认证失败和内容过滤拦截按行以JSON追加到
+// 独立的审计文件，与请求日志分开保存。每条记录带有上一条记录的哈希，记录自身的哈希覆盖全部字段，
+// 修改、删除或插入任何一行都会使之后的哈希链对不上，用 audit-verify 子命令检查。
+// 密钥来自配置，启动时（包括热升级启动的新进程）与上一次启动记录的密钥哈希比较，得出密钥的新增、轮换和撤销
+
+// auditGenesisHash 第一条记录的prev_hash
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// auditEntry 一条审计记录
+type auditEntry struct {
+	Seq       int64             `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Event     string            `json:"event"`
+	Actor     string            `json:"actor,omitempty"` // 客户端IP，进程自身的事件为system
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash,omitempty"`
+}
+
+// computeHash 记录除hash字段外全部内容的SHA-256
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditChain 顺序读取审计日志时的哈希链状态
+type auditChain struct {
+	Entries int64
+	Seq     int64
+	Hash    string
+	Broken  []string // 发现的问题，为空表示哈希链完整
+
+	startup map[string]string // 最近一条startup记录的详情
+}
+
+func newAuditChain() *auditChain {
+	return &auditChain{Hash: auditGenesisHash}
+}
+
+// scan 读取并校验一段审计记录，接在已校验的部分之后
+func (c *auditChain) scan(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			c.check(line, err == nil)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// check 校验一行记录：能否解析、序号是否连续、prev_hash是否指向上一条、哈希是否与内容一致
+func (c *auditChain) check(line []byte, complete bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	c.Entries++
+	var entry auditEntry
+	if err := json.Unmarshal(line, &entry); err != nil || !complete {
+		c.Broken = append(c.Broken, fmt.Sprintf("第 %d 条记录无法解析或不完整", c.Entries))
+		return
+	}
+	if entry.Seq != c.Seq+1 {
+		c.Broken = append(c.Broken, fmt.Sprintf("序号 %d 之后是 %d，有记录被删除或插入", c.Seq, entry.Seq))
+	}
+	if entry.PrevHash != c.Hash {
+		c.Broken = append(c.Broken, fmt.Sprintf("序号 %d 的prev_hash与上一条记录不符", entry.Seq))
+	}
+	if entry.computeHash() != entry.Hash {
+		c.Broken = append(c.Broken, fmt.Sprintf("序号 %d 的哈希与内容不符，记录被修改", entry.Seq))
+	}
+	c.Seq, c.Hash = entry.Seq, entry.Hash
+	if entry.Event == "startup" {
+		c.startup = entry.Details
+	}
+}
+
+// auditLog 只追加的审计日志文件
+type auditLog struct {
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64 // 已经读入哈希链的文件长度
+	chain *auditChain
+}
+
+// openAuditLog 打开审计日志并校验已有记录，AUDIT_LOG_FILE为空时返回nil。
+// 哈希链不完整时记录警告并接在最后一条记录之后继续写，不覆盖已有内容
+func openAuditLog(config *ProxyConfig) (*auditLog, error) {
+	if config.AuditLogFile == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(config.AuditLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("打开审计日志失败: %w", err)
+	}
+	l := &auditLog{path: config.AuditLogFile, file: file, chain: newAuditChain()}
+	if err := l.catchUp(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("读取审计日志失败: %w", err)
+	}
+	if len(l.chain.Broken) > 0 {
+		log.Printf("⚠ 审计日志 %s 的哈希链不完整: %s", l.path, strings.Join(l.chain.Broken, "；"))
+	}
+	return l, nil
+}
+
+// catchUp 读入文件中尚未校验的部分。热升级期间新旧进程会同时写同一个文件，
+// 写入前发现文件被其他进程追加过时先读入新增的记录，保持哈希链连续；文件变短说明被截断，从头重新读取
+func (l *auditLog) catchUp() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == l.size {
+		return nil
+	}
+	if info.Size() < l.size {
+		log.Printf("⚠ 审计日志 %s 被截断，重新校验", l.path)
+		l.size, l.chain = 0, newAuditChain()
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(l.size, io.SeekStart); err != nil {
+		return err
+	}
+	broken := len(l.chain.Broken)
+	if err := l.chain.scan(io.LimitReader(file, info.Size()-l.size)); err != nil {
+		return err
+	}
+	if l.size > 0 && len(l.chain.Broken) > broken {
+		log.Printf("⚠ 审计日志 %s 新增的记录无法接上哈希链: %s", l.path, strings.Join(l.chain.Broken[broken:], "；"))
+	}
+	l.size = info.Size()
+	return nil
+}
+
+// Record 追加一条审计记录
+func (l *auditLog) Record(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if err := l.catchUp(); err != nil {
+		log.Printf("读取审计日志失败: %v", err)
+	}
+
+	entry.Seq = l.chain.Seq + 1
+	entry.Time = time.Now().UTC()
+	// 没有来源IP的请求事件（如内容过滤拦截）通过请求ID对应到请求日志
+	if entry.Actor == "" && entry.RequestID == "" {
+		entry.Actor = "system"
+	}
+	entry.PrevHash = l.chain.Hash
+	entry.Hash = entry.computeHash()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	n, err := l.file.Write(append(data, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+		return
+	}
+	l.chain.Entries++
+	l.chain.Seq, l.chain.Hash = entry.Seq, entry.Hash
+	if entry.Event == "startup" {
+		l.chain.startup = entry.Details
+	}
+}
+
+// Stats 审计日志的记录数和最新的哈希
+func (l *auditLog) Stats() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"file":      l.path,
+		"entries":   l.chain.Entries,
+		"last_seq":  l.chain.Seq,
+		"last_hash": l.chain.Hash,
+		"intact":    len(l.chain.Broken) == 0,
+	}
+}
+
+// Close 关闭审计日志
+func (l *auditLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// requestAuditEntry 由请求填写审计记录的来源IP和请求ID
+func requestAuditEntry(event string, r *http.Request, details map[string]string) auditEntry {
+	entry := auditEntry{Event: event, Actor: getClientIP(r), Details: details}
+	if requestID, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		entry.RequestID = requestID
+	}
+	return entry
+}
+
+// auditKeys 按用途列出配置中的密钥哈希，用于比较两次启动之间的密钥变更
+func (ps *ProxyServer) auditKeys() map[string][]string {
+	keys := make(map[string][]string)
+	add := func(label string, values ...string) {
+		for _, value := range values {
+			if value != "" {
+				keys[label] = append(keys[label], keyHash(value))
+			}
+		}
+	}
+	add("deepseek_api_key", ps.config.DeepSeekAPIKey)
+	add("admin_api_key", ps.config.AdminAPIKey)
+	if ps.upstreams != nil {
+		for _, member := range ps.upstreams.members[1:] {
+			add("upstream_pool", member.apiKey)
+		}
+	}
+	if ps.tenants != nil {
+		for _, t := range ps.tenants.tenants {
+			add("tenant:"+t.Name, t.Keys...)
+			add("tenant:"+t.Name+":deepseek_api_key", t.DeepSeekAPIKey)
+		}
+	}
+	for label := range keys {
+		sort.Strings(keys[label])
+	}
+	return keys
+}
+
+// recordStartup 记录启动和当前配置的哈希，并与上一次启动比较，记录配置变更和密钥的新增、轮换、撤销
+func (ps *ProxyServer) recordStartup() {
+	l := ps.audit
+	if l == nil {
+		return
+	}
+	details := map[string]string{
+		"version":     Version,
+		"pid":         fmt.Sprint(os.Getpid()),
+		"config_hash": configHash(ps.config), // 与 /version 中的哈希相同
+	}
+	for label, hashes := range ps.auditKeys() {
+		details["key."+label] = strings.Join(hashes, ",")
+	}
+
+	l.mu.Lock()
+	previous := l.chain.startup
+	l.mu.Unlock()
+	l.Record(auditEntry{Event: "startup", Details: details})
+	if previous == nil {
+		return
+	}
+
+	if previous["config_hash"] != details["config_hash"] {
+		l.Record(auditEntry{Event: "config_changed", Details: map[string]string{
+			"previous_config_hash": previous["config_hash"],
+			"config_hash":          details["config_hash"],
+		}})
+	}
+	labels := make(map[string]bool)
+	for name := range previous {
+		labels[name] = true
+	}
+	for name := range details {
+		labels[name] = true
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if strings.HasPrefix(name, "key.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		before, after := previous[name], details[name]
+		if before == after {
+			continue
+		}
+		event := "key_rotated"
+		switch {
+		case before == "":
+			event = "key_created"
+		case after == "":
+			event = "key_revoked"
+		}
+		added, removed := diffKeyHashes(before, after)
+		l.Record(auditEntry{Event: event, Details: map[string]string{
+			"key":     strings.TrimPrefix(name, "key."),
+			"added":   strings.Join(added, ","),
+			"removed": strings.Join(removed, ","),
+		}})
+	}
+}
+
+// diffKeyHashes 比较逗号分隔的两组密钥哈希
+func diffKeyHashes(before, after string) (added, removed []string) {
+	split := func(s string) map[string]bool {
+		set := make(map[string]bool)
+		for _, hash := range strings.Split(s, ",") {
+			if hash != "" {
+				set[hash] = true
+			}
+		}
+		return set
+	}
+	old, cur := split(before), split(after)
+	for hash := range cur {
+		if !old[hash] {
+			added = append(added, hash)
+		}
+	}
+	for hash := range old {
+		if !cur[hash] {
+			removed = append(removed, hash)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// runAuditVerifyCommand 校验审计日志的哈希链，发现问题时返回1
+func runAuditVerifyCommand(args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	configFile := fs.String("config", ".env", "配置文件路径")
+	logFile := fs.String("file", "", "审计日志路径（默认: AUDIT_LOG_FILE）")
+	fs.Parse(args)
+
+	if *logFile == "" {
+		config, err := readConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			return 2
+		}
+		*logFile = config.AuditLogFile
+	}
+	if *logFile == "" {
+		fmt.Fprintln(os.Stderr, "错误：未配置AUDIT_LOG_FILE，请用 -file 指定审计日志")
+		return 2
+	}
+	file, err := os.Open(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	chain := newAuditChain()
+	if err := chain.scan(file); err != nil {
+		fmt.Fprintf(os.Stderr, "错误：读取审计日志失败: %v\n", err)
+		return 2
+	}
+	if len(chain.Broken) > 0 {
+		fmt.Printf("❌ 审计日志 %s 的哈希链不完整（共 %d 条记录）:\n", *logFile, chain.Entries)
+		for _, problem := range chain.Broken {
+			fmt.Printf("  - %s\n", problem)
+		}
+		return 1
+	}
+	fmt.Printf("✅ 审计日志 %s 完整: %d 条记录，最新哈希 %s\n", *logFile, chain.Entries, chain.Hash)
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 背压：上游并发的排队已满、排队超时或上游正在限流时，立即返回503/429并附带Retry-After和排队情况，
+// 而不是让请求一直挂起直到客户端超时。客户端据此退避重试，代理也不会积压大量等待中的连接
+
+// saturatedError 代理饱和、拒绝请求时返回的错误
+type saturatedError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+	Queue      map[string]interface{} // 调度器的快照，未限制上游并发时为nil
+}
+
+func (e *saturatedError) Error() string {
+	return e.Message
+}
+
+// retryAfterSeconds Retry-After的秒数，至少为1
+func (e *saturatedError) retryAfterSeconds() int {
+	return max(int(math.Ceil(e.RetryAfter.Seconds())), 1)
+}
+
+// setHeaders 设置Retry-After，429时同时补充x-ratelimit-*头部
+func (e *saturatedError) setHeaders(w http.ResponseWriter, config *ProxyConfig) {
+	retryAfter := strconv.Itoa(e.retryAfterSeconds())
+	if e.StatusCode == http.StatusTooManyRequests {
+		setRateLimitHeaders(w, http.Header{"Retry-After": {retryAfter}}, config)
+		return
+	}
+	w.Header().Set("Retry-After", retryAfter)
+}
+
+// apiError 转换为OpenAI格式的错误，排队情况放在error.queue中
+func (e *saturatedError) apiError() *apiError {
+	apiErr := newAPIError(e.StatusCode, e.Message)
+	apiErr.Code = e.Code
+	if e.Queue != nil {
+		apiErr.Extra = map[string]interface{}{"queue": e.Queue}
+	}
+	return apiErr
+}
+
+// newQueueSaturatedError 排队已满或排队超时时返回的503错误，调用方需持有调度器的锁
+func (s *upstreamScheduler) newQueueSaturatedError(reason string) *saturatedError {
+	return &saturatedError{
+		StatusCode: http.StatusServiceUnavailable,
+		Code:       "upstream_saturated",
+		Message:    fmt.Sprintf("代理繁忙，%s（进行中 %d/%d，排队 %d），请稍后重试", reason, s.active, s.limit, s.queued()),
+		RetryAfter: s.retryAfter,
+		Queue:      s.snapshot(),
+	}
+}
+
+// checkUpstreamRateLimit 本实例或其他实例记录的该上游密钥的限流尚未解除时返回429错误，不再把请求发往上游。
+// 暂停按密钥区分，一个租户或上游池成员的密钥被限流不影响其他密钥
+func (ps *ProxyServer) checkUpstreamRateLimit(apiKey string) error {
+	hash := keyHash(apiKey)
+	ps.rateLimitMu.Lock()
+	remaining := time.Until(ps.rateLimitedUntil[hash])
+	ps.rateLimitMu.Unlock()
+	if shared := time.Until(ps.sharedUpstreamHold(hash)); shared > remaining {
+		remaining = shared
+	}
+	if remaining <= 0 {
+		return nil
+	}
+	err := &saturatedError{
+		StatusCode: http.StatusTooManyRequests,
+		Code:       "upstream_rate_limited",
+		Message:    fmt.Sprintf("DeepSeek上游正在限流，%d 秒后重试", int(math.Ceil(remaining.Seconds()))),
+		RetryAfter: remaining,
+	}
+	if ps.scheduler != nil {
+		err.Queue = ps.scheduler.Snapshot()
+	}
+	return err
+}
+
+// holdForRateLimit 上游对该密钥返回429后，在其Retry-After期间直接拒绝使用该密钥的新请求
+func (ps *ProxyServer) holdForRateLimit(apiKey string, header http.Header) {
+	if !ps.config.UpstreamRateLimitHold {
+		return
+	}
+	hold := time.Second
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			hold = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			hold = time.Until(at)
+		}
+	}
+	if hold <= 0 {
+		return
+	}
+	hash := keyHash(apiKey)
+	until := time.Now().Add(hold)
+	ps.shareUpstreamHold(hash, until)
+
+	ps.rateLimitMu.Lock()
+	defer ps.rateLimitMu.Unlock()
+	if ps.rateLimitedUntil == nil {
+		ps.rateLimitedUntil = make(map[string]time.Time)
+	}
+	// 顺便清理已经解除的暂停
+	now := time.Now()
+	for key, expires := range ps.rateLimitedUntil {
+		if expires.Before(now) {
+			delete(ps.rateLimitedUntil, key)
+		}
+	}
+	if until.After(ps.rateLimitedUntil[hash]) {
+		ps.rateLimitedUntil[hash] = until
+	}
+}
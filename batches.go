@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 批处理任务的状态，与OpenAI Batch API一致
+const (
+	batchValidating = "validating"
+	batchInProgress = "in_progress"
+	batchFinalizing = "finalizing"
+	batchCompleted  = "completed"
+	batchExpired    = "expired"
+	batchCancelling = "cancelling"
+	batchCancelled  = "cancelled"
+)
+
+const (
+	batchMaxInputBytes = 200 << 20 // 单个批处理输入的最大字节数
+	batchMaxRequests   = 50000     // 单个批处理的最大请求数
+)
+
+// batchRequestCounts 批处理中各状态的请求数
+type batchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// batchObject OpenAI格式的批处理任务
+type batchObject struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           interface{}        `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    batchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+// terminal 任务是否已经结束
+func (b *batchObject) terminal() bool {
+	switch b.Status {
+	case batchCompleted, batchExpired, batchCancelled:
+		return true
+	}
+	return false
+}
+
+// batchRecord 保存在磁盘上的任务，Owner为创建者密钥的短哈希，Tenant为创建者所属的租户。
+// Key为创建者的客户端密钥，执行时附加到每一行请求上，按密钥配置的系统提示词、语义缓存阈值和优先级
+// 与直接调用时一致；任务文件只有代理自己可读
+type batchRecord struct {
+	Owner  string      `json:"owner"`
+	Key    string      `json:"key,omitempty"`
+	Tenant string      `json:"tenant,omitempty"`
+	Batch  batchObject `json:"batch"`
+}
+
+// batchRequestLine 输入JSONL中的一行请求
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchStore 批处理任务存储和后台执行
+// 每个任务在目录中保存元数据、输入、输出和错误四个文件；单个后台协程按配置的速率
+// 依次执行请求，每完成一个请求都写回进度，重启后从中断的位置继续
+type batchStore struct {
+	ps       *ProxyServer
+	dir      string
+	interval time.Duration
+
+	mu      sync.Mutex
+	batches map[string]*batchRecord
+	pending []string
+	wake    chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newBatchStore(ps *ProxyServer, config *ProxyConfig) (*batchStore, error) {
+	if err := os.MkdirAll(config.BatchDir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建批处理目录失败: %w", err)
+	}
+	s := &batchStore{
+		ps:      ps,
+		dir:     config.BatchDir,
+		batches: make(map[string]*batchRecord),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if config.BatchRequestsPerMinute > 0 {
+		s.interval = time.Minute / time.Duration(config.BatchRequestsPerMinute)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "batch_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取批处理目录失败: %w", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取批处理任务失败: %w", err)
+		}
+		record := &batchRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("解析批处理任务 %s 失败: %w", filepath.Base(path), err)
+		}
+		s.batches[record.Batch.ID] = record
+		if !record.Batch.terminal() {
+			s.pending = append(s.pending, record.Batch.ID)
+		}
+	}
+	// 按创建顺序继续执行重启前未完成的任务
+	sort.Slice(s.pending, func(i, j int) bool {
+		return s.batches[s.pending[i]].Batch.CreatedAt < s.batches[s.pending[j]].Batch.CreatedAt
+	})
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.worker()
+	return s, nil
+}
+
+// Close 停止后台执行，进行中的请求完成前返回的进度会在重启后重新执行
+func (s *batchStore) Close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *batchStore) path(id, suffix string) string {
+	return filepath.Join(s.dir, id+suffix)
+}
+
+// save 写回任务元数据，调用方持有s.mu
+func (s *batchStore) save(record *batchRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("序列化批处理任务失败: %w", err)
+	}
+	if err := writeFileAtomic(s.path(record.Batch.ID, ".json"), data); err != nil {
+		return fmt.Errorf("写入批处理任务失败: %w", err)
+	}
+	return nil
+}
+
+// update 在锁内修改任务并写回磁盘，返回修改后的副本
+func (s *batchStore) update(id string, change func(b *batchObject)) batchObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.batches[id]
+	change(&record.Batch)
+	if err := s.save(record); err != nil {
+		log.Printf("批处理 %s: %v", id, err)
+	}
+	return record.Batch
+}
+
+// create 校验输入并保存新任务，等待后台执行
+func (s *batchStore) create(key, tenantName, inputFileID, endpoint, window string, metadata map[string]string, input []byte) (*batchObject, error) {
+	lines, err := parseBatchInput(input, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	id := fmt.Sprintf("batch_%d", now.UnixNano())
+	if err := os.WriteFile(s.path(id, ".input.jsonl"), input, 0o600); err != nil {
+		return nil, fmt.Errorf("保存批处理输入失败: %w", err)
+	}
+	record := &batchRecord{Owner: keyHash(key), Key: key, Tenant: tenantName, Batch: batchObject{
+		ID:               id,
+		Object:           "batch",
+		Endpoint:         endpoint,
+		InputFileID:      inputFileID,
+		CompletionWindow: window,
+		Status:           batchValidating,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(batchWindow(window)).Unix(),
+		RequestCounts:    batchRequestCounts{Total: len(lines)},
+		Metadata:         metadata,
+	}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(record); err != nil {
+		os.Remove(s.path(id, ".input.jsonl"))
+		return nil, err
+	}
+	s.batches[id] = record
+	s.pending = append(s.pending, id)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	batch := record.Batch
+	return &batch, nil
+}
+
+// get 返回owner可见的任务副本
+func (s *batchStore) get(owner, id string) (*batchObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.batches[id]
+	if !ok || record.Owner != owner {
+		return nil, false
+	}
+	batch := record.Batch
+	return &batch, true
+}
+
+// list 按创建时间从新到旧返回owner的任务，after为上一页最后一个任务的ID
+func (s *batchStore) list(owner, after string, limit int) ([]batchObject, bool) {
+	s.mu.Lock()
+	batches := make([]batchObject, 0)
+	for _, record := range s.batches {
+		if record.Owner == owner {
+			batches = append(batches, record.Batch)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(batches, func(i, j int) bool { return batches[i].ID > batches[j].ID })
+	if after != "" {
+		start := len(batches)
+		for i, batch := range batches {
+			if batch.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		batches = batches[start:]
+	}
+	if len(batches) > limit {
+		return batches[:limit], true
+	}
+	return batches, false
+}
+
+// requestCancel 取消任务：尚未开始的任务直接取消，执行中的任务在当前请求完成后停止
+func (s *batchStore) requestCancel(owner, id string) (*batchObject, bool) {
+	if _, ok := s.get(owner, id); !ok {
+		return nil, false
+	}
+	batch := s.update(id, func(b *batchObject) {
+		now := time.Now().Unix()
+		switch b.Status {
+		case batchValidating:
+			b.Status, b.CancelledAt = batchCancelled, &now
+		case batchInProgress:
+			b.Status, b.CancellingAt = batchCancelling, &now
+		}
+	})
+	return &batch, true
+}
+
+// worker 依次执行等待中的任务
+func (s *batchStore) worker() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		var id string
+		if len(s.pending) > 0 {
+			id, s.pending = s.pending[0], s.pending[1:]
+		}
+		s.mu.Unlock()
+
+		if id == "" {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		s.run(id)
+		if s.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// run 执行一个任务，从已完成的请求数之后继续
+func (s *batchStore) run(id string) {
+	batch := s.update(id, func(b *batchObject) {
+		if b.Status == batchValidating {
+			now := time.Now().Unix()
+			b.Status, b.InProgressAt = batchInProgress, &now
+		}
+	})
+	if batch.terminal() {
+		return
+	}
+
+	input, err := os.ReadFile(s.path(id, ".input.jsonl"))
+	if err != nil {
+		log.Printf("批处理 %s: 读取输入失败: %v", id, err)
+		return
+	}
+	lines, err := parseBatchInput(input, batch.Endpoint)
+	if err != nil {
+		log.Printf("批处理 %s: 解析输入失败: %v", id, err)
+		return
+	}
+	log.Printf("批处理 %s 开始执行：共 %d 个请求，已完成 %d 个", id, len(lines),
+		batch.RequestCounts.Completed+batch.RequestCounts.Failed)
+
+	// 以创建者的密钥和租户执行，模型限制、按密钥的设置和上游费用与直接发起的请求一致
+	s.mu.Lock()
+	key, tenantName := s.batches[id].Key, s.batches[id].Tenant
+	s.mu.Unlock()
+
+	deferred := false
+	for i := batch.RequestCounts.Completed + batch.RequestCounts.Failed; i < len(lines); i++ {
+		if s.ctx.Err() != nil {
+			return
+		}
+		current := s.snapshot(id)
+		if current.Status == batchCancelling {
+			s.finish(id, func(b *batchObject) {
+				now := time.Now().Unix()
+				b.Status, b.CancelledAt = batchCancelled, &now
+			})
+			log.Printf("批处理 %s 已取消", id)
+			return
+		}
+		if time.Now().Unix() > current.ExpiresAt {
+			s.expire(id, lines[i:])
+			return
+		}
+		// 不在优惠时段时推迟到时段开始，等待期间每分钟重新检查取消和过期
+		if wait := s.ps.offPeak.batchDelay(time.Now(), current.ExpiresAt); wait > 0 {
+			if !deferred {
+				deferred = true
+				s.ps.offPeak.recordDeferred()
+				log.Printf("批处理 %s 推迟到优惠时段执行，%v 后开始", id, wait.Round(time.Second))
+			}
+			select {
+			case <-time.After(min(wait, time.Minute)):
+			case <-s.ctx.Done():
+				return
+			}
+			i--
+			continue
+		}
+
+		statusCode, body := s.execute(key, tenantName, lines[i])
+		failed := statusCode < 200 || statusCode >= 300
+		suffix := ".output.jsonl"
+		if failed {
+			suffix = ".error.jsonl"
+		}
+		s.appendResult(id, suffix, lines[i], statusCode, body, nil)
+		s.update(id, func(b *batchObject) {
+			if failed {
+				b.RequestCounts.Failed++
+			} else {
+				b.RequestCounts.Completed++
+			}
+		})
+
+		if s.interval > 0 && i < len(lines)-1 {
+			select {
+			case <-time.After(s.interval):
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+
+	s.update(id, func(b *batchObject) {
+		now := time.Now().Unix()
+		b.Status, b.FinalizingAt = batchFinalizing, &now
+	})
+	batch = s.finish(id, func(b *batchObject) {
+		now := time.Now().Unix()
+		b.Status, b.CompletedAt = batchCompleted, &now
+	})
+	log.Printf("批处理 %s 完成：成功 %d 个，失败 %d 个", id, batch.RequestCounts.Completed, batch.RequestCounts.Failed)
+}
+
+// finish 结束任务；启用了文件接口时把结果登记为文件，通过output_file_id和error_file_id下载
+func (s *batchStore) finish(id string, change func(b *batchObject)) batchObject {
+	var outputFileID, errorFileID *string
+	if s.ps.files != nil {
+		s.mu.Lock()
+		owner := s.batches[id].Owner
+		s.mu.Unlock()
+		outputFileID = s.registerResult(owner, id, ".output.jsonl")
+		errorFileID = s.registerResult(owner, id, ".error.jsonl")
+	}
+	return s.update(id, func(b *batchObject) {
+		b.OutputFileID, b.ErrorFileID = outputFileID, errorFileID
+		change(b)
+	})
+}
+
+// registerResult 把结果文件复制到文件存储，结果文件不存在时返回nil
+func (s *batchStore) registerResult(owner, id, suffix string) *string {
+	result, err := os.Open(s.path(id, suffix))
+	if err != nil {
+		return nil
+	}
+	defer result.Close()
+	file, err := s.ps.files.create(owner, id+suffix, "batch_output", result)
+	if err != nil {
+		log.Printf("批处理 %s: 登记结果文件失败: %v", id, err)
+		return nil
+	}
+	return &file.ID
+}
+
+// snapshot 返回任务当前状态的副本
+func (s *batchStore) snapshot(id string) batchObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches[id].Batch
+}
+
+// expire 超过完成时限时把剩余请求记为batch_expired错误
+func (s *batchStore) expire(id string, remaining []batchRequestLine) {
+	for _, line := range remaining {
+		s.appendResult(id, ".error.jsonl", line, 0, nil, map[string]string{
+			"code":    "batch_expired",
+			"message": "该请求在批处理的完成时限内未能执行",
+		})
+	}
+	s.finish(id, func(b *batchObject) {
+		now := time.Now().Unix()
+		b.Status, b.ExpiredAt = batchExpired, &now
+		b.RequestCounts.Failed += len(remaining)
+	})
+	log.Printf("批处理 %s 已过期，%d 个请求未执行", id, len(remaining))
+}
+
+// execute 把一行请求交给对应端点的处理器执行，流式参数会被忽略
+func (s *batchStore) execute(key, tenantName string, line batchRequestLine) (int, json.RawMessage) {
+	owner := s.ps.tenants.Named(tenantName)
+	if tenantName != "" && owner == nil {
+		// 租户已从配置中删除时不能改用DEEPSEEK_API_KEY执行
+		data, _ := json.Marshal(map[string]interface{}{"error": map[string]string{
+			"message": fmt.Sprintf("租户 %s 已不存在", tenantName),
+			"type":    "invalid_request_error",
+		}})
+		return http.StatusForbidden, data
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(line.Body, &body); err != nil {
+		return http.StatusBadRequest, json.RawMessage(`{"error":{"message":"body必须是JSON对象","type":"invalid_request_error"}}`)
+	}
+	body["stream"] = false
+	data, _ := json.Marshal(body)
+
+	// 批处理请求默认使用最低优先级，上游繁忙时让位于交互请求
+	priority, ok := s.ps.config.keyPriority(key)
+	if !ok {
+		priority = priorityBulk
+	}
+	ctx := withPriority(s.ctx, priority)
+	if owner != nil {
+		ctx = context.WithValue(ctx, tenantKey{}, owner)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", line.URL, bytes.NewReader(data))
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+
+	// 每一行单独计入创建者的配额和租户限流，配额用完后剩余的行以429失败
+	recorder := httptest.NewRecorder()
+	s.ps.serveInternal(recorder, req, s.ps.batchHandler(line.URL))
+	result := recorder.Body.Bytes()
+	if !json.Valid(result) {
+		result, _ = json.Marshal(strings.TrimSpace(string(result)))
+	}
+	return recorder.Code, result
+}
+
+// appendResult 把一行结果追加到输出或错误文件
+func (s *batchStore) appendResult(id, suffix string, line batchRequestLine, statusCode int, body json.RawMessage, batchErr interface{}) {
+	result := map[string]interface{}{
+		"id":        fmt.Sprintf("batch_req_%d", time.Now().UnixNano()),
+		"custom_id": line.CustomID,
+		"response":  nil,
+		"error":     batchErr,
+	}
+	if body != nil {
+		result["response"] = map[string]interface{}{
+			"status_code": statusCode,
+			"request_id":  generateRequestID(),
+			"body":        body,
+		}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(s.path(id, suffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("批处理 %s: 写入结果失败: %v", id, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("批处理 %s: 写入结果失败: %v", id, err)
+	}
+}
+
+// batchHandler 批处理请求对应的端点处理器
+func (ps *ProxyServer) batchHandler(url string) http.HandlerFunc {
+	switch url {
+	case "/v1/completions":
+		return ps.handleCompletions
+	default:
+		return ps.handleChatCompletions
+	}
+}
+
+// parseBatchInput 解析并校验输入JSONL：custom_id必须唯一，url必须与任务的端点一致
+func parseBatchInput(input []byte, endpoint string) ([]batchRequestLine, error) {
+	var lines []batchRequestLine
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	scanner.Buffer(make([]byte, 64*1024), batchMaxInputBytes)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var line batchRequestLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行不是有效的JSON: %v", number, err))
+		}
+		switch {
+		case line.CustomID == "":
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行缺少custom_id", number))
+		case seen[line.CustomID]:
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行的custom_id %q 重复", number, line.CustomID))
+		case line.Method != "POST":
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行的method必须是POST", number))
+		case line.URL != endpoint:
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行的url %q 与批处理端点 %s 不一致", number, line.URL, endpoint))
+		case len(line.Body) == 0:
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("第 %d 行缺少body", number))
+		}
+		seen[line.CustomID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("读取批处理输入失败: %v", err))
+	}
+	if len(lines) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, "批处理输入为空")
+	}
+	if len(lines) > batchMaxRequests {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("批处理最多包含 %d 个请求", batchMaxRequests))
+	}
+	return lines, nil
+}
+
+// batchWindow 解析完成时限，OpenAI目前只支持24h
+func batchWindow(window string) time.Duration {
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return 24 * time.Hour
+	}
+	return duration
+}
+
+// handleBatches 处理批处理接口：
+// POST /v1/batches 创建任务，GET /v1/batches 列出任务，GET /v1/batches/{id} 查询任务，
+// POST /v1/batches/{id}/cancel 取消任务，GET /v1/batches/{id}/output 和 /errors 下载结果
+func (ps *ProxyServer) handleBatches(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	owner := clientKeyHash(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/batches"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "POST":
+			ps.createBatch(w, r, owner)
+		case "GET":
+			ps.listBatches(w, r, owner)
+		default:
+			handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	batch, ok := ps.batches.get(owner, id)
+	if !ok {
+		handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("批处理任务 %s 不存在", id)), http.StatusNotFound, "批处理")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJSONResponse(w, batch)
+	case action == "cancel" && r.Method == "POST":
+		batch, _ = ps.batches.requestCancel(owner, id)
+		log.Printf("批处理 %s 请求取消，当前状态: %s", id, batch.Status)
+		writeJSONResponse(w, batch)
+	case (action == "output" || action == "errors") && r.Method == "GET":
+		suffix := ".output.jsonl"
+		if action == "errors" {
+			suffix = ".error.jsonl"
+		}
+		data, err := os.ReadFile(ps.batches.path(id, suffix))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			handleError(w, fmt.Errorf("读取批处理结果失败: %w", err), http.StatusInternalServerError, "批处理")
+			return
+		}
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Write(data)
+	default:
+		handleError(w, fmt.Errorf("不支持的批处理操作: %s %s", r.Method, r.URL.Path), http.StatusNotFound, "批处理")
+	}
+}
+
+// createBatch 创建批处理任务
+// 与OpenAI一样通过input_file_id引用已上传的文件（需要启用文件接口）；
+// 请求体为JSONL（Content-Type: application/jsonl）时直接作为输入，端点和完成时限通过查询参数指定
+func (ps *ProxyServer) createBatch(w http.ResponseWriter, r *http.Request, owner string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/jsonl" && mediaType != "application/x-ndjson" {
+		ps.createBatchFromFile(w, r, owner)
+		return
+	}
+
+	endpoint := r.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "/v1/chat/completions"
+	}
+	if endpoint != "/v1/chat/completions" && endpoint != "/v1/completions" {
+		apiErr := newAPIError(http.StatusBadRequest, "endpoint只支持 /v1/chat/completions 和 /v1/completions")
+		apiErr.Param = "endpoint"
+		handleError(w, apiErr, http.StatusBadRequest, "批处理")
+		return
+	}
+	window := r.URL.Query().Get("completion_window")
+	if window == "" {
+		window = "24h"
+	}
+
+	input, err := io.ReadAll(http.MaxBytesReader(w, r.Body, batchMaxInputBytes))
+	if err != nil {
+		handleError(w, fmt.Errorf("读取批处理输入失败: %w", err), http.StatusBadRequest, "批处理")
+		return
+	}
+	batch, err := ps.batches.create(clientAPIKey(r), tenantFor(r.Context()).tenantName(), "", endpoint, window, nil, input)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError, "批处理")
+		return
+	}
+	log.Printf("创建批处理 %s：%d 个请求，端点 %s", batch.ID, batch.RequestCounts.Total, endpoint)
+	writeJSONResponse(w, batch)
+}
+
+// createBatchFromFile 以OpenAI格式的JSON请求创建任务，输入来自文件接口上传的batch文件
+func (ps *ProxyServer) createBatchFromFile(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := readJSONRequest(r, &req); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	if ps.files == nil {
+		apiErr := newAPIError(http.StatusBadRequest, "未启用文件接口（FILES_DIR），请以 Content-Type: application/jsonl 直接提交批处理输入")
+		apiErr.Param = "input_file_id"
+		handleError(w, apiErr, http.StatusBadRequest, "批处理")
+		return
+	}
+	if req.Endpoint != "/v1/chat/completions" && req.Endpoint != "/v1/completions" {
+		apiErr := newAPIError(http.StatusBadRequest, "endpoint只支持 /v1/chat/completions 和 /v1/completions")
+		apiErr.Param = "endpoint"
+		handleError(w, apiErr, http.StatusBadRequest, "批处理")
+		return
+	}
+	if req.CompletionWindow == "" {
+		req.CompletionWindow = "24h"
+	}
+
+	file, ok := ps.files.get(owner, req.InputFileID)
+	if !ok || file.Purpose != "batch" {
+		apiErr := newAPIError(http.StatusBadRequest, fmt.Sprintf("input_file_id %q 不存在或用途不是batch", req.InputFileID))
+		apiErr.Param = "input_file_id"
+		handleError(w, apiErr, http.StatusBadRequest, "批处理")
+		return
+	}
+	input, err := ps.files.read(owner, req.InputFileID)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError, "批处理")
+		return
+	}
+
+	batch, err := ps.batches.create(clientAPIKey(r), tenantFor(r.Context()).tenantName(), req.InputFileID, req.Endpoint, req.CompletionWindow, req.Metadata, input)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError, "批处理")
+		return
+	}
+	log.Printf("创建批处理 %s：输入文件 %s，%d 个请求，端点 %s", batch.ID, req.InputFileID, batch.RequestCounts.Total, req.Endpoint)
+	writeJSONResponse(w, batch)
+}
+
+// listBatches 分页列出当前密钥创建的任务
+func (ps *ProxyServer) listBatches(w http.ResponseWriter, r *http.Request, owner string) {
+	limit := 20
+	if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 100 {
+		limit = value
+	}
+	batches, hasMore := ps.batches.list(owner, r.URL.Query().Get("after"), limit)
+	response := map[string]interface{}{
+		"object":   "list",
+		"data":     batches,
+		"has_more": hasMore,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(batches) > 0 {
+		response["first_id"] = batches[0].ID
+		response["last_id"] = batches[len(batches)-1].ID
+	}
+	writeJSONResponse(w, response)
+}
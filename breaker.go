@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen 熔断器处于打开状态时返回的错误
+var errCircuitOpen = errors.New("deepseek上游暂时不可用（熔断器已打开），请稍后重试")
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"    // 正常放行
+	breakerOpen     = "open"      // 快速失败
+	breakerHalfOpen = "half_open" // 放行一个探测请求
+)
+
+// circuitBreaker 上游熔断器
+// 它记录最近若干次上游调用的成败，当失败率过高时直接拒绝请求，
+// 避免在DeepSeek故障期间让每个请求都等待60秒超时
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	window       int
+	minRequests  int
+	failureRatio float64
+	openTimeout  time.Duration
+
+	state    string
+	results  []bool // 环形缓冲区，true表示失败
+	next     int
+	count    int
+	openedAt time.Time
+	probing  bool // 半开状态下是否已有探测请求在进行
+}
+
+// newCircuitBreaker 根据配置创建熔断器
+func newCircuitBreaker(config *ProxyConfig) *circuitBreaker {
+	window := config.BreakerWindow
+	if window <= 0 {
+		window = 20
+	}
+	return &circuitBreaker{
+		window:       window,
+		minRequests:  config.BreakerMinRequests,
+		failureRatio: config.BreakerFailureRatio,
+		openTimeout:  config.BreakerOpenTimeout,
+		state:        breakerClosed,
+		results:      make([]bool, window),
+	}
+}
+
+// Allow 判断当前是否允许向上游发送请求
+// 打开状态超过openTimeout后转为半开，只放行一个探测请求
+func (cb *circuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.openTimeout {
+			return errCircuitOpen
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		log.Printf("熔断器进入半开状态，放行探测请求")
+		return nil
+	case breakerHalfOpen:
+		if cb.probing {
+			return errCircuitOpen
+		}
+		cb.probing = true
+		return nil
+	}
+	return nil
+}
+
+// Record 记录一次上游调用结果
+func (cb *circuitBreaker) Record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+		if failed {
+			cb.trip()
+			log.Printf("熔断器探测失败，重新打开")
+		} else {
+			cb.reset()
+			log.Printf("熔断器探测成功，恢复正常")
+		}
+		return
+	}
+
+	cb.results[cb.next] = failed
+	cb.next = (cb.next + 1) % cb.window
+	if cb.count < cb.window {
+		cb.count++
+	}
+
+	if cb.state == breakerClosed && cb.count >= cb.minRequests {
+		if ratio := cb.failureRate(); ratio >= cb.failureRatio {
+			cb.trip()
+			log.Printf("上游失败率 %.0f%% 超过阈值，熔断器打开 %v", ratio*100, cb.openTimeout)
+		}
+	}
+}
+
+// Abort 放弃一次已放行但没有结果的调用（例如客户端取消），
+// 半开状态下允许下一个请求重新探测
+func (cb *circuitBreaker) Abort() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// RetryAfter 返回熔断器预计恢复探测前的剩余时间
+func (cb *circuitBreaker) RetryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != breakerOpen {
+		return 0
+	}
+	remaining := cb.openTimeout - time.Since(cb.openedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// State 返回熔断器当前状态
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Snapshot 返回熔断器当前状态，用于健康检查展示
+func (cb *circuitBreaker) Snapshot() map[string]interface{} {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":        cb.state,
+		"failure_rate": cb.failureRate(),
+		"samples":      cb.count,
+	}
+}
+
+func (cb *circuitBreaker) failureRate() float64 {
+	if cb.count == 0 {
+		return 0
+	}
+	failures := 0
+	for i := 0; i < cb.count; i++ {
+		if cb.results[i] {
+			failures++
+		}
+	}
+	return float64(failures) / float64(cb.count)
+}
+
+func (cb *circuitBreaker) trip() {
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.state = breakerClosed
+	cb.results = make([]bool, cb.window)
+	cb.next = 0
+	cb.count = 0
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 内置工具：web_search通过配置的搜索API检索网页，fetch_url抓取网页正文，
+// 与登记的HTTP工具一样自动加入请求并由代理执行
+
+// fetch_url返回给模型的正文最大字符数
+const fetchURLMaxChars = 32 << 10
+
+// builtinToolDefinitions 内置工具的定义
+var builtinToolDefinitions = map[string]*serverTool{
+	"web_search": {
+		Name:        "web_search",
+		Description: "搜索互联网，返回相关网页的标题、链接和摘要。需要最新信息或事实依据时使用",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{"type": "string", "description": "搜索关键词"},
+			},
+			"required": []string{"query"},
+		},
+	},
+	"fetch_url": {
+		Name:        "fetch_url",
+		Description: "抓取网页并返回其中的文本内容，用于阅读搜索结果或用户给出的链接",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"url": map[string]interface{}{"type": "string", "description": "http或https网址"},
+			},
+			"required": []string{"url"},
+		},
+	},
+}
+
+// builtinTools 按BUILTIN_TOOLS创建启用的内置工具
+func builtinTools(config *ProxyConfig, client *http.Client) ([]*serverTool, error) {
+	var tools []*serverTool
+	for _, name := range strings.Split(config.BuiltinTools, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		definition, ok := builtinToolDefinitions[name]
+		if !ok {
+			return nil, fmt.Errorf("未知的内置工具: %s（可选 web_search 或 fetch_url）", name)
+		}
+		tool := *definition
+		tool.timeout = config.BuiltinToolsTimeout
+		switch name {
+		case "web_search":
+			search, err := newWebSearch(config, client)
+			if err != nil {
+				return nil, err
+			}
+			tool.run = search.run
+		case "fetch_url":
+			tool.run = newURLFetcher(config).run
+		}
+		tools = append(tools, &tool)
+	}
+	return tools, nil
+}
+
+// searchResult 归一化后的搜索结果
+type searchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+}
+
+// webSearch 调用外部搜索API
+type webSearch struct {
+	provider string
+	endpoint string
+	apiKey   string
+	count    int
+	client   *http.Client
+}
+
+func newWebSearch(config *ProxyConfig, client *http.Client) (*webSearch, error) {
+	s := &webSearch{
+		client:   client,
+		provider: config.WebSearchProvider,
+		endpoint: config.WebSearchURL,
+		apiKey:   config.WebSearchAPIKey,
+		count:    config.WebSearchResults,
+	}
+	switch s.provider {
+	case "searxng":
+		if s.endpoint == "" {
+			return nil, fmt.Errorf("web_search使用searxng时需要设置WEB_SEARCH_URL")
+		}
+	case "brave":
+		if s.endpoint == "" {
+			s.endpoint = "https://api.search.brave.com/res/v1/web/search"
+		}
+	case "tavily":
+		if s.endpoint == "" {
+			s.endpoint = "https://api.tavily.com/search"
+		}
+	default:
+		return nil, fmt.Errorf("无效的搜索服务: %s（可选 searxng、brave 或 tavily）", s.provider)
+	}
+	if s.provider != "searxng" && s.apiKey == "" {
+		return nil, fmt.Errorf("web_search使用%s时需要设置WEB_SEARCH_API_KEY", s.provider)
+	}
+	return s, nil
+}
+
+func (s *webSearch) run(ctx context.Context, args map[string]interface{}, requestID string) (string, error) {
+	query, _ := args["query"].(string)
+	if strings.TrimSpace(query) == "" {
+		return "", fmt.Errorf("缺少query参数")
+	}
+
+	var httpReq *http.Request
+	var err error
+	switch s.provider {
+	case "tavily":
+		body, _ := json.Marshal(map[string]interface{}{"api_key": s.apiKey, "query": query, "max_results": s.count})
+		httpReq, err = http.NewRequestWithContext(ctx, "POST", s.endpoint, bytes.NewReader(body))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+	default:
+		params := url.Values{"q": {query}}
+		if s.provider == "searxng" {
+			params.Set("format", "json")
+		} else {
+			params.Set("count", fmt.Sprint(s.count))
+		}
+		httpReq, err = http.NewRequestWithContext(ctx, "GET", s.endpoint+"?"+params.Encode(), nil)
+		if err == nil && s.provider == "brave" {
+			httpReq.Header.Set("X-Subscription-Token", s.apiKey)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("创建搜索请求失败: %w", err)
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	injectTraceContext(ctx, httpReq)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("搜索请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", fmt.Errorf("读取搜索结果失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("搜索服务返回状态码 %d", resp.StatusCode)
+	}
+
+	// 三种服务的结果格式不同，统一为标题、链接和摘要
+	var parsed struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("解析搜索结果失败: %w", err)
+	}
+	results := make([]searchResult, 0, s.count)
+	for _, item := range parsed.Results {
+		results = append(results, searchResult{Title: item.Title, URL: item.URL, Snippet: item.Content})
+	}
+	for _, item := range parsed.Web.Results {
+		results = append(results, searchResult{Title: item.Title, URL: item.URL, Snippet: stripHTML(item.Description)})
+	}
+	if len(results) > s.count {
+		results = results[:s.count]
+	}
+	data, err := json.Marshal(map[string]interface{}{"query": query, "results": results})
+	return string(data), err
+}
+
+// urlFetcher 抓取网页，默认拒绝访问内网地址，避免模型被诱导探测内网服务
+type urlFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func newURLFetcher(config *ProxyConfig) *urlFetcher {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !config.FetchURLAllowPrivate {
+		// 在建立连接时检查解析后的地址，重定向和DNS重绑定也无法绕过
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+				ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+				return fmt.Errorf("不允许访问内网地址 %s", host)
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	return &urlFetcher{
+		client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return fmt.Errorf("重定向次数过多")
+				}
+				return nil
+			},
+		},
+		maxBytes: config.FetchURLMaxBytes,
+	}
+}
+
+func (f *urlFetcher) run(ctx context.Context, args map[string]interface{}, requestID string) (string, error) {
+	rawURL, _ := args["url"].(string)
+	target, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return "", fmt.Errorf("url必须是http或https网址: %q", rawURL)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %w", err)
+	}
+	httpReq.Header.Set("User-Agent", "Mozilla/5.0 (compatible; deepseek-proxy fetch_url)")
+	httpReq.Header.Set("Accept", "text/html,text/plain,application/json;q=0.9,*/*;q=0.5")
+	injectTraceContext(ctx, httpReq)
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("抓取失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("网页返回状态码 %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "text/") && !strings.Contains(contentType, "json") &&
+		!strings.Contains(contentType, "xml") && contentType != "" {
+		return "", fmt.Errorf("不支持的内容类型: %s", contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return "", fmt.Errorf("读取网页失败: %w", err)
+	}
+
+	text := string(body)
+	if strings.Contains(contentType, "html") || contentType == "" {
+		text = stripHTML(text)
+	}
+	truncated := false
+	if runes := []rune(text); len(runes) > fetchURLMaxChars {
+		text, truncated = string(runes[:fetchURLMaxChars]), true
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"url":       resp.Request.URL.String(),
+		"content":   text,
+		"truncated": truncated,
+	})
+	return string(data), err
+}
+
+var (
+	htmlNoisePattern = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head)\b.*?</(script|style|noscript|svg|head)>|<!--.*?-->`)
+	htmlBlockPattern = regexp.MustCompile(`(?i)</?(p|div|br|li|tr|h[1-6]|section|article|ul|ol|table|blockquote|pre)\b[^>]*>`)
+	htmlTagPattern   = regexp.MustCompile(`<[^>]*>`)
+	blankLinePattern = regexp.MustCompile(`\n\s*\n+`)
+	spacePattern     = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+// stripHTML 粗略地把HTML转换为纯文本：去掉脚本和样式，块级标签换行，其余标签删除
+func stripHTML(s string) string {
+	s = htmlNoisePattern.ReplaceAllString(s, "")
+	s = htmlBlockPattern.ReplaceAllString(s, "\n")
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = spacePattern.ReplaceAllString(s, " ")
+	s = blankLinePattern.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
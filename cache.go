@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// responseCache 精确匹配的响应缓存
+// 以转换后的DeepSeek请求（模型、消息、参数）的哈希为键，
+// 相同的提示词（RAG流水线、客户端重试等）直接由本地返回。
+// 配置了共享状态时同时写入共享存储，本地未命中时再查共享存储，其他实例缓存的响应同样可用
+type responseCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*cacheEntry
+	shared     sharedStore // 为nil时只使用本地缓存
+
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	resp      *DeepSeekResponse
+	expiresAt time.Time
+}
+
+// newResponseCache 创建响应缓存
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cacheEntry),
+	}
+}
+
+// cacheKey 计算请求的缓存键，是否流式不影响响应内容，因此不参与计算
+func cacheKey(req *DeepSeekRequest) (string, error) {
+	normalized := *req
+	normalized.Stream = false
+	normalized.User = "" // 不同终端用户的相同请求共用缓存
+
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// responseCacheKeyPrefix 响应缓存在共享存储中的键前缀
+const responseCacheKeyPrefix = "cache:"
+
+// Get 查找未过期的缓存响应，并统计命中率
+func (c *responseCache) Get(ctx context.Context, key string) (*DeepSeekResponse, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expiresAt) {
+		c.hits++
+		c.mu.Unlock()
+		return entry.resp, true
+	}
+	delete(c.entries, key)
+	c.mu.Unlock()
+
+	if resp := c.getShared(ctx, key); resp != nil {
+		c.mu.Lock()
+		c.hits++
+		c.put(key, resp)
+		c.mu.Unlock()
+		return resp, true
+	}
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+	return nil, false
+}
+
+// getShared 从共享存储中读取其他实例缓存的响应，出错时按未命中处理
+func (c *responseCache) getShared(ctx context.Context, key string) *DeepSeekResponse {
+	if c.shared == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+	defer cancel()
+	data, ok, err := c.shared.Get(ctx, responseCacheKeyPrefix+key)
+	if err != nil {
+		log.Printf("读取共享响应缓存失败: %v", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	var resp DeepSeekResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		log.Printf("解析共享响应缓存失败: %v", err)
+		return nil
+	}
+	return &resp
+}
+
+// Put 写入本地缓存和共享存储
+func (c *responseCache) Put(ctx context.Context, key string, resp *DeepSeekResponse) {
+	c.mu.Lock()
+	c.put(key, resp)
+	c.mu.Unlock()
+
+	if c.shared == nil {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("序列化响应缓存失败: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stateStoreTimeout)
+	defer cancel()
+	if err := c.shared.Set(ctx, responseCacheKeyPrefix+key, data, c.ttl); err != nil {
+		log.Printf("写入共享响应缓存失败: %v", err)
+	}
+}
+
+// put 写入本地缓存，超过容量时先清理过期条目，仍然不够则淘汰最早过期的条目，调用方持有c.mu
+func (c *responseCache) put(key string, resp *DeepSeekResponse) {
+	if len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || entry.expiresAt.Before(oldest) {
+				oldestKey, oldest = k, entry.expiresAt
+			}
+		}
+		if len(c.entries) >= c.maxEntries && oldestKey != "" {
+			delete(c.entries, oldestKey)
+		}
+	}
+
+	c.entries[key] = &cacheEntry{resp: resp, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// Flush 清空本地缓存和共享存储中的缓存，返回清除的条目数
+func (c *responseCache) Flush(ctx context.Context) int {
+	c.mu.Lock()
+	count := len(c.entries)
+	c.entries = make(map[string]*cacheEntry)
+	c.mu.Unlock()
+
+	if c.shared != nil {
+		deleted, err := c.shared.DeletePrefix(ctx, responseCacheKeyPrefix)
+		if err != nil {
+			log.Printf("清空共享响应缓存失败: %v", err)
+		}
+		if deleted > count {
+			count = deleted
+		}
+	}
+	return count
+}
+
+// Stats 返回缓存命中统计
+func (c *responseCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hitRate := 0.0
+	if total := c.hits + c.misses; total > 0 {
+		hitRate = float64(c.hits) / float64(total)
+	}
+	return map[string]interface{}{
+		"entries":  len(c.entries),
+		"hits":     c.hits,
+		"misses":   c.misses,
+		"hit_rate": hitRate,
+	}
+}
+
+// cacheLookup 一次缓存查询的中间结果，未命中时用于把上游响应写回缓存
+type cacheLookup struct {
+	key       string
+	scope     string
+	embedding []float64
+}
+
+// lookupCache 依次查询精确缓存和语义缓存
+// 返回的状态用于X-Proxy-Cache头：HIT、SEMANTIC-HIT、MISS，未启用任何缓存时为空
+func (ps *ProxyServer) lookupCache(ctx context.Context, req *DeepSeekRequest, requestID string) (*DeepSeekResponse, string, *cacheLookup) {
+	if ps.cache == nil && ps.semanticCache == nil {
+		return nil, "", nil
+	}
+	lookup := &cacheLookup{}
+
+	if ps.cache != nil {
+		key, err := cacheKey(req)
+		key = tenantScope(ctx) + key
+		if err != nil {
+			log.Printf("[%s] 计算缓存键失败: %v", requestID, err)
+		} else if cached, ok := ps.cache.Get(ctx, key); ok {
+			log.Printf("[%s] 响应缓存命中", requestID)
+			return cached, "HIT", nil
+		}
+		lookup.key = key
+	}
+
+	// 真正的流式响应不会写入缓存，也就不必为它向量化提示词
+	if ps.semanticCache != nil && !req.Stream {
+		scope, err := semanticScope(req)
+		scope = tenantScope(ctx) + scope
+		if err != nil {
+			log.Printf("[%s] 计算语义缓存范围失败: %v", requestID, err)
+			return nil, "MISS", lookup
+		}
+		embedding, err := ps.semanticCache.Embed(ctx, promptText(req.Messages))
+		if err != nil {
+			log.Printf("[%s] 获取提示词向量失败，跳过语义缓存: %v", requestID, err)
+			return nil, "MISS", lookup
+		}
+		if cached, score, ok := ps.semanticCache.Lookup(ctx, scope, req.Model, embedding); ok {
+			log.Printf("[%s] 语义缓存命中，相似度: %.4f", requestID, score)
+			return cached, "SEMANTIC-HIT", nil
+		}
+		lookup.scope = scope
+		lookup.embedding = embedding
+	}
+
+	return nil, "MISS", lookup
+}
+
+// storeCache 把上游响应写入本次查询未命中的缓存
+func (ps *ProxyServer) storeCache(ctx context.Context, lookup *cacheLookup, resp *DeepSeekResponse) {
+	if lookup == nil {
+		return
+	}
+	if lookup.key != "" {
+		ps.cache.Put(ctx, lookup.key, resp)
+	}
+	if lookup.embedding != nil {
+		ps.semanticCache.Put(lookup.scope, lookup.embedding, resp)
+	}
+}
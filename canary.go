@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 金丝雀发布：通过管理接口把某个客户端模型逐步切换到新的DeepSeek模型（如 o3 先切5%，再50%、100%），
+// 与A/B分流一样按user字段、会话ID或客户端密钥哈希分组，比例提高时已切换的用户保持不变。
+// 切换组与原映射组分别统计错误率和延迟，切换组明显变差时自动回滚，所有请求恢复原来的映射
+
+// 金丝雀发布的状态
+const (
+	canaryActive     = "active"
+	canaryRolledBack = "rolled_back"
+)
+
+// 请求所在的组
+const (
+	canaryGroupCanary   = "canary"
+	canaryGroupBaseline = "baseline"
+)
+
+// canaryArmStats 一组的累计指标，错误只统计5xx，延迟只统计成功的请求
+type canaryArmStats struct {
+	Requests       int64   `json:"requests"`
+	Errors         int64   `json:"errors"`
+	ErrorRate      float64 `json:"error_rate"`
+	AvgLatencyMs   float64 `json:"avg_latency_ms"`
+	TotalLatencyMs int64   `json:"total_latency_ms"`
+}
+
+func (s *canaryArmStats) record(status int, latency time.Duration) {
+	s.Requests++
+	if status >= http.StatusInternalServerError {
+		s.Errors++
+	} else {
+		s.TotalLatencyMs += latency.Milliseconds()
+	}
+	s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	if successes := s.Requests - s.Errors; successes > 0 {
+		s.AvgLatencyMs = float64(s.TotalLatencyMs) / float64(successes)
+	}
+}
+
+// canaryRollout 一个模型的金丝雀发布
+type canaryRollout struct {
+	Model     string         `json:"model"`   // 客户端请求的模型名
+	Target    string         `json:"target"`  // 切换到的DeepSeek模型
+	Percent   int            `json:"percent"` // 切换的比例（0-100）
+	Status    string         `json:"status"`
+	Reason    string         `json:"reason,omitempty"` // 自动回滚的原因
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Canary    canaryArmStats `json:"canary"`
+	Baseline  canaryArmStats `json:"baseline"`
+}
+
+// canaryRollouts 所有金丝雀发布及自动回滚的阈值，设置CANARY_STATE_FILE时变更会持久化
+type canaryRollouts struct {
+	file              string
+	minRequests       int64
+	maxErrorRateDelta float64
+	maxLatencyRatio   float64
+
+	mu       sync.Mutex
+	rollouts map[string]*canaryRollout
+}
+
+// newCanaryRollouts 创建金丝雀发布管理，从状态文件恢复之前的发布
+func newCanaryRollouts(config *ProxyConfig) (*canaryRollouts, error) {
+	c := &canaryRollouts{
+		file:              config.CanaryStateFile,
+		minRequests:       int64(config.CanaryMinRequests),
+		maxErrorRateDelta: config.CanaryMaxErrorRateDelta,
+		maxLatencyRatio:   config.CanaryMaxLatencyRatio,
+		rollouts:          make(map[string]*canaryRollout),
+	}
+	if c.file == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取金丝雀状态文件失败: %w", err)
+	}
+	var rollouts []*canaryRollout
+	if err := json.Unmarshal(data, &rollouts); err != nil {
+		return nil, fmt.Errorf("解析金丝雀状态文件失败: %w", err)
+	}
+	for _, rollout := range rollouts {
+		c.rollouts[rollout.Model] = rollout
+	}
+	return c, nil
+}
+
+// save 把所有发布写入状态文件，调用方持有c.mu
+func (c *canaryRollouts) save() {
+	if c.file == "" {
+		return
+	}
+	data, err := json.MarshalIndent(c.list(), "", "  ")
+	if err == nil {
+		err = writeFileAtomic(c.file, data)
+	}
+	if err != nil {
+		log.Printf("保存金丝雀状态失败: %v", err)
+	}
+}
+
+// list 按模型名排序的发布副本，调用方持有c.mu
+func (c *canaryRollouts) list() []canaryRollout {
+	rollouts := make([]canaryRollout, 0, len(c.rollouts))
+	for _, rollout := range c.rollouts {
+		rollouts = append(rollouts, *rollout)
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].Model < rollouts[j].Model })
+	return rollouts
+}
+
+// canaryBucket 请求在某个模型的发布中所在的桶（0-99）
+func canaryBucket(r *http.Request, req *ChatRequest) int {
+	h := fnv.New32a()
+	h.Write([]byte("canary\x00" + req.Model + "\x00" + splitKey(r, req)))
+	return int(h.Sum32() % 100)
+}
+
+// Assign 返回请求所在的组；在切换组时同时返回要使用的模型，模型没有进行中的发布时组为空
+func (c *canaryRollouts) Assign(r *http.Request, req *ChatRequest, requestID string) (string, string) {
+	model := req.Model
+	c.mu.Lock()
+	rollout, ok := c.rollouts[model]
+	if !ok || rollout.Status != canaryActive {
+		c.mu.Unlock()
+		return "", ""
+	}
+	target, percent := rollout.Target, rollout.Percent
+	c.mu.Unlock()
+
+	if canaryBucket(r, req) < percent {
+		log.Printf("[%s] 金丝雀发布: %s -> %s", requestID, model, target)
+		return target, canaryGroupCanary
+	}
+	return "", canaryGroupBaseline
+}
+
+// Record 汇总一个请求的结果，切换组的指标明显差于原映射组时自动回滚
+func (c *canaryRollouts) Record(model, group string, status int, latency time.Duration) {
+	if group == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rollout, ok := c.rollouts[model]
+	if !ok || rollout.Status != canaryActive {
+		return
+	}
+	if group == canaryGroupBaseline {
+		rollout.Baseline.record(status, latency)
+		return
+	}
+	rollout.Canary.record(status, latency)
+
+	if reason := c.regression(rollout); reason != "" {
+		rollout.Status, rollout.Reason, rollout.UpdatedAt = canaryRolledBack, reason, time.Now()
+		log.Printf("⚠ 金丝雀发布 %s -> %s 已自动回滚: %s", rollout.Model, rollout.Target, reason)
+		c.save()
+	}
+}
+
+// regression 比较两组的指标，样本不足时不做判断
+func (c *canaryRollouts) regression(rollout *canaryRollout) string {
+	canary, baseline := rollout.Canary, rollout.Baseline
+	if canary.Requests < c.minRequests || baseline.Requests < c.minRequests {
+		return ""
+	}
+	if c.maxErrorRateDelta > 0 && canary.ErrorRate-baseline.ErrorRate > c.maxErrorRateDelta {
+		return fmt.Sprintf("错误率 %.1f%% 高于原映射的 %.1f%%", canary.ErrorRate*100, baseline.ErrorRate*100)
+	}
+	if c.maxLatencyRatio > 0 && baseline.AvgLatencyMs > 0 && canary.AvgLatencyMs > baseline.AvgLatencyMs*c.maxLatencyRatio {
+		return fmt.Sprintf("平均延迟 %.0fms 超过原映射 %.0fms 的 %.1f 倍", canary.AvgLatencyMs, baseline.AvgLatencyMs, c.maxLatencyRatio)
+	}
+	return ""
+}
+
+// Set 创建发布或调整比例；目标模型改变或从回滚状态重新开始时清空指标
+func (c *canaryRollouts) Set(model, target string, percent int) canaryRollout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	rollout, ok := c.rollouts[model]
+	if !ok || rollout.Target != target || rollout.Status != canaryActive {
+		rollout = &canaryRollout{Model: model, Target: target, Status: canaryActive, CreatedAt: now}
+		c.rollouts[model] = rollout
+	}
+	rollout.Percent, rollout.UpdatedAt = percent, now
+	log.Printf("金丝雀发布 %s -> %s：%d%% 的请求", model, target, percent)
+	c.save()
+	return *rollout
+}
+
+// Delete 删除发布，该模型的请求恢复原来的映射
+func (c *canaryRollouts) Delete(model string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rollouts[model]; !ok {
+		return false
+	}
+	delete(c.rollouts, model)
+	log.Printf("金丝雀发布 %s 已删除", model)
+	c.save()
+	return true
+}
+
+// List 返回所有发布
+func (c *canaryRollouts) List() []canaryRollout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list()
+}
+
+// recordCanaryGroup 在请求的统计记录中登记金丝雀分组
+func recordCanaryGroup(ctx context.Context, group string) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.canary = group
+		record.mu.Unlock()
+	}
+}
+
+// handleAdminCanary 查看（GET）、创建或调整（POST）、删除（DELETE ?model=）金丝雀发布
+func (ps *ProxyServer) handleAdminCanary(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var body struct {
+			Model   string `json:"model"`
+			Target  string `json:"target"`
+			Percent *int   `json:"percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "金丝雀发布")
+			return
+		}
+		body.Model, body.Target = strings.TrimSpace(body.Model), strings.TrimSpace(body.Target)
+		if body.Model == "" || body.Target == "" || body.Percent == nil || *body.Percent < 0 || *body.Percent > 100 {
+			handleError(w, fmt.Errorf("请求体应为 {\"model\": 模型, \"target\": 目标模型, \"percent\": 0-100}"), http.StatusBadRequest, "金丝雀发布")
+			return
+		}
+		writeJSONResponse(w, ps.canary.Set(body.Model, body.Target, *body.Percent))
+		return
+	case "DELETE":
+		model := r.URL.Query().Get("model")
+		if !ps.canary.Delete(model) {
+			handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("模型 %s 没有金丝雀发布", model)), http.StatusNotFound, "金丝雀发布")
+			return
+		}
+		writeJSONResponse(w, map[string]interface{}{"model": model, "deleted": true})
+		return
+	default:
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	if err := writeJSONResponse(w, map[string]interface{}{"object": "list", "data": ps.canary.List()}); err != nil {
+		log.Printf("写入金丝雀发布列表失败: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 录制与回放：CASSETTE_MODE=record 时把发往DeepSeek的请求和完整响应（包括SSE流）保存为CASSETTE_DIR下的录制文件，
+// CASSETTE_MODE=replay 时不再调用上游，按请求内容找到对应的录制原样返回，集成测试可以得到确定的结果，
+// 线上问题也可以用录制文件在本地复现。录制以请求方法、路径和请求体的哈希命名，不保存认证头部
+
+// 录制模式
+const (
+	cassetteOff    = "off"
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+)
+
+// cassette 一次录制的请求和响应
+type cassette struct {
+	RecordedAt time.Time       `json:"recorded_at"`
+	Request    cassetteRequest `json:"request"`
+	Response   cassetteResult  `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type cassetteResult struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
+// cassetteDeck 录制文件目录和计数
+type cassetteDeck struct {
+	mode     string
+	dir      string
+	endpoint string
+
+	writeMu sync.Mutex
+
+	recorded atomic.Int64
+	replayed atomic.Int64
+	misses   atomic.Int64
+}
+
+// newCassetteDeck 按配置创建录制或回放，CASSETTE_MODE为off时返回nil
+func newCassetteDeck(config *ProxyConfig) (*cassetteDeck, error) {
+	switch config.CassetteMode {
+	case cassetteOff:
+		return nil, nil
+	case cassetteRecord, cassetteReplay:
+	default:
+		return nil, fmt.Errorf("CASSETTE_MODE 只能是 off、record 或 replay，当前为 %q", config.CassetteMode)
+	}
+	if config.CassetteMode == cassetteRecord {
+		if err := os.MkdirAll(config.CassetteDir, 0o700); err != nil {
+			return nil, fmt.Errorf("创建录制目录失败: %w", err)
+		}
+	} else if _, err := os.Stat(config.CassetteDir); err != nil {
+		return nil, fmt.Errorf("读取录制目录失败: %w", err)
+	}
+	return &cassetteDeck{mode: config.CassetteMode, dir: config.CassetteDir, endpoint: config.Endpoint}, nil
+}
+
+// wrap 在出站传输外层录制或回放
+func (d *cassetteDeck) wrap(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &cassetteTransport{deck: d, next: next}
+}
+
+// cassetteKey 录制文件名：请求方法、路径和请求体的哈希
+func cassetteKey(method, path string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+func (d *cassetteDeck) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+// save 写入一条录制，相同的请求覆盖之前的录制
+func (d *cassetteDeck) save(key string, c *cassette) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		d.writeMu.Lock()
+		err = writeFileAtomic(d.path(key), data)
+		d.writeMu.Unlock()
+	}
+	if err != nil {
+		log.Printf("保存录制 %s 失败: %v", key, err)
+		return
+	}
+	d.recorded.Add(1)
+	debugf("已录制 %s %s -> %s", c.Request.Method, c.Request.Path, key)
+}
+
+// cassetteTransport 只录制和回放发往DeepSeek端点的请求，影子请求、embeddings等其他出站请求照常发送
+type cassetteTransport struct {
+	deck *cassetteDeck
+	next http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := t.deck
+	if !strings.HasPrefix(req.URL.String(), d.endpoint) || req.Header.Get("X-Shadow-Request") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取请求体失败: %w", err)
+		}
+		body = data
+	}
+	key := cassetteKey(req.Method, req.URL.Path, body)
+
+	if d.mode == cassetteReplay {
+		return d.replay(req, key)
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{
+		RecordedAt: time.Now(),
+		Request:    cassetteRequest{Method: req.Method, Path: req.URL.Path},
+		Response:   cassetteResult{Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")},
+	}
+	if json.Valid(body) {
+		c.Request.Body = body
+	}
+	// 响应体边读边转发，读完后再保存，流式响应不会因为录制而延迟
+	resp.Body = &cassetteRecorder{ReadCloser: resp.Body, deck: d, key: key, cassette: c}
+	return resp, nil
+}
+
+// replay 返回录制的响应，没有对应的录制时返回404
+func (d *cassetteDeck) replay(req *http.Request, key string) (*http.Response, error) {
+	status := http.StatusOK
+	contentType := "application/json"
+	var body string
+
+	data, err := os.ReadFile(d.path(key))
+	var c cassette
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	switch {
+	case err == nil:
+		d.replayed.Add(1)
+		debugf("[%s] 回放录制 %s", req.Header.Get("X-Request-ID"), key)
+		status, body = c.Response.Status, c.Response.Body
+		if c.Response.ContentType != "" {
+			contentType = c.Response.ContentType
+		}
+	case errors.Is(err, os.ErrNotExist):
+		d.misses.Add(1)
+		log.Printf("[%s] 回放模式下没有 %s %s 的录制 %s", req.Header.Get("X-Request-ID"), req.Method, req.URL.Path, key)
+		status = http.StatusNotFound
+		message, _ := json.Marshal(fmt.Sprintf("回放模式下没有匹配的录制: %s", key))
+		body = fmt.Sprintf(`{"error":{"message":%s,"type":"invalid_request_error"}}`, message)
+	default:
+		return nil, fmt.Errorf("读取录制 %s 失败: %w", key, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// cassetteRecorder 读取响应体的同时保存一份，读到结尾时写入录制；没有读完就关闭的响应不保存
+type cassetteRecorder struct {
+	io.ReadCloser
+	deck     *cassetteDeck
+	key      string
+	cassette *cassette
+	buf      bytes.Buffer
+	done     bool
+}
+
+func (r *cassetteRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.cassette.Response.Body = r.buf.String()
+		r.deck.save(r.key, r.cassette)
+	}
+	return n, err
+}
+
+// Stats 录制和回放的计数，用于统计接口
+func (d *cassetteDeck) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"mode":     d.mode,
+		"dir":      d.dir,
+		"recorded": d.recorded.Load(),
+		"replayed": d.replayed.Load(),
+		"misses":   d.misses.Load(),
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 混沌测试：按CHAOS_*配置在发往DeepSeek的请求上注入人为延迟、随机5xx错误和流式响应中途断开，
+// 客户端可以在可控的环境中验证重试、超时和断线处理。故障在出站传输层注入，
+// 代理自身的熔断、重试、故障转移等逻辑照常执行，客户端看到的就是真实故障下代理的行为。
+// 只用于测试，不要在生产环境开启
+
+// chaosErrorStatuses 随机注入的错误状态码
+var chaosErrorStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// chaosMaxDisconnectBytes 流式响应最多读取多少字节后断开
+const chaosMaxDisconnectBytes = 1024
+
+// chaosInjector 故障注入的配置和计数
+type chaosInjector struct {
+	endpoint       string
+	latency        time.Duration
+	jitter         time.Duration
+	errorRate      float64
+	disconnectRate float64
+
+	delayed     atomic.Int64
+	errors      atomic.Int64
+	disconnects atomic.Int64
+}
+
+// newChaosInjector 按配置创建故障注入，未配置任何故障时返回nil
+func newChaosInjector(config *ProxyConfig) (*chaosInjector, error) {
+	if config.ChaosLatency <= 0 && config.ChaosLatencyJitter <= 0 && config.ChaosErrorRate <= 0 && config.ChaosDisconnectRate <= 0 {
+		return nil, nil
+	}
+	if config.ChaosErrorRate < 0 || config.ChaosErrorRate > 1 {
+		return nil, fmt.Errorf("CHAOS_ERROR_RATE 必须在0到1之间: %v", config.ChaosErrorRate)
+	}
+	if config.ChaosDisconnectRate < 0 || config.ChaosDisconnectRate > 1 {
+		return nil, fmt.Errorf("CHAOS_DISCONNECT_RATE 必须在0到1之间: %v", config.ChaosDisconnectRate)
+	}
+	return &chaosInjector{
+		endpoint:       config.Endpoint,
+		latency:        config.ChaosLatency,
+		jitter:         config.ChaosLatencyJitter,
+		errorRate:      config.ChaosErrorRate,
+		disconnectRate: config.ChaosDisconnectRate,
+	}, nil
+}
+
+// wrap 在出站传输外层注入故障
+func (c *chaosInjector) wrap(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &chaosTransport{chaos: c, next: next}
+}
+
+// chaosTransport 只对发往DeepSeek端点的请求注入故障，影子请求、embeddings等其他出站请求不受影响
+type chaosTransport struct {
+	chaos *chaosInjector
+	next  http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.chaos
+	if !strings.HasPrefix(req.URL.String(), c.endpoint) || req.Header.Get("X-Shadow-Request") != "" {
+		return t.next.RoundTrip(req)
+	}
+	requestID := req.Header.Get("X-Request-ID")
+
+	if delay := c.delay(); delay > 0 {
+		c.delayed.Add(1)
+		debugf("[%s] 混沌测试：延迟 %v", requestID, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+
+	if c.errorRate > 0 && rand.Float64() < c.errorRate {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		status := chaosErrorStatuses[rand.Intn(len(chaosErrorStatuses))]
+		c.errors.Add(1)
+		log.Printf("[%s] 混沌测试：注入 %d 错误", requestID, status)
+		body := fmt.Sprintf(`{"error":{"message":"混沌测试注入的 %d 错误","type":"server_error"}}`, status)
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return resp, err
+	}
+	if c.disconnectRate > 0 && rand.Float64() < c.disconnectRate {
+		c.disconnects.Add(1)
+		after := rand.Intn(chaosMaxDisconnectBytes) + 1
+		log.Printf("[%s] 混沌测试：流式响应将在 %d 字节后断开", requestID, after)
+		resp.Body = &chaosDisconnectBody{ReadCloser: resp.Body, remaining: after}
+	}
+	return resp, nil
+}
+
+// delay 本次请求注入的延迟：固定延迟加上随机抖动
+func (c *chaosInjector) delay() time.Duration {
+	delay := c.latency
+	if c.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.jitter)))
+	}
+	return delay
+}
+
+// chaosDisconnectBody 读取指定字节数后模拟连接中断
+type chaosDisconnectBody struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (b *chaosDisconnectBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+// Stats 故障注入的配置和计数，用于统计接口
+func (c *chaosInjector) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"latency":         c.latency.String(),
+		"latency_jitter":  c.jitter.String(),
+		"error_rate":      c.errorRate,
+		"disconnect_rate": c.disconnectRate,
+		"delayed":         c.delayed.Load(),
+		"errors":          c.errors.Load(),
+		"disconnects":     c.disconnects.Load(),
+	}
+}
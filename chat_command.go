@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// chat 子命令：在终端里与运行中的代理（或直接与DeepSeek）流式对话，保留多轮历史，
+// 可以随时切换模型、显示或隐藏推理内容，用于快速检查模型映射是否正常。
+// 请求带 deepseek-proxy-cli 的User-Agent，代理按内置的cli客户端配置保留reasoning_content字段
+
+// chatUserAgent chat子命令使用的User-Agent
+const chatUserAgent = "deepseek-proxy-cli"
+
+// 推理内容的显示颜色
+const (
+	chatReasoningColor = "\033[90m"
+	chatResetColor     = "\033[0m"
+)
+
+// chatSession 对话的连接信息、选项和历史
+type chatSession struct {
+	client        *http.Client
+	endpoint      string
+	apiKey        string
+	model         string
+	stream        bool
+	showReasoning bool
+	system        string
+	history       []Message
+}
+
+// runChatCommand 读取标准输入的每一行作为用户消息，以 / 开头的行是命令，输入 /exit 退出
+func runChatCommand(args []string) int {
+	fs := flag.NewFlagSet("chat", flag.ExitOnError)
+	configFile := fs.String("config", ".env", "配置文件路径")
+	baseURL := fs.String("url", "", "代理地址（默认: 本机PORT端口）")
+	apiKey := fs.String("key", "", "访问代理的API密钥（默认: DEEPSEEK_API_KEY）")
+	model := fs.String("model", "gpt-4o", "请求的模型名")
+	upstream := fs.Bool("upstream", false, "不经过代理，直接请求DEEPSEEK_ENDPOINT")
+	stream := fs.Bool("stream", true, "流式输出")
+	reasoning := fs.Bool("reasoning", true, "显示推理内容")
+	system := fs.String("system", "", "系统提示词")
+	fs.Parse(args)
+	config, err := clientConfig(*configFile, baseURL, apiKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		return 2
+	}
+
+	base := strings.TrimRight(*baseURL, "/")
+	if *upstream {
+		base = strings.TrimRight(config.Endpoint, "/")
+		if !flagPassed(fs, "model") {
+			*model = "deepseek-chat"
+		}
+	}
+	session := &chatSession{
+		client:        &http.Client{Timeout: 10 * time.Minute},
+		endpoint:      base + "/v1/chat/completions",
+		apiKey:        *apiKey,
+		model:         *model,
+		stream:        *stream,
+		showReasoning: *reasoning,
+		system:        *system,
+	}
+
+	fmt.Printf("💬 已连接 %s，模型 %s，输入 /help 查看命令，/exit 退出\n", base, session.model)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Printf("%s> ", session.model)
+		if !scanner.Scan() {
+			fmt.Println()
+			return 0
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			if !session.command(line) {
+				return 0
+			}
+			continue
+		}
+		session.send(line)
+	}
+}
+
+// flagPassed 命令行中是否显式指定了某个参数
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// command 执行以 / 开头的命令，返回false时退出
+func (s *chatSession) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/exit", "/quit":
+		return false
+	case "/model":
+		if arg == "" {
+			fmt.Printf("当前模型: %s\n", s.model)
+		} else {
+			s.model = arg
+			fmt.Printf("已切换到模型 %s\n", s.model)
+		}
+	case "/reasoning":
+		s.showReasoning = !s.showReasoning
+		fmt.Printf("推理内容显示: %s\n", onOff(s.showReasoning))
+	case "/stream":
+		s.stream = !s.stream
+		fmt.Printf("流式输出: %s\n", onOff(s.stream))
+	case "/system":
+		s.system = arg
+		fmt.Printf("系统提示词: %s\n", truncateString(arg, 100))
+	case "/clear":
+		s.history = nil
+		fmt.Println("已清空对话历史")
+	case "/help":
+		fmt.Println("  /model [名称]   查看或切换模型")
+		fmt.Println("  /reasoning      显示或隐藏推理内容")
+		fmt.Println("  /stream         开启或关闭流式输出")
+		fmt.Println("  /system [内容]  设置系统提示词，内容为空时清除")
+		fmt.Println("  /clear          清空对话历史")
+		fmt.Println("  /exit           退出")
+	default:
+		fmt.Printf("未知命令 %s，输入 /help 查看命令\n", name)
+	}
+	return true
+}
+
+func onOff(on bool) string {
+	if on {
+		return "开"
+	}
+	return "关"
+}
+
+// send 发送一轮对话，成功时把问答加入历史
+func (s *chatSession) send(text string) {
+	messages := make([]Message, 0, len(s.history)+2)
+	if s.system != "" {
+		messages = append(messages, Message{Role: "system", Content: s.system})
+	}
+	messages = append(messages, s.history...)
+	messages = append(messages, Message{Role: "user", Content: text})
+
+	start := time.Now()
+	reply, usage, err := s.request(messages)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if usage != nil {
+		fmt.Printf("%s[%v，%d tokens]%s\n", chatReasoningColor, time.Since(start).Round(time.Millisecond), usage.TotalTokens, chatResetColor)
+	}
+	s.history = append(s.history, Message{Role: "user", Content: text}, Message{Role: "assistant", Content: reply})
+}
+
+// request 发送请求并输出回复，返回回复正文和用量
+func (s *chatSession) request(messages []Message) (string, *Usage, error) {
+	payload := map[string]interface{}{"model": s.model, "messages": messages, "stream": s.stream}
+	if s.stream {
+		payload["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("序列化请求失败: %w", err)
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, fmt.Errorf("创建请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("User-Agent", chatUserAgent+"/"+Version)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return "", nil, fmt.Errorf("请求失败，状态码: %d, 响应: %s", resp.StatusCode, truncateString(string(data), 500))
+	}
+	if s.stream {
+		return s.readStream(resp.Body)
+	}
+
+	var result DeepSeekResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", nil, fmt.Errorf("解析响应失败: %w", err)
+	}
+	if len(result.Choices) == 0 {
+		return "", nil, fmt.Errorf("响应中没有choices")
+	}
+	message := result.Choices[0].Message
+	s.printReasoning(message.ReasoningContent)
+	if message.ReasoningContent != "" && s.showReasoning {
+		fmt.Println()
+	}
+	fmt.Println(message.Content)
+	return message.Content, &result.Usage, nil
+}
+
+// readStream 逐个输出流式数据块中的推理内容和正文
+func (s *chatSession) readStream(body io.Reader) (string, *Usage, error) {
+	var content strings.Builder
+	var usage *Usage
+	reasoning := false
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:"); ok {
+			data = strings.TrimSpace(data)
+			if data == "[DONE]" {
+				break
+			}
+			var chunk struct {
+				Choices []struct {
+					Delta struct {
+						Content          string `json:"content"`
+						ReasoningContent string `json:"reasoning_content"`
+					} `json:"delta"`
+				} `json:"choices"`
+				Usage *Usage          `json:"usage"`
+				Error json.RawMessage `json:"error"`
+			}
+			if json.Unmarshal([]byte(data), &chunk) != nil {
+				continue
+			}
+			if len(chunk.Error) > 0 {
+				fmt.Println()
+				return "", nil, fmt.Errorf("流式响应出错: %s", string(chunk.Error))
+			}
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+			}
+			for _, choice := range chunk.Choices {
+				if choice.Delta.ReasoningContent != "" {
+					reasoning = true
+					s.printReasoning(choice.Delta.ReasoningContent)
+				}
+				if choice.Delta.Content != "" {
+					if reasoning {
+						reasoning = false
+						if s.showReasoning {
+							fmt.Print("\n\n")
+						}
+					}
+					fmt.Print(choice.Delta.Content)
+					content.WriteString(choice.Delta.Content)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println()
+			return "", nil, fmt.Errorf("读取流式响应失败: %w", err)
+		}
+	}
+	fmt.Println()
+	return content.String(), usage, nil
+}
+
+// printReasoning 开启推理内容显示时用灰色输出推理内容
+func (s *chatSession) printReasoning(text string) {
+	if text == "" || !s.showReasoning {
+		return
+	}
+	fmt.Print(chatReasoningColor + text + chatResetColor)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 客户端兼容配置：按User-Agent识别Cursor、Cline等客户端，每个配置声明该客户端需要的特殊处理
+// （max_tokens上限、推理内容的呈现方式、错误风格），取代原先写死在代码里的Cursor判断。
+// 内置配置可以在CLIENT_PROFILES_FILE中按名称覆盖或禁用，也可以追加新的客户端
+
+// 推理内容的呈现方式
+const (
+	reasoningSeparate  = "separate"   // 保留reasoning_content字段
+	reasoningMerge     = "merge"      // 推理内容放在正文之前，用空行分隔
+	reasoningThinkTags = "think_tags" // 推理内容用<think>标签包裹后放在正文之前
+	reasoningDrop      = "drop"       // 丢弃推理内容
+)
+
+// 错误风格
+const (
+	errorStyleOpenAI = "openai" // 按错误类型返回对应的状态码
+	errorStyleRetry  = "retry"  // 认证和请求错误统一返回503，客户端会自动重试
+)
+
+// clientProfile 一个客户端的兼容配置
+type clientProfile struct {
+	Name         string   `json:"name"`
+	UserAgents   []string `json:"user_agents"`              // User-Agent包含其中任一子串（不区分大小写）即匹配
+	MaxTokensCap int      `json:"max_tokens_cap,omitempty"` // 客户端未设置max_tokens或超过该值时使用该值，0表示不限制
+	Reasoning    string   `json:"reasoning,omitempty"`      // separate、merge、think_tags或drop，为空时保持默认
+	ErrorStyle   string   `json:"error_style,omitempty"`    // openai（默认）或retry
+	Disabled     bool     `json:"disabled,omitempty"`       // 禁用同名的内置配置
+}
+
+// defaultClientProfiles 内置的客户端配置
+var defaultClientProfiles = []clientProfile{
+	{Name: "cursor", UserAgents: []string{"cursor"}, MaxTokensCap: 1500, Reasoning: reasoningMerge, ErrorStyle: errorStyleRetry},
+	{Name: "cline", UserAgents: []string{"cline"}, Reasoning: reasoningSeparate},
+	{Name: "continue", UserAgents: []string{"continue"}, Reasoning: reasoningThinkTags},
+	{Name: "aider", UserAgents: []string{"aider"}, Reasoning: reasoningThinkTags},
+	{Name: "sillytavern", UserAgents: []string{"sillytavern"}, Reasoning: reasoningSeparate},
+	{Name: "cli", UserAgents: []string{chatUserAgent}, Reasoning: reasoningSeparate},
+}
+
+// clientProfiles 按顺序匹配的客户端配置
+type clientProfiles struct {
+	Profiles []clientProfile `json:"profiles"`
+}
+
+// loadClientProfiles 在内置配置的基础上合并CLIENT_PROFILES_FILE，同名配置整体替换内置配置
+func loadClientProfiles(config *ProxyConfig) (*clientProfiles, error) {
+	profiles := append([]clientProfile{}, defaultClientProfiles...)
+	if config.ClientProfilesFile != "" {
+		data, err := os.ReadFile(config.ClientProfilesFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端配置文件失败: %w", err)
+		}
+		var file clientProfiles
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("解析客户端配置文件失败: %w", err)
+		}
+	next:
+		for _, profile := range file.Profiles {
+			for i := range profiles {
+				if strings.EqualFold(profiles[i].Name, profile.Name) {
+					profiles[i] = profile
+					continue next
+				}
+			}
+			profiles = append(profiles, profile)
+		}
+	}
+
+	enabled := profiles[:0]
+	for _, profile := range profiles {
+		if profile.Disabled {
+			continue
+		}
+		if profile.Name == "" {
+			return nil, fmt.Errorf("客户端配置缺少name")
+		}
+		switch profile.Reasoning {
+		case "", reasoningSeparate, reasoningMerge, reasoningThinkTags, reasoningDrop:
+		default:
+			return nil, fmt.Errorf("客户端配置 %s 的reasoning无效: %s（可选 separate、merge、think_tags、drop）", profile.Name, profile.Reasoning)
+		}
+		switch profile.ErrorStyle {
+		case "", errorStyleOpenAI, errorStyleRetry:
+		default:
+			return nil, fmt.Errorf("客户端配置 %s 的error_style无效: %s（可选 openai、retry）", profile.Name, profile.ErrorStyle)
+		}
+		if strings.EqualFold(profile.Name, "cursor") && !config.CursorMaxTokensClamp {
+			profile.MaxTokensCap = 0
+		}
+		patterns := make([]string, len(profile.UserAgents))
+		for i, pattern := range profile.UserAgents {
+			patterns[i] = strings.ToLower(pattern)
+		}
+		profile.UserAgents = patterns
+		enabled = append(enabled, profile)
+	}
+	return &clientProfiles{Profiles: enabled}, nil
+}
+
+// Match 返回请求对应的客户端配置：X-Client-Profile头部指定名称时优先，否则按User-Agent匹配
+func (p *clientProfiles) Match(r *http.Request) *clientProfile {
+	if p == nil {
+		return nil
+	}
+	if name := r.Header.Get("X-Client-Profile"); name != "" {
+		for i := range p.Profiles {
+			if strings.EqualFold(p.Profiles[i].Name, name) {
+				return &p.Profiles[i]
+			}
+		}
+	}
+	userAgent := strings.ToLower(r.Header.Get("User-Agent"))
+	if userAgent == "" {
+		return nil
+	}
+	for i := range p.Profiles {
+		for _, pattern := range p.Profiles[i].UserAgents {
+			if pattern != "" && strings.Contains(userAgent, pattern) {
+				return &p.Profiles[i]
+			}
+		}
+	}
+	return nil
+}
+
+type clientProfileKey struct{}
+
+// clientProfileFor 返回请求context中的客户端配置，没有匹配时为nil
+func clientProfileFor(ctx context.Context) *clientProfile {
+	profile, _ := ctx.Value(clientProfileKey{}).(*clientProfile)
+	return profile
+}
+
+// clientProfileMiddleware 识别客户端并把配置保存到请求context中，认证失败的错误风格同样依赖它
+func (ps *ProxyServer) clientProfileMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profile := ps.profiles.Match(r)
+		if profile == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("[%s] 检测到%s客户端，启用兼容配置", requestIDFor(r), profile.Name)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientProfileKey{}, profile)))
+	})
+}
+
+// reasoningMode 推理内容的呈现方式；没有配置时非流式响应合并到正文，流式响应保留reasoning_content
+func (p *clientProfile) reasoningMode(stream bool) string {
+	if p != nil && p.Reasoning != "" {
+		return p.Reasoning
+	}
+	if stream {
+		return reasoningSeparate
+	}
+	return reasoningMerge
+}
+
+// retryErrors 是否把错误统一返回为503
+func (p *clientProfile) retryErrors() bool {
+	return p != nil && p.ErrorStyle == errorStyleRetry
+}
+
+// applyMaxTokensCap 按客户端配置限制max_tokens
+func (p *clientProfile) applyMaxTokensCap(req *ChatRequest, requestID string) {
+	if p == nil || p.MaxTokensCap <= 0 {
+		return
+	}
+	if req.MaxTokens == nil || *req.MaxTokens > p.MaxTokensCap {
+		maxTokens := p.MaxTokensCap
+		req.MaxTokens = &maxTokens
+		log.Printf("[%s] %s客户端：限制最大tokens为%d", requestID, p.Name, maxTokens)
+	}
+}
+
+// foldReasoning 按呈现方式整理推理内容和正文
+func foldReasoning(mode, reasoning, content string) (string, string) {
+	if reasoning == "" {
+		return "", content
+	}
+	switch mode {
+	case reasoningMerge:
+		return "", reasoning + "\n\n" + content
+	case reasoningThinkTags:
+		return "", "<think>\n" + reasoning + "\n</think>\n\n" + content
+	case reasoningDrop:
+		return "", content
+	}
+	return reasoning, content
+}
+
+// reasoningStream 在流式响应中按呈现方式改写推理内容增量
+type reasoningStream struct {
+	mode     string
+	thinking map[float64]bool // 各choice是否已输出推理内容、尚未进入正文
+}
+
+func newReasoningStream(mode string) *reasoningStream {
+	return &reasoningStream{mode: mode, thinking: make(map[float64]bool)}
+}
+
+// Rewrite 改写数据块中的reasoning_content增量
+func (rs *reasoningStream) Rewrite(chunk map[string]interface{}) {
+	if rs.mode == reasoningSeparate {
+		return
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		reasoning, _ := delta["reasoning_content"].(string)
+		content, _ := delta["content"].(string)
+		delete(delta, "reasoning_content")
+		if rs.mode == reasoningDrop {
+			continue
+		}
+
+		var text string
+		if reasoning != "" {
+			if !rs.thinking[index] && rs.mode == reasoningThinkTags {
+				text = "<think>\n"
+			}
+			rs.thinking[index] = true
+			text += reasoning
+		}
+		finished := choice["finish_reason"] != nil
+		if rs.thinking[index] && (content != "" || finished) {
+			rs.thinking[index] = false
+			if rs.mode == reasoningThinkTags {
+				text += "\n</think>\n\n"
+			} else if content != "" {
+				text += "\n\n"
+			}
+		}
+		if text != "" {
+			delta["content"] = text + content
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// requestCoalescer 合并并发的相同请求
+// 多个客户端同时发送完全相同的非流式请求时（例如重试风暴），只向上游发起一次调用，
+// 结果分发给所有等待者
+type requestCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+
+	coalesced int64
+}
+
+// inflightCall 一次正在进行的上游调用
+type inflightCall struct {
+	done    chan struct{}
+	resp    *DeepSeekResponse
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// newRequestCoalescer 创建请求合并器
+func newRequestCoalescer() *requestCoalescer {
+	return &requestCoalescer{calls: make(map[string]*inflightCall)}
+}
+
+// Do 执行fn，若已有相同key的调用在进行中则等待它的结果
+// 上游调用使用独立的context（保留发起者context中的值，如链路上下文），
+// 只有所有等待者都离开后才会取消，因此发起调用的客户端断开不会影响其他等待者
+func (c *requestCoalescer) Do(ctx context.Context, key string,
+	fn func(ctx context.Context) (*DeepSeekResponse, error)) (*DeepSeekResponse, bool, error) {
+
+	c.mu.Lock()
+	call, shared := c.calls[key]
+	if shared {
+		call.waiters++
+		c.coalesced++
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &inflightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		c.calls[key] = call
+		go c.run(callCtx, key, call, fn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.resp, shared, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+func (c *requestCoalescer) run(ctx context.Context, key string, call *inflightCall,
+	fn func(ctx context.Context) (*DeepSeekResponse, error)) {
+
+	call.resp, call.err = fn(ctx)
+
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+
+	call.cancel()
+	close(call.done)
+}
+
+// Stats 返回请求合并统计
+func (c *requestCoalescer) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]interface{}{
+		"in_flight": len(c.calls),
+		"coalesced": c.coalesced,
+	}
+}
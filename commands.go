@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// 子命令：serve（默认）启动代理服务器，test 对运行中的代理执行测试客户端，
+// validate 检查配置，chat 打开命令行对话，usage-export 导出用量日志，audit-verify 校验审计日志。
+// 不带子命令时按 serve 处理，兼容原来的启动方式
+
+// subcommandNames 支持的子命令
+var subcommandNames = []string{"serve", "test", "validate", "chat", "usage-export", "audit-verify"}
+
+// commandFromArgs 从命令行参数中取出子命令，第一个参数不是子命令时返回serve和原参数
+func commandFromArgs(args []string) (string, []string) {
+	if len(args) > 0 {
+		for _, name := range subcommandNames {
+			if args[0] == name {
+				return name, args[1:]
+			}
+		}
+	}
+	return "serve", args
+}
+
+// defaultProxyURL 本机代理的地址，test和chat子命令默认连接它
+func defaultProxyURL(config *ProxyConfig) string {
+	return fmt.Sprintf("http://localhost:%d", config.Port)
+}
+
+// clientConfig 读取test、chat子命令的配置，未指定-url、-key时使用配置中的端口和密钥
+func clientConfig(path string, baseURL, apiKey *string) (*ProxyConfig, error) {
+	config, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if *baseURL == "" {
+		*baseURL = defaultProxyURL(config)
+	}
+	if *apiKey == "" {
+		*apiKey = config.DeepSeekAPIKey
+	}
+	return config, nil
+}
+
+// testCase 测试套件中的一项
+type testCase struct {
+	name string
+	run  func() error
+}
+
+// runTestCommand 对目标代理依次执行测试客户端，有失败时返回1
+func runTestCommand(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	configFile := fs.String("config", ".env", "配置文件路径")
+	baseURL := fs.String("url", "", "代理地址（默认: 本机PORT端口）")
+	apiKey := fs.String("key", "", "访问代理的API密钥（默认: DEEPSEEK_API_KEY）")
+	suite := fs.String("suite", "basic", "测试套件：basic、reasoner 或 all")
+	fs.Parse(args)
+	if _, err := clientConfig(*configFile, baseURL, apiKey); err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		return 2
+	}
+
+	base := strings.TrimRight(*baseURL, "/")
+	client := NewTestClient(base, *apiKey)
+	reasoner := NewReasonerTestClient(base, *apiKey)
+	basic := []testCase{
+		{"健康检查", client.TestHealth},
+		{"模型列表", client.TestModels},
+		{"聊天完成", client.TestChatCompletion},
+		{"流式聊天完成", client.TestStreamingCompletion},
+	}
+	reasoning := []testCase{
+		{"数学推理", reasoner.TestMathReasoning},
+		{"逻辑推理", reasoner.TestLogicalPuzzle},
+		{"代码调试", reasoner.TestCodeDebugging},
+	}
+
+	var cases []testCase
+	switch *suite {
+	case "basic":
+		cases = basic
+	case "reasoner":
+		cases = reasoning
+	case "all":
+		cases = append(basic, reasoning...)
+	default:
+		fmt.Fprintf(os.Stderr, "未知的测试套件: %s（可选 basic、reasoner、all）\n", *suite)
+		return 2
+	}
+
+	fmt.Printf("🎯 测试目标: %s\n\n", base)
+	var failed []string
+	start := time.Now()
+	for _, tc := range cases {
+		if err := tc.run(); err != nil {
+			fmt.Printf("❌ %s失败: %v\n\n", tc.name, err)
+			failed = append(failed, tc.name)
+		}
+	}
+
+	fmt.Printf("测试完成：%d 项通过，%d 项失败，耗时 %v\n", len(cases)-len(failed), len(failed), time.Since(start).Round(time.Millisecond))
+	if len(failed) > 0 {
+		fmt.Printf("失败的测试: %s\n", strings.Join(failed, "、"))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 旧版文本补全：把prompt包装为对话消息，由系统消息要求模型直接续写
+const completionInstruction = "请直接续写用户提供的文本，只输出续写的部分，不要重复原文，也不要添加任何解释。"
+
+// CompletionRequest OpenAI旧版 /v1/completions 请求
+type CompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"` // 字符串或字符串数组
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	Stream      bool            `json:"stream"`
+	Echo        bool            `json:"echo,omitempty"`
+	Suffix      *string         `json:"suffix,omitempty"` // 带suffix时转发到beta补全接口做中间填充
+	Stop        interface{}     `json:"stop,omitempty"`   // 只在beta补全接口中生效
+	Logprobs    *int            `json:"logprobs,omitempty"`
+	N           int             `json:"n,omitempty"`
+	User        string          `json:"user,omitempty"`
+}
+
+// prompts 解析prompt，不支持token数组形式
+func (req *CompletionRequest) prompts() ([]string, error) {
+	var prompt string
+	if err := json.Unmarshal(req.Prompt, &prompt); err == nil {
+		return []string{prompt}, nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(req.Prompt, &prompts); err == nil && len(prompts) > 0 {
+		return prompts, nil
+	}
+	apiErr := newAPIError(http.StatusBadRequest, "prompt必须是字符串或非空的字符串数组，不支持token数组")
+	apiErr.Param = "prompt"
+	return nil, apiErr
+}
+
+// toChatRequest 把单个prompt包装为ChatRequest
+func (req *CompletionRequest) toChatRequest(prompt string) *ChatRequest {
+	return &ChatRequest{
+		Model: req.Model,
+		Messages: []Message{
+			{Role: "system", Content: completionInstruction},
+			{Role: "user", Content: prompt},
+		},
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		User:        req.User,
+	}
+}
+
+// handleCompletions 处理旧版文本补全请求：POST /v1/completions
+// 多个prompt依次请求上游，每个prompt对应一个choice；流式响应只支持单个prompt
+func (ps *ProxyServer) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var req CompletionRequest
+	if err := readJSONRequest(r, &req); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	prompts, err := req.prompts()
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest, "请求检查")
+		return
+	}
+	if req.Stream && len(prompts) > 1 {
+		apiErr := newAPIError(http.StatusBadRequest, "流式请求只支持单个prompt")
+		apiErr.Param = "prompt"
+		handleError(w, apiErr, http.StatusBadRequest, "请求检查")
+		return
+	}
+	if req.N > 1 {
+		log.Printf("[%s] 忽略n=%d：每个prompt只返回一个结果", requestID, req.N)
+	}
+	if req.Logprobs != nil {
+		log.Printf("[%s] 忽略logprobs：上游不支持", requestID)
+	}
+	if req.Suffix != nil || ps.config.CompletionsBeta {
+		ps.handleBetaCompletions(w, r, &req, prompts, requestID)
+		return
+	}
+
+	created := time.Now().Unix()
+	choices := make([]map[string]interface{}, 0, len(prompts))
+	var usage Usage
+	for i, prompt := range prompts {
+		chatReq := req.toChatRequest(prompt)
+		if blocked, err := ps.screenInput(chatReq, requestID); err != nil {
+			handleError(w, err, http.StatusBadRequest, "凭据检查")
+			return
+		} else if blocked != "" {
+			w.Header().Set("X-Proxy-Guardrail", blocked)
+			choices = append(choices, completionChoice(i, "", "content_filter"))
+			continue
+		}
+
+		deepseekReq, err := ps.buildUpstreamRequest(r, chatReq, requestID)
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError, "请求转换")
+			return
+		}
+
+		if req.Stream {
+			defer ps.stats.BeginStream(requestID, req.Model, getClientIP(r))()
+			ps.streamCompletion(w, r, &req, prompt, requestID, func(ctx context.Context) (*http.Response, error) {
+				return ps.sendStreamingRequestToDeepSeek(ctx, deepseekReq, requestID)
+			})
+			return
+		}
+
+		deepseekResp, err := ps.fetchCompletion(w, r.Context(), deepseekReq, requestID)
+		if err != nil {
+			if r.Context().Err() != nil {
+				log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+				return
+			}
+			ps.handleUpstreamError(w, fmt.Errorf("DeepSeek请求失败: %w", err), "DeepSeek通信")
+			return
+		}
+		recordUsage(r.Context(), deepseekResp.Usage)
+		deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+
+		text, finishReason := "", "stop"
+		if len(deepseekResp.Choices) > 0 {
+			text, finishReason = deepseekResp.Choices[0].Message.Content, deepseekResp.Choices[0].FinishReason
+		}
+		if req.Echo {
+			text = prompt + text
+		}
+		choices = append(choices, completionChoice(i, text, finishReason))
+		usage.PromptTokens += deepseekResp.Usage.PromptTokens
+		usage.CompletionTokens += deepseekResp.Usage.CompletionTokens
+		usage.TotalTokens += deepseekResp.Usage.TotalTokens
+	}
+
+	writeCompletionResponse(w, req.Model, created, choices, usage, requestID)
+}
+
+// writeCompletionResponse 写入非流式的text_completion响应
+func writeCompletionResponse(w http.ResponseWriter, model string, created int64,
+	choices []map[string]interface{}, usage Usage, requestID string) {
+	if err := writeJSONResponse(w, map[string]interface{}{
+		"id":      "cmpl-" + requestID,
+		"object":  "text_completion",
+		"created": created,
+		"model":   model,
+		"choices": choices,
+		"usage":   usage,
+	}); err != nil {
+		log.Printf("[%s] 写入响应失败: %v", requestID, err)
+	}
+}
+
+// completionChoice 文本补全响应中的一个choice
+func completionChoice(index int, text, finishReason string) map[string]interface{} {
+	var reason interface{}
+	if finishReason != "" {
+		reason = finishReason
+	}
+	return map[string]interface{}{
+		"text":          text,
+		"index":         index,
+		"logprobs":      nil,
+		"finish_reason": reason,
+	}
+}
+
+// streamCompletion 以text_completion数据块流式返回续写内容，推理内容不输出
+// open发起上游流式请求，上游可以是对话接口或beta补全接口
+func (ps *ProxyServer) streamCompletion(w http.ResponseWriter, r *http.Request, req *CompletionRequest, prompt, requestID string,
+	open func(ctx context.Context) (*http.Response, error)) {
+
+	ctx, cancel := ps.newStreamContext(r.Context())
+	defer cancel()
+
+	resp, err := open(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("[%s] 客户端在上游响应前断开连接: %v", requestID, err)
+			return
+		}
+		ps.handleUpstreamError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err), "DeepSeek流式通信")
+		return
+	}
+	defer resp.Body.Close()
+
+	setSSEHeaders(w)
+	flusher, _ := w.(http.Flusher)
+	created := time.Now().Unix()
+	send := func(text, finishReason string) {
+		data, err := json.Marshal(map[string]interface{}{
+			"id":      "cmpl-" + requestID,
+			"object":  "text_completion",
+			"created": created,
+			"model":   req.Model,
+			"choices": []interface{}{completionChoice(0, text, finishReason)},
+		})
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if req.Echo {
+		send(prompt, "")
+	}
+	result := ps.consumeUpstreamStream(ctx, resp.Body, w, flusher, requestID, func(chunk *deepSeekStreamChunk) {
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if text := choice.Delta.Content + choice.Text; text != "" {
+				send(text, "")
+			}
+		}
+	})
+
+	switch {
+	case result.done:
+		finishReason := result.finishReason
+		if finishReason == "" {
+			finishReason = "stop"
+		}
+		send("", finishReason)
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		if flusher != nil {
+			flusher.Flush()
+		}
+		log.Printf("[%s] 文本补全流式响应完成", requestID)
+	case result.err != nil && flusher != nil:
+		writeStreamError(w, flusher, result.err, requestID)
+	}
+}
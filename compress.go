@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// compressResponseWriter 按客户端的Accept-Encoding压缩响应体
+// 是否压缩在写出响应头时才决定，这样可以根据处理器设置的Content-Type跳过流式响应
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressSSE bool
+
+	decided    bool
+	compressor io.WriteCloser
+}
+
+// withCompression 为处理器加上响应压缩
+func (ps *ProxyServer) withCompression(handler http.Handler) http.Handler {
+	if !ps.config.ResponseCompression {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			compressSSE:    ps.config.CompressSSE,
+		}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding 从Accept-Encoding中选出支持的压缩算法，gzip优先
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		rejected := false
+		for _, param := range fields[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == "q=0" {
+				rejected = true
+			}
+		}
+		if !rejected {
+			accepted[name] = true
+		}
+	}
+
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+func (cw *compressResponseWriter) decide() {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" {
+		return
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") && !cw.compressSSE {
+		return
+	}
+
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	if cw.encoding == "gzip" {
+		cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+	} else {
+		// HTTP的deflate编码是zlib格式（RFC 1950），不是裸的deflate数据
+		cw.compressor = zlib.NewWriter(cw.ResponseWriter)
+	}
+}
+
+func (cw *compressResponseWriter) WriteHeader(statusCode int) {
+	// 没有响应体的状态码不能写入压缩流的头尾
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		cw.decided = true
+	}
+	cw.decide()
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	cw.decide()
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.compressor.Write(p)
+}
+
+// Flush 先刷新压缩器缓冲区，再刷新底层连接，保证流式数据能及时送达
+func (cw *compressResponseWriter) Flush() {
+	if cw.compressor != nil {
+		if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+			flusher.Flush()
+		}
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack WebSocket升级需要接管底层连接，升级后不再压缩
+func (cw *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.decided = true
+	return hijack(cw.ResponseWriter)
+}
+
+// Close 写出压缩流的结尾
+func (cw *compressResponseWriter) Close() {
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
@@ -1,45 +1,387 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
-// 全局配置变量
-var GlobalConfig *ProxyConfig
+// ConfigOverride 在读取配置文件和环境变量之后修改配置，用于命令行参数
+type ConfigOverride func(*ProxyConfig)
 
-// 初始化配置
-func init() {
+// LoadConfig 读取配置文件和环境变量，依次应用覆盖项，检查配置并加载配置引用的头部、证书等文件。
+// 配置有错误时返回所有错误，调用方决定如何处理
+func LoadConfig(path string, overrides ...ConfigOverride) (*ProxyConfig, error) {
 	log.Printf("开始初始化代理配置...")
 
-	if err := godotenv.Load(); err != nil {
-		log.Printf("警告：无法加载.env文件，将使用环境变量: %v", err)
+	config, err := readConfig(path, overrides...)
+	if err != nil {
+		return nil, err
 	}
+	if errs := checkConfig(config); len(errs) > 0 {
+		return nil, fmt.Errorf("配置有 %d 处错误:\n%w", len(errs), errors.Join(errs...))
+	}
+	if err := prepareConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readConfig 读取配置文件和环境变量并应用覆盖项，不做检查；已设置的环境变量优先于配置文件，
+// 配置文件不存在时只使用环境变量。test、chat子命令只需要端口和密钥，直接使用它
+func readConfig(path string, overrides ...ConfigOverride) (*ProxyConfig, error) {
+	if path != "" {
+		if err := godotenv.Load(path); errors.Is(err, os.ErrNotExist) {
+			log.Printf("警告：未找到配置文件 %s，将使用环境变量", path)
+		} else if err != nil {
+			return nil, fmt.Errorf("无法加载配置文件 %s: %w", path, err)
+		}
+	}
+
+	config := newConfigFromEnv()
+	for _, override := range overrides {
+		override(config)
+	}
+
+	// HTTP/3默认与HTTPS使用同一个端口号（UDP），在命令行覆盖端口之后再取默认值
+	if config.HTTP3Port == 0 {
+		config.HTTP3Port = config.Port
+	}
+
+	// 模拟模式和回放模式不调用DeepSeek，未配置密钥时使用固定的模拟密钥
+	if (config.MockUpstream || config.CassetteMode == cassetteReplay) && config.DeepSeekAPIKey == "" {
+		config.DeepSeekAPIKey = mockAPIKey
+		log.Printf("不调用DeepSeek：未配置DEEPSEEK_API_KEY，客户端使用 %s 认证", mockAPIKey)
+	}
+	return config, nil
+}
 
-	// 初始化全局配置
-	GlobalConfig = &ProxyConfig{
+// logConfigSummary 输出启动时的主要配置
+func logConfigSummary(config *ProxyConfig) {
+	log.Printf("配置初始化完成:")
+	log.Printf("  - 绑定主机: %s", getDisplayHost(config.Host))
+	log.Printf("  - 监听端口: %d", config.Port)
+	log.Printf("  - DeepSeek模型: %s", config.DeepSeekModel)
+	log.Printf("  - API端点: %s", config.Endpoint)
+	log.Printf("  - API密钥状态: %s", maskAPIKey(config.DeepSeekAPIKey))
+	if config.ProxyURL != "" {
+		log.Printf("  - Proxy URL: %s", config.ProxyURL)
+	}
+	if config.CAFile != "" {
+		log.Printf("  - CA证书: %s", config.CAFile)
+	}
+	if config.InsecureSkipVerify {
+		log.Printf("  - 警告：已关闭出站请求的TLS证书校验，仅应在测试或受信任的内网中使用")
+	}
+}
+
+// newConfigFromEnv 从环境变量读取配置
+func newConfigFromEnv() *ProxyConfig {
+	config := &ProxyConfig{
 		Port:           getEnvAsInt("PORT", 9000),
 		Host:           getEnvAsString("HOST", ""),                                       // 默认空字符串表示localhost
 		DeepSeekAPIKey: getEnvAsString("DEEPSEEK_API_KEY", ""),
 		DeepSeekModel:  getEnvAsString("DEEPSEEK_MODEL", "deepseek-reasoner"),           // 默认使用推理模型
 		Endpoint:       getEnvAsString("DEEPSEEK_ENDPOINT", "https://api.deepseek.com"),
 		ProxyURL:       getEnvAsString("PROXY_URL", ""),
+
+		BreakerWindow:       getEnvAsInt("BREAKER_WINDOW", 20),
+		BreakerMinRequests:  getEnvAsInt("BREAKER_MIN_REQUESTS", 5),
+		BreakerFailureRatio: getEnvAsFloat("BREAKER_FAILURE_RATIO", 0.5),
+		BreakerOpenTimeout:  getEnvAsDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second),
+
+		HealthProbeInterval: getEnvAsDuration("HEALTH_PROBE_INTERVAL", 0),
+		HealthProbeTimeout:  getEnvAsDuration("HEALTH_PROBE_TIMEOUT", 10*time.Second),
+
+		ShutdownDrainDelay: getEnvAsDuration("SHUTDOWN_DRAIN_DELAY", 0),
+		ShutdownTimeout:    getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		StreamMaxLineBytes:      getEnvAsInt("STREAM_MAX_LINE_BYTES", 8*1024*1024),
+		StreamKeepAliveInterval: getEnvAsDuration("STREAM_KEEPALIVE_INTERVAL", 15*time.Second),
+		StreamTimeout:           getEnvAsDuration("STREAM_TIMEOUT", 10*time.Minute),
+		StreamResume:            getEnvAsBool("STREAM_RESUME", false),
+		StreamResumeTTL:         getEnvAsDuration("STREAM_RESUME_TTL", 5*time.Minute),
+		FakeStream:              getEnvAsBool("FAKE_STREAM", false),
+		FakeStreamChunkSize:     getEnvAsInt("FAKE_STREAM_CHUNK_SIZE", 20),
+		FakeStreamInterval:      getEnvAsDuration("FAKE_STREAM_INTERVAL", 20*time.Millisecond),
+		Destream:                getEnvAsBool("DESTREAM", false),
+		StreamPassthrough:       getEnvAsBool("STREAM_PASSTHROUGH", true),
+
+		UpstreamTimeout:   getEnvAsDuration("UPSTREAM_TIMEOUT", 10*time.Minute),
+		FirstTokenTimeout: getEnvAsDuration("FIRST_TOKEN_TIMEOUT", 0),
+
+		ResponseCompression: getEnvAsBool("RESPONSE_COMPRESSION", true),
+		CompressSSE:         getEnvAsBool("COMPRESS_SSE", false),
+
+		ResponseCache:           getEnvAsBool("RESPONSE_CACHE", false),
+		ResponseCacheTTL:        getEnvAsDuration("RESPONSE_CACHE_TTL", 5*time.Minute),
+		ResponseCacheMaxEntries: getEnvAsInt("RESPONSE_CACHE_MAX_ENTRIES", 1000),
+
+		SemanticCache:                  getEnvAsBool("SEMANTIC_CACHE", false),
+		SemanticCacheEmbeddingsURL:     getEnvAsString("SEMANTIC_CACHE_EMBEDDINGS_URL", "https://api.openai.com/v1/embeddings"),
+		SemanticCacheEmbeddingsKey:     getEnvAsString("SEMANTIC_CACHE_EMBEDDINGS_KEY", ""),
+		SemanticCacheEmbeddingsModel:   getEnvAsString("SEMANTIC_CACHE_EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		SemanticCacheEmbeddingsTimeout: getEnvAsDuration("SEMANTIC_CACHE_EMBEDDINGS_TIMEOUT", 5*time.Second),
+		SemanticCacheThreshold:         getEnvAsFloat("SEMANTIC_CACHE_THRESHOLD", 0.95),
+		SemanticCacheModelThresholds:   getEnvAsFloatMap("SEMANTIC_CACHE_MODEL_THRESHOLDS"),
+		SemanticCacheKeyThresholds:     getEnvAsFloatMap("SEMANTIC_CACHE_KEY_THRESHOLDS"),
+		SemanticCacheTTL:               getEnvAsDuration("SEMANTIC_CACHE_TTL", time.Hour),
+		SemanticCacheMaxEntries:        getEnvAsInt("SEMANTIC_CACHE_MAX_ENTRIES", 1000),
+
+		RequestCoalescing: getEnvAsBool("REQUEST_COALESCING", true),
+
+		TLSCertFile: getEnvAsString("TLS_CERT_FILE", ""),
+		TLSKeyFile:  getEnvAsString("TLS_KEY_FILE", ""),
+
+		ACMEDomains:  getEnvAsList("ACME_DOMAIN"),
+		ACMEEmail:    getEnvAsString("ACME_EMAIL", ""),
+		ACMECacheDir: getEnvAsString("ACME_CACHE_DIR", "acme-cache"),
+		ACMEHTTPPort: getEnvAsInt("ACME_HTTP_PORT", 80),
+
+		HTTP3:     getEnvAsBool("HTTP3", false),
+		HTTP3Port: getEnvAsInt("HTTP3_PORT", 0),
+
+		ListenSocket:     getEnvAsString("LISTEN_SOCKET", ""),
+		ListenSocketMode: getEnvAsFileMode("LISTEN_SOCKET_MODE", 0660),
+
+		UpgradeTimeout: getEnvAsDuration("UPGRADE_TIMEOUT", 30*time.Second),
+		PIDFile:        getEnvAsString("PID_FILE", ""),
+
+		AdminAPIKey: getEnvAsString("ADMIN_API_KEY", ""),
+		Playground:  getEnvAsBool("PLAYGROUND", true),
+
+		DebugEndpoints: getEnvAsBool("DEBUG_ENDPOINTS", false),
+
+		PreRequestHookURL:   getEnvAsString("PRE_REQUEST_HOOK_URL", ""),
+		PostResponseHookURL: getEnvAsString("POST_RESPONSE_HOOK_URL", ""),
+		HookTimeout:         getEnvAsDuration("HOOK_TIMEOUT", 5*time.Second),
+		HookFailOpen:        getEnvAsBool("HOOK_FAIL_OPEN", false),
+		HookSecret:          getEnvAsString("HOOK_SECRET", ""),
+
+		ScriptFile:           getEnvAsString("SCRIPT_FILE", ""),
+		ScriptReloadInterval: getEnvAsDuration("SCRIPT_RELOAD_INTERVAL", 2*time.Second),
+
+		PromptTemplatesFile: getEnvAsString("PROMPT_TEMPLATES_FILE", ""),
+
+		SystemPrompt:         getEnvAsString("SYSTEM_PROMPT", ""),
+		SystemPromptPosition: getEnvAsString("SYSTEM_PROMPT_POSITION", "prepend"),
+		SystemPromptsFile:    getEnvAsString("SYSTEM_PROMPTS_FILE", ""),
+
+		GuardrailsFile: getEnvAsString("GUARDRAILS_FILE", ""),
+		SecretScanning: getEnvAsString("SECRET_SCANNING", "off"),
+
+		ContextLimitStrategy: getEnvAsString("CONTEXT_LIMIT_STRATEGY", "off"),
+		ContextKeepLastN:     getEnvAsInt("CONTEXT_KEEP_LAST_N", 20),
+		ModelContextWindows:  getEnvAsIntMap("MODEL_CONTEXT_WINDOWS"),
+		SlidingWindowTokens:  getEnvAsInt("SLIDING_WINDOW_TOKENS", 0),
+
+		HistorySummarization:     getEnvAsBool("HISTORY_SUMMARIZATION", false),
+		HistorySummaryModel:      getEnvAsString("HISTORY_SUMMARY_MODEL", "deepseek-chat"),
+		HistorySummaryMinDropped: getEnvAsInt("HISTORY_SUMMARY_MIN_DROPPED", 4),
+		HistorySummaryMaxTokens:  getEnvAsInt("HISTORY_SUMMARY_MAX_TOKENS", 512),
+
+		SessionStore:       getEnvAsString("SESSION_STORE", ""),
+		SessionDir:         getEnvAsString("SESSION_DIR", "sessions"),
+		SessionTTL:         getEnvAsDuration("SESSION_TTL", 24*time.Hour),
+		SessionMaxMessages: getEnvAsInt("SESSION_MAX_MESSAGES", 200),
+
+		ChatPrefixCompletion: getEnvAsBool("CHAT_PREFIX_COMPLETION", true),
+		FIMModel:             getEnvAsString("FIM_MODEL", "deepseek-chat"),
+		CompletionsBeta:      getEnvAsBool("COMPLETIONS_BETA", false),
+
+		ModerationURL:       getEnvAsString("MODERATION_URL", ""),
+		ModerationAPIKey:    getEnvAsString("MODERATION_API_KEY", ""),
+		ModerationRulesFile: getEnvAsString("MODERATION_RULES_FILE", ""),
+
+		FilesDir:      getEnvAsString("FILES_DIR", ""),
+		FilesMaxBytes: getEnvAsInt64("FILES_MAX_BYTES", 512<<20),
+
+		BatchDir:               getEnvAsString("BATCH_DIR", ""),
+		BatchRequestsPerMinute: getEnvAsInt("BATCH_REQUESTS_PER_MINUTE", 60),
+
+		AssistantsDir: getEnvAsString("ASSISTANTS_DIR", ""),
+
+		ServerToolsFile:      getEnvAsString("SERVER_TOOLS_FILE", ""),
+		ServerToolsMaxRounds: getEnvAsInt("SERVER_TOOLS_MAX_ROUNDS", 5),
+
+		BuiltinTools:         getEnvAsString("BUILTIN_TOOLS", ""),
+		BuiltinToolsTimeout:  getEnvAsDuration("BUILTIN_TOOLS_TIMEOUT", 20*time.Second),
+		WebSearchProvider:    getEnvAsString("WEB_SEARCH_PROVIDER", "searxng"),
+		WebSearchURL:         getEnvAsString("WEB_SEARCH_URL", ""),
+		WebSearchAPIKey:      getEnvAsString("WEB_SEARCH_API_KEY", ""),
+		WebSearchResults:     getEnvAsInt("WEB_SEARCH_RESULTS", 5),
+		FetchURLMaxBytes:     getEnvAsInt64("FETCH_URL_MAX_BYTES", 2<<20),
+		FetchURLAllowPrivate: getEnvAsBool("FETCH_URL_ALLOW_PRIVATE", false),
+
+		ToolArgsValidation: getEnvAsString("TOOL_ARGS_VALIDATION", "repair"),
+		ToolArgsMaxReasks:  getEnvAsInt("TOOL_ARGS_MAX_REASKS", 1),
+
+		ParallelToolCallsMode: getEnvAsString("PARALLEL_TOOL_CALLS_MODE", "drop"),
+
+		StrictToolsMode: getEnvAsString("STRICT_TOOLS_MODE", "beta"),
+
+		UserStatsMaxUsers:         getEnvAsInt("USER_STATS_MAX_USERS", 1000),
+		UsagePricePromptCacheHit:  getEnvAsFloat("USAGE_PRICE_PROMPT_CACHE_HIT", 0),
+		UsagePricePromptCacheMiss: getEnvAsFloat("USAGE_PRICE_PROMPT_CACHE_MISS", 0),
+		UsagePriceCompletion:      getEnvAsFloat("USAGE_PRICE_COMPLETION", 0),
+
+		IdempotencyTTL:        getEnvAsDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		IdempotencyMaxEntries: getEnvAsInt("IDEMPOTENCY_MAX_ENTRIES", 10000),
+
+		PassthroughExtraFields: getEnvAsBool("PASSTHROUGH_EXTRA_FIELDS", true),
+		DropExtraFields:        getEnvAsList("DROP_EXTRA_FIELDS"),
+
+		ReasoningEffortMaxTokens: getEnvAsIntMap("REASONING_EFFORT_MAX_TOKENS"),
+
+		ParamPolicy:          getEnvAsString("PARAM_POLICY", "clamp"),
+		TemperatureMin:       getEnvAsFloat("TEMPERATURE_MIN", 0),
+		TemperatureMax:       getEnvAsFloat("TEMPERATURE_MAX", 2),
+		ModelMaxOutputTokens: getEnvAsIntMap("MODEL_MAX_OUTPUT_TOKENS"),
+
+		ClientProfilesFile:   getEnvAsString("CLIENT_PROFILES_FILE", ""),
+		CursorMaxTokensClamp: getEnvAsBool("CURSOR_MAX_TOKENS_CLAMP", true),
+
+		UpstreamBrowserHeaders: getEnvAsBool("UPSTREAM_BROWSER_HEADERS", false),
+		UpstreamUserAgent:      getEnvAsString("UPSTREAM_USER_AGENT", ""),
+		UpstreamHeaders:        getEnvAsString("UPSTREAM_HEADERS", ""),
+		UpstreamHeadersFile:    getEnvAsString("UPSTREAM_HEADERS_FILE", ""),
+
+		CAFile:             getEnvAsString("DEEPSEEK_CA_FILE", ""),
+		InsecureSkipVerify: getEnvAsBool("INSECURE_SKIP_VERIFY", false),
+
+		HTTPMaxIdleConns:        getEnvAsInt("HTTP_MAX_IDLE_CONNS", 100),
+		HTTPMaxIdleConnsPerHost: getEnvAsInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 32),
+		HTTPIdleConnTimeout:     getEnvAsDuration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		HTTPDialTimeout:         getEnvAsDuration("HTTP_DIAL_TIMEOUT", 10*time.Second),
+		HTTP2Enabled:            getEnvAsBool("HTTP2_ENABLED", true),
+
+		UpstreamHosts: getEnvAsList("UPSTREAM_HOSTS"),
+		DNSServer:     getEnvAsString("DNS_SERVER", ""),
+		DNSDoHURL:     getEnvAsString("DNS_DOH_URL", ""),
+
+		StreamTokenRate:     getEnvAsInt("STREAM_TOKEN_RATE", 0),
+		StreamTokenRateKeys: getEnvAsIntMap("STREAM_TOKEN_RATE_KEYS"),
+
+		UpstreamMaxConcurrency: getEnvAsInt("UPSTREAM_MAX_CONCURRENCY", 0),
+		PriorityDefault:        getEnvAsString("PRIORITY_DEFAULT", "normal"),
+		PriorityKeys:           getEnvAsList("PRIORITY_KEYS"),
+		PriorityWeights:        getEnvAsIntMap("PRIORITY_WEIGHTS"),
+
+		UpstreamMaxQueue:       getEnvAsInt("UPSTREAM_MAX_QUEUE", 0),
+		UpstreamQueueTimeout:   getEnvAsDuration("UPSTREAM_QUEUE_TIMEOUT", 30*time.Second),
+		BackpressureRetryAfter: getEnvAsDuration("BACKPRESSURE_RETRY_AFTER", 2*time.Second),
+		UpstreamRateLimitHold:  getEnvAsBool("UPSTREAM_RATE_LIMIT_HOLD", true),
+
+		UpstreamPool: getEnvAsList("UPSTREAM_POOL"),
+
+		UpstreamKeyRPM: getEnvAsInt("UPSTREAM_KEY_RPM", 0),
+		UpstreamKeyTPM: getEnvAsInt("UPSTREAM_KEY_TPM", 0),
+
+		OffPeakWindows:        getEnvAsList("OFF_PEAK_WINDOWS"),
+		OffPeakTimezone:       getEnvAsString("OFF_PEAK_TIMEZONE", "UTC"),
+		OffPeakDeferBatches:   getEnvAsBool("OFF_PEAK_DEFER_BATCHES", true),
+		OffPeakPeakModels:     getEnvAsList("OFF_PEAK_PEAK_MODELS"),
+		OffPeakDiscount:       getEnvAsFloat("OFF_PEAK_DISCOUNT", 0.5),
+		OffPeakModelDiscounts: getEnvAsFloatMap("OFF_PEAK_MODEL_DISCOUNTS"),
+
+		ModelSplits: getEnvAsList("MODEL_SPLITS"),
+
+		ShadowSampleRate:     getEnvAsFloat("SHADOW_SAMPLE_RATE", 0),
+		ShadowEndpoint:       getEnvAsString("SHADOW_ENDPOINT", ""),
+		ShadowAPIKey:         getEnvAsString("SHADOW_API_KEY", ""),
+		ShadowModel:          getEnvAsString("SHADOW_MODEL", ""),
+		ShadowLogFile:        getEnvAsString("SHADOW_LOG_FILE", ""),
+		ShadowMaxConcurrency: getEnvAsInt("SHADOW_MAX_CONCURRENCY", 4),
+		ShadowTimeout:        getEnvAsDuration("SHADOW_TIMEOUT", 120*time.Second),
+
+		CanaryStateFile:         getEnvAsString("CANARY_STATE_FILE", ""),
+		CanaryMinRequests:       getEnvAsInt("CANARY_MIN_REQUESTS", 20),
+		CanaryMaxErrorRateDelta: getEnvAsFloat("CANARY_MAX_ERROR_RATE_DELTA", 0.05),
+		CanaryMaxLatencyRatio:   getEnvAsFloat("CANARY_MAX_LATENCY_RATIO", 1.5),
+
+		MockUpstream: getEnvAsBool("MOCK_UPSTREAM", false),
+		MockLatency:  getEnvAsDuration("MOCK_LATENCY", 0),
+
+		ChaosLatency:        getEnvAsDuration("CHAOS_LATENCY", 0),
+		ChaosLatencyJitter:  getEnvAsDuration("CHAOS_LATENCY_JITTER", 0),
+		ChaosErrorRate:      getEnvAsFloat("CHAOS_ERROR_RATE", 0),
+		ChaosDisconnectRate: getEnvAsFloat("CHAOS_DISCONNECT_RATE", 0),
+
+		CassetteMode: getEnvAsString("CASSETTE_MODE", "off"),
+		CassetteDir:  getEnvAsString("CASSETTE_DIR", "cassettes"),
+
+		TenantsFile: getEnvAsString("TENANTS_FILE", ""),
+
+		QuotasFile:     getEnvAsString("QUOTAS_FILE", ""),
+		QuotaStateFile: getEnvAsString("QUOTA_STATE_FILE", "quota_state.json"),
+		QuotaTimezone:  getEnvAsString("QUOTA_TIMEZONE", "UTC"),
+
+		UsageLogFile: getEnvAsString("USAGE_LOG_FILE", ""),
+
+		AuditLogFile: getEnvAsString("AUDIT_LOG_FILE", ""),
+
+		LogStdout:         getEnvAsBool("LOG_STDOUT", true),
+		LogFile:           getEnvAsString("LOG_FILE", ""),
+		LogFileMaxSize:    getEnvAsInt64("LOG_FILE_MAX_SIZE", 100),
+		LogFileMaxAge:     getEnvAsDuration("LOG_FILE_MAX_AGE", 24*time.Hour),
+		LogFileMaxBackups: getEnvAsInt("LOG_FILE_MAX_BACKUPS", 7),
+		LogSyslog:         getEnvAsString("LOG_SYSLOG", ""),
+		LogSyslogTag:      getEnvAsString("LOG_SYSLOG_TAG", "deepseek-proxy"),
+		LogSampleRate:     getEnvAsInt("LOG_SAMPLE_RATE", 1),
+		LogSampleSlow:     getEnvAsDuration("LOG_SAMPLE_SLOW", 0),
+
+		StatsdAddr:      getEnvAsString("STATSD_ADDR", ""),
+		StatsdPrefix:    getEnvAsString("STATSD_PREFIX", "deepseek_proxy"),
+		StatsdTags:      getEnvAsList("STATSD_TAGS"),
+		StatsdDogStatsD: getEnvAsBool("STATSD_DOGSTATSD", false),
+		StatsdInterval:  getEnvAsDuration("STATSD_INTERVAL", 10*time.Second),
+
+		StateStore:     getEnvAsString("STATE_STORE", "memory"),
+		RedisURL:       getEnvAsString("REDIS_URL", ""),
+		RedisKeyPrefix: getEnvAsString("REDIS_KEY_PREFIX", "deepseek-proxy:"),
+
+		ReportSchedule:   getEnvAsString("REPORT_SCHEDULE", "off"),
+		ReportAt:         getEnvAsString("REPORT_AT", "08:00"),
+		ReportTimezone:   getEnvAsString("REPORT_TIMEZONE", "UTC"),
+		ReportWebhookURL: getEnvAsString("REPORT_WEBHOOK_URL", ""),
+		ReportEmailTo:    getEnvAsList("REPORT_EMAIL_TO"),
+		SMTPAddr:         getEnvAsString("SMTP_ADDR", ""),
+		SMTPUsername:     getEnvAsString("SMTP_USERNAME", ""),
+		SMTPPassword:     getEnvAsString("SMTP_PASSWORD", ""),
+		SMTPFrom:         getEnvAsString("SMTP_FROM", ""),
+
+		RouteTimeout: getEnvAsDuration("ROUTE_TIMEOUT", 30*time.Second),
+	}
+	return config
+}
+
+// prepareConfig 加载配置引用的上游头部、TLS证书、DNS解析和优先级规则
+func prepareConfig(config *ProxyConfig) error {
+	headers, err := loadUpstreamHeaders(config)
+	if err != nil {
+		return fmt.Errorf("无法加载上游请求头部: %w", err)
 	}
+	config.upstreamHeaders = headers
 
-	validateConfig(GlobalConfig)
+	tlsConfig, err := loadUpstreamTLSConfig(config)
+	if err != nil {
+		return fmt.Errorf("无法加载TLS配置: %w", err)
+	}
+	config.upstreamTLS = tlsConfig
 
-	log.Printf("配置初始化完成:")
-	log.Printf("  - 绑定主机: %s", getDisplayHost(GlobalConfig.Host))
-	log.Printf("  - 监听端口: %d", GlobalConfig.Port)
-	log.Printf("  - DeepSeek模型: %s", GlobalConfig.DeepSeekModel)
-	log.Printf("  - API端点: %s", GlobalConfig.Endpoint)
-	log.Printf("  - API密钥状态: %s", maskAPIKey(GlobalConfig.DeepSeekAPIKey))
-	if GlobalConfig.ProxyURL != "" {
-		log.Printf("  - Proxy URL: %s", GlobalConfig.ProxyURL)
+	resolver, err := newUpstreamResolver(config)
+	if err != nil {
+		return fmt.Errorf("无法配置DNS解析: %w", err)
 	}
+	config.upstreamResolver = resolver
+
+	return loadPriorityConfig(config)
 }
 
 // getDisplayHost 获取用于显示的主机地址
@@ -73,21 +415,288 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
-// 验证配置的有效性
-func validateConfig(config *ProxyConfig) {
+// 从环境变量获取64位整数值，用于字节数等可能超过int32的配置
+func getEnvAsInt64(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			log.Printf("从环境变量读取 %s: %d", key, intValue)
+			return intValue
+		}
+		log.Printf("警告：环境变量 %s 的值 '%s' 不是有效整数，使用默认值 %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 从环境变量获取布尔值
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			log.Printf("从环境变量读取 %s: %v", key, boolValue)
+			return boolValue
+		}
+		log.Printf("警告：环境变量 %s 的值 '%s' 不是有效布尔值，使用默认值 %v", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 从环境变量获取浮点数值
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			log.Printf("从环境变量读取 %s: %g", key, floatValue)
+			return floatValue
+		}
+		log.Printf("警告：环境变量 %s 的值 '%s' 不是有效数字，使用默认值 %g", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 从环境变量获取时间间隔（如 30s、5m）
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			log.Printf("从环境变量读取 %s: %v", key, durationValue)
+			return durationValue
+		}
+		log.Printf("警告：环境变量 %s 的值 '%s' 不是有效时间间隔，使用默认值 %v", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 从环境变量获取八进制的文件权限，如 0660
+func getEnvAsFileMode(key string, defaultValue os.FileMode) os.FileMode {
+	if value := os.Getenv(key); value != "" {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+			log.Printf("从环境变量读取 %s: %04o", key, mode)
+			return os.FileMode(mode)
+		}
+		log.Printf("警告：环境变量 %s 的值 '%s' 不是有效的八进制权限，使用默认值 %04o", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 从环境变量获取逗号分隔的列表
+func getEnvAsList(key string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	if len(result) > 0 {
+		log.Printf("从环境变量读取 %s: %v", key, result)
+	}
+	return result
+}
+
+// 从环境变量获取 "键=浮点数" 列表，格式如 deepseek-chat=0.9,deepseek-reasoner=0.97
+func getEnvAsFloatMap(key string) map[string]float64 {
+	result := make(map[string]float64)
+	value := os.Getenv(key)
+	if value == "" {
+		return result
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			log.Printf("警告：环境变量 %s 中的 '%s' 格式错误，应为 键=数值", key, pair)
+			continue
+		}
+		floatValue, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			log.Printf("警告：环境变量 %s 中 %s 的值 '%s' 不是有效数字", key, name, raw)
+			continue
+		}
+		result[strings.TrimSpace(name)] = floatValue
+	}
+	log.Printf("从环境变量读取 %s: %v", key, result)
+	return result
+}
+
+// getEnvAsIntMap 读取 键=整数,键=整数 格式的环境变量
+func getEnvAsIntMap(key string) map[string]int {
+	result := make(map[string]int)
+	value := os.Getenv(key)
+	if value == "" {
+		return result
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			log.Printf("警告：环境变量 %s 中的 '%s' 格式错误，应为 键=整数", key, pair)
+			continue
+		}
+		intValue, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			log.Printf("警告：环境变量 %s 中 %s 的值 '%s' 不是有效整数", key, name, raw)
+			continue
+		}
+		result[strings.TrimSpace(name)] = intValue
+	}
+	log.Printf("从环境变量读取 %s: %v", key, result)
+	return result
+}
+
+// checkConfig 检查配置，返回发现的所有错误
+func checkConfig(config *ProxyConfig) []error {
+	var errs []error
 	if config.DeepSeekAPIKey == "" {
-		log.Fatal("错误：DEEPSEEK_API_KEY 环境变量是必需的，请设置你的DeepSeek API密钥")
+		errs = append(errs, fmt.Errorf("DEEPSEEK_API_KEY 环境变量是必需的，请设置你的DeepSeek API密钥"))
 	}
 
 	if config.Port <= 0 || config.Port > 65535 {
-		log.Fatal("错误：端口号必须在1-65535之间")
+		errs = append(errs, fmt.Errorf("端口号必须在1-65535之间"))
 	}
 
 	if config.Endpoint == "" {
-		log.Fatal("错误：DeepSeek API端点不能为空")
+		errs = append(errs, fmt.Errorf("DeepSeek API端点不能为空"))
+	}
+
+	if config.StreamMaxLineBytes <= 0 {
+		errs = append(errs, fmt.Errorf("STREAM_MAX_LINE_BYTES 必须大于0"))
+	}
+
+	if config.ResponseCache && config.ResponseCacheMaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("RESPONSE_CACHE_MAX_ENTRIES 必须大于0"))
+	}
+
+	if config.SemanticCache && config.SemanticCacheMaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("SEMANTIC_CACHE_MAX_ENTRIES 必须大于0"))
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT_FILE 和 TLS_KEY_FILE 必须同时设置"))
+	}
+	if len(config.ACMEDomains) > 0 && config.TLSCertFile != "" {
+		errs = append(errs, fmt.Errorf("ACME_DOMAIN 不能与 TLS_CERT_FILE / TLS_KEY_FILE 同时使用"))
+	}
+	for _, file := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("无法读取TLS文件 %s: %v", file, err))
+		}
+	}
+
+	if config.ListenSocket != "" && config.HTTP3 {
+		errs = append(errs, fmt.Errorf("HTTP3 不能与 LISTEN_SOCKET 同时使用"))
+	}
+
+	if config.HTTP3 && !config.TLSEnabled() {
+		errs = append(errs, fmt.Errorf("HTTP3 需要先配置 TLS_CERT_FILE / TLS_KEY_FILE 或 ACME_DOMAIN"))
+	}
+
+	if config.BreakerFailureRatio <= 0 || config.BreakerFailureRatio > 1 {
+		errs = append(errs, fmt.Errorf("BREAKER_FAILURE_RATIO 必须在 (0, 1] 之间"))
+	}
+
+	switch config.SecretScanning {
+	case "off", "block", "redact":
+	default:
+		errs = append(errs, fmt.Errorf("SECRET_SCANNING 只能是 off、block 或 redact，当前为 %q", config.SecretScanning))
 	}
 
-	log.Printf("✓ 配置验证通过")
+	switch config.ContextLimitStrategy {
+	case "off", "reject", "drop_oldest", "keep_last":
+	default:
+		errs = append(errs, fmt.Errorf("CONTEXT_LIMIT_STRATEGY 只能是 off、reject、drop_oldest 或 keep_last，当前为 %q", config.ContextLimitStrategy))
+	}
+
+	switch config.ToolArgsValidation {
+	case "off", "repair", "reask":
+	default:
+		errs = append(errs, fmt.Errorf("TOOL_ARGS_VALIDATION 只能是 off、repair 或 reask，当前为 %q", config.ToolArgsValidation))
+	}
+
+	switch config.ParallelToolCallsMode {
+	case "drop", "queue":
+	default:
+		errs = append(errs, fmt.Errorf("PARALLEL_TOOL_CALLS_MODE 只能是 drop 或 queue，当前为 %q", config.ParallelToolCallsMode))
+	}
+
+	switch config.StrictToolsMode {
+	case "beta", "validate":
+	default:
+		errs = append(errs, fmt.Errorf("STRICT_TOOLS_MODE 只能是 beta 或 validate，当前为 %q", config.StrictToolsMode))
+	}
+
+	switch config.ParamPolicy {
+	case "off", "clamp", "reject":
+	default:
+		errs = append(errs, fmt.Errorf("PARAM_POLICY 只能是 off、clamp 或 reject，当前为 %q", config.ParamPolicy))
+	}
+	if config.TemperatureMin > config.TemperatureMax {
+		errs = append(errs, fmt.Errorf("TEMPERATURE_MIN (%v) 不能大于 TEMPERATURE_MAX (%v)", config.TemperatureMin, config.TemperatureMax))
+	}
+
+	switch config.SessionStore {
+	case "", "memory", "file":
+	default:
+		errs = append(errs, fmt.Errorf("SESSION_STORE 只能是 memory 或 file，当前为 %q", config.SessionStore))
+	}
+
+	if config.LogFileMaxSize < 0 || config.LogFileMaxAge < 0 || config.LogFileMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("LOG_FILE_MAX_SIZE、LOG_FILE_MAX_AGE 和 LOG_FILE_MAX_BACKUPS 不能为负数"))
+	}
+	if !config.LogStdout && config.LogFile == "" && config.LogSyslog == "" {
+		errs = append(errs, fmt.Errorf("LOG_STDOUT=false 时需要设置 LOG_FILE 或 LOG_SYSLOG，否则日志会全部丢失"))
+	}
+	if config.LogSampleRate < 1 {
+		errs = append(errs, fmt.Errorf("LOG_SAMPLE_RATE 必须大于等于1，当前为 %d", config.LogSampleRate))
+	}
+	if config.LogSampleSlow < 0 {
+		errs = append(errs, fmt.Errorf("LOG_SAMPLE_SLOW 不能为负数"))
+	}
+
+	if config.StatsdAddr != "" && config.StatsdInterval <= 0 {
+		errs = append(errs, fmt.Errorf("STATSD_INTERVAL 必须大于0"))
+	}
+
+	if config.UpstreamKeyRPM < 0 || config.UpstreamKeyTPM < 0 {
+		errs = append(errs, fmt.Errorf("UPSTREAM_KEY_RPM 和 UPSTREAM_KEY_TPM 不能为负数"))
+	}
+
+	switch config.StateStore {
+	case "memory":
+	case "redis":
+		if config.RedisURL == "" {
+			errs = append(errs, fmt.Errorf("STATE_STORE=redis 需要设置 REDIS_URL"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STATE_STORE 只能是 memory 或 redis，当前为 %q", config.StateStore))
+	}
+
+	switch config.ReportSchedule {
+	case "off":
+	case "daily", "weekly":
+		if _, err := time.Parse("15:04", config.ReportAt); err != nil {
+			errs = append(errs, fmt.Errorf("REPORT_AT 必须是 HH:MM 格式，当前为 %q", config.ReportAt))
+		}
+		if _, err := time.LoadLocation(config.ReportTimezone); err != nil {
+			errs = append(errs, fmt.Errorf("REPORT_TIMEZONE 无效: %v", err))
+		}
+		if config.ReportWebhookURL == "" && len(config.ReportEmailTo) == 0 {
+			errs = append(errs, fmt.Errorf("REPORT_SCHEDULE=%s 需要设置 REPORT_WEBHOOK_URL 或 REPORT_EMAIL_TO", config.ReportSchedule))
+		}
+		if len(config.ReportEmailTo) > 0 && (config.SMTPAddr == "" || config.SMTPFrom == "") {
+			errs = append(errs, fmt.Errorf("REPORT_EMAIL_TO 需要同时设置 SMTP_ADDR 和 SMTP_FROM"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("REPORT_SCHEDULE 只能是 off、daily 或 weekly，当前为 %q", config.ReportSchedule))
+	}
+
+	return errs
+}
+
+// TLSEnabled 是否以HTTPS方式监听
+func (c *ProxyConfig) TLSEnabled() bool {
+	return (c.TLSCertFile != "" && c.TLSKeyFile != "") || c.ACMEEnabled()
+}
+
+// ACMEEnabled 是否通过ACME自动获取证书
+func (c *ProxyConfig) ACMEEnabled() bool {
+	return len(c.ACMEDomains) > 0
 }
 
 // 隐藏API密钥的敏感部分
@@ -120,7 +729,7 @@ func GetSupportedModels() []string {
 }
 
 // 将OpenAI模型名映射到DeepSeek模型名
-func MapModelName(openaiModel string) string {
+func MapModelName(openaiModel, defaultModel string) string {
 	// 统一映射到推理模型
 	modelMapping := map[string]string{
 		"gpt-4o":            "deepseek-reasoner",
@@ -140,8 +749,8 @@ func MapModelName(openaiModel string) string {
 		return mappedModel
 	}
 
-	log.Printf("未知模型 %s，使用默认模型: %s", openaiModel, GlobalConfig.DeepSeekModel)
-	return GlobalConfig.DeepSeekModel
+	log.Printf("未知模型 %s，使用默认模型: %s", openaiModel, defaultModel)
+	return defaultModel
 }
 
 // 检查模型是否支持工具调用
@@ -160,4 +769,4 @@ func ModelSupportsTools(modelName string) bool {
 	}
 
 	return supported
-}
\ No newline at end of file
+}
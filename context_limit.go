@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeepSeek模型默认的上下文长度（token），可用MODEL_CONTEXT_WINDOWS覆盖
+var defaultContextWindows = map[string]int{
+	"deepseek-chat":     128000,
+	"deepseek-reasoner": 128000,
+}
+
+// 每条消息在角色、分隔符等格式上的额外token开销（估算值）
+const messageTokenOverhead = 4
+
+// contextWindow 返回模型的上下文长度，未知模型返回0（不检查）
+func (ps *ProxyServer) contextWindow(model string) int {
+	if window, ok := ps.config.ModelContextWindows[model]; ok {
+		return window
+	}
+	return defaultContextWindows[model]
+}
+
+// countPromptTokens 估算请求的提示词token数，包括消息、工具调用和工具定义
+func countPromptTokens(messages []Message, tools []Tool) int {
+	total := 0
+	for _, msg := range messages {
+		total += countMessageTokens(msg)
+	}
+	if len(tools) > 0 {
+		if data, err := json.Marshal(tools); err == nil {
+			total += estimateTokens(string(data))
+		}
+	}
+	return total
+}
+
+func countMessageTokens(msg Message) int {
+	tokens := messageTokenOverhead + estimateTokens(msg.Content) + estimateTokens(msg.Name)
+	for _, call := range msg.ToolCalls {
+		tokens += estimateTokens(call.Function.Name) + estimateTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+// enforceContextLimit 检查提示词是否超出模型上下文，超出时按CONTEXT_LIMIT_STRATEGY处理
+// reject直接拒绝；drop_oldest从最早的对话轮次开始丢弃；keep_last只保留系统消息和最后N条消息。
+// 截断后仍然超出时返回context_length_exceeded错误
+func (ps *ProxyServer) enforceContextLimit(req *DeepSeekRequest, requestID string) error {
+	strategy := ps.config.ContextLimitStrategy
+	window := ps.contextWindow(req.Model)
+	if strategy == "off" || window <= 0 {
+		return nil
+	}
+	budget := window - req.MaxTokens
+	tokens := countPromptTokens(req.Messages, req.Tools)
+	if tokens <= budget {
+		return nil
+	}
+
+	log.Printf("[%s] 提示词约 %d tokens，超出模型 %s 的可用上下文 %d tokens，处理策略: %s",
+		requestID, tokens, req.Model, budget, strategy)
+
+	messages := req.Messages
+	switch strategy {
+	case "keep_last":
+		messages = keepLastMessages(messages, ps.config.ContextKeepLastN)
+		fallthrough
+	case "drop_oldest":
+		for countPromptTokens(messages, req.Tools) > budget {
+			trimmed, ok := dropOldestTurn(messages)
+			if !ok {
+				break
+			}
+			messages = trimmed
+		}
+	}
+
+	tokens = countPromptTokens(messages, req.Tools)
+	if tokens > budget {
+		return &apiError{
+			StatusCode: http.StatusBadRequest,
+			Type:       errTypeInvalidRequest,
+			Message: fmt.Sprintf("模型 %s 的最大上下文长度为 %d tokens，但请求的消息约有 %d tokens（另有 max_tokens %d）。请缩短消息或减少 max_tokens",
+				req.Model, window, tokens, req.MaxTokens),
+			Param: "messages",
+			Code:  "context_length_exceeded",
+		}
+	}
+
+	log.Printf("[%s] 上下文截断：消息 %d 条 -> %d 条，约 %d tokens", requestID, len(req.Messages), len(messages), tokens)
+	req.Messages = messages
+	return nil
+}
+
+// applySlidingWindow 按SLIDING_WINDOW_TOKENS修剪对话：保留开头的系统消息，
+// 再从最新的消息往前保留，直到用完扣除max_tokens后的token预算，最后一条消息始终保留。
+// 丢弃的消息达到HISTORY_SUMMARY_MIN_DROPPED条时，可选地把它们总结为一条系统消息
+func (ps *ProxyServer) applySlidingWindow(ctx context.Context, req *DeepSeekRequest, requestID string) {
+	if ps.config.SlidingWindowTokens <= 0 {
+		return
+	}
+	budget := ps.config.SlidingWindowTokens - req.MaxTokens
+	if countPromptTokens(req.Messages, req.Tools) <= budget {
+		return
+	}
+
+	system := leadingSystemCount(req.Messages)
+	kept := slidingWindow(req.Messages, req.Tools, budget)
+	dropped := len(req.Messages) - len(kept)
+	if dropped == 0 {
+		return
+	}
+
+	summarize := ps.config.HistorySummarization && dropped >= ps.config.HistorySummaryMinDropped
+	if summarize {
+		// 为摘要留出空间后重新计算窗口
+		kept = slidingWindow(req.Messages, req.Tools, budget-ps.config.HistorySummaryMaxTokens-messageTokenOverhead)
+		dropped = len(req.Messages) - len(kept)
+	}
+
+	droppedMessages := req.Messages[system : system+dropped]
+	roles := make([]string, 0, dropped)
+	for _, msg := range droppedMessages {
+		roles = append(roles, msg.Role)
+	}
+	log.Printf("[%s] 滑动窗口：预算 %d tokens，丢弃第 %d-%d 条消息 %v，保留 %d 条，约 %d tokens",
+		requestID, budget, system+1, system+dropped, roles, len(kept), countPromptTokens(kept, req.Tools))
+
+	if summarize {
+		summary, err := ps.summarizeHistory(ctx, droppedMessages, requestID)
+		if err != nil {
+			log.Printf("[%s] 警告：总结被丢弃的对话失败，继续发送修剪后的对话: %v", requestID, err)
+		} else {
+			summaryMessage := Message{
+				Role:    "system",
+				Content: fmt.Sprintf("以下是此前 %d 条对话消息的摘要，原消息已省略：\n%s", dropped, summary),
+			}
+			kept = append(append(append([]Message{}, kept[:system]...), summaryMessage), kept[system:]...)
+		}
+	}
+	req.Messages = kept
+}
+
+// slidingWindow 返回开头的系统消息加上能放进预算的最近消息
+func slidingWindow(messages []Message, tools []Tool, budget int) []Message {
+	system := leadingSystemCount(messages)
+	if system >= len(messages) {
+		return messages
+	}
+	used := countPromptTokens(messages[:system], tools)
+	start := len(messages) - 1
+	used += countMessageTokens(messages[start])
+	for start > system {
+		tokens := countMessageTokens(messages[start-1])
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start--
+	}
+	if start == system {
+		return messages
+	}
+
+	kept := append(append([]Message{}, messages[:system]...), messages[start:]...)
+	return dropOrphanToolMessages(kept, system)
+}
+
+// summarizeHistory 调用HISTORY_SUMMARY_MODEL把被丢弃的消息总结成一段文本
+// 被丢弃的消息过长时只总结最近的部分
+func (ps *ProxyServer) summarizeHistory(ctx context.Context, messages []Message, requestID string) (string, error) {
+	limit := ps.contextWindow(ps.config.HistorySummaryModel)
+	if limit <= 0 {
+		limit = 32000
+	}
+	limit -= ps.config.HistorySummaryMaxTokens + 512
+
+	var lines []string
+	used := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		line := transcriptLine(messages[i])
+		tokens := estimateTokens(line)
+		if used+tokens > limit {
+			break
+		}
+		used += tokens
+		lines = append([]string{line}, lines...)
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("被丢弃的消息过长，无法总结")
+	}
+
+	summaryReq := &DeepSeekRequest{
+		Model: ps.config.HistorySummaryModel,
+		Messages: []Message{
+			{Role: "system", Content: "你负责压缩对话历史。请把用户提供的对话记录总结为简洁的摘要，保留关键事实、用户的要求、已做出的决定、工具调用的结果和尚未完成的任务。使用与对话相同的语言，只输出摘要本身。"},
+			{Role: "user", Content: strings.Join(lines, "\n")},
+		},
+		MaxTokens: ps.config.HistorySummaryMaxTokens,
+	}
+
+	start := time.Now()
+	resp, err := ps.sendRequestToDeepSeek(ctx, summaryReq, requestID+"-summary")
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("摘要响应为空")
+	}
+	log.Printf("[%s] 已总结 %d 条被丢弃的消息，耗时 %v，用量 %d tokens",
+		requestID, len(messages), time.Since(start), resp.Usage.TotalTokens)
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// transcriptLine 把一条消息写成摘要输入中的一行
+func transcriptLine(msg Message) string {
+	var b strings.Builder
+	b.WriteString(msg.Role)
+	b.WriteString(": ")
+	b.WriteString(msg.Content)
+	for _, call := range msg.ToolCalls {
+		fmt.Fprintf(&b, " [调用工具 %s(%s)]", call.Function.Name, call.Function.Arguments)
+	}
+	return b.String()
+}
+
+// leadingSystemCount 返回开头连续系统消息的数量，这些消息在截断时始终保留
+func leadingSystemCount(messages []Message) int {
+	n := 0
+	for n < len(messages) && messages[n].Role == "system" {
+		n++
+	}
+	return n
+}
+
+// keepLastMessages 保留开头的系统消息和最后n条其他消息
+func keepLastMessages(messages []Message, n int) []Message {
+	system := leadingSystemCount(messages)
+	rest := messages[system:]
+	if n <= 0 || len(rest) <= n {
+		return messages
+	}
+	kept := append(append([]Message{}, messages[:system]...), rest[len(rest)-n:]...)
+	return dropOrphanToolMessages(kept, system)
+}
+
+// dropOldestTurn 丢弃系统消息之后最早的一条消息，始终保留最后一条消息
+// 丢弃带工具调用的assistant消息时，其后的工具结果一并丢弃
+func dropOldestTurn(messages []Message) ([]Message, bool) {
+	system := leadingSystemCount(messages)
+	if len(messages)-system <= 1 {
+		return messages, false
+	}
+	trimmed := append(append([]Message{}, messages[:system]...), messages[system+1:]...)
+	trimmed = dropOrphanToolMessages(trimmed, system)
+	if len(trimmed) == system {
+		return messages, false
+	}
+	return trimmed, true
+}
+
+// dropOrphanToolMessages 去掉from位置开始、失去对应工具调用的tool消息，否则上游会拒绝请求
+func dropOrphanToolMessages(messages []Message, from int) []Message {
+	end := from
+	for end < len(messages)-1 && messages[end].Role == "tool" {
+		end++
+	}
+	if end == from {
+		return messages
+	}
+	return append(messages[:from], messages[end:]...)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+// dashboardAssets 仪表盘的静态资源，编译进二进制文件
+//
+//go:embed web/dashboard
+var dashboardAssets embed.FS
+
+// serveDashboard 返回仪表盘页面
+func (ps *ProxyServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	page, err := dashboardAssets.ReadFile("web/dashboard/index.html")
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError, "仪表盘")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page)
+}
+
+// handleDashboardAssets 返回仪表盘的脚本和样式
+func (ps *ProxyServer) handleDashboardAssets(w http.ResponseWriter, r *http.Request) {
+	assets, _ := fs.Sub(dashboardAssets, "web/dashboard")
+	http.StripPrefix("/dashboard/", http.FileServer(http.FS(assets))).ServeHTTP(w, r)
+}
+
+// handleAdminDashboardData 仪表盘轮询的数据：每分钟请求数和错误数、各模型token用量、
+// 进行中的流式响应和最近的请求记录
+func (ps *ProxyServer) handleAdminDashboardData(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"summary": ps.stats.Snapshot(),
+		"series":  ps.stats.Series(),
+		"tokens":  ps.stats.Tokens(),
+		"streams": ps.stats.Streams(),
+		"recent":  ps.stats.Recent(),
+		"breaker": ps.breaker.Snapshot(),
+	}
+	if err := writeJSONResponse(w, data); err != nil {
+		log.Printf("写入仪表盘数据失败: %v", err)
+	}
+}
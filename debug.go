@@ -0,0 +1,48 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+)
+
+// expvar的名称在进程内只能注册一次，测试和validate子命令会创建多个ProxyServer，
+// 因此只注册一次，由最近启用调试接口的实例提供数据
+var (
+	publishDebugVars sync.Once
+	debugVarsServer  atomic.Pointer[ProxyServer]
+)
+
+// setupDebugRoutes 注册/debug/pprof和/debug/vars，用于在生产环境分析高并发流式负载下的CPU和内存
+// 设置了ADMIN_API_KEY时需要管理密钥；只设置DEBUG_ENDPOINTS时不做认证，仅应在本机或内网使用
+func (ps *ProxyServer) setupDebugRoutes() {
+	if ps.config.AdminAPIKey == "" && !ps.config.DebugEndpoints {
+		return
+	}
+
+	debugVarsServer.Store(ps)
+	publishDebugVars.Do(func() {
+		expvar.Publish("proxy", expvar.Func(func() interface{} { return debugVarsServer.Load().stats.Snapshot() }))
+		expvar.Publish("breaker", expvar.Func(func() interface{} { return debugVarsServer.Load().breaker.Snapshot() }))
+	})
+
+	// 配置了管理密钥时要求认证；采样类接口（如profile、trace）会持续数十秒，因此不加路由超时
+	auth := authNone
+	if ps.config.AdminAPIKey != "" {
+		auth = authAdmin
+	}
+	ps.handle(route{pattern: "/debug/pprof/", auth: auth}, pprof.Index)
+	ps.handle(route{pattern: "/debug/pprof/cmdline", auth: auth}, pprof.Cmdline)
+	ps.handle(route{pattern: "/debug/pprof/profile", auth: auth}, pprof.Profile)
+	ps.handle(route{pattern: "/debug/pprof/symbol", auth: auth}, pprof.Symbol)
+	ps.handle(route{pattern: "/debug/pprof/trace", auth: auth}, pprof.Trace)
+	ps.handle(route{pattern: "/debug/vars", auth: auth}, expvar.Handler().ServeHTTP)
+
+	if ps.config.AdminAPIKey == "" {
+		log.Printf("警告：调试接口 /debug/pprof 和 /debug/vars 未设置认证，请勿暴露到公网")
+	} else {
+		log.Printf("✓ 调试接口已启用: /debug/pprof, /debug/vars")
+	}
+}
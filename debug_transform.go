@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// 请求转换预览：POST /v1/debug/transform 接受与 /v1/chat/completions 相同的请求体，
+// 按同样的流程做模型映射、消息规范化和参数处理，返回将要发往DeepSeek的请求体和地址，
+// 不调用上游也不计入统计，用于排查客户端兼容性问题
+
+// transformPreview 请求转换预览的响应
+type transformPreview struct {
+	RequestID   string           `json:"request_id"`
+	Model       string           `json:"model"`                  // 客户端请求的模型名
+	Method      string           `json:"method"`                 // 发往DeepSeek的请求方法
+	URL         string           `json:"url"`                    // 发往DeepSeek的地址
+	ServerTools []string         `json:"server_tools,omitempty"` // 由代理执行的服务端工具
+	Request     *DeepSeekRequest `json:"request"`                // 发往DeepSeek的请求体
+}
+
+func (ps *ProxyServer) handleDebugTransform(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var openaiReq ChatRequest
+	if err := readJSONRequest(r, &openaiReq); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	clientProfileFor(r.Context()).applyMaxTokensCap(&openaiReq, requestID)
+
+	deepseekReq, err := ps.transformRequest(r, &openaiReq, requestID)
+	if err != nil {
+		if _, ok := asAPIError(err); ok {
+			handleError(w, err, http.StatusInternalServerError, "请求转换")
+		} else {
+			handleError(w, err, http.StatusBadRequest, "请求转换")
+		}
+		return
+	}
+
+	// 与发送前的处理保持一致：注入服务端工具，高峰期bulk请求换用模型，被拒绝的指定工具改用提示词
+	preview := transformPreview{RequestID: requestID, Model: openaiReq.Model, Method: "POST"}
+	for name := range ps.serverTools.inject(deepseekReq, openaiReq.ToolChoice, clientAPIKey(r)) {
+		preview.ServerTools = append(preview.ServerTools, name)
+	}
+	sort.Strings(preview.ServerTools)
+	deepseekReq = ps.offPeak.switchModel(r.Context(), deepseekReq, requestID)
+	if name := namedToolChoice(deepseekReq.ToolChoice); name != "" && ps.namedToolChoiceRejected.Load() {
+		deepseekReq = deepseekReq.forceToolByPrompt(name)
+	}
+	preview.URL = ps.config.Endpoint + deepseekReq.chatCompletionsPath()
+	preview.Request = deepseekReq
+
+	if err := writeJSONResponse(w, preview); err != nil {
+		log.Printf("[%s] 写入转换结果失败: %v", requestID, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// deepSeekStreamChunk 上游流式响应中的单个数据块
+type deepSeekStreamChunk struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role             string `json:"role"`
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		Text         string  `json:"text"` // beta补全接口的数据块使用text而不是delta
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// collectStreamingResponse 以流式方式请求上游，并把所有数据块拼装成一个完整响应
+// 长时间的推理输出在非流式请求下容易触发上游或中间代理的空闲超时，
+// 流式请求可以持续收到数据，对只接受非流式响应的客户端保持透明
+func (ps *ProxyServer) collectStreamingResponse(ctx context.Context, req *DeepSeekRequest, requestID string) (*DeepSeekResponse, error) {
+	log.Printf("[%s] 反流式模式：以流式请求上游并拼装完整响应", requestID)
+
+	upstreamReq := *req
+	upstreamReq.Stream = true
+
+	resp, err := ps.sendStreamingRequestToDeepSeek(ctx, &upstreamReq, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &DeepSeekResponse{Object: "chat.completion"}
+	choices := make(map[int]*DeepSeekChoice)
+	reader := bufio.NewReaderSize(resp.Body, 64*1024)
+
+	for {
+		line, err := readSSELine(reader, ps.config.StreamMaxLineBytes)
+		if err == io.EOF {
+			return nil, fmt.Errorf("上游流式响应意外中断")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取上游流式响应失败: %w", err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk deepSeekStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Printf("[%s] 解析流式数据块失败: %v", requestID, err)
+			continue
+		}
+		mergeStreamChunk(result, choices, &chunk)
+	}
+
+	indexes := make([]int, 0, len(choices))
+	for index := range choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		result.Choices = append(result.Choices, *choices[index])
+	}
+
+	log.Printf("[%s] 流式数据块拼装完成，共 %d 个选项", requestID, len(result.Choices))
+	return result, nil
+}
+
+// mergeStreamChunk 把一个数据块的增量合并进完整响应
+func mergeStreamChunk(result *DeepSeekResponse, choices map[int]*DeepSeekChoice, chunk *deepSeekStreamChunk) {
+	if result.ID == "" {
+		result.ID = chunk.ID
+		result.Created = chunk.Created
+		result.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		result.Usage = *chunk.Usage
+	}
+
+	for _, delta := range chunk.Choices {
+		choice, ok := choices[delta.Index]
+		if !ok {
+			choice = &DeepSeekChoice{Index: delta.Index, Message: Message{Role: "assistant"}}
+			choices[delta.Index] = choice
+		}
+
+		if delta.Delta.Role != "" {
+			choice.Message.Role = delta.Delta.Role
+		}
+		choice.Message.Content += delta.Delta.Content
+		choice.Message.ReasoningContent += delta.Delta.ReasoningContent
+
+		// 工具调用按index增量拼接：首个增量带id和函数名，后续增量只追加参数
+		for _, toolDelta := range delta.Delta.ToolCalls {
+			for len(choice.Message.ToolCalls) <= toolDelta.Index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, ToolCall{Type: "function"})
+			}
+			toolCall := &choice.Message.ToolCalls[toolDelta.Index]
+			if toolDelta.ID != "" {
+				toolCall.ID = toolDelta.ID
+			}
+			if toolDelta.Type != "" {
+				toolCall.Type = toolDelta.Type
+			}
+			toolCall.Function.Name += toolDelta.Function.Name
+			toolCall.Function.Arguments += toolDelta.Function.Arguments
+		}
+
+		if delta.FinishReason != nil {
+			choice.FinishReason = *delta.FinishReason
+		}
+	}
+}
+
+// newStreamContext 创建流式响应的上下文：客户端断开时取消，并限制整个流的最长持续时间
+func (ps *ProxyServer) newStreamContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if ps.config.StreamTimeout > 0 {
+		return context.WithTimeout(parent, ps.config.StreamTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// upstreamStreamResult 上游流式响应的结束状态
+type upstreamStreamResult struct {
+	done         bool   // 收到了[DONE]或因内容过滤提前结束
+	blocked      bool   // 命中内容过滤的拦截规则
+	finishReason string // 第一个选项的finish_reason
+	usage        Usage
+	err          error // 上游没有正常结束的原因，客户端已断开时为nil
+}
+
+// consumeUpstreamStream 读取上游流式响应，按内容过滤规则处理后把每个数据块交给handle
+// 供需要把数据块转换为其他协议格式的兼容端点使用；首token超时、心跳和最大行长度与
+// /v1/chat/completions的流式响应一致
+func (ps *ProxyServer) consumeUpstreamStream(ctx context.Context, body io.ReadCloser, w io.Writer, flusher http.Flusher,
+	requestID string, handle func(chunk *deepSeekStreamChunk)) upstreamStreamResult {
+
+	firstTokenTimer := startFirstTokenTimer(ps.config.FirstTokenTimeout, body)
+	defer firstTokenTimer.Stop()
+
+	heartbeat := startStreamHeartbeat(w, flusher, ps.config.StreamKeepAliveInterval, requestID)
+	defer heartbeat.Stop()
+
+	filter := ps.guardrails.NewStream(requestID)
+	reader := bufio.NewReaderSize(body, 64*1024)
+	var result upstreamStreamResult
+	var readErr error
+
+	for ctx.Err() == nil {
+		line, err := readSSELine(reader, ps.config.StreamMaxLineBytes)
+		heartbeat.Stop()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "" {
+			continue
+		}
+		firstTokenTimer.Stop()
+		if data == "[DONE]" {
+			result.done = true
+			return result
+		}
+
+		recordStreamUsage(ctx, data)
+		data, blocked := filter.FilterData(data)
+		if blocked {
+			log.Printf("[%s] 流式响应命中内容过滤规则，提前结束", requestID)
+			result.done, result.blocked = true, true
+			result.finishReason = "content_filter"
+			return result
+		}
+
+		var chunk deepSeekStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Printf("[%s] 解析流式数据块失败: %v", requestID, err)
+			continue
+		}
+		handle(&chunk)
+		for _, choice := range chunk.Choices {
+			if choice.Index == 0 && choice.FinishReason != nil {
+				result.finishReason = *choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			result.usage = *chunk.Usage
+		}
+	}
+
+	result.err = ps.abnormalStreamError(ctx, firstTokenTimer.Expired(), readErr, requestID)
+	return result
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// OpenAI错误类型
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeAuthentication = "authentication_error"
+	errTypePermission     = "permission_error"
+	errTypeRateLimit      = "rate_limit_error"
+	errTypeServer         = "server_error"
+)
+
+// apiError 以OpenAI格式返回给客户端的错误
+// 所有处理器都通过它输出 {"error":{"message","type","param","code"}}
+type apiError struct {
+	StatusCode int
+	Type       string
+	Message    string
+	Param      string
+	Code       string
+	Extra      map[string]interface{} // 附加在error对象中的其他字段
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError 根据HTTP状态码创建错误，错误类型按OpenAI的约定推断
+func newAPIError(statusCode int, message string) *apiError {
+	return &apiError{
+		StatusCode: statusCode,
+		Type:       openAIErrorType(statusCode),
+		Message:    message,
+	}
+}
+
+// openAIErrorType 将HTTP状态码映射为OpenAI错误类型
+func openAIErrorType(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return errTypeAuthentication
+	case statusCode == http.StatusForbidden:
+		return errTypePermission
+	case statusCode == http.StatusTooManyRequests:
+		return errTypeRateLimit
+	case statusCode >= http.StatusInternalServerError:
+		return errTypeServer
+	default:
+		return errTypeInvalidRequest
+	}
+}
+
+// writeAPIError 输出OpenAI格式的错误响应
+func writeAPIError(w http.ResponseWriter, apiErr *apiError) {
+	detail := map[string]interface{}{
+		"message": apiErr.Message,
+		"type":    apiErr.Type,
+		"param":   nil,
+		"code":    nil,
+	}
+	if apiErr.Param != "" {
+		detail["param"] = apiErr.Param
+	}
+	if apiErr.Code != "" {
+		detail["code"] = apiErr.Code
+	}
+	for key, value := range apiErr.Extra {
+		detail[key] = value
+	}
+
+	// 必须在WriteHeader之前设置内容类型，否则会沿用流式响应预设的头部
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(apiErr.StatusCode)
+
+	body := map[string]interface{}{"error": detail}
+	if requestID := w.Header().Get("X-Request-ID"); requestID != "" {
+		body["request_id"] = requestID
+	}
+	if err := writeJSONResponse(w, body); err != nil {
+		log.Printf("写入错误响应失败: %v", err)
+	}
+}
+
+// upstreamAPIError 将DeepSeek的错误响应转换为返回给客户端的错误
+// 4xx原样保留状态码，5xx统一视为网关错误，错误信息尽量取自上游的OpenAI格式响应体
+func upstreamAPIError(upstreamErr *upstreamError) *apiError {
+	statusCode := upstreamErr.StatusCode
+	if statusCode >= http.StatusInternalServerError {
+		statusCode = http.StatusBadGateway
+	}
+	apiErr := newAPIError(statusCode, upstreamErr.Error())
+
+	var body struct {
+		Error struct {
+			Message string      `json:"message"`
+			Param   string      `json:"param"`
+			Code    interface{} `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(upstreamErr.Body), &body); err == nil && body.Error.Message != "" {
+		apiErr.Message = body.Error.Message
+		apiErr.Param = body.Error.Param
+		if code, ok := body.Error.Code.(string); ok {
+			apiErr.Code = code
+		}
+	}
+	return apiErr
+}
+
+// asAPIError 如果错误链中包含apiError则返回它
+func asAPIError(err error) (*apiError, bool) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr, true
+	}
+	return nil, false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 额外字段透传：客户端请求中代理不认识的顶层字段（DeepSeek特有的参数、OpenAI SDK通过extra_body
+// 合并进来的字段等）原样保留并转发给DeepSeek，新参数不需要等代理升级就能使用
+
+// chatRequestFields ChatRequest中已定义的JSON字段名
+var chatRequestFields = jsonFieldNames(reflect.TypeOf(ChatRequest{}))
+
+// jsonFieldNames 读取结构体的JSON字段名
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// UnmarshalJSON 解析已定义的字段，其余顶层字段保存在Extra中
+func (req *ChatRequest) UnmarshalJSON(data []byte) error {
+	type plain ChatRequest
+	if err := json.Unmarshal(data, (*plain)(req)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	req.Extra = nil
+	for name, value := range fields {
+		if !chatRequestFields[name] {
+			if req.Extra == nil {
+				req.Extra = make(map[string]json.RawMessage)
+			}
+			req.Extra[name] = value
+		}
+	}
+	return nil
+}
+
+// MarshalJSON 在已定义的字段之外附加透传的额外字段，已定义的字段优先
+func (req DeepSeekRequest) MarshalJSON() ([]byte, error) {
+	type plain DeepSeekRequest
+	data, err := json.Marshal(plain(req))
+	if err != nil || len(req.extra) == 0 {
+		return data, err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	for name, value := range req.extra {
+		if _, exists := merged[name]; !exists {
+			merged[name] = value
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// extraFields 选出要转发给DeepSeek的额外字段：extra_body对象展开到顶层，
+// DROP_EXTRA_FIELDS中的字段丢弃
+func (ps *ProxyServer) extraFields(extra map[string]json.RawMessage, requestID string) map[string]json.RawMessage {
+	if !ps.config.PassthroughExtraFields || len(extra) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]json.RawMessage, len(extra))
+	for name, value := range extra {
+		fields[name] = value
+	}
+	if raw, ok := fields["extra_body"]; ok {
+		var body map[string]json.RawMessage
+		if json.Unmarshal(raw, &body) == nil {
+			delete(fields, "extra_body")
+			for name, value := range body {
+				if _, exists := fields[name]; !exists {
+					fields[name] = value
+				}
+			}
+		}
+	}
+	for _, name := range ps.config.DropExtraFields {
+		delete(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("[%s] 透传额外字段: %s", requestID, strings.Join(names, ", "))
+	return fields
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的假DeepSeek服务器：按脚本依次返回普通响应、SSE流、错误、gzip压缩响应和工具调用，
+// 并记录收到的请求，测试可以检查代理发给上游的内容。脚本用完后返回500，避免测试意外多发请求
+
+// TestMain 测试时关闭日志输出，转换过程的逐条日志会淹没测试结果
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeReply 一次脚本化的响应；events不为空时按SSE发送
+type fakeReply struct {
+	status int         // 默认200
+	header http.Header // 附加的响应头
+	body   string      // 非流式响应体
+	events []string    // SSE的data内容，不含"data: "前缀
+	done   bool        // 事件发送完后追加[DONE]
+	gzip   bool        // 响应体用gzip压缩
+	delay  time.Duration
+}
+
+// fakeRequest 假服务器收到的一次请求
+type fakeRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   map[string]interface{}
+}
+
+// fakeDeepSeek 基于httptest的假DeepSeek服务器
+type fakeDeepSeek struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	replies  []fakeReply
+	requests []fakeRequest
+}
+
+// newFakeDeepSeek 启动假服务器，测试结束时自动关闭
+func newFakeDeepSeek(t *testing.T, replies ...fakeReply) *fakeDeepSeek {
+	t.Helper()
+	f := &fakeDeepSeek{replies: replies}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// enqueue 追加脚本化的响应
+func (f *fakeDeepSeek) enqueue(replies ...fakeReply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, replies...)
+}
+
+// received 返回收到的所有请求
+func (f *fakeDeepSeek) received() []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeRequest(nil), f.requests...)
+}
+
+func (f *fakeDeepSeek) serve(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	request := fakeRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()}
+	json.Unmarshal(data, &request.Body)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	reply := fakeReply{status: http.StatusInternalServerError, body: fakeErrorBody("假服务器没有更多的脚本响应")}
+	if len(f.replies) > 0 {
+		reply = f.replies[0]
+		f.replies = f.replies[1:]
+	}
+	f.mu.Unlock()
+
+	if reply.delay > 0 {
+		time.Sleep(reply.delay)
+	}
+	for key, values := range reply.header {
+		w.Header()[key] = values
+	}
+	if reply.status == 0 {
+		reply.status = http.StatusOK
+	}
+
+	var out io.Writer = w
+	if reply.gzip {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	if len(reply.events) == 0 && !reply.done {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(reply.status)
+		io.WriteString(out, reply.body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(reply.status)
+	flusher, _ := w.(http.Flusher)
+	for _, event := range reply.events {
+		fmt.Fprintf(out, "data: %s\n\n", event)
+		if gz, ok := out.(*gzip.Writer); ok {
+			gz.Flush()
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if reply.done {
+		io.WriteString(out, "data: [DONE]\n\n")
+	}
+}
+
+// fakeErrorBody DeepSeek格式的错误响应体
+func fakeErrorBody(message string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": "api_error"},
+	})
+	return string(data)
+}
+
+// fakeCompletion 非流式的对话响应体
+func fakeCompletion(model string, message Message, finishReason string) string {
+	data, _ := json.Marshal(DeepSeekResponse{
+		ID:      "chatcmpl-fake",
+		Object:  "chat.completion",
+		Created: 1700000000,
+		Model:   model,
+		Choices: []DeepSeekChoice{{Index: 0, Message: message, FinishReason: finishReason}},
+		Usage:   Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, PromptCacheHitTokens: 4, PromptCacheMissTokens: 6},
+	})
+	return string(data)
+}
+
+// fakeChunk 一个流式数据块，delta为空时只携带finish_reason
+func fakeChunk(model string, delta map[string]interface{}, finishReason interface{}) string {
+	if delta == nil {
+		delta = map[string]interface{}{}
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-fake",
+		"object":  "chat.completion.chunk",
+		"created": 1700000000,
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+	})
+	return string(data)
+}
+
+// fakeUsageChunk 只携带用量的最后一个数据块
+func fakeUsageChunk(model string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-fake",
+		"object":  "chat.completion.chunk",
+		"created": 1700000000,
+		"model":   model,
+		"choices": []interface{}{},
+		"usage":   map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15, "prompt_cache_hit_tokens": 4},
+	})
+	return string(data)
+}
+
+// fakeTextStream 按片段输出正文的SSE流，reasoning不为空时先输出推理内容
+func fakeTextStream(model, reasoning string, pieces ...string) []string {
+	var events []string
+	if reasoning != "" {
+		events = append(events, fakeChunk(model, map[string]interface{}{"role": "assistant", "reasoning_content": reasoning}, nil))
+	}
+	for _, piece := range pieces {
+		events = append(events, fakeChunk(model, map[string]interface{}{"content": piece}, nil))
+	}
+	return append(events, fakeChunk(model, nil, "stop"), fakeUsageChunk(model))
+}
+
+// fakeToolCallStream 分块输出一个工具调用的SSE流，参数分两段发送
+func fakeToolCallStream(model, name, arguments string) []string {
+	half := len(arguments) / 2
+	return []string{
+		fakeChunk(model, map[string]interface{}{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{
+			"index": 0, "id": "call_fake", "type": "function",
+			"function": map[string]interface{}{"name": name, "arguments": arguments[:half]},
+		}}}, nil),
+		fakeChunk(model, map[string]interface{}{"tool_calls": []interface{}{map[string]interface{}{
+			"index": 0, "function": map[string]interface{}{"arguments": arguments[half:]},
+		}}}, nil),
+		fakeChunk(model, nil, "tool_calls"),
+	}
+}
+
+// fakeToolCall 非流式响应中的工具调用
+func fakeToolCall(id, name, arguments string) ToolCall {
+	call := ToolCall{ID: id, Type: "function"}
+	call.Function.Name = name
+	call.Function.Arguments = arguments
+	return call
+}
+
+// testAPIKey 测试代理使用的密钥
+const testAPIKey = "sk-test-harness"
+
+// newTestProxy 创建指向假服务器的代理，配置从环境变量的默认值开始，modify可以调整个别配置
+func newTestProxy(t *testing.T, endpoint string, modify ...ConfigOverride) *ProxyServer {
+	t.Helper()
+	overrides := append([]ConfigOverride{func(c *ProxyConfig) {
+		c.Endpoint = endpoint
+		c.DeepSeekAPIKey = testAPIKey
+		c.Port = 0
+		c.HealthProbeInterval = 0
+	}}, modify...)
+	config, err := readConfig("", overrides...)
+	if err != nil {
+		t.Fatalf("读取配置失败: %v", err)
+	}
+	if err := prepareConfig(config); err != nil {
+		t.Fatalf("准备配置失败: %v", err)
+	}
+	return NewProxyServer(config)
+}
+
+// proxyPost 向代理发送一个请求并返回响应
+func proxyPost(t *testing.T, ps *ProxyServer, path string, payload interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("序列化请求失败: %v", err)
+	}
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	rec := httptest.NewRecorder()
+	ps.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// sseData 取出SSE响应中所有data行的内容
+func sseData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, value)
+		}
+	}
+	return data
+}
+
+// decodeChunks 解析SSE响应中除[DONE]外的所有数据块
+func decodeChunks(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var chunks []map[string]interface{}
+	for _, data := range sseData(body) {
+		if data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("无法解析数据块 %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// streamText 拼接数据块中delta的指定字段
+func streamText(chunks []map[string]interface{}, field string) string {
+	var text strings.Builder
+	for _, chunk := range chunks {
+		choices, _ := chunk["choices"].([]interface{})
+		for _, item := range choices {
+			choice, _ := item.(map[string]interface{})
+			delta, _ := choice["delta"].(map[string]interface{})
+			if value, ok := delta[field].(string); ok {
+				text.WriteString(value)
+			}
+		}
+	}
+	return text.String()
+}
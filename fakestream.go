@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// handleFakeStreamingResponse 伪流式响应
+// 向上游发送非流式请求，拿到完整响应后再按OpenAI的chunk格式逐段发送给客户端
+func (ps *ProxyServer) handleFakeStreamingResponse(w http.ResponseWriter, r *http.Request, flusher http.Flusher,
+	deepseekReq *DeepSeekRequest, originalModel, requestID string) {
+
+	log.Printf("[%s] 伪流式模式：以非流式请求上游", requestID)
+
+	upstreamReq := *deepseekReq
+	upstreamReq.Stream = false
+
+	deepseekResp, err := ps.fetchCompletion(w, r.Context(), &upstreamReq, requestID)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+			return
+		}
+		ps.handleUpstreamError(w, fmt.Errorf("DeepSeek请求失败: %w", err), "DeepSeek通信")
+		return
+	}
+
+	deepseekResp = ps.checkToolCalls(r.Context(), &upstreamReq, deepseekResp, requestID)
+	deepseekResp = ps.limitToolCalls(r, &upstreamReq, deepseekResp, requestID)
+	deepseekResp = legacyFunctionCallResponse(&upstreamReq, deepseekResp, requestID)
+	ps.streamCompleteResponse(r.Context(), w, flusher, deepseekResp, originalModel, requestID)
+}
+
+// streamCompleteResponse 把一个完整的响应拆分成流式数据块发送
+// 推理内容和正文按FakeStreamChunkSize个字符一段，段与段之间间隔FakeStreamInterval
+func (ps *ProxyServer) streamCompleteResponse(ctx context.Context, w io.Writer, flusher http.Flusher,
+	deepseekResp *DeepSeekResponse, originalModel, requestID string) {
+
+	deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+
+	chunkSize := ps.config.FakeStreamChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 20
+	}
+
+	send := func(choice map[string]interface{}, extra map[string]interface{}) bool {
+		chunk := map[string]interface{}{
+			"id":      deepseekResp.ID,
+			"object":  "chat.completion.chunk",
+			"created": deepseekResp.Created,
+			"model":   originalModel,
+			"choices": []interface{}{choice},
+		}
+		for key, value := range extra {
+			chunk[key] = value
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			log.Printf("[%s] 序列化伪流式数据块失败: %v", requestID, err)
+			return false
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		return true
+	}
+
+	// 按节奏发送一段文本，客户端断开时返回false
+	sendText := func(index int, field, text string) bool {
+		runes := []rune(text)
+		for start := 0; start < len(runes); start += chunkSize {
+			end := start + chunkSize
+			if end > len(runes) {
+				end = len(runes)
+			}
+			delta := map[string]interface{}{field: string(runes[start:end])}
+			if !send(map[string]interface{}{"index": index, "delta": delta, "finish_reason": nil}, nil) {
+				return false
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Printf("[%s] 客户端连接已断开", requestID)
+				return false
+			case <-time.After(ps.config.FakeStreamInterval):
+			}
+		}
+		return true
+	}
+
+	mode := clientProfileFor(ctx).reasoningMode(true)
+	for i, choice := range deepseekResp.Choices {
+		reasoning, content := foldReasoning(mode, choice.Message.ReasoningContent, choice.Message.Content)
+		role := choice.Message.Role
+		if role == "" {
+			role = "assistant"
+		}
+		if !send(map[string]interface{}{"index": choice.Index, "delta": map[string]interface{}{"role": role}, "finish_reason": nil}, nil) {
+			return
+		}
+		if !sendText(choice.Index, "reasoning_content", reasoning) {
+			return
+		}
+		if !sendText(choice.Index, "content", content) {
+			return
+		}
+
+		if len(choice.Message.ToolCalls) > 0 {
+			toolCalls := make([]interface{}, len(choice.Message.ToolCalls))
+			for j, toolCall := range choice.Message.ToolCalls {
+				toolCalls[j] = map[string]interface{}{
+					"index":    j,
+					"id":       toolCall.ID,
+					"type":     "function",
+					"function": toolCall.Function,
+				}
+			}
+			delta := map[string]interface{}{"tool_calls": toolCalls}
+			if !send(map[string]interface{}{"index": choice.Index, "delta": delta, "finish_reason": nil}, nil) {
+				return
+			}
+		}
+		if choice.Message.FunctionCall != nil {
+			delta := map[string]interface{}{"function_call": choice.Message.FunctionCall}
+			if !send(map[string]interface{}{"index": choice.Index, "delta": delta, "finish_reason": nil}, nil) {
+				return
+			}
+		}
+
+		// 用量信息只附加在最后一个数据块上
+		var extra map[string]interface{}
+		if i == len(deepseekResp.Choices)-1 {
+			extra = map[string]interface{}{"usage": deepseekResp.openAIUsage()}
+		}
+		send(map[string]interface{}{"index": choice.Index, "delta": map[string]interface{}{}, "finish_reason": choice.FinishReason}, extra)
+	}
+
+	recordUsage(ctx, deepseekResp.Usage)
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	log.Printf("[%s] 伪流式响应发送完成", requestID)
+}
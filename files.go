@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filePurposes OpenAI Files API接受的用途
+var filePurposes = map[string]bool{
+	"assistants": true, "batch": true, "fine-tune": true, "vision": true, "user_data": true, "evals": true,
+}
+
+// fileObject OpenAI格式的文件对象
+type fileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+// fileRecord 保存在磁盘上的文件元数据，Owner为上传者密钥的短哈希
+type fileRecord struct {
+	Owner string     `json:"owner"`
+	File  fileObject `json:"file"`
+}
+
+// fileStore 本地磁盘上的文件存储
+// 每个文件保存为内容和元数据两个文件，文件按客户端密钥隔离
+type fileStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files map[string]*fileRecord
+}
+
+func newFileStore(config *ProxyConfig) (*fileStore, error) {
+	if err := os.MkdirAll(config.FilesDir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建文件目录失败: %w", err)
+	}
+	s := &fileStore{
+		dir:      config.FilesDir,
+		maxBytes: config.FilesMaxBytes,
+		files:    make(map[string]*fileRecord),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "file-*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取文件目录失败: %w", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取文件元数据失败: %w", err)
+		}
+		record := &fileRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("解析文件元数据 %s 失败: %w", filepath.Base(path), err)
+		}
+		s.files[record.File.ID] = record
+	}
+	return s, nil
+}
+
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".data")
+}
+
+// create 保存上传的内容，超过大小上限时返回413错误
+func (s *fileStore) create(owner, filename, purpose string, content io.Reader) (*fileObject, error) {
+	id := fmt.Sprintf("file-%d", time.Now().UnixNano())
+	path := s.path(id)
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("保存文件失败: %w", err)
+	}
+	written, err := io.Copy(out, io.LimitReader(content, s.maxBytes+1))
+	out.Close()
+	if err == nil && written > s.maxBytes {
+		err = newAPIError(http.StatusRequestEntityTooLarge, fmt.Sprintf("文件超过 %d 字节的大小上限", s.maxBytes))
+	}
+	if err != nil {
+		os.Remove(path)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("保存文件失败: %w", err)
+	}
+
+	record := &fileRecord{Owner: owner, File: fileObject{
+		ID:        id,
+		Object:    "file",
+		Bytes:     written,
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}}
+	data, err := json.Marshal(record)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("序列化文件元数据失败: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, id+".json"), data, 0o600); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("写入文件元数据失败: %w", err)
+	}
+
+	s.mu.Lock()
+	s.files[id] = record
+	s.mu.Unlock()
+	file := record.File
+	return &file, nil
+}
+
+// setPurpose 上传完成后补充用途并写回元数据
+func (s *fileStore) setPurpose(id, purpose string) *fileObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.files[id]
+	record.File.Purpose = purpose
+	if data, err := json.Marshal(record); err == nil {
+		if err := os.WriteFile(filepath.Join(s.dir, id+".json"), data, 0o600); err != nil {
+			log.Printf("写入文件 %s 的元数据失败: %v", id, err)
+		}
+	}
+	file := record.File
+	return &file
+}
+
+// get 返回owner可见的文件
+func (s *fileStore) get(owner, id string) (*fileObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.files[id]
+	if !ok || record.Owner != owner {
+		return nil, false
+	}
+	file := record.File
+	return &file, true
+}
+
+// read 读取owner可见的文件内容
+func (s *fileStore) read(owner, id string) ([]byte, error) {
+	if _, ok := s.get(owner, id); !ok {
+		return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("文件 %s 不存在", id))
+	}
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+	return data, nil
+}
+
+// list 按创建时间从新到旧返回owner的文件，purpose为空时不过滤
+func (s *fileStore) list(owner, purpose, after string, limit int) ([]fileObject, bool) {
+	s.mu.Lock()
+	files := make([]fileObject, 0)
+	for _, record := range s.files {
+		if record.Owner == owner && (purpose == "" || record.File.Purpose == purpose) {
+			files = append(files, record.File)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ID > files[j].ID })
+	if after != "" {
+		start := len(files)
+		for i, file := range files {
+			if file.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		files = files[start:]
+	}
+	if len(files) > limit {
+		return files[:limit], true
+	}
+	return files, false
+}
+
+// delete 删除owner的文件，文件不存在时返回false
+func (s *fileStore) delete(owner, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.files[id]
+	if !ok || record.Owner != owner {
+		return false, nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, id+".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("删除文件失败: %w", err)
+	}
+	os.Remove(s.path(id))
+	delete(s.files, id)
+	return true, nil
+}
+
+// handleFiles 处理文件接口：
+// POST /v1/files 上传，GET /v1/files 列出，GET /v1/files/{id} 查询，
+// GET /v1/files/{id}/content 下载内容，DELETE /v1/files/{id} 删除
+func (ps *ProxyServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	owner := clientKeyHash(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "POST":
+			ps.uploadFile(w, r, owner)
+		case "GET":
+			ps.listFiles(w, r, owner)
+		default:
+			handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	file, ok := ps.files.get(owner, id)
+	if !ok {
+		handleError(w, newAPIError(http.StatusNotFound, fmt.Sprintf("文件 %s 不存在", id)), http.StatusNotFound, "文件")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJSONResponse(w, file)
+	case action == "" && r.Method == "DELETE":
+		deleted, err := ps.files.delete(owner, id)
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError, "文件")
+			return
+		}
+		log.Printf("删除文件 %s", id)
+		writeJSONResponse(w, map[string]interface{}{"id": id, "object": "file", "deleted": deleted})
+	case action == "content" && r.Method == "GET":
+		content, err := os.Open(ps.files.path(id))
+		if err != nil {
+			handleError(w, fmt.Errorf("读取文件失败: %w", err), http.StatusInternalServerError, "文件")
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Bytes, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+		io.Copy(w, content)
+	default:
+		handleError(w, fmt.Errorf("不支持的文件操作: %s %s", r.Method, r.URL.Path), http.StatusNotFound, "文件")
+	}
+}
+
+// uploadFile 处理multipart/form-data上传，字段file为文件内容，purpose为用途
+func (ps *ProxyServer) uploadFile(w http.ResponseWriter, r *http.Request, owner string) {
+	// 留出表单其他字段的空间，文件本身的大小在写入时检查
+	r.Body = http.MaxBytesReader(w, r.Body, ps.config.FilesMaxBytes+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		handleError(w, fmt.Errorf("请求必须是multipart/form-data: %w", err), http.StatusBadRequest, "文件上传")
+		return
+	}
+
+	// purpose可能出现在file字段之后，先把文件写入存储，读完表单后再校验
+	var file *fileObject
+	purpose := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			handleError(w, fmt.Errorf("解析上传表单失败: %w", err), http.StatusBadRequest, "文件上传")
+			return
+		}
+		switch part.FormName() {
+		case "purpose":
+			value, _ := io.ReadAll(io.LimitReader(part, 64))
+			purpose = strings.TrimSpace(string(value))
+		case "file":
+			if file != nil {
+				break
+			}
+			file, err = ps.files.create(owner, filepath.Base(part.FileName()), "", part)
+			if err != nil {
+				handleError(w, err, http.StatusInternalServerError, "文件上传")
+				return
+			}
+		}
+		part.Close()
+	}
+
+	if file == nil {
+		apiErr := newAPIError(http.StatusBadRequest, "缺少file字段")
+		apiErr.Param = "file"
+		handleError(w, apiErr, http.StatusBadRequest, "文件上传")
+		return
+	}
+	if !filePurposes[purpose] {
+		ps.files.delete(owner, file.ID)
+		apiErr := newAPIError(http.StatusBadRequest, fmt.Sprintf("purpose无效: %q", purpose))
+		apiErr.Param = "purpose"
+		handleError(w, apiErr, http.StatusBadRequest, "文件上传")
+		return
+	}
+	file = ps.files.setPurpose(file.ID, purpose)
+
+	log.Printf("上传文件 %s：%s，%d 字节，用途 %s", file.ID, file.Filename, file.Bytes, purpose)
+	writeJSONResponse(w, file)
+}
+
+// listFiles 分页列出当前密钥上传的文件
+func (ps *ProxyServer) listFiles(w http.ResponseWriter, r *http.Request, owner string) {
+	limit := 10000
+	if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 10000 {
+		limit = value
+	}
+	files, hasMore := ps.files.list(owner, r.URL.Query().Get("purpose"), r.URL.Query().Get("after"), limit)
+	response := map[string]interface{}{
+		"object":   "list",
+		"data":     files,
+		"has_more": hasMore,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(files) > 0 {
+		response["first_id"] = files[0].ID
+		response["last_id"] = files[len(files)-1].ID
+	}
+	writeJSONResponse(w, response)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DeepSeek beta补全接口的max_tokens上限
+const fimMaxTokens = 4096
+
+// fimRequest DeepSeek beta补全接口（/beta/completions）的请求，带suffix时做中间填充
+type fimRequest struct {
+	Model       string      `json:"model"`
+	Prompt      string      `json:"prompt"`
+	Suffix      string      `json:"suffix,omitempty"`
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"`
+	Stream      bool        `json:"stream"`
+}
+
+// fimResponse beta补全接口的非流式响应
+type fimResponse struct {
+	ID      string `json:"id"`
+	Choices []struct {
+		Index        int    `json:"index"`
+		Text         string `json:"text"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+// toFIMRequest 把单个prompt转换为beta补全请求，max_tokens超出上限时截断
+func (req *CompletionRequest) toFIMRequest(model, prompt, suffix, requestID string) *fimRequest {
+	fim := &fimRequest{
+		Model:       model,
+		Prompt:      prompt,
+		Suffix:      suffix,
+		Temperature: req.Temperature,
+		Stop:        req.Stop,
+		Stream:      req.Stream,
+	}
+	if req.MaxTokens != nil {
+		fim.MaxTokens = *req.MaxTokens
+		if fim.MaxTokens > fimMaxTokens {
+			log.Printf("[%s] max_tokens=%d 超过beta补全接口上限，截断为 %d", requestID, fim.MaxTokens, fimMaxTokens)
+			fim.MaxTokens = fimMaxTokens
+		}
+	}
+	return fim
+}
+
+// handleBetaCompletions 把文本补全请求转发到DeepSeek beta补全接口
+// prompt和suffix同样经过凭据检查和内容过滤；多个prompt依次请求，流式响应只支持单个prompt
+func (ps *ProxyServer) handleBetaCompletions(w http.ResponseWriter, r *http.Request,
+	req *CompletionRequest, prompts []string, requestID string) {
+
+	suffix := ""
+	if req.Suffix != nil {
+		suffix = *req.Suffix
+	}
+	log.Printf("[%s] 文本补全转发到beta补全接口，模型: %s -> %s", requestID, req.Model, ps.config.FIMModel)
+
+	created := time.Now().Unix()
+	choices := make([]map[string]interface{}, 0, len(prompts))
+	var usage Usage
+	for i, prompt := range prompts {
+		// 借用对话请求的检查流程，prompt和suffix各作为一条消息
+		screened := &ChatRequest{Model: req.Model, Messages: []Message{
+			{Role: "user", Content: prompt},
+			{Role: "user", Content: suffix},
+		}}
+		if blocked, err := ps.screenInput(screened, requestID); err != nil {
+			handleError(w, err, http.StatusBadRequest, "凭据检查")
+			return
+		} else if blocked != "" {
+			w.Header().Set("X-Proxy-Guardrail", blocked)
+			choices = append(choices, completionChoice(i, "", "content_filter"))
+			continue
+		}
+
+		fimReq := req.toFIMRequest(ps.config.FIMModel, screened.Messages[0].Content, screened.Messages[1].Content, requestID)
+		ps.stats.RecordModel(req.Model)
+		recordRequest(r.Context(), requestID, req.Model, req.User)
+
+		if req.Stream {
+			defer ps.stats.BeginStream(requestID, req.Model, getClientIP(r))()
+			ps.streamCompletion(w, r, req, prompt, requestID, func(ctx context.Context) (*http.Response, error) {
+				return ps.postUpstream(ctx, "/beta/completions", fimReq, true, requestID)
+			})
+			return
+		}
+
+		fimResp, err := ps.sendBetaCompletion(r.Context(), fimReq, requestID)
+		if err != nil {
+			if r.Context().Err() != nil {
+				log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+				return
+			}
+			ps.handleUpstreamError(w, fmt.Errorf("DeepSeek请求失败: %w", err), "DeepSeek通信")
+			return
+		}
+		recordUsage(r.Context(), fimResp.Usage)
+
+		text, finishReason := "", "stop"
+		if len(fimResp.Choices) > 0 {
+			text, finishReason = fimResp.Choices[0].Text, fimResp.Choices[0].FinishReason
+		}
+		if ps.guardrails != nil && ps.guardrails.hasOutput {
+			filtered, blocked := ps.guardrails.filter(text, "output")
+			if blocked != "" {
+				log.Printf("[%s] 响应命中内容过滤规则，已拦截", requestID)
+				ps.guardrails.recordBlock(requestID, "output", blocked)
+				filtered, finishReason = "", "content_filter"
+			}
+			text = filtered
+		}
+		if req.Echo {
+			text = prompt + text
+		}
+		choices = append(choices, completionChoice(i, text, finishReason))
+		usage.PromptTokens += fimResp.Usage.PromptTokens
+		usage.CompletionTokens += fimResp.Usage.CompletionTokens
+		usage.TotalTokens += fimResp.Usage.TotalTokens
+	}
+
+	writeCompletionResponse(w, req.Model, created, choices, usage, requestID)
+}
+
+// sendBetaCompletion 向DeepSeek beta补全接口发送非流式请求
+func (ps *ProxyServer) sendBetaCompletion(ctx context.Context, req *fimRequest, requestID string) (*fimResponse, error) {
+	resp, err := ps.postUpstream(ctx, "/beta/completions", req, false, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var fimResp fimResponse
+	if err := decodeUpstreamJSON(resp, &fimResp, requestID); err != nil {
+		return nil, fmt.Errorf("解析DeepSeek响应失败: %w", err)
+	}
+	return &fimResp, nil
+}
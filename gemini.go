@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Google Gemini generateContent兼容层
+// /v1beta/models/{model}:generateContent、:streamGenerateContent和:countTokens
+// 接收Gemini格式的contents/parts请求，转换为ChatRequest后与/v1/chat/completions共用同一套处理流程，
+// 再把DeepSeek的响应转换为candidates格式。流式响应带alt=sse时以SSE发送，否则以JSON数组发送
+
+// geminiRequest Gemini格式的请求
+type geminiRequest struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	GenerationConfig  *struct {
+		Temperature     *float64 `json:"temperature,omitempty"`
+		MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+		StopSequences   []string `json:"stopSequences,omitempty"`
+		CandidateCount  int      `json:"candidateCount,omitempty"`
+		ThinkingConfig  *struct {
+			IncludeThoughts bool `json:"includeThoughts"`
+		} `json:"thinkingConfig,omitempty"`
+	} `json:"generationConfig,omitempty"`
+	Tools []struct {
+		FunctionDeclarations []struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description,omitempty"`
+			Parameters  json.RawMessage `json:"parameters,omitempty"`
+		} `json:"functionDeclarations,omitempty"`
+	} `json:"tools,omitempty"`
+	ToolConfig *struct {
+		FunctionCallingConfig struct {
+			Mode                 string   `json:"mode"` // AUTO、ANY或NONE
+			AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+		} `json:"functionCallingConfig"`
+	} `json:"toolConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"` // user、model，旧版本的函数结果使用function
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       json.RawMessage         `json:"inlineData,omitempty"`
+	FileData         json.RawMessage         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// includeThoughts 客户端是否请求返回思考过程
+func (req *geminiRequest) includeThoughts() bool {
+	return req.GenerationConfig != nil && req.GenerationConfig.ThinkingConfig != nil &&
+		req.GenerationConfig.ThinkingConfig.IncludeThoughts
+}
+
+// geminiPartsText 拼接普通文本part，图片和文件替换为占位说明，思考过程不再发回上游
+func geminiPartsText(parts []geminiPart) (string, bool) {
+	var texts []string
+	for _, part := range parts {
+		switch {
+		case part.Thought:
+		case part.Text != "":
+			texts = append(texts, part.Text)
+		case len(part.InlineData) > 0 || len(part.FileData) > 0:
+			texts = append(texts, "[图片或文件内容已省略：上游模型不支持]")
+		}
+	}
+	return strings.Join(texts, "\n"), len(texts) > 0
+}
+
+// toChatRequest 把Gemini请求转换为OpenAI格式的ChatRequest
+// Gemini的函数调用没有必填的ID，这里为每个调用生成ID，并按函数名依次对应后续的函数结果
+func (req *geminiRequest) toChatRequest(model string, stream bool, requestID string) (*ChatRequest, error) {
+	chatReq := &ChatRequest{Model: model, Stream: stream}
+	if config := req.GenerationConfig; config != nil {
+		chatReq.Temperature = config.Temperature
+		if config.MaxOutputTokens > 0 {
+			maxTokens := config.MaxOutputTokens
+			chatReq.MaxTokens = &maxTokens
+		}
+		if len(config.StopSequences) > 0 {
+			log.Printf("[%s] 忽略stopSequences：上游不支持", requestID)
+		}
+		if config.CandidateCount > 1 {
+			log.Printf("[%s] 忽略candidateCount=%d：只返回一个候选", requestID, config.CandidateCount)
+		}
+	}
+
+	if req.SystemInstruction != nil {
+		if system, ok := geminiPartsText(req.SystemInstruction.Parts); ok {
+			chatReq.Messages = append(chatReq.Messages, Message{Role: "system", Content: system})
+		}
+	}
+
+	pending := make(map[string][]string) // 函数名 -> 尚未收到结果的调用ID
+	for i, content := range req.Contents {
+		switch content.Role {
+		case "model":
+			text, _ := geminiPartsText(content.Parts)
+			reply := Message{Role: "assistant", Content: text}
+			for j, part := range content.Parts {
+				if part.FunctionCall == nil {
+					continue
+				}
+				call := ToolCall{ID: part.FunctionCall.ID, Type: "function"}
+				if call.ID == "" {
+					call.ID = fmt.Sprintf("call_%d_%d", i, j)
+				}
+				call.Function.Name = part.FunctionCall.Name
+				call.Function.Arguments = string(part.FunctionCall.Args)
+				if len(part.FunctionCall.Args) == 0 {
+					call.Function.Arguments = "{}"
+				}
+				pending[call.Function.Name] = append(pending[call.Function.Name], call.ID)
+				reply.ToolCalls = append(reply.ToolCalls, call)
+			}
+			chatReq.Messages = append(chatReq.Messages, reply)
+
+		case "user", "function", "":
+			for _, part := range content.Parts {
+				result := part.FunctionResponse
+				if result == nil {
+					continue
+				}
+				id := result.ID
+				if ids := pending[result.Name]; id == "" && len(ids) > 0 {
+					id, pending[result.Name] = ids[0], ids[1:]
+				}
+				if id == "" {
+					id = "call_" + result.Name
+				}
+				response := string(result.Response)
+				if len(result.Response) == 0 {
+					response = "{}"
+				}
+				chatReq.Messages = append(chatReq.Messages, Message{Role: "tool", ToolCallID: id, Content: response})
+			}
+			if text, ok := geminiPartsText(content.Parts); ok {
+				chatReq.Messages = append(chatReq.Messages, Message{Role: "user", Content: text})
+			}
+
+		default:
+			return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+				Message: fmt.Sprintf("contents[%d].role只能是user或model", i), Param: "contents"}
+		}
+	}
+
+	for _, tool := range req.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			var schema interface{} = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+			if len(decl.Parameters) > 0 {
+				if err := json.Unmarshal(decl.Parameters, &schema); err != nil {
+					return nil, &apiError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+						Message: fmt.Sprintf("函数 %s 的parameters无效", decl.Name), Param: "tools"}
+				}
+			}
+			chatReq.Tools = append(chatReq.Tools, Tool{
+				Type:     "function",
+				Function: Function{Name: decl.Name, Description: decl.Description, Parameters: schema},
+			})
+		}
+	}
+
+	if req.ToolConfig != nil {
+		config := req.ToolConfig.FunctionCallingConfig
+		switch strings.ToUpper(config.Mode) {
+		case "NONE":
+			chatReq.ToolChoice = "none"
+		case "ANY":
+			chatReq.ToolChoice = "required"
+			if len(config.AllowedFunctionNames) == 1 {
+				chatReq.ToolChoice = map[string]interface{}{
+					"type":     "function",
+					"function": map[string]interface{}{"name": config.AllowedFunctionNames[0]},
+				}
+			}
+		case "AUTO":
+			chatReq.ToolChoice = "auto"
+		}
+	}
+	return chatReq, nil
+}
+
+// geminiFinishReason 将finish_reason映射为Gemini的finishReason
+func geminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+// geminiStatus 将HTTP状态码映射为Google API的错误状态
+func geminiStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return "INTERNAL"
+	}
+	return "FAILED_PRECONDITION"
+}
+
+// geminiError 解析错误对应的状态码和信息，带状态码的apiError和上游错误沿用其状态码
+func (ps *ProxyServer) geminiError(w http.ResponseWriter, err error, statusCode int) map[string]interface{} {
+	message := err.Error()
+	if apiErr, ok := asAPIError(err); ok {
+		statusCode, message = apiErr.StatusCode, apiErr.Message
+	}
+	var upstreamErr *upstreamError
+	var saturated *saturatedError
+	switch {
+	case errors.As(err, &upstreamErr):
+		apiErr := upstreamAPIError(upstreamErr)
+		statusCode, message = apiErr.StatusCode, apiErr.Message
+		if upstreamErr.StatusCode == http.StatusTooManyRequests {
+			setRateLimitHeaders(w, upstreamErr.Header, ps.config)
+		}
+	case errors.Is(err, errCircuitOpen):
+		statusCode = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(int(ps.breaker.RetryAfter().Seconds())+1))
+	case errors.As(err, &saturated):
+		statusCode, message = saturated.StatusCode, saturated.Message
+		saturated.setHeaders(w, ps.config)
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{"code": statusCode, "message": message, "status": geminiStatus(statusCode)},
+	}
+}
+
+// writeGeminiError 输出Google API格式的错误响应 {"error":{"code","message","status"}}
+func (ps *ProxyServer) writeGeminiError(w http.ResponseWriter, err error, statusCode int, context string) {
+	log.Printf("错误 [%s]: %v", context, err)
+	body := ps.geminiError(w, err, statusCode)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(body["error"].(map[string]interface{})["code"].(int))
+	if err := writeJSONResponse(w, body); err != nil {
+		log.Printf("写入错误响应失败: %v", err)
+	}
+}
+
+// handleGemini 处理 /v1beta/models/{model}:{method}
+func (ps *ProxyServer) handleGemini(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	model, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta/models/"), ":")
+	if !ok || model == "" {
+		ps.writeGeminiError(w, fmt.Errorf("未知的路径: %s", r.URL.Path), http.StatusNotFound, "Gemini路由")
+		return
+	}
+	if r.Method != "POST" {
+		ps.writeGeminiError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var req geminiRequest
+	if err := readJSONRequest(r, &req); err != nil {
+		ps.writeGeminiError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+
+	switch method {
+	case "generateContent":
+		ps.geminiGenerate(w, r, &req, model, false, requestID)
+	case "streamGenerateContent":
+		ps.geminiGenerate(w, r, &req, model, true, requestID)
+	case "countTokens":
+		chatReq, err := req.toChatRequest(model, false, requestID)
+		if err != nil {
+			ps.writeGeminiError(w, err, http.StatusBadRequest, "请求转换")
+			return
+		}
+		systemRules := ps.systemPrompts.Resolve(clientAPIKey(r), model, mapNewModelsToDeepSeek(model))
+		messages := convertMessagesFormat(chatReq.Messages, systemRules)
+		writeJSONResponse(w, map[string]interface{}{"totalTokens": countPromptTokens(messages, chatReq.Tools)})
+	default:
+		ps.writeGeminiError(w, fmt.Errorf("不支持的方法: %s", method), http.StatusNotFound, "Gemini路由")
+	}
+}
+
+// geminiGenerate 处理generateContent和streamGenerateContent
+func (ps *ProxyServer) geminiGenerate(w http.ResponseWriter, r *http.Request, req *geminiRequest, model string, stream bool, requestID string) {
+	chatReq, err := req.toChatRequest(model, stream, requestID)
+	if err != nil {
+		ps.writeGeminiError(w, err, http.StatusBadRequest, "请求转换")
+		return
+	}
+	log.Printf("[%s] Gemini请求: 模型 %s，%d 条消息，%d 个工具", requestID, model, len(chatReq.Messages), len(chatReq.Tools))
+
+	blocked, err := ps.screenInput(chatReq, requestID)
+	if err != nil {
+		ps.writeGeminiError(w, err, http.StatusBadRequest, "凭据检查")
+		return
+	}
+	if blocked != "" {
+		w.Header().Set("X-Proxy-Guardrail", blocked)
+		if err := writeJSONResponse(w, geminiResponse(&DeepSeekResponse{
+			Choices: []DeepSeekChoice{{FinishReason: "content_filter"}},
+		}, model, false, requestID)); err != nil {
+			log.Printf("[%s] 写入响应失败: %v", requestID, err)
+		}
+		return
+	}
+
+	deepseekReq, err := ps.buildUpstreamRequest(r, chatReq, requestID)
+	if err != nil {
+		ps.writeGeminiError(w, err, http.StatusInternalServerError, "请求转换")
+		return
+	}
+
+	if stream {
+		defer ps.stats.BeginStream(requestID, model, getClientIP(r))()
+		ps.streamGeminiResponse(w, r, deepseekReq, req, model, requestID)
+		return
+	}
+
+	deepseekResp, err := ps.fetchCompletion(w, r.Context(), deepseekReq, requestID)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+			return
+		}
+		ps.writeGeminiError(w, fmt.Errorf("DeepSeek请求失败: %w", err), http.StatusBadGateway, "DeepSeek通信")
+		return
+	}
+	recordUsage(r.Context(), deepseekResp.Usage)
+	deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+	if err := writeJSONResponse(w, geminiResponse(deepseekResp, model, req.includeThoughts(), requestID)); err != nil {
+		log.Printf("[%s] 写入响应失败: %v", requestID, err)
+	}
+}
+
+// geminiParts 把一条回复转换为Gemini的parts
+func geminiParts(msg Message, thoughts bool, requestID string) []map[string]interface{} {
+	parts := []map[string]interface{}{}
+	if thoughts && msg.ReasoningContent != "" {
+		parts = append(parts, map[string]interface{}{"text": msg.ReasoningContent, "thought": true})
+	}
+	if msg.Content != "" {
+		parts = append(parts, map[string]interface{}{"text": msg.Content})
+	}
+	for _, call := range msg.ToolCalls {
+		args := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(args) {
+			log.Printf("[%s] 函数 %s 的参数不是有效的JSON，按空对象返回", requestID, call.Function.Name)
+			args = json.RawMessage("{}")
+		}
+		parts = append(parts, map[string]interface{}{
+			"functionCall": map[string]interface{}{"id": call.ID, "name": call.Function.Name, "args": args},
+		})
+	}
+	return parts
+}
+
+// geminiUsage Gemini格式的用量
+func geminiUsage(usage Usage) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"promptTokenCount":     usage.PromptTokens,
+		"candidatesTokenCount": usage.CompletionTokens,
+		"totalTokenCount":      usage.TotalTokens,
+	}
+	if usage.PromptCacheHitTokens > 0 {
+		metadata["cachedContentTokenCount"] = usage.PromptCacheHitTokens
+	}
+	if usage.CompletionTokensDetails != nil {
+		metadata["thoughtsTokenCount"] = usage.CompletionTokensDetails.ReasoningTokens
+	}
+	return metadata
+}
+
+// geminiResponse 把完整响应转换为Gemini的GenerateContentResponse
+func geminiResponse(resp *DeepSeekResponse, model string, thoughts bool, requestID string) map[string]interface{} {
+	var choice DeepSeekChoice
+	if len(resp.Choices) > 0 {
+		choice = resp.Choices[0]
+	}
+	return map[string]interface{}{
+		"candidates": []interface{}{map[string]interface{}{
+			"content":      map[string]interface{}{"role": "model", "parts": geminiParts(choice.Message, thoughts, requestID)},
+			"finishReason": geminiFinishReason(choice.FinishReason),
+			"index":        0,
+		}},
+		"usageMetadata": geminiUsage(resp.Usage),
+		"modelVersion":  model,
+		"responseId":    requestID,
+	}
+}
+
+// geminiStream 以SSE或JSON数组发送Gemini流式响应
+type geminiStream struct {
+	w       io.Writer
+	flusher http.Flusher
+	sse     bool
+	count   int // 已发送的数据块数量，JSON数组需要据此输出分隔符
+}
+
+func (s *geminiStream) send(data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	switch {
+	case s.sse:
+		fmt.Fprintf(s.w, "data: %s\r\n\r\n", payload)
+	case s.count == 0:
+		fmt.Fprintf(s.w, "[%s", payload)
+	default:
+		fmt.Fprintf(s.w, ",\r\n%s", payload)
+	}
+	s.count++
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// close 结束JSON数组
+func (s *geminiStream) close() {
+	if s.sse {
+		return
+	}
+	if s.count == 0 {
+		fmt.Fprint(s.w, "[")
+	}
+	fmt.Fprint(s.w, "]")
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// streamGeminiResponse 以流式请求上游，把文本增量逐块转发
+// Gemini的函数调用必须完整返回，工具调用的增量拼接完成后随最后一个数据块发送
+func (ps *ProxyServer) streamGeminiResponse(w http.ResponseWriter, r *http.Request,
+	deepseekReq *DeepSeekRequest, req *geminiRequest, model, requestID string) {
+
+	ctx, cancel := ps.newStreamContext(r.Context())
+	defer cancel()
+
+	resp, err := ps.sendStreamingRequestToDeepSeek(ctx, deepseekReq, requestID)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("[%s] 客户端在上游响应前断开连接: %v", requestID, err)
+			return
+		}
+		ps.writeGeminiError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err), http.StatusBadGateway, "DeepSeek流式通信")
+		return
+	}
+	defer resp.Body.Close()
+
+	s := &geminiStream{w: w, sse: r.URL.Query().Get("alt") == "sse"}
+	s.flusher, _ = w.(http.Flusher)
+	if s.sse {
+		setSSEHeaders(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	thoughts := req.includeThoughts()
+	collected := &DeepSeekResponse{}
+	choices := make(map[int]*DeepSeekChoice)
+	result := ps.consumeUpstreamStream(ctx, resp.Body, w, s.flusher, requestID, func(chunk *deepSeekStreamChunk) {
+		mergeStreamChunk(collected, choices, chunk)
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			parts := geminiParts(Message{Content: choice.Delta.Content, ReasoningContent: choice.Delta.ReasoningContent}, thoughts, requestID)
+			if len(parts) > 0 {
+				s.send(map[string]interface{}{
+					"candidates":   []interface{}{map[string]interface{}{"content": map[string]interface{}{"role": "model", "parts": parts}, "index": 0}},
+					"modelVersion": model,
+					"responseId":   requestID,
+				})
+			}
+		}
+	})
+
+	switch {
+	case result.done:
+		var toolCalls []ToolCall
+		if choice, ok := choices[0]; ok && !result.blocked {
+			toolCalls = choice.Message.ToolCalls
+		}
+		parts := geminiParts(Message{ToolCalls: toolCalls}, false, requestID)
+		if len(parts) == 0 {
+			parts = append(parts, map[string]interface{}{"text": ""})
+		}
+		s.send(map[string]interface{}{
+			"candidates": []interface{}{map[string]interface{}{
+				"content":      map[string]interface{}{"role": "model", "parts": parts},
+				"finishReason": geminiFinishReason(result.finishReason),
+				"index":        0,
+			}},
+			"usageMetadata": geminiUsage(result.usage),
+			"modelVersion":  model,
+			"responseId":    requestID,
+		})
+		log.Printf("[%s] Gemini流式响应完成", requestID)
+	case result.err != nil:
+		log.Printf("[%s] 流式响应异常终止: %v", requestID, result.err)
+		s.send(ps.geminiError(w, result.err, http.StatusBadGateway))
+	}
+	s.close()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// guardrailRule 一条内容过滤规则
+type guardrailRule struct {
+	Name        string   `json:"name"`
+	Patterns    []string `json:"patterns,omitempty"`    // 正则表达式
+	Words       []string `json:"words,omitempty"`       // 词表，不区分大小写
+	Action      string   `json:"action"`                // block：拦截；redact：替换为Replacement
+	Direction   string   `json:"direction,omitempty"`   // input、output或both（默认）
+	Replacement string   `json:"replacement,omitempty"` // redact时的替换文本，默认***
+
+	pattern *regexp.Regexp
+}
+
+// guardrails 入站和出站内容过滤
+// 命中block规则时返回finish_reason为content_filter的响应，命中redact规则时替换匹配的文本
+type guardrails struct {
+	Rules []*guardrailRule `json:"rules"`
+
+	hasOutput bool
+	audit     *auditLog // 拦截记入审计日志，为nil时不记录
+}
+
+func loadGuardrails(path string) (*guardrails, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取内容过滤规则失败: %w", err)
+	}
+	g := &guardrails{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("解析内容过滤规则失败: %w", err)
+	}
+
+	for i, rule := range g.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if rule.Action != "block" && rule.Action != "redact" {
+			return nil, fmt.Errorf("规则 %s 的action无效: %q（可选 block 或 redact）", rule.Name, rule.Action)
+		}
+		switch rule.Direction {
+		case "":
+			rule.Direction = "both"
+		case "input", "output", "both":
+		default:
+			return nil, fmt.Errorf("规则 %s 的direction无效: %q（可选 input、output 或 both）", rule.Name, rule.Direction)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "***"
+		}
+
+		pattern, err := compileRulePattern(rule.Name, rule.Patterns, rule.Words)
+		if err != nil {
+			return nil, err
+		}
+		rule.pattern = pattern
+
+		if rule.Direction != "input" {
+			g.hasOutput = true
+		}
+	}
+	return g, nil
+}
+
+// compileRulePattern 把规则的正则表达式和词表合并为一个正则，词表不区分大小写
+func compileRulePattern(name string, patterns, words []string) (*regexp.Regexp, error) {
+	alternatives := make([]string, 0, len(patterns)+len(words))
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("规则 %s 的正则表达式无效: %w", name, err)
+		}
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+	for _, word := range words {
+		if word != "" {
+			alternatives = append(alternatives, "(?i:"+regexp.QuoteMeta(word)+")")
+		}
+	}
+	if len(alternatives) == 0 {
+		return nil, fmt.Errorf("规则 %s 没有配置patterns或words", name)
+	}
+	return regexp.MustCompile(strings.Join(alternatives, "|")), nil
+}
+
+// filter 对一段文本应用指定方向的规则，返回处理后的文本和命中的拦截规则名
+func (g *guardrails) filter(text, direction string) (string, string) {
+	if text == "" {
+		return text, ""
+	}
+	for _, rule := range g.Rules {
+		if rule.Direction != "both" && rule.Direction != direction {
+			continue
+		}
+		if !rule.pattern.MatchString(text) {
+			continue
+		}
+		if rule.Action == "block" {
+			return text, rule.Name
+		}
+		text = rule.pattern.ReplaceAllLiteralString(text, rule.Replacement)
+	}
+	return text, ""
+}
+
+// recordBlock 把一次拦截记入审计日志
+func (g *guardrails) recordBlock(requestID, direction, rule string) {
+	if g == nil {
+		return
+	}
+	g.audit.Record(auditEntry{Event: "guardrail_block", RequestID: requestID, Details: map[string]string{
+		"direction": direction,
+		"rule":      rule,
+	}})
+}
+
+// FilterInput 过滤客户端消息，就地脱敏，命中拦截规则时返回规则名
+func (g *guardrails) FilterInput(messages []Message) string {
+	if g == nil {
+		return ""
+	}
+	for i := range messages {
+		content, blocked := g.filter(messages[i].Content, "input")
+		if blocked != "" {
+			return blocked
+		}
+		messages[i].Content = content
+	}
+	return ""
+}
+
+// FilterResponse 过滤完整响应，返回过滤后的副本，不修改可能被缓存或共享的原响应
+func (g *guardrails) FilterResponse(resp *DeepSeekResponse, requestID string) *DeepSeekResponse {
+	if g == nil || !g.hasOutput {
+		return resp
+	}
+	filtered := *resp
+	filtered.Choices = make([]DeepSeekChoice, len(resp.Choices))
+	for i, choice := range resp.Choices {
+		content, blockedContent := g.filter(choice.Message.Content, "output")
+		reasoning, blockedReasoning := g.filter(choice.Message.ReasoningContent, "output")
+		if blocked := blockedContent + blockedReasoning; blocked != "" {
+			log.Printf("[%s] 响应命中内容过滤规则，已拦截", requestID)
+			g.recordBlock(requestID, "output", blocked)
+			choice.Message.Content, choice.Message.ReasoningContent = "", ""
+			choice.Message.ToolCalls = nil
+			choice.FinishReason = "content_filter"
+		} else {
+			choice.Message.Content, choice.Message.ReasoningContent = content, reasoning
+		}
+		filtered.Choices[i] = choice
+	}
+	return &filtered
+}
+
+// guardrailStream 流式响应的过滤状态
+// 脱敏只能作用于单个数据块内的文本；拦截按累计的全部文本判断，命中后结束流
+type guardrailStream struct {
+	g         *guardrails
+	requestID string
+	text      map[float64]*strings.Builder
+}
+
+// NewStream 为一个流式响应创建过滤状态，没有出站规则时返回nil
+func (g *guardrails) NewStream(requestID string) *guardrailStream {
+	if g == nil || !g.hasOutput {
+		return nil
+	}
+	return &guardrailStream{g: g, requestID: requestID, text: make(map[float64]*strings.Builder)}
+}
+
+// FilterChunk 就地过滤一个OpenAI格式的数据块，命中拦截规则时把数据块改写为content_filter结束块并返回true
+func (s *guardrailStream) FilterChunk(chunk map[string]interface{}) bool {
+	if s == nil {
+		return false
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	for _, item := range choices {
+		choice, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// beta补全接口的数据块没有delta，文本直接放在text字段
+		delta, fields := choice, []string{"text"}
+		if d, ok := choice["delta"].(map[string]interface{}); ok {
+			delta, fields = d, []string{"reasoning_content", "content"}
+		}
+		index, _ := choice["index"].(float64)
+		accumulated, ok := s.text[index]
+		if !ok {
+			accumulated = &strings.Builder{}
+			s.text[index] = accumulated
+		}
+
+		for _, field := range fields {
+			text, ok := delta[field].(string)
+			if !ok || text == "" {
+				continue
+			}
+			filtered, _ := s.g.filter(text, "output")
+			delta[field] = filtered
+			accumulated.WriteString(text)
+		}
+		if _, blocked := s.g.filter(accumulated.String(), "output"); blocked != "" {
+			s.g.recordBlock(s.requestID, "output", blocked)
+			chunk["choices"] = []interface{}{map[string]interface{}{
+				"index":         choice["index"],
+				"delta":         map[string]interface{}{},
+				"finish_reason": "content_filter",
+			}}
+			return true
+		}
+	}
+	return false
+}
+
+// FilterData 过滤一行OpenAI格式的流式数据，返回过滤后的JSON
+// 供需要先过滤再转换为其他协议格式的兼容端点使用，命中拦截规则时返回true
+func (s *guardrailStream) FilterData(data string) (string, bool) {
+	if s == nil {
+		return data, false
+	}
+	var chunk map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return data, false
+	}
+	if s.FilterChunk(chunk) {
+		return "", true
+	}
+	filtered, err := json.Marshal(chunk)
+	if err != nil {
+		return data, false
+	}
+	return string(filtered), false
+}
+
+// writeContentFilterResponse 请求命中拦截规则时返回空内容、finish_reason为content_filter的响应
+func writeContentFilterResponse(w http.ResponseWriter, stream bool, model, requestID string) {
+	id := "chatcmpl-" + requestID
+	created := time.Now().Unix()
+	if !stream {
+		if err := writeJSONResponse(w, map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   model,
+			"choices": []interface{}{map[string]interface{}{
+				"index":         0,
+				"message":       map[string]interface{}{"role": "assistant", "content": ""},
+				"finish_reason": "content_filter",
+			}},
+			"usage": Usage{},
+		}); err != nil {
+			log.Printf("[%s] 写入内容过滤响应失败: %v", requestID, err)
+		}
+		return
+	}
+
+	setSSEHeaders(w)
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"delta":         map[string]interface{}{"role": "assistant", "content": ""},
+			"finish_reason": "content_filter",
+		}},
+	})
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -6,44 +6,46 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// convertToOpenAIResponse 专为Cursor优化的响应转换
-func (ps *ProxyServer) convertToOpenAIResponse(deepseekResp *DeepSeekResponse, originalModel, requestID string) map[string]interface{} {
-	log.Printf("[%s] 转换响应格式（Cursor兼容模式）", requestID)
+// convertToOpenAIResponse 转换非流式响应，推理内容按客户端配置的呈现方式处理
+func (ps *ProxyServer) convertToOpenAIResponse(ctx context.Context, deepseekResp *DeepSeekResponse, originalModel, requestID string) map[string]interface{} {
+	mode := clientProfileFor(ctx).reasoningMode(false)
+	log.Printf("[%s] 转换响应格式（推理内容: %s）", requestID, mode)
 
 	var processedChoices []interface{}
 
 	for _, choice := range deepseekResp.Choices {
-		// Cursor兼容性：合并推理内容到主内容
-		finalContent := choice.Message.Content
-		
-		// 如果有推理内容，追加到主内容（而不是单独字段）
-		if choice.Message.ReasoningContent != "" {
-			finalContent = choice.Message.ReasoningContent + "\n\n" + choice.Message.Content
-			log.Printf("[%s] 合并推理内容到主回复，长度: %d字符", requestID, len(finalContent))
-		}
+		reasoning, finalContent := foldReasoning(mode, choice.Message.ReasoningContent, choice.Message.Content)
 
 		processedChoice := map[string]interface{}{
 			"index":         choice.Index,
 			"finish_reason": choice.FinishReason,
 			"message": map[string]interface{}{
 				"role":    choice.Message.Role,
-				"content": finalContent, // 使用合并后的内容
+				"content": finalContent,
 			},
 		}
+		if reasoning != "" {
+			processedChoice["message"].(map[string]interface{})["reasoning_content"] = reasoning
+		}
 
 		// 工具调用处理
 		if len(choice.Message.ToolCalls) > 0 {
 			processedChoice["message"].(map[string]interface{})["tool_calls"] = choice.Message.ToolCalls
 		}
+		if choice.Message.FunctionCall != nil {
+			processedChoice["message"].(map[string]interface{})["function_call"] = choice.Message.FunctionCall
+		}
 
 		processedChoices = append(processedChoices, processedChoice)
 	}
@@ -55,34 +57,26 @@ func (ps *ProxyServer) convertToOpenAIResponse(deepseekResp *DeepSeekResponse, o
 		"created": deepseekResp.Created,
 		"model":   originalModel, // 保持客户端请求的模型名
 		"choices": processedChoices,
-		"usage":   deepseekResp.Usage,
+		"usage":   deepseekResp.openAIUsage(),
 	}
 
-	log.Printf("[%s] Cursor兼容响应转换完成", requestID)
 	return openaiResp
 }
 
-// 新增：Cursor特定的错误处理
-func (ps *ProxyServer) handleCursorError(w http.ResponseWriter, err error, requestID string) {
-	log.Printf("[%s] Cursor兼容错误处理: %v", requestID, err)
-	
-	// Cursor期望的标准错误格式
-	errorResponse := map[string]interface{}{
-		"error": map[string]interface{}{
-			"message": "服务暂时不可用，请稍后重试",
-			"type":    "service_unavailable",
-			"code":    "503",
-		},
+// handleClientError 按客户端配置的错误风格返回错误
+// retry风格的客户端（如Cursor）遇到503会自动重试，因此统一返回服务不可用
+func (ps *ProxyServer) handleClientError(w http.ResponseWriter, r *http.Request, err error, statusCode int, context string) {
+	if !clientProfileFor(r.Context()).retryErrors() {
+		handleError(w, err, statusCode, context)
+		return
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusServiceUnavailable)
-	writeJSONResponse(w, errorResponse)
+	log.Printf("[%s] %s失败，按客户端配置返回503: %v", requestIDFor(r), context, err)
+	apiErr := newAPIError(http.StatusServiceUnavailable, "服务暂时不可用，请稍后重试")
+	apiErr.Code = "service_unavailable"
+	writeAPIError(w, apiErr)
 }
 
-// 修改：主处理函数添加Cursor检测
 func (ps *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	logRequest(r, "聊天完成")
 	ps.handleCORS(w, r)
 
 	if r.Method == "OPTIONS" {
@@ -95,116 +89,199 @@ func (ps *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Cursor客户端检测
-	userAgent := r.Header.Get("User-Agent")
-	isCursor := strings.Contains(userAgent, "Cursor") || strings.Contains(userAgent, "cursor")
-	
-	requestID := generateRequestID()
-	if isCursor {
-		log.Printf("[%s] 检测到Cursor客户端，启用兼容模式", requestID)
-	}
+	requestID := requestIDFor(r)
+	profile := clientProfileFor(r.Context())
 
-	if err := validateAPIKey(r); err != nil {
-		if isCursor {
-			ps.handleCursorError(w, err, requestID)
-		} else {
-			handleError(w, err, http.StatusUnauthorized, "API密钥验证")
+	// 断线重连：客户端携带Last-Event-ID时从缓冲区继续发送
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" && ps.streams != nil {
+		if ps.resumeStream(w, r, requestID, lastEventID) {
+			return
 		}
-		return
 	}
 
 	var openaiReq ChatRequest
 	if err := readJSONRequest(r, &openaiReq); err != nil {
-		if isCursor {
-			ps.handleCursorError(w, err, requestID)
-		} else {
-			handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
-		}
+		ps.handleClientError(w, r, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+
+	// 按客户端配置限制响应长度
+	profile.applyMaxTokensCap(&openaiReq, requestID)
+
+	if blocked, err := ps.screenInput(&openaiReq, requestID); err != nil {
+		handleError(w, err, http.StatusBadRequest, "凭据检查")
+		return
+	} else if blocked != "" {
+		w.Header().Set("X-Proxy-Guardrail", blocked)
+		writeContentFilterResponse(w, openaiReq.Stream, openaiReq.Model, requestID)
 		return
 	}
 
-	// Cursor优化：限制响应大小
-	if isCursor && (openaiReq.MaxTokens == nil || *openaiReq.MaxTokens > 2000) {
-		maxTokens := 1500 // Cursor推荐限制
-		openaiReq.MaxTokens = &maxTokens
-		log.Printf("[%s] Cursor模式：限制最大tokens为%d", requestID, maxTokens)
+	// 服务端会话：历史由代理保存，客户端只发送新消息
+	var sessionKeyID string
+	var sessionMessages []Message
+	if ps.sessions != nil {
+		sessionID, err := requestSessionID(r, &openaiReq)
+		if err != nil {
+			handleError(w, err, http.StatusBadRequest, "会话")
+			return
+		}
+		if sessionID != "" {
+			sessionKeyID = sessionKey(r, sessionID)
+			history, err := ps.sessions.Load(sessionKeyID)
+			if err != nil {
+				handleError(w, err, http.StatusInternalServerError, "读取会话")
+				return
+			}
+			openaiReq.Messages = mergeSessionHistory(history, openaiReq.Messages)
+			sessionMessages = append([]Message{}, openaiReq.Messages...)
+			w.Header().Set("X-Session-ID", sessionID)
+			log.Printf("[%s] 会话 %s：历史 %d 条，合并后 %d 条消息", requestID, sessionID, len(history), len(openaiReq.Messages))
+		}
 	}
 
-	deepseekReq, err := ps.convertToDeepSeekRequest(openaiReq, requestID)
+	deepseekReq, err := ps.buildUpstreamRequest(r, &openaiReq, requestID)
 	if err != nil {
-		if isCursor {
-			ps.handleCursorError(w, err, requestID)
+		if _, ok := asAPIError(err); ok {
+			handleError(w, err, http.StatusInternalServerError, "请求转换")
 		} else {
-			handleError(w, fmt.Errorf("请求转换失败: %w", err), http.StatusInternalServerError, "请求转换")
+			ps.handleClientError(w, r, err, http.StatusInternalServerError, "请求转换")
+		}
+		return
+	}
+
+	if sessionKeyID != "" {
+		rec := &sessionRecorder{ResponseWriter: w}
+		defer ps.saveSessionTurn(sessionKeyID, sessionMessages, rec, requestID)
+		w = rec
+	}
+
+	// 关闭并行工具调用时，客户端提交上一个调用的结果后先返回暂存的下一个调用
+	if queued := ps.nextQueuedToolCall(r, deepseekReq, requestID); queued != nil {
+		ps.writeQueuedToolCall(w, r, queued, openaiReq.Model, requestID, openaiReq.Stream)
+		return
+	}
+
+	// 服务端工具：由代理执行工具调用，直到模型给出最终回复
+	if available := ps.serverTools.inject(deepseekReq, openaiReq.ToolChoice, clientAPIKey(r)); len(available) > 0 {
+		if openaiReq.Stream {
+			defer ps.stats.BeginStream(requestID, openaiReq.Model, getClientIP(r))()
 		}
+		ps.handleServerToolLoop(w, r, deepseekReq, available, openaiReq.Model, requestID, openaiReq.Stream)
 		return
 	}
 
 	// 处理响应
 	if openaiReq.Stream {
+		defer ps.stats.BeginStream(requestID, openaiReq.Model, getClientIP(r))()
 		ps.handleStreamingResponse(w, r, deepseekReq, openaiReq.Model, requestID)
 	} else {
-		ps.handleNormalResponse(w, deepseekReq, openaiReq.Model, requestID)
+		ps.handleNormalResponse(w, r, deepseekReq, openaiReq.Model, requestID)
 	}
 }
 
 
-// enhanceRequestHeaders 为HTTP请求添加完整的浏览器伪装头部
-// 这个函数就像为网络请求穿上一套完美的"伪装服"，让它看起来像来自真实的浏览器
-func enhanceRequestHeaders(req *http.Request) {
-	// 模拟最新版Chrome浏览器的User-Agent字符串
-	// 更新为最新的Chrome版本，增强真实性
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-
-	// 设置Accept头部，告诉服务器我们能接受什么类型的响应
-	req.Header.Set("Accept", "application/json, text/plain, */*")
-
-	// 设置语言偏好，模拟真实用户的语言环境
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-
-	// 设置编码偏好，告诉服务器我们支持的压缩方式
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-
-	// DNT表示"Do Not Track"，这是现代浏览器的标准头部
-	req.Header.Set("DNT", "1")
-
-	// 连接类型设置，keep-alive可以复用TCP连接，提高效率
-	req.Header.Set("Connection", "keep-alive")
-
-	// 这些Sec-Fetch头部是现代浏览器的安全特性，帮助服务器识别请求类型
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "cross-site")
+// screenInput 检查客户端消息中的凭据并应用入站内容过滤规则
+// 需要拒绝时返回带状态码的错误，命中内容过滤的拦截规则时返回规则名
+func (ps *ProxyServer) screenInput(req *ChatRequest, requestID string) (string, error) {
+	if err := ps.checkSecrets(req, requestID); err != nil {
+		return "", err
+	}
+	if blocked := ps.guardrails.FilterInput(req.Messages); blocked != "" {
+		log.Printf("[%s] 请求命中内容过滤规则 %s，已拦截", requestID, blocked)
+		ps.guardrails.recordBlock(requestID, "input", blocked)
+		return blocked, nil
+	}
+	return "", nil
+}
 
-	// 添加Cache-Control头部，模拟浏览器的缓存行为
-	req.Header.Set("Cache-Control", "no-cache")
+// buildUpstreamRequest 套用提示词模板、注入系统提示词并转换为DeepSeek请求，
+// 再按配置修剪对话和检查上下文长度。各兼容端点把请求转换为ChatRequest后共用这一步
+func (ps *ProxyServer) buildUpstreamRequest(r *http.Request, req *ChatRequest, requestID string) (*DeepSeekRequest, error) {
+	deepseekReq, err := ps.transformRequest(r, req, requestID)
+	if err != nil {
+		return nil, err
+	}
 
-	// 添加一个随机的请求ID，模拟真实应用程序的行为
-	req.Header.Set("X-Request-ID", generateRandomRequestID())
+	ps.stats.RecordModel(req.Model)
+	recordRequest(r.Context(), requestID, req.Model, req.User)
+	if sessionID := req.SessionID; sessionID != "" {
+		recordSession(r.Context(), sessionID)
+	} else if sessionID := r.Header.Get("X-Session-ID"); sessionID != "" {
+		recordSession(r.Context(), sessionID)
+	}
+	return deepseekReq, nil
+}
 
-	// 添加Referer头部，让请求看起来像是从一个合法的网页发起的
-	req.Header.Set("Referer", "https://chat.deepseek.com/")
+// transformRequest 完成请求转换但不记录统计，/v1/debug/transform 用它预览发往DeepSeek的请求
+func (ps *ProxyServer) transformRequest(r *http.Request, req *ChatRequest, requestID string) (*DeepSeekRequest, error) {
+	if ps.templates != nil {
+		if err := ps.templates.Apply(req, requestID); err != nil {
+			return nil, err
+		}
+	}
 
-	// 添加Origin头部，进一步增强请求的可信度
-	req.Header.Set("Origin", "https://chat.deepseek.com")
+	// 金丝雀发布或A/B分流时按分到的模型转换，响应中仍使用客户端请求的模型名
+	converted := *req
+	if target, group := ps.canary.Assign(r, req, requestID); group != "" {
+		recordCanaryGroup(r.Context(), group)
+		if target != "" {
+			converted.Model = target
+		}
+	} else if arm := ps.modelSplits.Assign(r, req, requestID); arm != "" {
+		converted.Model = arm
+		recordSplitArm(r.Context(), arm)
+	}
+	owner := tenantFor(r.Context())
+	if target := owner.mapModel(req.Model); target != "" {
+		converted.Model = target
+	}
+	systemRules := ps.systemPrompts.Resolve(clientAPIKey(r), req.Model, mapNewModelsToDeepSeek(converted.Model))
+	deepseekReq, err := ps.convertToDeepSeekRequest(converted, systemRules, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("请求转换失败: %w", err)
+	}
+	if err := owner.applyLimits(deepseekReq, requestID); err != nil {
+		return nil, err
+	}
 
-	log.Printf("已应用完整的浏览器伪装头部")
+	ps.applySlidingWindow(r.Context(), deepseekReq, requestID)
+	if err := ps.enforceContextLimit(deepseekReq, requestID); err != nil {
+		return nil, err
+	}
+	return deepseekReq, nil
 }
 
-// generateRandomRequestID 生成一个随机的请求ID
-// 这模拟了真实应用程序为每个请求分配唯一标识符的行为
-func generateRandomRequestID() string {
-	// 使用当前时间的纳秒部分作为随机种子，确保每次生成的ID都不同
-	rand.Seed(time.Now().UnixNano())
-
-	// 生成一个16位的随机十六进制字符串，这是常见的请求ID格式
-	const chars = "0123456789abcdef"
-	result := make([]byte, 16)
-	for i := range result {
-		result[i] = chars[rand.Intn(len(chars))]
+// browserUserAgent 伪装浏览器时默认使用的User-Agent
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// setUpstreamHeaders 设置发往DeepSeek的请求的User-Agent，UPSTREAM_BROWSER_HEADERS开启时附加浏览器伪装头部
+// 流式和非流式请求、后台探测使用同一套头部，最后附加UPSTREAM_HEADERS配置的头部
+func setUpstreamHeaders(req *http.Request, config *ProxyConfig) {
+	userAgent := config.UpstreamUserAgent
+	if userAgent == "" {
+		userAgent = "DeepSeek-Proxy/1.0.0"
+		if config.UpstreamBrowserHeaders {
+			userAgent = browserUserAgent
+		}
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if config.UpstreamBrowserHeaders {
+		// 模拟从chat.deepseek.com网页发起的跨站请求
+		req.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
+		req.Header.Set("DNT", "1")
+		req.Header.Set("Sec-Fetch-Dest", "empty")
+		req.Header.Set("Sec-Fetch-Mode", "cors")
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Referer", "https://chat.deepseek.com/")
+		req.Header.Set("Origin", "https://chat.deepseek.com")
 	}
 
-	return string(result)
+	// 配置的自定义头部最后设置，可以覆盖以上默认值
+	for name, values := range config.upstreamHeaders {
+		req.Header[name] = values
+	}
 }
 
 // mapNewModelsToDeepSeek 将新的OpenAI模型映射到DeepSeek模型
@@ -225,6 +302,11 @@ func mapNewModelsToDeepSeek(requestedModel string) string {
 		"gpt-4":         "deepseek-chat",
 		"gpt-3.5-turbo": "deepseek-chat",
 
+		// 旧版文本补全模型
+		"gpt-3.5-turbo-instruct": "deepseek-chat",
+		"davinci-002":            "deepseek-chat",
+		"babbage-002":            "deepseek-chat",
+
 		// DeepSeek原生模型保持不变
 		"deepseek-chat":     "deepseek-chat",
 		"deepseek-coder":    "deepseek-coder",
@@ -236,6 +318,12 @@ func mapNewModelsToDeepSeek(requestedModel string) string {
 		return mappedModel
 	}
 
+	// Anthropic和Gemini客户端使用的模型映射到支持工具调用的对话模型
+	if strings.HasPrefix(requestedModel, "claude-") || strings.HasPrefix(requestedModel, "gemini-") {
+		log.Printf("兼容端点模型映射: %s -> deepseek-chat", requestedModel)
+		return "deepseek-chat"
+	}
+
 	// 如果没有找到映射，默认使用推理模型
 	log.Printf("未知模型 %s，默认映射到 deepseek-reasoner", requestedModel)
 	return "deepseek-reasoner"
@@ -246,7 +334,7 @@ func mapNewModelsToDeepSeek(requestedModel string) string {
 
 // convertToDeepSeekRequest 将OpenAI请求转换为DeepSeek格式
 // 这个函数是翻译过程的核心，处理两种API格式之间的所有差异
-func (ps *ProxyServer) convertToDeepSeekRequest(openaiReq ChatRequest, requestID string) (*DeepSeekRequest, error) {
+func (ps *ProxyServer) convertToDeepSeekRequest(openaiReq ChatRequest, systemRules []systemPromptRule, requestID string) (*DeepSeekRequest, error) {
 	log.Printf("[%s] 开始转换请求格式", requestID)
 
 	// 使用新的模型映射函数
@@ -262,8 +350,10 @@ func (ps *ProxyServer) convertToDeepSeekRequest(openaiReq ChatRequest, requestID
 	// 创建DeepSeek请求结构
 	deepseekReq := &DeepSeekRequest{
 		Model:    deepseekModel,
-		Messages: convertMessagesFormat(openaiReq.Messages),
+		Messages: convertMessagesFormat(openaiReq.Messages, systemRules),
 		Stream:   openaiReq.Stream,
+		User:     openaiReq.User,
+		extra:    ps.extraFields(openaiReq.Extra, requestID),
 	}
 
 	// 处理可选参数
@@ -288,12 +378,13 @@ func (ps *ProxyServer) convertToDeepSeekRequest(openaiReq ChatRequest, requestID
 		deepseekReq.MaxTokens = *openaiReq.MaxTokens
 		log.Printf("[%s] 设置最大令牌数: %d", requestID, *openaiReq.MaxTokens)
 	}
+	ps.applyReasoningEffort(openaiReq, deepseekReq, requestID)
 
 	// 处理工具调用功能
 	if len(openaiReq.Tools) > 0 {
 		deepseekReq.Tools = openaiReq.Tools
 		deepseekReq.ToolChoice = convertToolChoice(openaiReq.ToolChoice)
-		log.Printf("[%s] 设置工具: %d个工具, 选择策略: %s",
+		log.Printf("[%s] 设置工具: %d个工具, 选择策略: %v",
 			requestID, len(openaiReq.Tools), deepseekReq.ToolChoice)
 	} else if len(openaiReq.Functions) > 0 {
 		// 处理旧版本的Functions格式（向后兼容）
@@ -305,29 +396,78 @@ func (ps *ProxyServer) convertToDeepSeekRequest(openaiReq ChatRequest, requestID
 			}
 		}
 		deepseekReq.Tools = tools
-		deepseekReq.ToolChoice = convertToolChoice(openaiReq.ToolChoice)
+		if openaiReq.FunctionCall != nil {
+			deepseekReq.ToolChoice = convertFunctionCallChoice(openaiReq.FunctionCall)
+		} else {
+			deepseekReq.ToolChoice = convertToolChoice(openaiReq.ToolChoice)
+		}
+		deepseekReq.legacyFunctions = true
 		log.Printf("[%s] 转换Functions为Tools: %d个函数", requestID, len(openaiReq.Functions))
 	}
+	if len(deepseekReq.Tools) > 0 {
+		deepseekReq.ParallelToolCalls = openaiReq.ParallelToolCalls
+		ps.applyStrictTools(deepseekReq, requestID)
+	}
+
+	if err := ps.enforceParamPolicy(deepseekReq, requestID); err != nil {
+		return nil, err
+	}
+
+	if ps.config.ChatPrefixCompletion {
+		markAssistantPrefix(deepseekReq, requestID)
+	}
 
 	log.Printf("[%s] 请求转换完成", requestID)
 	return deepseekReq, nil
 }
 
+// markAssistantPrefix 对话以助手消息结尾时，把它作为回复的前缀交给DeepSeek beta接口续写
+// 模型的回复只包含续写的部分，与OpenAI、Anthropic客户端预填助手消息的用法一致
+func markAssistantPrefix(req *DeepSeekRequest, requestID string) {
+	if len(req.Messages) == 0 {
+		return
+	}
+	last := &req.Messages[len(req.Messages)-1]
+	if last.Role != "assistant" || len(last.ToolCalls) > 0 {
+		return
+	}
+	last.Prefix = true
+	req.beta = true
+	log.Printf("[%s] 对话以助手消息结尾，使用前缀续写", requestID)
+}
+
+// chatCompletionsPath 上游对话接口的路径，前缀续写需要使用beta接口
+func (req *DeepSeekRequest) chatCompletionsPath() string {
+	if req.beta {
+		return "/beta/chat/completions"
+	}
+	return "/v1/chat/completions"
+}
+
 // handleNormalResponse 处理普通（非流式）响应
 // 这种方式等待DeepSeek完全生成响应后，一次性返回给客户端
-func (ps *ProxyServer) handleNormalResponse(w http.ResponseWriter, deepseekReq *DeepSeekRequest, originalModel, requestID string) {
+func (ps *ProxyServer) handleNormalResponse(w http.ResponseWriter, r *http.Request, deepseekReq *DeepSeekRequest, originalModel, requestID string) {
 	log.Printf("[%s] 处理普通响应模式", requestID)
 
-	// 向DeepSeek发送请求
-	deepseekResp, err := ps.sendRequestToDeepSeek(deepseekReq, requestID)
+	// 向DeepSeek发送请求，客户端断开时上游请求随之取消
+	deepseekResp, err := ps.fetchCompletion(w, r.Context(), deepseekReq, requestID)
 	if err != nil {
-		handleError(w, fmt.Errorf("DeepSeek请求失败: %w", err),
-			http.StatusBadGateway, "DeepSeek通信")
+		if r.Context().Err() != nil {
+			log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+			return
+		}
+		ps.handleUpstreamError(w, fmt.Errorf("DeepSeek请求失败: %w", err), "DeepSeek通信")
 		return
 	}
 
+	deepseekResp = ps.checkToolCalls(r.Context(), deepseekReq, deepseekResp, requestID)
+	deepseekResp = ps.limitToolCalls(r, deepseekReq, deepseekResp, requestID)
+	deepseekResp = legacyFunctionCallResponse(deepseekReq, deepseekResp, requestID)
+	recordUsage(r.Context(), deepseekResp.Usage)
+	deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+
 	// 将DeepSeek响应转换为OpenAI格式
-	openaiResp := ps.convertToOpenAIResponse(deepseekResp, originalModel, requestID)
+	openaiResp := ps.convertToOpenAIResponse(r.Context(), deepseekResp, originalModel, requestID)
 
 	// 返回响应给客户端
 	w.Header().Set("Content-Type", "application/json")
@@ -339,57 +479,178 @@ func (ps *ProxyServer) handleNormalResponse(w http.ResponseWriter, deepseekReq *
 	log.Printf("[%s] 普通响应处理完成", requestID)
 }
 
-// sendRequestToDeepSeek 向DeepSeek API发送普通请求
-// 这个函数负责与DeepSeek API的实际通信，现在包含完整的浏览器伪装
-func (ps *ProxyServer) sendRequestToDeepSeek(req *DeepSeekRequest, requestID string) (*DeepSeekResponse, error) {
-	log.Printf("[%s] 向DeepSeek发送请求", requestID)
+// fetchCompletion 获取一个完整的（非流式）响应
+// 启用缓存时先查缓存并通过X-Proxy-Cache头告知客户端是否命中，
+// 未命中时按配置直接请求或以流式请求后拼装，并发的相同请求合并为一次上游调用
+func (ps *ProxyServer) fetchCompletion(w http.ResponseWriter, ctx context.Context, deepseekReq *DeepSeekRequest, requestID string) (*DeepSeekResponse, error) {
+	cached, cacheStatus, lookup := ps.lookupCache(ctx, deepseekReq, requestID)
+	if cacheStatus != "" {
+		w.Header().Set("X-Proxy-Cache", cacheStatus)
+	}
+	if cached != nil {
+		return cached, nil
+	}
 
-	reqBody, err := json.Marshal(req)
-	if err != nil {
-		return nil, fmt.Errorf("序列化请求失败: %w", err)
+	upstream := func(ctx context.Context) (*DeepSeekResponse, error) {
+		if ps.config.Destream {
+			return ps.collectStreamingResponse(ctx, deepseekReq, requestID)
+		}
+		return ps.sendRequestToDeepSeek(ctx, deepseekReq, requestID)
+	}
+
+	if ps.coalescer != nil {
+		key, err := cacheKey(deepseekReq)
+		if err == nil {
+			key = tenantScope(ctx) + key
+			deepseekResp, shared, err := ps.coalescer.Do(ctx, key, upstream)
+			if err != nil {
+				return nil, err
+			}
+			if shared {
+				// 结果已由发起调用的请求写入缓存
+				log.Printf("[%s] 合并到进行中的相同请求", requestID)
+				w.Header().Set("X-Proxy-Coalesced", "true")
+				return deepseekResp, nil
+			}
+			ps.storeCache(ctx, lookup, deepseekResp)
+			return deepseekResp, nil
+		}
+		log.Printf("[%s] 计算请求合并键失败: %v", requestID, err)
 	}
 
-	url := ps.config.Endpoint + "/v1/chat/completions"
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	deepseekResp, err := upstream(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
+		return nil, err
 	}
 
-	// 设置正确的请求头部，避免压缩问题
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+ps.config.DeepSeekAPIKey)
-	httpReq.Header.Set("User-Agent", "DeepSeek-Proxy/1.0.0")
-	httpReq.Header.Set("Accept", "application/json")
-	httpReq.Header.Set("Accept-Encoding", "gzip, deflate") // 明确支持压缩
+	ps.storeCache(ctx, lookup, deepseekResp)
+	return deepseekResp, nil
+}
 
-	client := createHTTPClient()
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("发送请求失败: %w", err)
+// upstreamError DeepSeek返回的非200响应
+// 保留状态码和响应头，便于把限流等信息按OpenAI的约定转发给客户端
+type upstreamError struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+func newUpstreamError(resp *http.Response, body []byte) *upstreamError {
+	return &upstreamError{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(body),
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("DeepSeek API返回错误 %d: %s", resp.StatusCode, string(body))
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("DeepSeek API返回错误 %d: %s", e.StatusCode, e.Body)
+}
+
+// handleUpstreamError 处理与DeepSeek通信时产生的错误
+// 熔断器打开或代理饱和时返回503/429并告知客户端何时重试，上游的错误响应按状态码映射，网络错误返回502
+func (ps *ProxyServer) handleUpstreamError(w http.ResponseWriter, err error, context string) {
+	if errors.Is(err, errCircuitOpen) {
+		retryAfter := int(ps.breaker.RetryAfter().Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		handleError(w, err, http.StatusServiceUnavailable, context)
+		return
 	}
 
-	// 核心修复：处理可能的gzip压缩响应
-	var reader io.Reader = resp.Body
+	var saturated *saturatedError
+	if errors.As(err, &saturated) {
+		saturated.setHeaders(w, ps.config)
+		log.Printf("错误 [%s]: %v", context, err)
+		writeAPIError(w, saturated.apiError())
+		return
+	}
 
-	// 检查响应是否被压缩
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzipReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("gzip解压失败: %w", err)
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		if upstreamErr.StatusCode == http.StatusTooManyRequests {
+			setRateLimitHeaders(w, upstreamErr.Header, ps.config)
+		}
+		log.Printf("错误 [%s]: %v", context, err)
+		writeAPIError(w, upstreamAPIError(upstreamErr))
+		return
+	}
+
+	handleError(w, err, http.StatusBadGateway, context)
+}
+
+// setRateLimitHeaders 按OpenAI的约定设置限流相关的响应头
+// OpenAI SDK依赖Retry-After和x-ratelimit-*头部决定退避时间，
+// 上游提供的值原样转发，缺失时补充保守的默认值；限额取自UPSTREAM_KEY_RPM和UPSTREAM_KEY_TPM
+func setRateLimitHeaders(w http.ResponseWriter, upstreamHeader http.Header, config *ProxyConfig) {
+	for key, values := range upstreamHeader {
+		if strings.HasPrefix(strings.ToLower(key), "x-ratelimit-") {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
 		}
-		defer gzipReader.Close()
-		reader = gzipReader
-		log.Printf("[%s] 已处理gzip压缩响应", requestID)
 	}
-	// 解析响应
+
+	retryAfter := upstreamHeader.Get("Retry-After")
+	if retryAfter == "" {
+		retryAfter = "1"
+	}
+	w.Header().Set("Retry-After", retryAfter)
+
+	// 上游已限流，剩余额度视为0，重置时间与Retry-After一致
+	reset := fmt.Sprintf("%ds", retryAfterSeconds(retryAfter))
+	defaults := map[string]string{
+		"x-ratelimit-remaining-requests": "0",
+		"x-ratelimit-remaining-tokens":   "0",
+		"x-ratelimit-reset-requests":     reset,
+		"x-ratelimit-reset-tokens":       reset,
+	}
+	if config.UpstreamKeyRPM > 0 {
+		defaults["x-ratelimit-limit-requests"] = strconv.Itoa(config.UpstreamKeyRPM)
+	}
+	if config.UpstreamKeyTPM > 0 {
+		defaults["x-ratelimit-limit-tokens"] = strconv.Itoa(config.UpstreamKeyTPM)
+	}
+	for key, value := range defaults {
+		if w.Header().Get(key) == "" {
+			w.Header().Set(key, value)
+		}
+	}
+}
+
+// retryAfterSeconds 把Retry-After的秒数或HTTP日期转换为秒数，无法解析时为1
+func retryAfterSeconds(value string) int {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return int(math.Ceil(seconds))
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(int(math.Ceil(time.Until(at).Seconds())), 0)
+	}
+	return 1
+}
+
+// recordUpstreamFailure 记录一次上游调用失败
+// 客户端主动断开导致的取消不是上游故障，不计入熔断统计
+func (ps *ProxyServer) recordUpstreamFailure(ctx context.Context) {
+	if ctx.Err() != nil {
+		ps.breaker.Abort()
+		return
+	}
+	ps.breaker.Record(true)
+}
+
+// sendRequestToDeepSeek 向DeepSeek API发送普通请求
+// 这个函数负责与DeepSeek API的实际通信，现在包含完整的浏览器伪装
+func (ps *ProxyServer) sendRequestToDeepSeek(ctx context.Context, req *DeepSeekRequest, requestID string) (*DeepSeekResponse, error) {
+	log.Printf("[%s] 向DeepSeek发送请求", requestID)
+
+	resp, err := ps.postChatCompletion(ctx, req, false, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
 	var deepseekResp DeepSeekResponse
-	if err := json.NewDecoder(reader).Decode(&deepseekResp); err != nil {
+	if err := decodeUpstreamJSON(resp, &deepseekResp, requestID); err != nil {
 		return nil, fmt.Errorf("解析DeepSeek响应失败: %w", err)
 	}
 
@@ -399,49 +660,109 @@ func (ps *ProxyServer) sendRequestToDeepSeek(req *DeepSeekRequest, requestID str
 
 // sendStreamingRequestToDeepSeek 向DeepSeek API发送流式请求
 // 现在也包含完整的浏览器伪装功能
-func (ps *ProxyServer) sendStreamingRequestToDeepSeek(req *DeepSeekRequest, requestID string) (*http.Response, error) {
+func (ps *ProxyServer) sendStreamingRequestToDeepSeek(ctx context.Context, req *DeepSeekRequest, requestID string) (*http.Response, error) {
 	log.Printf("[%s] 向DeepSeek发送流式请求", requestID)
 
-	// 序列化请求
-	reqBody, err := json.Marshal(req)
+	resp, err := ps.postChatCompletion(ctx, req, true, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[%s] DeepSeek流式响应开始接收", requestID)
+	return resp, nil
+}
+
+// postUpstream 向DeepSeek的指定路径发送JSON请求，经过熔断器并检查状态码
+// 成功时返回的响应体由调用方关闭；非200响应转换为upstreamError
+func (ps *ProxyServer) postUpstream(ctx context.Context, path string, payload interface{}, stream bool, requestID string) (*http.Response, error) {
+	reqBody, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("序列化请求失败: %w", err)
 	}
 
-	// 创建HTTP请求
-	url := ps.config.Endpoint + "/v1/chat/completions"
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	endpoint, apiKey := ps.routeUpstream(ctx, payload, requestID)
+	url := endpoint + path
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
 	}
 
-	// 设置基础头部
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+ps.config.DeepSeekAPIKey)
-	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	httpReq.Header.Set("X-Request-ID", requestID)
+	forwardClientRequestID(ctx, httpReq)
+	injectTraceContext(ctx, httpReq)
+	setUpstreamHeaders(httpReq, ps.config)
+	if stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	} else {
+		// 设置正确的请求头部，避免压缩问题
+		httpReq.Header.Set("Accept", "application/json")
+		httpReq.Header.Set("Accept-Encoding", "gzip, deflate") // 明确支持压缩
+	}
+
+	// 上游正在限流或密钥预算用完时直接拒绝，并发已满时按优先级排队
+	if err := ps.checkUpstreamRateLimit(apiKey); err != nil {
+		return nil, err
+	}
+	if err := ps.keyBudget.Acquire(ctx, apiKey); err != nil {
+		return nil, err
+	}
+	release := func() {}
+	if ps.scheduler != nil {
+		if err := ps.scheduler.Acquire(ctx, priorityFor(ctx), requestID); err != nil {
+			return nil, err
+		}
+		release = ps.scheduler.Release
+	}
 
-	// *** 关键改进：为流式请求也应用浏览器伪装 ***
-	enhanceRequestHeaders(httpReq)
-	log.Printf("[%s] 已为流式请求应用浏览器伪装头部", requestID)
+	if err := ps.breaker.Allow(); err != nil {
+		release()
+		return nil, err
+	}
 
-	// 发送请求
-	client := createHTTPClient()
-	resp, err := client.Do(httpReq)
+	resp, err := ps.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("发送流式请求失败: %w", err)
+		release()
+		ps.recordUpstreamFailure(ctx)
+		if stream {
+			return nil, fmt.Errorf("发送流式请求失败: %w", err)
+		}
+		return nil, fmt.Errorf("发送请求失败: %w", err)
 	}
+	ps.breaker.Record(resp.StatusCode >= http.StatusInternalServerError)
 
-	// 检查响应状态
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("DeepSeek API返回错误 %d: %s", resp.StatusCode, string(body))
+		release()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			ps.holdForRateLimit(apiKey, resp.Header)
+		}
+		return nil, newUpstreamError(resp, body)
 	}
-
-	log.Printf("[%s] DeepSeek流式响应开始接收", requestID)
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
 	return resp, nil
 }
 
+// decodeUpstreamJSON 解析上游的JSON响应
+// 核心修复：处理可能的gzip压缩响应
+func decodeUpstreamJSON(resp *http.Response, target interface{}, requestID string) error {
+	var reader io.Reader = resp.Body
+
+	// 检查响应是否被压缩
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("gzip解压失败: %w", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+		log.Printf("[%s] 已处理gzip压缩响应", requestID)
+	}
+	return json.NewDecoder(reader).Decode(target)
+}
+
 // handleStreamingResponse 处理流式响应
 // 这种方式实时传输DeepSeek的生成过程，让用户看到文字逐步出现
 func (ps *ProxyServer) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
@@ -450,10 +771,7 @@ func (ps *ProxyServer) handleStreamingResponse(w http.ResponseWriter, r *http.Re
 	log.Printf("[%s] 处理流式响应模式", requestID)
 
 	// 设置流式响应的HTTP头部
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	setSSEHeaders(w)
 
 	// 获取Flusher接口，用于实时发送数据
 	flusher, ok := w.(http.Flusher)
@@ -463,45 +781,103 @@ func (ps *ProxyServer) handleStreamingResponse(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// 伪流式模式或缓存命中时，由完整响应拆分成数据块发送；
+	// 代理需要校验strict工具的参数时也要先拿到完整响应
+	if ps.config.FakeStream || deepseekReq.strictTools {
+		ps.handleFakeStreamingResponse(w, r, flusher, deepseekReq, originalModel, requestID)
+		return
+	}
+	if cached, cacheStatus, _ := ps.lookupCache(r.Context(), deepseekReq, requestID); cacheStatus != "" {
+		w.Header().Set("X-Proxy-Cache", cacheStatus)
+		if cached != nil {
+			log.Printf("[%s] 缓存命中，以伪流式发送", requestID)
+			ps.streamCompleteResponse(r.Context(), w, flusher, cached, originalModel, requestID)
+			return
+		}
+	}
+
+	if ps.streams != nil {
+		ps.handleResumableStream(w, r, flusher, deepseekReq, originalModel, requestID)
+		return
+	}
+
+	// 创建上下文用于处理客户端断开连接，并限制整个流的最长持续时间；
+	// 上游请求同样绑定这个上下文，客户端断开后立即中止上游生成
+	ctx, cancel := ps.newStreamContext(r.Context())
+	defer cancel()
+
 	// 向DeepSeek发送流式请求
-	resp, err := ps.sendStreamingRequestToDeepSeek(deepseekReq, requestID)
+	resp, err := ps.sendStreamingRequestToDeepSeek(ctx, deepseekReq, requestID)
 	if err != nil {
-		handleError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err),
-			http.StatusBadGateway, "DeepSeek流式通信")
+		if ctx.Err() != nil {
+			log.Printf("[%s] 客户端在上游响应前断开连接: %v", requestID, err)
+			return
+		}
+		ps.handleUpstreamError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err), "DeepSeek流式通信")
 		return
 	}
 	defer resp.Body.Close()
 
-	// 创建上下文用于处理客户端断开连接
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
-
-	// 处理流式数据
-	ps.processStreamingData(w, resp.Body, flusher, originalModel, requestID, ctx)
+	// 处理流式数据；原生DeepSeek模型且无需转换时直接透传
+	if ps.canPassthrough(ctx, originalModel, deepseekReq) {
+		ps.passthroughStreamingData(w, resp.Body, flusher, requestID, ctx)
+	} else {
+		ps.processStreamingData(w, resp.Body, flusher, deepseekReq, originalModel, requestID, ctx)
+	}
 
 	log.Printf("[%s] 流式响应处理完成", requestID)
 }
 
+// setSSEHeaders 设置流式响应的HTTP头部
+func setSSEHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+}
+
 // processStreamingData 处理流式数据
 // 这个函数负责读取DeepSeek的流式响应并转换为OpenAI格式
-func (ps *ProxyServer) processStreamingData(w http.ResponseWriter, reader io.Reader,
-	flusher http.Flusher, originalModel, requestID string, ctx context.Context) {
+func (ps *ProxyServer) processStreamingData(w io.Writer, reader io.ReadCloser,
+	flusher http.Flusher, deepseekReq *DeepSeekRequest, originalModel, requestID string, ctx context.Context) {
 
 	log.Printf("[%s] 开始处理流式数据", requestID)
 
-	// 创建一个扫描器来逐行读取SSE数据
-	scanner := bufio.NewScanner(reader)
+	firstTokenTimer := startFirstTokenTimer(ps.config.FirstTokenTimeout, reader)
+	defer firstTokenTimer.Stop()
+
+	// 逐行读取SSE数据；推理内容和工具调用参数可能让单行远超64KB，
+	// 因此不使用bufio.Scanner，而是按配置的最大行长度读取
+	bufReader := bufio.NewReaderSize(reader, 64*1024)
+	var readErr error
+
+	heartbeat := startStreamHeartbeat(w, flusher, ps.config.StreamKeepAliveInterval, requestID)
+	defer heartbeat.Stop()
+
+	filter := ps.guardrails.NewStream(requestID)
+	toolCalls := newToolCallStream(requestID, deepseekReq)
+	reasoning := newReasoningStream(clientProfileFor(ctx).reasoningMode(true))
+
+readLoop:
+	for {
+		line, err := readSSELine(bufReader, ps.config.StreamMaxLineBytes)
+		heartbeat.Stop()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
 
-	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
-			log.Printf("[%s] 客户端连接已断开", requestID)
-			return
+			break readLoop
 		default:
-			line := scanner.Text()
 
 			// 处理Server-Sent Events格式
 			if strings.HasPrefix(line, "data: ") {
+				firstTokenTimer.Stop()
+
 				// 提取JSON数据部分
 				dataContent := strings.TrimPrefix(line, "data: ")
 
@@ -515,11 +891,18 @@ func (ps *ProxyServer) processStreamingData(w http.ResponseWriter, reader io.Rea
 
 				// 转换DeepSeek流式响应为OpenAI格式
 				if dataContent != "" {
-					convertedData := ps.convertStreamChunk(dataContent, originalModel, requestID)
+					convertedData, blocked := ps.convertStreamChunk(dataContent, originalModel, requestID, filter, toolCalls, reasoning)
 					if convertedData != "" {
 						fmt.Fprintf(w, "data: %s\n\n", convertedData)
 						flusher.Flush()
 					}
+					recordStreamUsage(ctx, dataContent)
+					if blocked {
+						log.Printf("[%s] 流式响应命中内容过滤规则，提前结束", requestID)
+						fmt.Fprintf(w, "data: [DONE]\n\n")
+						flusher.Flush()
+						return
+					}
 				}
 			} else if line == "" {
 				continue
@@ -530,34 +913,115 @@ func (ps *ProxyServer) processStreamingData(w http.ResponseWriter, reader io.Rea
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("[%s] 流式数据读取错误: %v", requestID, err)
+	// 走到这里说明上游没有发送[DONE]就结束了，需要告诉客户端流已异常终止，
+	// 否则客户端会一直等待结束标记
+	if streamErr := ps.abnormalStreamError(ctx, firstTokenTimer.Expired(), readErr, requestID); streamErr != nil {
+		writeStreamError(w, flusher, streamErr, requestID)
 	}
 
 	log.Printf("[%s] 流式数据处理完成", requestID)
 }
 
-// convertStreamChunk 转换单个流式数据块
-func (ps *ProxyServer) convertStreamChunk(dataContent, originalModel, requestID string) string {
+// abnormalStreamError 判断上游流没有正常结束的原因
+// 客户端已断开时返回nil，此时无需再向客户端写入任何内容
+func (ps *ProxyServer) abnormalStreamError(ctx context.Context, firstTokenExpired bool, readErr error, requestID string) error {
+	switch {
+	case firstTokenExpired:
+		return newAPIError(http.StatusGatewayTimeout,
+			fmt.Sprintf("上游在 %v 内没有返回首个数据块", ps.config.FirstTokenTimeout))
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("流式响应超过最大时长 %v", ps.config.StreamTimeout)
+	case ctx.Err() != nil:
+		log.Printf("[%s] 客户端连接已断开", requestID)
+		return nil
+	case readErr != nil:
+		log.Printf("[%s] 流式数据读取错误: %v", requestID, readErr)
+		return fmt.Errorf("读取上游流式响应失败: %w", readErr)
+	}
+	return fmt.Errorf("上游流式响应意外中断")
+}
+
+// errSSELineTooLong 上游SSE单行超过配置的最大长度
+var errSSELineTooLong = errors.New("sse数据行超过最大长度限制，请调大STREAM_MAX_LINE_BYTES")
+
+// readSSELine 读取一行SSE数据并去掉行尾的换行符
+// 超过maxBytes时返回errSSELineTooLong，而不是像bufio.Scanner那样静默截断
+func readSSELine(reader *bufio.Reader, maxBytes int) (string, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if len(line)+len(fragment) > maxBytes {
+			return "", errSSELineTooLong
+		}
+		line = append(line, fragment...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// writeStreamError 在流式响应中途发送OpenAI格式的错误事件，并以[DONE]结束
+func writeStreamError(w io.Writer, flusher http.Flusher, err error, requestID string) {
+	log.Printf("[%s] 流式响应异常终止: %v", requestID, err)
+
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		apiErr = newAPIError(http.StatusBadGateway, err.Error())
+	}
+	event := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": apiErr.Message,
+			"type":    apiErr.Type,
+			"param":   nil,
+			"code":    "stream_interrupted",
+		},
+		"request_id": requestID,
+	}
+	if apiErr.Code != "" {
+		event["error"].(map[string]interface{})["code"] = apiErr.Code
+	}
+	if data, marshalErr := json.Marshal(event); marshalErr == nil {
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// convertStreamChunk 转换单个流式数据块，整理工具调用增量，并按内容过滤规则处理
+// 命中拦截规则时返回改写后的结束块和true
+func (ps *ProxyServer) convertStreamChunk(dataContent, originalModel, requestID string, filter *guardrailStream, toolCalls *toolCallStream, reasoning *reasoningStream) (string, bool) {
 	var deepSeekChunk map[string]interface{}
 	if err := json.Unmarshal([]byte(dataContent), &deepSeekChunk); err != nil {
 		log.Printf("[%s] 解析流式数据块失败: %v", requestID, err)
-		return ""
+		return "", false
 	}
 
 	// 转换模型名称为客户端请求的原始模型名
 	if model, exists := deepSeekChunk["model"]; exists {
 		deepSeekChunk["model"] = originalModel
-		log.Printf("[%s] 转换流式块模型名: %v -> %s", requestID, model, originalModel)
+		debugf("[%s] 转换流式块模型名: %v -> %s", requestID, model, originalModel)
+	}
+
+	if usage, ok := deepSeekChunk["usage"].(map[string]interface{}); ok {
+		convertUsageMap(usage)
 	}
 
+	toolCalls.Rewrite(deepSeekChunk)
+	blocked := filter.FilterChunk(deepSeekChunk)
+	reasoning.Rewrite(deepSeekChunk)
+
 	convertedData, err := json.Marshal(deepSeekChunk)
 	if err != nil {
 		log.Printf("[%s] 序列化转换后的流式数据失败: %v", requestID, err)
-		return ""
+		return "", blocked
 	}
 
-	return string(convertedData)
+	return string(convertedData), blocked
 }
 
 // convertToOpenAIResponse 将DeepSeek响应转换为OpenAI格式
@@ -566,8 +1030,6 @@ func (ps *ProxyServer) convertStreamChunk(dataContent, originalModel, requestID
 
 // handleModels 处理模型列表请求
 func (ps *ProxyServer) handleModels(w http.ResponseWriter, r *http.Request) {
-	logRequest(r, "模型列表")
-
 	ps.handleCORS(w, r)
 	if r.Method == "OPTIONS" {
 		return
@@ -609,8 +1071,6 @@ func (ps *ProxyServer) handleModels(w http.ResponseWriter, r *http.Request) {
 
 // handleUsage 处理使用情况查询
 func (ps *ProxyServer) handleUsage(w http.ResponseWriter, r *http.Request) {
-	logRequest(r, "使用情况查询")
-
 	ps.handleCORS(w, r)
 	if r.Method == "OPTIONS" {
 		return
@@ -624,12 +1084,28 @@ func (ps *ProxyServer) handleUsage(w http.ResponseWriter, r *http.Request) {
 
 	usageResponse := map[string]interface{}{
 		"status":           "active",
-		"proxy_version":    "1.0.0",
+		"proxy_version":    Version,
 		"uptime_seconds":   time.Since(startTime).Seconds(),
 		"supported_models": GetSupportedModels(),
 		"endpoint":         ps.config.Endpoint,
 		"timestamp":        time.Now().Unix(),
 	}
+	if ps.cache != nil {
+		usageResponse["cache"] = ps.cache.Stats()
+	}
+	if ps.semanticCache != nil {
+		usageResponse["semantic_cache"] = ps.semanticCache.Stats()
+	}
+	if ps.coalescer != nil {
+		usageResponse["coalescing"] = ps.coalescer.Stats()
+	}
+	// 携带有效密钥时返回该密钥的配额状态
+	if key := clientAPIKey(r); ps.quotas != nil && ps.isClientKey(key) {
+		if status := ps.quotas.Status(key, time.Now()); status != nil {
+			status.setHeaders(w.Header())
+			usageResponse["quota"] = status
+		}
+	}
 
 	if err := writeJSONResponse(w, usageResponse); err != nil {
 		log.Printf("写入使用情况响应失败: %v", err)
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// toJSONMap 经过一次JSON序列化，按客户端看到的形式检查结果
+func toJSONMap(t *testing.T, v interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	return out
+}
+
+// firstMessage 取出非流式响应中第一个选项的消息
+func firstMessage(t *testing.T, resp map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	choices, _ := resp["choices"].([]interface{})
+	if len(choices) == 0 {
+		t.Fatalf("响应中没有choices: %v", resp)
+	}
+	message, _ := choices[0].(map[string]interface{})["message"].(map[string]interface{})
+	return message
+}
+
+func withProfile(reasoning string) context.Context {
+	return context.WithValue(context.Background(), clientProfileKey{}, &clientProfile{Reasoning: reasoning})
+}
+
+var weatherTool = Tool{Type: "function", Function: Function{
+	Name:       "get_weather",
+	Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{"city": map[string]interface{}{"type": "string"}}},
+}}
+
+func TestConvertToDeepSeekRequest(t *testing.T) {
+	ps := newTestProxy(t, "http://127.0.0.1:1")
+	temperature := 0.2
+	maxTokens := 256
+	legacyCall := &FunctionCall{Name: "get_weather", Arguments: `{"city":"北京"}`}
+
+	tests := []struct {
+		name  string
+		req   ChatRequest
+		check func(t *testing.T, got *DeepSeekRequest)
+	}{
+		{
+			name: "对话模型映射并使用默认温度",
+			req:  ChatRequest{Model: "gpt-4", Messages: []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if got.Model != "deepseek-chat" || got.Temperature != 0.7 {
+					t.Errorf("model=%s temperature=%v，期望 deepseek-chat 0.7", got.Model, got.Temperature)
+				}
+			},
+		},
+		{
+			name: "保留温度、最大令牌数、流式和用户标识",
+			req: ChatRequest{Model: "gpt-3.5-turbo", Messages: []Message{{Role: "user", Content: "你好"}},
+				Temperature: &temperature, MaxTokens: &maxTokens, Stream: true, User: "user-1"},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if got.Temperature != 0.2 || got.MaxTokens != 256 || !got.Stream || got.User != "user-1" {
+					t.Errorf("got %+v", got)
+				}
+			},
+		},
+		{
+			name: "推理模型忽略温度",
+			req:  ChatRequest{Model: "gpt-4o", Messages: []Message{{Role: "user", Content: "1+1=?"}}, Temperature: &temperature},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if got.Model != "deepseek-reasoner" || got.Temperature != 0 {
+					t.Errorf("model=%s temperature=%v，期望 deepseek-reasoner 0", got.Model, got.Temperature)
+				}
+			},
+		},
+		{
+			name: "指定函数的工具选择原样转发",
+			req: ChatRequest{Model: "gpt-4", Messages: []Message{{Role: "user", Content: "天气"}}, Tools: []Tool{weatherTool},
+				ToolChoice: map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				want := map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}
+				if len(got.Tools) != 1 || !reflect.DeepEqual(got.ToolChoice, want) {
+					t.Errorf("tools=%d tool_choice=%v", len(got.Tools), got.ToolChoice)
+				}
+			},
+		},
+		{
+			name: "未知的工具选择回退为auto",
+			req:  ChatRequest{Model: "gpt-4", Messages: []Message{{Role: "user", Content: "天气"}}, Tools: []Tool{weatherTool}, ToolChoice: "sometimes"},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if got.ToolChoice != "auto" {
+					t.Errorf("tool_choice=%v，期望auto", got.ToolChoice)
+				}
+			},
+		},
+		{
+			name: "旧版functions转换为tools",
+			req: ChatRequest{Model: "gpt-4", Messages: []Message{{Role: "user", Content: "天气"}},
+				Functions: []Function{weatherTool.Function}, FunctionCall: map[string]interface{}{"name": "get_weather"}},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if len(got.Tools) != 1 || got.Tools[0].Type != "function" || got.Tools[0].Function.Name != "get_weather" {
+					t.Errorf("tools=%+v", got.Tools)
+				}
+				if !got.legacyFunctions {
+					t.Errorf("没有标记旧版functions")
+				}
+				want := map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}
+				if !reflect.DeepEqual(got.ToolChoice, want) {
+					t.Errorf("tool_choice=%v", got.ToolChoice)
+				}
+			},
+		},
+		{
+			name: "旧版function_call消息转换为工具调用",
+			req: ChatRequest{Model: "gpt-4", Messages: []Message{
+				{Role: "user", Content: "天气"},
+				{Role: "assistant", FunctionCall: legacyCall},
+				{Role: "function", Name: "get_weather", Content: "晴"},
+			}},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if len(got.Messages) != 3 {
+					t.Fatalf("消息数 %d，期望3", len(got.Messages))
+				}
+				call, result := got.Messages[1], got.Messages[2]
+				if len(call.ToolCalls) != 1 || call.ToolCalls[0].Function.Name != "get_weather" || call.ToolCalls[0].Type != "function" {
+					t.Errorf("工具调用消息: %+v", call)
+				}
+				if result.Role != "tool" || result.ToolCallID == "" || result.ToolCallID != call.ToolCalls[0].ID {
+					t.Errorf("工具结果消息: %+v", result)
+				}
+			},
+		},
+		{
+			name: "以助手消息结尾时使用前缀续写",
+			req: ChatRequest{Model: "deepseek-chat", Messages: []Message{
+				{Role: "user", Content: "写一首诗"},
+				{Role: "assistant", Content: "床前明月光"},
+			}},
+			check: func(t *testing.T, got *DeepSeekRequest) {
+				if !got.Messages[1].Prefix || got.chatCompletionsPath() != "/beta/chat/completions" {
+					t.Errorf("prefix=%v path=%s", got.Messages[1].Prefix, got.chatCompletionsPath())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ps.convertToDeepSeekRequest(tt.req, nil, "req-test")
+			if err != nil {
+				t.Fatalf("转换失败: %v", err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestConvertToOpenAIResponse(t *testing.T) {
+	ps := newTestProxy(t, "http://127.0.0.1:1")
+	reply := func(message Message, finishReason string) *DeepSeekResponse {
+		var resp DeepSeekResponse
+		json.Unmarshal([]byte(fakeCompletion("deepseek-reasoner", message, finishReason)), &resp)
+		return &resp
+	}
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		resp          *DeepSeekResponse
+		wantContent   string
+		wantReasoning string
+		wantFinish    string
+		wantToolCalls int
+	}{
+		{
+			name:        "默认把推理内容合并到正文",
+			ctx:         context.Background(),
+			resp:        reply(Message{Role: "assistant", ReasoningContent: "先想一想", Content: "答案是2"}, "stop"),
+			wantContent: "先想一想\n\n答案是2",
+			wantFinish:  "stop",
+		},
+		{
+			name:          "客户端配置为单独字段时保留reasoning_content",
+			ctx:           withProfile(reasoningSeparate),
+			resp:          reply(Message{Role: "assistant", ReasoningContent: "先想一想", Content: "答案是2"}, "stop"),
+			wantContent:   "答案是2",
+			wantReasoning: "先想一想",
+			wantFinish:    "stop",
+		},
+		{
+			name:        "think标签",
+			ctx:         withProfile(reasoningThinkTags),
+			resp:        reply(Message{Role: "assistant", ReasoningContent: "先想一想", Content: "答案是2"}, "stop"),
+			wantContent: "<think>\n先想一想\n</think>\n\n答案是2",
+			wantFinish:  "stop",
+		},
+		{
+			name:        "丢弃推理内容",
+			ctx:         withProfile(reasoningDrop),
+			resp:        reply(Message{Role: "assistant", ReasoningContent: "先想一想", Content: "答案是2"}, "stop"),
+			wantContent: "答案是2",
+			wantFinish:  "stop",
+		},
+		{
+			name: "工具调用",
+			ctx:  context.Background(),
+			resp: reply(Message{Role: "assistant", ToolCalls: []ToolCall{
+				fakeToolCall("call_1", "get_weather", `{"city":"北京"}`),
+			}}, "tool_calls"),
+			wantFinish:    "tool_calls",
+			wantToolCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := toJSONMap(t, ps.convertToOpenAIResponse(tt.ctx, tt.resp, "gpt-4o", "req-test"))
+			if out["model"] != "gpt-4o" || out["object"] != "chat.completion" || out["id"] != "chatcmpl-fake" {
+				t.Errorf("model=%v object=%v id=%v", out["model"], out["object"], out["id"])
+			}
+			message := firstMessage(t, out)
+			if message["content"] != tt.wantContent {
+				t.Errorf("content=%q，期望 %q", message["content"], tt.wantContent)
+			}
+			if reasoning, _ := message["reasoning_content"].(string); reasoning != tt.wantReasoning {
+				t.Errorf("reasoning_content=%q，期望 %q", reasoning, tt.wantReasoning)
+			}
+			choice := out["choices"].([]interface{})[0].(map[string]interface{})
+			if choice["finish_reason"] != tt.wantFinish {
+				t.Errorf("finish_reason=%v，期望 %s", choice["finish_reason"], tt.wantFinish)
+			}
+			if calls, _ := message["tool_calls"].([]interface{}); len(calls) != tt.wantToolCalls {
+				t.Errorf("tool_calls=%d，期望 %d", len(calls), tt.wantToolCalls)
+			}
+
+			usage, _ := out["usage"].(map[string]interface{})
+			details, _ := usage["prompt_tokens_details"].(map[string]interface{})
+			if usage["total_tokens"] != float64(15) || details["cached_tokens"] != float64(4) {
+				t.Errorf("usage=%v", usage)
+			}
+		})
+	}
+}
+
+// flushRecorder 记录Flush次数的ResponseRecorder
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func TestProcessStreamingData(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		config ConfigOverride
+		req    *DeepSeekRequest
+		input  string
+		check  func(t *testing.T, body string)
+	}{
+		{
+			name:  "改写模型名并以DONE结束",
+			req:   &DeepSeekRequest{Model: "deepseek-chat"},
+			input: sseInput(fakeTextStream("deepseek-chat", "", "你", "好"), true),
+			check: func(t *testing.T, body string) {
+				chunks := decodeChunks(t, body)
+				if text := streamText(chunks, "content"); text != "你好" {
+					t.Errorf("content=%q", text)
+				}
+				for _, chunk := range chunks {
+					if chunk["model"] != "gpt-4" {
+						t.Errorf("model=%v，期望gpt-4", chunk["model"])
+					}
+				}
+				if data := sseData(body); data[len(data)-1] != "[DONE]" {
+					t.Errorf("没有以[DONE]结束: %q", body)
+				}
+			},
+		},
+		{
+			name:  "推理内容默认单独输出",
+			req:   &DeepSeekRequest{Model: "deepseek-reasoner"},
+			input: sseInput(fakeTextStream("deepseek-reasoner", "先想一想", "答案"), true),
+			check: func(t *testing.T, body string) {
+				chunks := decodeChunks(t, body)
+				if reasoning := streamText(chunks, "reasoning_content"); reasoning != "先想一想" {
+					t.Errorf("reasoning_content=%q", reasoning)
+				}
+				if text := streamText(chunks, "content"); text != "答案" {
+					t.Errorf("content=%q", text)
+				}
+			},
+		},
+		{
+			name:  "think标签包裹推理内容",
+			ctx:   withProfile(reasoningThinkTags),
+			req:   &DeepSeekRequest{Model: "deepseek-reasoner"},
+			input: sseInput(fakeTextStream("deepseek-reasoner", "先想一想", "答案"), true),
+			check: func(t *testing.T, body string) {
+				chunks := decodeChunks(t, body)
+				if text := streamText(chunks, "content"); !strings.Contains(text, "<think>") || !strings.Contains(text, "先想一想") || !strings.HasSuffix(text, "答案") {
+					t.Errorf("content=%q", text)
+				}
+				if reasoning := streamText(chunks, "reasoning_content"); reasoning != "" {
+					t.Errorf("reasoning_content=%q，期望为空", reasoning)
+				}
+			},
+		},
+		{
+			name:  "工具调用增量",
+			req:   &DeepSeekRequest{Model: "deepseek-chat", Tools: []Tool{weatherTool}},
+			input: sseInput(fakeToolCallStream("deepseek-chat", "get_weather", `{"city":"北京"}`), true),
+			check: func(t *testing.T, body string) {
+				var arguments strings.Builder
+				finish := ""
+				for _, chunk := range decodeChunks(t, body) {
+					choice := chunk["choices"].([]interface{})[0].(map[string]interface{})
+					if reason, ok := choice["finish_reason"].(string); ok {
+						finish = reason
+					}
+					calls, _ := choice["delta"].(map[string]interface{})["tool_calls"].([]interface{})
+					for _, call := range calls {
+						function, _ := call.(map[string]interface{})["function"].(map[string]interface{})
+						arguments.WriteString(fmt.Sprint(function["arguments"]))
+					}
+				}
+				if arguments.String() != `{"city":"北京"}` || finish != "tool_calls" {
+					t.Errorf("arguments=%q finish_reason=%q", arguments.String(), finish)
+				}
+			},
+		},
+		{
+			name:  "上游没有发送DONE时补发错误事件",
+			req:   &DeepSeekRequest{Model: "deepseek-chat"},
+			input: sseInput(fakeTextStream("deepseek-chat", "", "你")[:1], false),
+			check: func(t *testing.T, body string) {
+				data := sseData(body)
+				if len(data) < 3 || data[len(data)-1] != "[DONE]" || !strings.Contains(data[len(data)-2], "stream_interrupted") {
+					t.Errorf("期望错误事件和[DONE]: %q", body)
+				}
+			},
+		},
+		{
+			name:   "数据行超过最大长度",
+			config: func(c *ProxyConfig) { c.StreamMaxLineBytes = 64 },
+			req:    &DeepSeekRequest{Model: "deepseek-chat"},
+			input:  sseInput([]string{fakeChunk("deepseek-chat", map[string]interface{}{"content": strings.Repeat("长", 100)}, nil)}, true),
+			check: func(t *testing.T, body string) {
+				if !strings.Contains(body, "STREAM_MAX_LINE_BYTES") || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+					t.Errorf("期望超长错误: %q", body)
+				}
+			},
+		},
+		{
+			name:  "注释行原样转发",
+			req:   &DeepSeekRequest{Model: "deepseek-chat"},
+			input: ": keep-alive\n\n" + sseInput(fakeTextStream("deepseek-chat", "", "好"), true),
+			check: func(t *testing.T, body string) {
+				if !strings.HasPrefix(body, ": keep-alive\n") {
+					t.Errorf("注释行没有转发: %q", body)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var modify []ConfigOverride
+			if tt.config != nil {
+				modify = append(modify, tt.config)
+			}
+			ps := newTestProxy(t, "http://127.0.0.1:1", modify...)
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			ps.processStreamingData(rec, io.NopCloser(strings.NewReader(tt.input)), rec, tt.req, "gpt-4", "req-test", ctx)
+			if rec.flushes == 0 {
+				t.Errorf("没有调用Flush")
+			}
+			tt.check(t, rec.Body.String())
+		})
+	}
+}
+
+// sseInput 把数据块拼成上游的SSE响应体
+func sseInput(events []string, done bool) string {
+	var b strings.Builder
+	for _, event := range events {
+		fmt.Fprintf(&b, "data: %s\n\n", event)
+	}
+	if done {
+		b.WriteString("data: [DONE]\n\n")
+	}
+	return b.String()
+}
+
+func TestChatCompletionsWithFakeUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   fakeReply
+		request map[string]interface{}
+		check   func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest)
+	}{
+		{
+			name:    "非流式响应",
+			reply:   fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "你好！"}, "stop")},
+			request: map[string]interface{}{"model": "gpt-4", "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				out := toJSONMap(t, json.RawMessage(rec.Body.Bytes()))
+				if message := firstMessage(t, out); message["content"] != "你好！" || out["model"] != "gpt-4" {
+					t.Errorf("响应: %s", rec.Body.String())
+				}
+				if upstream.Path != "/v1/chat/completions" || upstream.Body["model"] != "deepseek-chat" {
+					t.Errorf("上游请求: %s %v", upstream.Path, upstream.Body["model"])
+				}
+				if upstream.Header.Get("Authorization") != "Bearer "+testAPIKey {
+					t.Errorf("上游认证头: %q", upstream.Header.Get("Authorization"))
+				}
+			},
+		},
+		{
+			name:    "gzip压缩的非流式响应",
+			reply:   fakeReply{gzip: true, body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "压缩的回复"}, "stop")},
+			request: map[string]interface{}{"model": "gpt-4", "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				out := toJSONMap(t, json.RawMessage(rec.Body.Bytes()))
+				if message := firstMessage(t, out); message["content"] != "压缩的回复" {
+					t.Errorf("响应: %s", rec.Body.String())
+				}
+			},
+		},
+		{
+			name:    "流式响应",
+			reply:   fakeReply{events: fakeTextStream("deepseek-reasoner", "想一想", "一", "二"), done: true},
+			request: map[string]interface{}{"model": "gpt-4o", "stream": true, "messages": []Message{{Role: "user", Content: "数数"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+					t.Errorf("Content-Type=%q", ct)
+				}
+				if text := streamText(decodeChunks(t, rec.Body.String()), "content"); !strings.HasSuffix(text, "一二") {
+					t.Errorf("content=%q", text)
+				}
+				if upstream.Body["stream"] != true {
+					t.Errorf("上游请求没有开启流式")
+				}
+			},
+		},
+		{
+			name:    "gzip压缩的流式响应",
+			reply:   fakeReply{gzip: true, events: fakeTextStream("deepseek-chat", "", "压", "缩"), done: true},
+			request: map[string]interface{}{"model": "gpt-4", "stream": true, "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				if text := streamText(decodeChunks(t, rec.Body.String()), "content"); text != "压缩" {
+					t.Errorf("content=%q，响应: %s", text, rec.Body.String())
+				}
+			},
+		},
+		{
+			name:    "非流式工具调用",
+			reply:   fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", ToolCalls: []ToolCall{fakeToolCall("call_1", "get_weather", `{"city":"北京"}`)}}, "tool_calls")},
+			request: map[string]interface{}{"model": "gpt-4", "tools": []Tool{weatherTool}, "messages": []Message{{Role: "user", Content: "北京天气"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				out := toJSONMap(t, json.RawMessage(rec.Body.Bytes()))
+				calls, _ := firstMessage(t, out)["tool_calls"].([]interface{})
+				if len(calls) != 1 {
+					t.Fatalf("响应: %s", rec.Body.String())
+				}
+				function := calls[0].(map[string]interface{})["function"].(map[string]interface{})
+				if function["name"] != "get_weather" || function["arguments"] != `{"city":"北京"}` {
+					t.Errorf("工具调用: %v", function)
+				}
+				if tools, _ := upstream.Body["tools"].([]interface{}); len(tools) != 1 {
+					t.Errorf("上游请求的tools: %v", upstream.Body["tools"])
+				}
+			},
+		},
+		{
+			name:    "旧版functions返回function_call",
+			reply:   fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", ToolCalls: []ToolCall{fakeToolCall("call_1", "get_weather", `{"city":"北京"}`)}}, "tool_calls")},
+			request: map[string]interface{}{"model": "gpt-4", "functions": []Function{weatherTool.Function}, "messages": []Message{{Role: "user", Content: "北京天气"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				out := toJSONMap(t, json.RawMessage(rec.Body.Bytes()))
+				call, _ := firstMessage(t, out)["function_call"].(map[string]interface{})
+				if call["name"] != "get_weather" {
+					t.Errorf("响应: %s", rec.Body.String())
+				}
+			},
+		},
+		{
+			name:    "流式工具调用",
+			reply:   fakeReply{events: fakeToolCallStream("deepseek-chat", "get_weather", `{"city":"上海"}`), done: true},
+			request: map[string]interface{}{"model": "gpt-4", "stream": true, "tools": []Tool{weatherTool}, "messages": []Message{{Role: "user", Content: "上海天气"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				if body := rec.Body.String(); !strings.Contains(body, `"finish_reason":"tool_calls"`) || !strings.Contains(body, "get_weather") {
+					t.Errorf("响应: %s", body)
+				}
+			},
+		},
+		{
+			name: "上游限流时转发Retry-After",
+			reply: fakeReply{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"7"}},
+				body: fakeErrorBody("Rate limit reached")},
+			request: map[string]interface{}{"model": "gpt-4", "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "7" {
+					t.Errorf("status=%d Retry-After=%q", rec.Code, rec.Header().Get("Retry-After"))
+				}
+			},
+		},
+		{
+			name: "Retry-After为HTTP日期时转换为秒数",
+			reply: fakeReply{status: http.StatusTooManyRequests,
+				header: http.Header{"Retry-After": {time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)}},
+				body:   fakeErrorBody("Rate limit reached")},
+			request: map[string]interface{}{"model": "gpt-4", "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				reset, err := time.ParseDuration(rec.Header().Get("x-ratelimit-reset-requests"))
+				if err != nil || reset <= 0 || reset > 31*time.Second {
+					t.Errorf("x-ratelimit-reset-requests=%q", rec.Header().Get("x-ratelimit-reset-requests"))
+				}
+			},
+		},
+		{
+			name:    "上游服务器错误",
+			reply:   fakeReply{status: http.StatusInternalServerError, body: fakeErrorBody("internal error")},
+			request: map[string]interface{}{"model": "gpt-4", "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				if rec.Code < 500 {
+					t.Errorf("status=%d，期望5xx", rec.Code)
+				}
+				var out struct {
+					Error struct {
+						Message string `json:"message"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || out.Error.Message == "" {
+					t.Errorf("不是OpenAI格式的错误: %s", rec.Body.String())
+				}
+			},
+		},
+		{
+			name:    "流式请求的上游错误",
+			reply:   fakeReply{status: http.StatusServiceUnavailable, body: fakeErrorBody("overloaded")},
+			request: map[string]interface{}{"model": "gpt-4", "stream": true, "messages": []Message{{Role: "user", Content: "你好"}}},
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, upstream fakeRequest) {
+				// 上游的5xx按网关错误返回，保留上游的错误信息
+				if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "overloaded") {
+					t.Errorf("status=%d，响应: %s", rec.Code, rec.Body.String())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDeepSeek(t, tt.reply)
+			ps := newTestProxy(t, fake.URL)
+			rec := proxyPost(t, ps, "/v1/chat/completions", tt.request)
+			requests := fake.received()
+			if len(requests) != 1 {
+				t.Fatalf("上游收到 %d 个请求，期望1个；响应: %s", len(requests), rec.Body.String())
+			}
+			tt.check(t, rec, requests[0])
+		})
+	}
+}
+
+func TestFakeUpstreamScriptOrder(t *testing.T) {
+	fake := newFakeDeepSeek(t, fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "第一次"}, "stop")})
+	fake.enqueue(fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "第二次"}, "stop")})
+	ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) { c.RequestCoalescing = false })
+
+	for i, want := range []string{"第一次", "第二次"} {
+		rec := proxyPost(t, ps, "/v1/chat/completions", map[string]interface{}{
+			"model": "gpt-4", "messages": []Message{{Role: "user", Content: fmt.Sprintf("第%d个问题", i+1)}},
+		})
+		if message := firstMessage(t, toJSONMap(t, json.RawMessage(rec.Body.Bytes()))); message["content"] != want {
+			t.Errorf("第%d次请求 content=%v，期望 %s", i+1, message["content"], want)
+		}
+	}
+
+	// 脚本用完后返回500
+	rec := proxyPost(t, ps, "/v1/chat/completions", map[string]interface{}{
+		"model": "gpt-4", "messages": []Message{{Role: "user", Content: "第三个问题"}},
+	})
+	if rec.Code < 500 {
+		t.Errorf("脚本用完后 status=%d，期望5xx", rec.Code)
+	}
+}
+
+// 原样透传的流式响应同样要把用量计入配额
+func TestPassthroughStreamChargesQuota(t *testing.T) {
+	quotasFile := filepath.Join(t.TempDir(), "quotas.json")
+	if err := os.WriteFile(quotasFile, []byte(`{"default": {"tokens": 1000}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeDeepSeek(t, fakeReply{events: fakeTextStream("deepseek-chat", "", "一", "二"), done: true})
+	ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) {
+		c.StreamPassthrough = true
+		c.QuotasFile = quotasFile
+		c.QuotaStateFile = ""
+	})
+
+	rec := proxyPost(t, ps, "/v1/chat/completions", map[string]interface{}{
+		"model": "deepseek-chat", "stream": true, "messages": []Message{{Role: "user", Content: "数数"}},
+	})
+	if text := streamText(decodeChunks(t, rec.Body.String()), "content"); text != "一二" {
+		t.Fatalf("content=%q，响应: %s", text, rec.Body.String())
+	}
+	status := ps.quotas.Status(testAPIKey, time.Now())
+	if status == nil || status.Tokens == nil || status.Tokens.Used != 15 {
+		t.Errorf("配额用量: %+v，期望15个token", status.Tokens)
+	}
+}
+
+// 租户密钥通过WebSocket和批处理发起的请求也要用租户自己的DeepSeek密钥调用上游
+func TestTenantWebSocketAndBatchUseTenantKey(t *testing.T) {
+	dir := t.TempDir()
+	tenantsFile := filepath.Join(dir, "tenants.json")
+	tenants := `{"tenants": [{"name": "team-a", "keys": ["sk-team-a"], "deepseek_api_key": "sk-upstream-a"}]}`
+	if err := os.WriteFile(tenantsFile, []byte(tenants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reply := fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "好"}, "stop")}
+	fake := newFakeDeepSeek(t, reply, reply)
+	ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) {
+		c.TenantsFile = tenantsFile
+		c.BatchDir = filepath.Join(dir, "batches")
+	})
+	t.Cleanup(ps.batches.Close)
+	server := httptest.NewServer(ps.mux)
+	t.Cleanup(server.Close)
+
+	body := `{"model": "deepseek-chat", "messages": [{"role": "user", "content": "你好"}]}`
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/chat/ws?key=sk-team-a", "", server.URL)
+	if err != nil {
+		t.Fatalf("WebSocket连接失败: %v", err)
+	}
+	if err := websocket.Message.Send(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	var message string
+	if err := websocket.Message.Receive(conn, &message); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	line := `{"custom_id": "1", "method": "POST", "url": "/v1/chat/completions", "body": ` + body + "}\n"
+	req := httptest.NewRequest("POST", "/v1/batches", strings.NewReader(line))
+	req.Header.Set("Content-Type", "application/jsonl")
+	req.Header.Set("Authorization", "Bearer sk-team-a")
+	rec := httptest.NewRecorder()
+	ps.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("创建批处理失败: %d %s", rec.Code, rec.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := fake.received()
+	if len(received) != 2 {
+		t.Fatalf("上游收到 %d 个请求，期望2个", len(received))
+	}
+	for i, request := range received {
+		if auth := request.Header.Get("Authorization"); auth != "Bearer sk-upstream-a" {
+			t.Errorf("第 %d 个上游请求的Authorization=%q，期望租户的密钥", i+1, auth)
+		}
+	}
+}
+
+// WebSocket上的每条消息和批处理的每一行都要单独计入配额
+func TestWebSocketAndBatchChargeQuota(t *testing.T) {
+	dir := t.TempDir()
+	quotasFile := filepath.Join(dir, "quotas.json")
+	if err := os.WriteFile(quotasFile, []byte(`{"default": {"requests": 100, "tokens": 1000}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reply := fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "好"}, "stop")}
+	fake := newFakeDeepSeek(t, reply, reply, reply, reply)
+	ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) {
+		c.QuotasFile = quotasFile
+		c.QuotaStateFile = ""
+		c.BatchDir = filepath.Join(dir, "batches")
+		c.BatchRequestsPerMinute = 0
+	})
+	t.Cleanup(ps.batches.Close)
+	server := httptest.NewServer(ps.mux)
+	t.Cleanup(server.Close)
+
+	body := `{"model": "deepseek-chat", "messages": [{"role": "user", "content": "你好"}]}`
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/chat/ws?key="+testAPIKey, "", server.URL)
+	if err != nil {
+		t.Fatalf("WebSocket连接失败: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := websocket.Message.Send(conn, body); err != nil {
+			t.Fatal(err)
+		}
+		var message string
+		if err := websocket.Message.Receive(conn, &message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	line := `{"custom_id": "%d", "method": "POST", "url": "/v1/chat/completions", "body": ` + body + "}\n"
+	input := fmt.Sprintf(line, 1) + fmt.Sprintf(line, 2)
+	req := httptest.NewRequest("POST", "/v1/batches", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/jsonl")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	rec := httptest.NewRecorder()
+	ps.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("创建批处理失败: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 两条消息和两行批处理各15个token；请求数还包括WebSocket连接和创建批处理的请求
+	deadline := time.Now().Add(5 * time.Second)
+	var status *quotaStatus
+	for time.Now().Before(deadline) {
+		if status = ps.quotas.Status(testAPIKey, time.Now()); status.Tokens.Used == 60 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Tokens.Used != 60 || status.Requests.Used != 6 {
+		t.Errorf("配额用量: 请求 %d，token %d，期望6个请求、60个token", status.Requests.Used, status.Tokens.Used)
+	}
+}
+
+// 客户端的X-Request-ID以X-Client-Request-ID转发给上游，上游的X-Request-ID仍是内部ID
+func TestClientRequestIDForwardedUpstream(t *testing.T) {
+	fake := newFakeDeepSeek(t, fakeReply{body: fakeCompletion("deepseek-chat", Message{Role: "assistant", Content: "好"}, "stop")})
+	ps := newTestProxy(t, fake.URL)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "deepseek-chat", "messages": [{"role": "user", "content": "你好"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	req.Header.Set("X-Request-ID", "client-trace-1")
+	rec := httptest.NewRecorder()
+	ps.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", rec.Code, rec.Body.String())
+	}
+
+	received := fake.received()
+	if len(received) != 1 {
+		t.Fatalf("上游收到 %d 个请求", len(received))
+	}
+	if got := received[0].Header.Get("X-Client-Request-ID"); got != "client-trace-1" {
+		t.Errorf("X-Client-Request-ID=%q", got)
+	}
+	if got := received[0].Header.Get("X-Request-ID"); got == "" || got == "client-trace-1" {
+		t.Errorf("上游的X-Request-ID应为内部ID，实际为 %q", got)
+	}
+}
+
+func TestRateLimitHeadersIncludeUpstreamBudget(t *testing.T) {
+	fake := newFakeDeepSeek(t, fakeReply{status: http.StatusTooManyRequests, body: fakeErrorBody("Rate limit reached")})
+	ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) {
+		c.UpstreamKeyRPM = 60
+		c.UpstreamKeyTPM = 100000
+		c.UpstreamRateLimitHold = false
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "deepseek-chat", "messages": [{"role": "user", "content": "你好"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	rec := httptest.NewRecorder()
+	ps.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("状态码 %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("x-ratelimit-limit-requests"); got != "60" {
+		t.Errorf("x-ratelimit-limit-requests=%q", got)
+	}
+	if got := rec.Header().Get("x-ratelimit-limit-tokens"); got != "100000" {
+		t.Errorf("x-ratelimit-limit-tokens=%q", got)
+	}
+}
+
+func TestDeepHealthReusesRecentProbe(t *testing.T) {
+	fake := newFakeDeepSeek(t, fakeReply{status: http.StatusUnauthorized, body: fakeErrorBody("invalid key sk-upstream-secret")})
+	ps := newTestProxy(t, fake.URL)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		ps.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/health?deep=1", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("第 %d 次: 状态码 %d: %s", i+1, rec.Code, rec.Body.String())
+		}
+		if strings.Contains(rec.Body.String(), "sk-upstream-secret") {
+			t.Errorf("健康检查返回了上游的响应内容: %s", rec.Body.String())
+		}
+	}
+	if n := len(fake.received()); n != 1 {
+		t.Errorf("上游收到 %d 次探测，期望 1 次", n)
+	}
+}
+
+func TestDebugRoutesWithMultipleServers(t *testing.T) {
+	fake := newFakeDeepSeek(t)
+	for i := 0; i < 2; i++ {
+		ps := newTestProxy(t, fake.URL, func(c *ProxyConfig) { c.DebugEndpoints = true })
+		rec := httptest.NewRecorder()
+		ps.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"proxy"`) {
+			t.Errorf("第 %d 个实例: 状态码 %d", i+1, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamProber 上游探测器
+// 通过请求DeepSeek的模型列表接口来确认密钥有效、端点可达，并记录最近一次探测结果
+type upstreamProber struct {
+	config *ProxyConfig
+	client *http.Client
+
+	// probeMu 保证同一时间只有一个探测请求发往上游
+	probeMu sync.Mutex
+
+	mu        sync.Mutex
+	checked   bool
+	healthy   bool
+	lastError string
+	latency   time.Duration
+	checkedAt time.Time
+}
+
+// deepProbeMaxAge 深度健康检查复用探测结果的最长时间，避免每次请求都调用上游
+const deepProbeMaxAge = 10 * time.Second
+
+// newUpstreamProber 创建上游探测器
+func newUpstreamProber(config *ProxyConfig, client *http.Client) *upstreamProber {
+	return &upstreamProber{config: config, client: client}
+}
+
+// Probe 执行一次轻量级的上游调用并记录结果
+func (p *upstreamProber) Probe() map[string]interface{} {
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+	return p.probe()
+}
+
+// ProbeIfStale 最近一次探测早于maxAge时重新探测，否则直接返回最近的结果
+// 并发的请求排队等待同一次探测，不会同时调用上游
+func (p *upstreamProber) ProbeIfStale(maxAge time.Duration) map[string]interface{} {
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+
+	p.mu.Lock()
+	fresh := p.checked && time.Since(p.checkedAt) < maxAge
+	p.mu.Unlock()
+	if fresh {
+		return p.Status()
+	}
+	return p.probe()
+}
+
+func (p *upstreamProber) probe() map[string]interface{} {
+	start := time.Now()
+	statusCode, err := p.callUpstream()
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	p.checked = true
+	p.healthy = err == nil
+	p.latency = latency
+	p.checkedAt = time.Now()
+	p.lastError = ""
+	if err != nil {
+		// 详细错误只写日志，健康检查接口不需要认证，不返回上游的响应内容
+		p.lastError = "上游不可达"
+		if statusCode != 0 {
+			p.lastError = fmt.Sprintf("上游返回 %d", statusCode)
+		}
+		log.Printf("上游探测失败 (%v): %v", latency, err)
+	}
+	p.mu.Unlock()
+
+	return p.Status()
+}
+
+// Status 返回最近一次探测的结果，尚未探测时状态为unknown
+func (p *upstreamProber) Status() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := "unknown"
+	if p.checked {
+		status = "unhealthy"
+		if p.healthy {
+			status = "healthy"
+		}
+	}
+
+	result := map[string]interface{}{
+		"status": status,
+	}
+	if p.checked {
+		result["latency_ms"] = p.latency.Milliseconds()
+		result["checked_at"] = p.checkedAt.Unix()
+	}
+	if p.lastError != "" {
+		result["last_error"] = p.lastError
+	}
+	return result
+}
+
+// Healthy 返回上游是否可用，尚未探测时视为可用
+func (p *upstreamProber) Healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.checked || p.healthy
+}
+
+// Run 按固定间隔在后台探测上游
+func (p *upstreamProber) Run(interval time.Duration) {
+	log.Printf("启动上游后台探测，间隔: %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.Probe()
+	for range ticker.C {
+		p.Probe()
+	}
+}
+
+// callUpstream 请求上游的模型列表，返回上游的状态码，未收到响应时为0
+func (p *upstreamProber) callUpstream() (int, error) {
+	req, err := http.NewRequest("GET", p.config.Endpoint+"/v1/models", nil)
+	if err != nil {
+		return 0, fmt.Errorf("创建探测请求失败: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.config.DeepSeekAPIKey)
+	req.Header.Set("Accept", "application/json")
+	setUpstreamHeaders(req, p.config)
+
+	client := *p.client
+	client.Timeout = p.config.HealthProbeTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("上游不可达: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("上游返回 %d: %s", resp.StatusCode, string(body))
+	}
+	return resp.StatusCode, nil
+}
+
+// handleLiveness 存活检查，只要进程能处理HTTP请求就返回200
+func (ps *ProxyServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadiness 就绪检查
+// 综合配置有效性、上游可达性以及是否正在停机排空，决定是否继续接收流量
+func (ps *ProxyServer) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"config":   "ok",
+		"upstream": "ok",
+		"draining": "ok",
+	}
+	ready := true
+
+	if ps.config.DeepSeekAPIKey == "" || ps.config.Endpoint == "" {
+		checks["config"] = "缺少API密钥或端点配置"
+		ready = false
+	}
+	if !ps.prober.Healthy() {
+		checks["upstream"] = "上游探测失败"
+		ready = false
+	} else if ps.breaker.State() == breakerOpen {
+		checks["upstream"] = "熔断器已打开"
+		ready = false
+	}
+	if ps.draining.Load() {
+		checks["draining"] = "服务器正在停机"
+		ready = false
+	}
+	// 共享状态不可用时限流放行、缓存按未命中处理，只报告状态，不影响就绪
+	if ps.state.Shared() {
+		checks["state_store"] = "ok"
+		ctx, cancel := context.WithTimeout(r.Context(), stateStoreTimeout)
+		err := ps.state.Ping(ctx)
+		cancel()
+		if err != nil {
+			checks["state_store"] = "共享状态不可用: " + err.Error()
+		}
+	}
+
+	status := "ready"
+	statusCode := http.StatusOK
+	if !ready {
+		status = "not_ready"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := writeJSONResponse(w, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	}); err != nil {
+		log.Printf("写入就绪检查响应失败: %v", err)
+	}
+}
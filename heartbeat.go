@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamHeartbeat 在上游首个数据到达前定期发送SSE注释
+// deepseek-reasoner可能思考数十秒才输出第一个token，
+// 期间中间代理或客户端可能因连接空闲而断开
+type streamHeartbeat struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startStreamHeartbeat 启动心跳，interval不大于0时不发送任何内容
+func startStreamHeartbeat(w io.Writer, flusher http.Flusher, interval time.Duration, requestID string) *streamHeartbeat {
+	hb := &streamHeartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(hb.done)
+		return hb
+	}
+
+	go func() {
+		defer close(hb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-hb.stop:
+				return
+			case <-ticker.C:
+				fmt.Fprintf(w, ": keep-alive\n\n")
+				flusher.Flush()
+				log.Printf("[%s] 等待上游首个数据块，已发送心跳", requestID)
+			}
+		}
+	}()
+	return hb
+}
+
+// Stop 停止心跳并等待后台协程退出，之后调用方可以安全地写入响应
+func (hb *streamHeartbeat) Stop() {
+	hb.stopOnce.Do(func() {
+		close(hb.stop)
+	})
+	<-hb.done
+}
+
+// firstTokenTimer 首token超时：规定时间内没有收到任何数据块就关闭上游连接，
+// 让长时间的推理生成可以继续，同时对卡住的请求快速失败
+type firstTokenTimer struct {
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// startFirstTokenTimer 启动首token计时，timeout不大于0时不创建计时器，也不会关闭body
+func startFirstTokenTimer(timeout time.Duration, body io.Closer) *firstTokenTimer {
+	ft := &firstTokenTimer{}
+	if timeout <= 0 {
+		return ft
+	}
+	ft.timer = time.AfterFunc(timeout, func() {
+		ft.expired.Store(true)
+		body.Close()
+	})
+	return ft
+}
+
+// Stop 收到数据块后停止计时，可以重复调用
+func (ft *firstTokenTimer) Stop() {
+	if ft.timer != nil {
+		ft.timer.Stop()
+	}
+}
+
+// Expired 是否因超时关闭了上游连接
+func (ft *firstTokenTimer) Expired() bool {
+	return ft.expired.Load()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 外部HTTP钩子：前置钩子在请求进入处理器前收到客户端请求体，后置钩子在返回客户端前收到响应体，
+// 两者都可以放行、替换内容或拒绝，用于在不修改代理代码的情况下实施自定义策略
+
+// hookPayload 发送给钩子的内容
+type hookPayload struct {
+	Stage    string            `json:"stage"` // pre 或 post
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	ClientIP string            `json:"client_ip"`
+	Headers  map[string]string `json:"headers"`          // 不包含Authorization和Cookie
+	Status   int               `json:"status,omitempty"` // 仅post：处理器返回的状态码
+	Body     json.RawMessage   `json:"body"`
+}
+
+// hookDecision 钩子的返回
+type hookDecision struct {
+	Action  string          `json:"action"`            // allow（默认）或 reject
+	Body    json.RawMessage `json:"body,omitempty"`    // 非空时替换请求体或响应体
+	Status  int             `json:"status,omitempty"`  // reject时返回给客户端的状态码，默认403
+	Message string          `json:"message,omitempty"` // reject时返回给客户端的错误信息
+}
+
+// hooksMiddleware 对客户端API路由调用前置和后置钩子
+func (ps *ProxyServer) hooksMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || (ps.config.PreRequestHookURL == "" && ps.config.PostResponseHookURL == "") {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ps.config.PreRequestHookURL != "" && !ps.runPreHook(w, r) {
+			return
+		}
+		if ps.config.PostResponseHookURL == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		hw := &hookResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r)
+		if !hw.passthrough {
+			ps.runPostHook(w, r, hw)
+		}
+	})
+}
+
+// runPreHook 调用前置钩子，按返回替换请求体；请求被拒绝时写出错误并返回false
+func (ps *ProxyServer) runPreHook(w http.ResponseWriter, r *http.Request) bool {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		handleError(w, fmt.Errorf("读取请求体失败: %w", err), http.StatusBadRequest, "前置钩子")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	// 请求体不是合法JSON时交给处理器报错
+	if !json.Valid(body) {
+		return true
+	}
+
+	decision, err := ps.callHook(r.Context(), ps.config.PreRequestHookURL, newHookPayload("pre", r, 0, body))
+	if err != nil {
+		return ps.hookFailed(w, err, "前置钩子")
+	}
+	if decision.Action == "reject" {
+		writeHookRejection(w, decision)
+		return false
+	}
+	if len(decision.Body) > 0 {
+		log.Printf("前置钩子替换了请求体: %s %s", r.Method, r.URL.Path)
+		r.Body = io.NopCloser(bytes.NewReader(decision.Body))
+		r.ContentLength = int64(len(decision.Body))
+	}
+	return true
+}
+
+// runPostHook 调用后置钩子，再把（可能被替换的）响应写给客户端
+func (ps *ProxyServer) runPostHook(w http.ResponseWriter, r *http.Request, hw *hookResponseWriter) {
+	body := hw.buf.Bytes()
+	if json.Valid(body) {
+		decision, err := ps.callHook(r.Context(), ps.config.PostResponseHookURL, newHookPayload("post", r, hw.status, body))
+		if err != nil {
+			if !ps.hookFailed(w, err, "后置钩子") {
+				return
+			}
+		} else if decision.Action == "reject" {
+			writeHookRejection(w, decision)
+			return
+		} else if len(decision.Body) > 0 {
+			log.Printf("后置钩子替换了响应体: %s %s", r.Method, r.URL.Path)
+			body = decision.Body
+		}
+	}
+
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(hw.status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
+}
+
+// hookFailed 处理钩子调用失败：HOOK_FAIL_OPEN时放行并返回true，否则返回502
+func (ps *ProxyServer) hookFailed(w http.ResponseWriter, err error, context string) bool {
+	if ps.config.HookFailOpen {
+		log.Printf("警告：%s调用失败，按配置放行: %v", context, err)
+		return true
+	}
+	// 钩子地址属于内部信息，只记录日志，不返回给客户端
+	log.Printf("%s调用失败: %v", context, err)
+	writeAPIError(w, newAPIError(http.StatusBadGateway, context+"暂不可用"))
+	return false
+}
+
+func writeHookRejection(w http.ResponseWriter, decision *hookDecision) {
+	status := decision.Status
+	if status < 400 || status > 599 {
+		status = http.StatusForbidden
+	}
+	message := decision.Message
+	if message == "" {
+		message = "请求被策略拒绝"
+	}
+	apiErr := newAPIError(status, message)
+	apiErr.Code = "rejected_by_hook"
+	writeAPIError(w, apiErr)
+}
+
+func newHookPayload(stage string, r *http.Request, status int, body []byte) hookPayload {
+	return hookPayload{
+		Stage:    stage,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		ClientIP: getClientIP(r),
+		Headers:  forwardableHeaders(r),
+		Status:   status,
+		Body:     body,
+	}
+}
+
+// forwardableHeaders 可以交给钩子和脚本的请求头，去掉了凭据
+func forwardableHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string, len(r.Header))
+	for key := range r.Header {
+		switch strings.ToLower(key) {
+		case "authorization", "cookie", "proxy-authorization":
+			continue
+		}
+		headers[key] = r.Header.Get(key)
+	}
+	return headers
+}
+
+// callHook 调用钩子，钩子返回非2xx时视为调用失败
+func (ps *ProxyServer) callHook(ctx context.Context, url string, payload hookPayload) (*hookDecision, error) {
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("序列化钩子请求失败: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ps.config.HookTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("创建钩子请求失败: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if ps.config.HookSecret != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+ps.config.HookSecret)
+	}
+	injectTraceContext(ctx, httpReq)
+
+	resp, err := ps.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("钩子返回 %d: %s", resp.StatusCode, string(body))
+	}
+
+	decision := &hookDecision{}
+	// 空响应体视为放行
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("解析钩子响应失败: %w", err)
+	}
+	return decision, nil
+}
+
+// hookResponseWriter 缓冲处理器的响应以便交给后置钩子
+// 流式响应无法整体改写，检测到text/event-stream时直接透传，不调用后置钩子
+type hookResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+func (hw *hookResponseWriter) WriteHeader(statusCode int) {
+	if hw.status != 0 {
+		return
+	}
+	hw.status = statusCode
+	if strings.HasPrefix(hw.Header().Get("Content-Type"), "text/event-stream") {
+		hw.passthrough = true
+		hw.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+func (hw *hookResponseWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if hw.passthrough {
+		return hw.ResponseWriter.Write(p)
+	}
+	return hw.buf.Write(p)
+}
+
+func (hw *hookResponseWriter) Flush() {
+	if hw.status == 0 {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if hw.passthrough {
+		if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
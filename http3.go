@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// setupHTTP3 在TCP监听之外创建HTTP/3（QUIC）监听
+// 证书与HTTPS监听共用；TCP监听的响应带有Alt-Svc头，支持HTTP/3的客户端会自动切换过来，
+// 弱网和高延迟环境下的流式响应不再受TCP队头阻塞影响
+func (ps *ProxyServer) setupHTTP3() error {
+	var tlsConfig *tls.Config
+	if ps.httpServer.TLSConfig != nil && ps.httpServer.TLSConfig.GetCertificate != nil {
+		tlsConfig = ps.httpServer.TLSConfig.Clone()
+	} else {
+		cert, err := tls.LoadX509KeyPair(ps.config.TLSCertFile, ps.config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("加载TLS证书失败: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ps.http3Server = &http3.Server{
+		Addr:      fmt.Sprintf("%s:%d", ps.config.Host, ps.config.HTTP3Port),
+		Port:      ps.config.HTTP3Port,
+		Handler:   ps.httpServer.Handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	ps.httpServer.Handler = ps.withAltSvc(ps.httpServer.Handler)
+	return nil
+}
+
+// withAltSvc 在TCP监听的响应中通告HTTP/3端点
+func (ps *ProxyServer) withAltSvc(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps.http3Server.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// runHTTP3Server 在已建立的UDP监听上运行HTTP/3服务
+func (ps *ProxyServer) runHTTP3Server(conn net.PacketConn) {
+	log.Printf("📡 HTTP/3监听地址: udp %s", ps.http3Server.Addr)
+	if err := ps.http3Server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP/3监听异常退出: %v", err)
+	}
+}
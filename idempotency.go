@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 幂等请求：客户端带Idempotency-Key头部发送POST请求时，代理保存响应并在IDEMPOTENCY_TTL内
+// 对相同密钥的重试直接重放，避免网络不稳定导致客户端重发而被重复计费。
+// 同一个密钥的请求仍在处理时，重试等待它完成后重放；密钥相同但请求体不同时返回422。
+// 配置了共享状态时记录同时保存在共享存储中，重试落到其他实例上同样会重放，
+// 原始请求仍在其他实例上处理时返回409
+
+// idempotencyEntry 一个幂等密钥对应的请求和保存的响应
+type idempotencyEntry struct {
+	fingerprint [32]byte
+	done        chan struct{} // 原始请求处理完成后关闭
+	stored      bool          // 响应是否已保存，为false时说明原始请求失败，重试需要重新执行
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore 按客户端密钥、路径和幂等密钥保存响应
+type idempotencyStore struct {
+	mu         sync.Mutex
+	entries    map[string]*idempotencyEntry
+	ttl        time.Duration
+	maxEntries int
+	shared     sharedStore // 为nil时只在本实例内重放
+}
+
+// idempotencyPendingTTL 共享存储中处理中记录的有效期，处理请求的实例异常退出后记录在此之后失效
+const idempotencyPendingTTL = 10 * time.Minute
+
+// sharedIdempotencyRecord 共享存储中的幂等记录，Done为false时请求仍在某个实例上处理
+type sharedIdempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+func newIdempotencyStore(ttl time.Duration, maxEntries int) *idempotencyStore {
+	return &idempotencyStore{entries: make(map[string]*idempotencyEntry), ttl: ttl, maxEntries: maxEntries}
+}
+
+// begin 登记一个请求；返回的entry已存在时由调用方重放或等待，否则调用方负责执行请求并调用finish
+func (s *idempotencyStore) begin(key string, fingerprint [32]byte) (*idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.entries[key]; ok {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			return entry, true
+		}
+		delete(s.entries, key)
+	}
+	if len(s.entries) >= s.maxEntries {
+		for k, entry := range s.entries {
+			if !entry.expires.IsZero() && now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	if len(s.entries) >= s.maxEntries {
+		return nil, false
+	}
+	entry := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = entry
+	return entry, false
+}
+
+// finish 保存响应；不保存时删除登记，让之后的重试重新执行
+func (s *idempotencyStore) finish(key string, entry *idempotencyEntry, rec *idempotencyRecorder, store bool) {
+	s.mu.Lock()
+	if store {
+		entry.stored = true
+		entry.status = rec.status
+		entry.header = rec.header
+		entry.body = rec.buf.Bytes()
+		entry.expires = time.Now().Add(s.ttl)
+	} else {
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+	close(entry.done)
+}
+
+// claim 在共享存储中登记请求；已有其他实例登记时返回该记录，共享存储不可用时按本实例独占处理
+func (s *idempotencyStore) claim(ctx context.Context, key string, fingerprint [32]byte) (*sharedIdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+	defer cancel()
+	pending, err := json.Marshal(sharedIdempotencyRecord{Fingerprint: hex.EncodeToString(fingerprint[:])})
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := s.shared.SetNX(ctx, "idempotency:"+key, pending, idempotencyPendingTTL)
+		if err != nil || claimed {
+			return nil, err
+		}
+		data, ok, err := s.shared.Get(ctx, "idempotency:"+key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// 记录在两次访问之间过期或被删除，重新登记
+			continue
+		}
+		var record sharedIdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, nil
+}
+
+// release 保存响应到共享存储；不保存时删除登记，让之后的重试重新执行
+func (s *idempotencyStore) release(key string, fingerprint [32]byte, rec *idempotencyRecorder, store bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+	var err error
+	if store {
+		var data []byte
+		data, err = json.Marshal(sharedIdempotencyRecord{
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Done:        true,
+			Status:      rec.status,
+			Header:      rec.header,
+			Body:        rec.buf.Bytes(),
+		})
+		if err == nil {
+			err = s.shared.Set(ctx, "idempotency:"+key, data, s.ttl)
+		}
+	} else {
+		err = s.shared.Delete(ctx, "idempotency:"+key)
+	}
+	if err != nil {
+		log.Printf("更新共享幂等记录失败: %v", err)
+	}
+}
+
+// replayIdempotent 重放保存的响应
+func replayIdempotent(w http.ResponseWriter, r *http.Request, idempotencyKey string, status int, header http.Header, body []byte) {
+	log.Printf("重放幂等请求的响应: %s %s", r.URL.Path, idempotencyKey)
+	for name, values := range header {
+		if name != "X-Request-Id" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// idempotencyRecorder 把响应写给客户端的同时保存一份，流式响应同样适用
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (ir *idempotencyRecorder) WriteHeader(statusCode int) {
+	if ir.status == 0 {
+		ir.status = statusCode
+		ir.header = ir.Header().Clone()
+	}
+	ir.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (ir *idempotencyRecorder) Write(p []byte) (int, error) {
+	if ir.status == 0 {
+		ir.WriteHeader(http.StatusOK)
+	}
+	ir.buf.Write(p)
+	return ir.ResponseWriter.Write(p)
+}
+
+func (ir *idempotencyRecorder) Flush() {
+	if flusher, ok := ir.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// storable 是否保存响应：服务端错误、限流和冲突允许客户端重试，不保存
+func (ir *idempotencyRecorder) storable() bool {
+	return ir.status != 0 && ir.status < 500 &&
+		ir.status != http.StatusTooManyRequests && ir.status != http.StatusConflict
+}
+
+// idempotencyMiddleware 为客户端API的POST请求提供幂等重放
+func (ps *ProxyServer) idempotencyMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || ps.idempotency == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if r.Method != "POST" || idempotencyKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(idempotencyKey) > 255 {
+			handleError(w, fmt.Errorf("Idempotency-Key不能超过255个字符"), http.StatusBadRequest, "幂等请求")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			handleError(w, fmt.Errorf("读取请求体失败: %w", err), http.StatusBadRequest, "幂等请求")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(body)
+		key := clientKeyHash(r) + "|" + r.URL.Path + "|" + idempotencyKey
+
+		for {
+			entry, exists := ps.idempotency.begin(key, fingerprint)
+			if entry == nil {
+				log.Printf("幂等记录已满，不保存本次响应: %s", idempotencyKey)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !exists {
+				shared := ps.idempotency.shared != nil
+				if shared {
+					record, err := ps.idempotency.claim(r.Context(), key, fingerprint)
+					if err != nil {
+						log.Printf("登记共享幂等记录失败，只在本实例内去重: %v", err)
+						shared = false
+					} else if record != nil {
+						ps.idempotency.finish(key, entry, nil, false)
+						ps.replaySharedIdempotent(w, r, idempotencyKey, record, fingerprint)
+						return
+					}
+				}
+				rec := &idempotencyRecorder{ResponseWriter: w}
+				defer func() {
+					store := rec.storable() && r.Context().Err() == nil
+					ps.idempotency.finish(key, entry, rec, store)
+					if shared {
+						ps.idempotency.release(key, fingerprint, rec, store)
+					}
+				}()
+				next.ServeHTTP(rec, r)
+				return
+			}
+
+			if entry.fingerprint != fingerprint {
+				writeIdempotencyKeyReused(w)
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !entry.stored {
+				// 原始请求失败，重新执行
+				continue
+			}
+
+			replayIdempotent(w, r, idempotencyKey, entry.status, entry.header, entry.body)
+			return
+		}
+	})
+}
+
+// replaySharedIdempotent 处理其他实例登记的幂等记录：请求体不同时返回422，仍在处理时返回409，否则重放
+func (ps *ProxyServer) replaySharedIdempotent(w http.ResponseWriter, r *http.Request, idempotencyKey string, record *sharedIdempotencyRecord, fingerprint [32]byte) {
+	if record.Fingerprint != hex.EncodeToString(fingerprint[:]) {
+		writeIdempotencyKeyReused(w)
+		return
+	}
+	if !record.Done {
+		w.Header().Set("Retry-After", "1")
+		apiErr := newAPIError(http.StatusConflict, "相同Idempotency-Key的请求仍在处理中，请稍后重试")
+		apiErr.Code = "idempotency_request_in_progress"
+		writeAPIError(w, apiErr)
+		return
+	}
+	replayIdempotent(w, r, idempotencyKey, record.Status, record.Header, record.Body)
+}
+
+func writeIdempotencyKeyReused(w http.ResponseWriter) {
+	apiErr := newAPIError(http.StatusUnprocessableEntity, "Idempotency-Key已用于另一个不同的请求")
+	apiErr.Code = "idempotency_key_reused"
+	writeAPIError(w, apiErr)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// 旧版函数调用兼容：客户端使用已废弃的functions/function_call字段时，
+// 请求中的function_call消息转换为tool_calls发给上游，
+// 响应中的工具调用再转换回message.function_call，finish_reason为function_call。
+// 旧版格式每轮只有一个函数调用，多余的调用被丢弃
+
+// FunctionCall 旧版格式的函数调用
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// convertFunctionCallChoice 把旧版function_call请求字段转换为tool_choice
+func convertFunctionCallChoice(choice interface{}) interface{} {
+	if choiceMap, ok := choice.(map[string]interface{}); ok {
+		if name, ok := choiceMap["name"].(string); ok && name != "" {
+			return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": name}}
+		}
+	}
+	return convertToolChoice(choice)
+}
+
+// legacyCallID 为旧版函数调用消息生成的工具调用id，同一次对话中的编号保持稳定
+func legacyCallID(messageIndex int) string {
+	return fmt.Sprintf("call_legacy_%d", messageIndex)
+}
+
+// legacyFunctionCallResponse 把响应中的工具调用转换为旧版function_call格式
+// 不修改传入的响应（它可能来自缓存）
+func legacyFunctionCallResponse(req *DeepSeekRequest, resp *DeepSeekResponse, requestID string) *DeepSeekResponse {
+	if !req.legacyFunctions {
+		return resp
+	}
+	converted := *resp
+	converted.Choices = append([]DeepSeekChoice{}, resp.Choices...)
+	for i := range converted.Choices {
+		message := &converted.Choices[i].Message
+		if len(message.ToolCalls) == 0 {
+			continue
+		}
+		if len(message.ToolCalls) > 1 {
+			log.Printf("[%s] 旧版函数调用格式只支持一个调用，丢弃 %d 个", requestID, len(message.ToolCalls)-1)
+		}
+		functionCall := FunctionCall(message.ToolCalls[0].Function)
+		message.FunctionCall = &functionCall
+		message.ToolCalls = nil
+		converted.Choices[i].FinishReason = "function_call"
+	}
+	return &converted
+}
+
+// legacyFunctionCallDelta 把流式工具调用增量转换为旧版function_call增量
+func legacyFunctionCallDelta(call map[string]interface{}) map[string]interface{} {
+	function, _ := call["function"].(map[string]interface{})
+	delta := map[string]interface{}{"arguments": function["arguments"]}
+	if name, ok := function["name"]; ok {
+		delta["name"] = name
+	}
+	return delta
+}
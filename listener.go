@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+// listen 创建主监听
+// 设置了ListenSocket时监听Unix域套接字，便于同机的nginx/caddy反向代理而无需开放TCP端口
+// 热升级启动的新进程直接使用父进程交接的监听
+func (ps *ProxyServer) listen() (net.Listener, error) {
+	return ps.inheritOrListen("main", func() (net.Listener, error) {
+		if ps.config.ListenSocket == "" {
+			return net.Listen("tcp", ps.httpServer.Addr)
+		}
+		return listenUnixSocket(ps.config.ListenSocket, ps.config.ListenSocketMode)
+	})
+}
+
+// listenUnixSocket 监听Unix域套接字并设置文件权限
+// 上次异常退出残留的套接字文件会先被清理；监听关闭时Go会自动删除套接字文件
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s 已存在且不是套接字文件", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s 正在被其他进程使用", path)
+		}
+		log.Printf("清理残留的套接字文件: %s", path)
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("清理残留的套接字文件失败: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("设置套接字文件权限失败: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志输出：除标准错误外，日志可以同时写入文件（LOG_FILE）和syslog（LOG_SYSLOG），三者分别开关。
+// 日志文件超过LOG_FILE_MAX_SIZE或打开时间超过LOG_FILE_MAX_AGE时轮转，旧文件以时间戳为后缀保留
+// LOG_FILE_MAX_BACKUPS个，长期运行的部署不依赖外部的日志收集和轮转工具
+
+// logOutputs 当前使用的日志输出，停机时关闭
+var logOutputs []io.Writer
+
+// setupLogOutputs 按配置设置标准库log的输出
+func setupLogOutputs(config *ProxyConfig) error {
+	var writers []io.Writer
+	if config.LogStdout {
+		writers = append(writers, os.Stderr)
+	}
+	if config.LogFile != "" {
+		file, err := openRotatingFile(config.LogFile, config.LogFileMaxSize*1024*1024, config.LogFileMaxAge, config.LogFileMaxBackups)
+		if err != nil {
+			return fmt.Errorf("无法打开日志文件: %w", err)
+		}
+		writers = append(writers, file)
+	}
+	if config.LogSyslog != "" {
+		writer, err := dialSyslog(config.LogSyslog, config.LogSyslogTag)
+		if err != nil {
+			return fmt.Errorf("无法连接syslog: %w", err)
+		}
+		writers = append(writers, writer)
+	}
+
+	logOutputs = writers
+	var out io.Writer = logFanout(writers)
+	if len(writers) == 1 {
+		out = writers[0]
+	}
+	if config.LogSampleRate > 1 {
+		logSampling = newLogSampler(out, config.LogSampleRate, config.LogSampleSlow)
+		out = logSampling
+	}
+	log.SetOutput(out)
+	return nil
+}
+
+// closeLogOutputs 关闭日志文件和syslog连接，之后的日志只写标准错误
+func closeLogOutputs() {
+	log.SetOutput(os.Stderr)
+	for _, writer := range logOutputs {
+		if closer, ok := writer.(io.Closer); ok && writer != os.Stderr {
+			closer.Close()
+		}
+	}
+	logOutputs = nil
+}
+
+// logFanout 把每条日志写到所有输出，某个输出失败（syslog断开、磁盘已满）不影响其他输出
+type logFanout []io.Writer
+
+func (f logFanout) Write(p []byte) (int, error) {
+	for _, writer := range f {
+		writer.Write(p)
+	}
+	return len(p), nil
+}
+
+// rotatingFile 按大小和时间轮转的日志文件
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64         // 超过该字节数时轮转，0表示不按大小轮转
+	maxAge     time.Duration // 打开超过该时间后轮转，0表示不按时间轮转
+	maxBackups int           // 保留的旧文件数，0表示全部保留
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open 以追加方式打开日志文件，已有内容计入大小
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size, rf.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && ((rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize) ||
+		(rf.maxAge > 0 && time.Since(rf.openedAt) >= rf.maxAge)) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "轮转日志文件失败: %v\n", err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate 把当前文件改名为带时间戳的旧文件并打开新文件，调用方持有rf.mu
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	backup := rf.path + "." + time.Now().Format("20060102-150405.000")
+	renameErr := os.Rename(rf.path, backup)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.pruneBackups()
+	return nil
+}
+
+// pruneBackups 删除超出保留数量的旧文件，时间戳后缀按字典序即按时间排序
+func (rf *rotatingFile) pruneBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if isLogBackup(strings.TrimPrefix(match, rf.path+".")) {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > rf.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// isLogBackup 后缀是否为轮转时添加的时间戳
+func isLogBackup(suffix string) bool {
+	_, err := time.Parse("20060102-150405.000", suffix)
+	return err == nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 日志采样：每分钟数千个请求时逐请求的日志量难以保存和检索。LOG_SAMPLE_RATE=N 时每N个请求完整记录
+// 一个，其余请求的日志先缓存在内存中：请求失败（状态码≥400）或耗时超过LOG_SAMPLE_SLOW时照常写出，
+// 成功的请求直接丢弃。日志按行首的 [请求ID] 归属到请求，不带请求ID的日志（启动、后台任务等）不受影响。
+// 开启调试日志时不采样
+
+// 每个未采样请求最多缓存的日志行数和字节数，超出的部分在写出时只记录省略的行数
+const (
+	logSampleMaxLines = 200
+	logSampleMaxBytes = 64 * 1024
+)
+
+// logSampling 启用采样时的日志采样器，未启用时为nil
+var logSampling *logSampler
+
+// logSampler 包装日志输出，暂存未采样请求的日志
+type logSampler struct {
+	out    io.Writer
+	logger *log.Logger // 直接写到out，用于记录省略的行数
+	rate   uint64
+	slow   time.Duration // 超过该耗时的请求总是写出日志，0表示不按耗时
+
+	counter    atomic.Uint64
+	sampledOut atomic.Int64 // 日志被丢弃的请求数
+	dropped    atomic.Int64 // 被丢弃的日志行数
+
+	mu      sync.Mutex
+	pending map[string]*sampledLog
+}
+
+// sampledLog 一个未采样请求暂存的日志
+type sampledLog struct {
+	lines   [][]byte
+	size    int
+	omitted int
+}
+
+func newLogSampler(out io.Writer, rate int, slow time.Duration) *logSampler {
+	return &logSampler{
+		out:     out,
+		logger:  log.New(out, "", log.Flags()),
+		rate:    uint64(rate),
+		slow:    slow,
+		pending: make(map[string]*sampledLog),
+	}
+}
+
+// logLineRequestID 取出日志行中标准前缀之后的 [请求ID]，没有时返回nil
+func logLineRequestID(p []byte) []byte {
+	start := bytes.Index(p, []byte(": ["))
+	if start < 0 {
+		return nil
+	}
+	rest := p[start+3:]
+	end := bytes.IndexByte(rest, ']')
+	if end <= 0 {
+		return nil
+	}
+	return rest[:end]
+}
+
+// Write 属于未采样请求的日志行暂存起来，其他日志直接写出。标准库log每条日志调用一次Write
+func (s *logSampler) Write(p []byte) (int, error) {
+	if id := logLineRequestID(p); id != nil {
+		s.mu.Lock()
+		if pending, ok := s.pending[string(id)]; ok {
+			if len(pending.lines) >= logSampleMaxLines || pending.size+len(p) > logSampleMaxBytes {
+				pending.omitted++
+			} else {
+				// log在返回后会复用p的底层数组
+				pending.lines = append(pending.lines, append([]byte(nil), p...))
+				pending.size += len(p)
+			}
+			s.mu.Unlock()
+			return len(p), nil
+		}
+		s.mu.Unlock()
+	}
+	return s.out.Write(p)
+}
+
+// begin 决定请求是否采样，未采样的请求开始暂存日志并返回true
+func (s *logSampler) begin(requestID string) bool {
+	if (s.counter.Add(1)-1)%s.rate == 0 || debugLogging.Load() {
+		return false
+	}
+	s.mu.Lock()
+	s.pending[requestID] = &sampledLog{}
+	s.mu.Unlock()
+	return true
+}
+
+// end 结束暂存，keep为true时按原顺序写出暂存的日志，否则丢弃
+func (s *logSampler) end(requestID string, keep bool) {
+	s.mu.Lock()
+	pending := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	if !keep {
+		s.sampledOut.Add(1)
+		s.dropped.Add(int64(len(pending.lines) + pending.omitted))
+		return
+	}
+	for _, line := range pending.lines {
+		s.out.Write(line)
+	}
+	if pending.omitted > 0 {
+		s.logger.Printf("[%s] 日志过多，省略了 %d 行", requestID, pending.omitted)
+	}
+}
+
+// Stats 采样率和丢弃的日志数量
+func (s *logSampler) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"rate":                 s.rate,
+		"slow_threshold_ms":    s.slow.Milliseconds(),
+		"requests_sampled_out": s.sampledOut.Load(),
+		"lines_dropped":        s.dropped.Load(),
+	}
+}
+
+// logSamplingMiddleware 为未采样的请求暂存日志，请求结束时按状态码和耗时决定是否写出
+func logSamplingMiddleware(rt route, next http.Handler) http.Handler {
+	sampler := logSampling
+	if sampler == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFor(r)
+		if !sampler.begin(requestID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// 处理器panic时completed为false，保留日志便于排查
+			keep := !completed || recorder.status >= 400 ||
+				(sampler.slow > 0 && time.Since(start) >= sampler.slow)
+			sampler.end(requestID, keep)
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
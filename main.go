@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -9,11 +10,8 @@ import (
 	"syscall"
 )
 
-// 程序版本信息
-const (
-	Version     = "1.0.0"
-	ProgramName = "DeepSeek API 代理服务器"
-)
+// 程序名称，版本信息见version.go
+const ProgramName = "DeepSeek API 代理服务器"
 
 // 命令行参数定义
 var (
@@ -23,56 +21,100 @@ var (
 	port        = flag.Int("port", 0, "服务器端口号（覆盖配置文件设置）")
 	host        = flag.String("host", "", "绑定主机地址")
 	debug       = flag.Bool("debug", false, "启用调试模式")
+	mock        = flag.Bool("mock", false, "使用模拟上游，不调用DeepSeek API")
 )
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-	printWelcomeBanner()
-	flag.Parse()
 
-	if *showVersion {
-		printVersion()
-		return
+	command, args := commandFromArgs(os.Args[1:])
+	switch command {
+	case "test":
+		os.Exit(runTestCommand(args))
+	case "validate":
+		os.Exit(runValidateCommand(args))
+	case "chat":
+		os.Exit(runChatCommand(args))
+	case "usage-export":
+		os.Exit(runUsageExportCommand(args))
+	case "audit-verify":
+		os.Exit(runAuditVerifyCommand(args))
 	}
 
+	printWelcomeBanner()
+	flag.CommandLine.Parse(args)
+
 	if *showHelp {
 		printHelp()
 		return
 	}
 
-	if err := validateEnvironment(); err != nil {
-		log.Fatalf("环境验证失败: %v", err)
+	if *showVersion {
+		// 只用于显示配置哈希，不要求配置完整
+		config, err := readConfig(*configPath)
+		if err != nil {
+			log.Fatalf("错误：%v", err)
+		}
+		printVersion(config)
+		return
 	}
 
-	// 处理命令行主机地址覆盖
-	if *host != "" {
-		GlobalConfig.Host = *host
-		log.Printf("使用命令行指定的主机地址: %s", *host)
+	config, err := LoadConfig(*configPath, commandLineOverrides()...)
+	if err != nil {
+		log.Fatalf("错误：%v", err)
 	}
+	if err := setupLogOutputs(config); err != nil {
+		log.Fatalf("错误：%v", err)
+	}
+	logConfigSummary(config)
 
-	// 处理命令行端口覆盖
-	if *port > 0 {
-		GlobalConfig.Port = *port
-		log.Printf("使用命令行指定的端口: %d", *port)
+	if err := validateEnvironment(config); err != nil {
+		log.Fatalf("环境验证失败: %v", err)
 	}
 
 	if *debug {
 		log.Println("调试模式已启用")
-		printDebugInfo()
+		debugLogging.Store(true)
+		printDebugInfo(config)
 	}
 
 	log.Println("正在初始化代理服务器...")
-	proxyServer := NewProxyServer(GlobalConfig)
+	proxyServer := NewProxyServer(config)
 
-	setupGracefulShutdown(proxyServer)
+	shutdownDone := setupGracefulShutdown(proxyServer)
 
 	log.Printf("🎉 %s v%s 启动完成！", ProgramName, Version)
-	log.Printf("📖 访问 http://localhost:%d 查看服务器信息", GlobalConfig.Port)
+	log.Printf("📖 访问 http://localhost:%d 查看服务器信息", config.Port)
 	log.Println("🛑 按 Ctrl+C 停止服务器")
 
 	if err := proxyServer.Start(); err != nil {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
+	<-shutdownDone
+	closeLogOutputs()
+}
+
+// commandLineOverrides 命令行参数覆盖配置文件和环境变量中的设置
+func commandLineOverrides() []ConfigOverride {
+	var overrides []ConfigOverride
+	if *host != "" {
+		overrides = append(overrides, func(c *ProxyConfig) {
+			c.Host = *host
+			log.Printf("使用命令行指定的主机地址: %s", *host)
+		})
+	}
+	if *port > 0 {
+		overrides = append(overrides, func(c *ProxyConfig) {
+			c.Port = *port
+			log.Printf("使用命令行指定的端口: %d", *port)
+		})
+	}
+	if *mock {
+		overrides = append(overrides, func(c *ProxyConfig) {
+			c.MockUpstream = true
+		})
+	}
+	return overrides
 }
 
 func printWelcomeBanner() {
@@ -88,14 +130,16 @@ func printWelcomeBanner() {
 `, Version)
 }
 
-func printVersion() {
-	fmt.Printf("%s v%s", ProgramName, Version)
+func printVersion(config *ProxyConfig) {
+	info := currentBuildInfo()
+	fmt.Printf("%s v%s", ProgramName, info.Version)
 	fmt.Println()
 	fmt.Println("构建信息:")
-	fmt.Println("  - Go 版本: 1.19+")
-	fmt.Println("  - 支持的协议: HTTP/1.1, HTTP/2")
-	fmt.Println("  - 支持的格式: JSON, Server-Sent Events")
-	fmt.Println("  - 兼容性: OpenAI Chat Completions API v1")
+	fmt.Printf("  - Git 提交: %s\n", info.GitCommit)
+	fmt.Printf("  - 构建时间: %s\n", info.BuildDate)
+	fmt.Printf("  - Go 版本: %s\n", info.GoVersion)
+	fmt.Printf("  - 平台: %s\n", info.Platform)
+	fmt.Printf("  - 配置哈希: %s\n", configHash(config))
 	fmt.Println()
 	fmt.Println("项目主页: https://github.com/your-username/deepseek-proxy")
 }
@@ -105,9 +149,17 @@ func printHelp() {
 	fmt.Println()
 	fmt.Println()
 	fmt.Println("用法:")
-	fmt.Printf("  %s [选项]", os.Args[0])
+	fmt.Printf("  %s [子命令] [选项]", os.Args[0])
 	fmt.Println()
 	fmt.Println()
+	fmt.Println("子命令:")
+	fmt.Println("  serve             启动代理服务器 (默认)")
+	fmt.Println("  test              对运行中的代理执行测试 (-url, -key, -suite basic|reasoner|all)")
+	fmt.Println("  validate          检查配置、密钥、端点连通性和证书后退出 (-config, -offline)")
+	fmt.Println("  chat              在终端中与代理流式对话 (-url, -key, -model, -upstream)")
+	fmt.Println("  usage-export      按时间范围导出用量日志为CSV或JSONL (-from, -to, -group-by, -format, -o)")
+	fmt.Println("  audit-verify      校验审计日志的哈希链是否完整 (-file)")
+	fmt.Println()
 	fmt.Println("选项:")
 	fmt.Println("  -version          显示版本信息并退出")
 	fmt.Println("  -help             显示此帮助信息并退出")
@@ -115,6 +167,7 @@ func printHelp() {
 	fmt.Println("  -port int         服务器端口号 (覆盖配置文件)")
 	fmt.Println("  -host string      绑定主机地址 (如: 0.0.0.0)")
 	fmt.Println("  -debug            启用调试模式")
+	fmt.Println("  -mock             使用模拟上游返回固定响应，不需要API密钥")
 	fmt.Println()
 	fmt.Println("环境变量:")
 	fmt.Println("  DEEPSEEK_API_KEY     DeepSeek API 密钥 (必需)")
@@ -133,6 +186,10 @@ func printHelp() {
 		{os.Args[0] + " -host 0.0.0.0", "绑定所有网络接口"},
 		{os.Args[0] + " -host 0.0.0.0 -port 9000", "绑定所有接口端口9000"},
 		{os.Args[0] + " -debug", "启用调试模式"},
+		{os.Args[0] + " -mock", "不调用DeepSeek，用模拟响应做本地开发和CI"},
+		{os.Args[0] + " test -url http://localhost:9000", "测试运行中的代理"},
+		{os.Args[0] + " chat -model deepseek-chat", "在终端中对话"},
+		{os.Args[0] + " usage-export -from 2026-10-01 -to 2026-11-01 -group-by day,model", "导出10月按日期和模型汇总的用量"},
 	}
 
 	for _, example := range examples {
@@ -147,32 +204,33 @@ func printHelp() {
 	fmt.Println("  DEEPSEEK_MODEL=deepseek-reasoner")
 }
 
-func validateEnvironment() error {
+func validateEnvironment(config *ProxyConfig) error {
 	log.Println("正在验证运行环境...")
 	log.Println("✓ Go 运行时环境正常")
 
-	if GlobalConfig.DeepSeekAPIKey == "" {
+	if config.DeepSeekAPIKey == "" {
 		return fmt.Errorf("缺少必需的环境变量: DEEPSEEK_API_KEY")
 	}
 	log.Println("✓ API 密钥已配置")
 
-	if GlobalConfig.Port <= 0 || GlobalConfig.Port > 65535 {
-		return fmt.Errorf("无效的端口号: %d (必须在 1-65535 之间)", GlobalConfig.Port)
+	if config.Port <= 0 || config.Port > 65535 {
+		return fmt.Errorf("无效的端口号: %d (必须在 1-65535 之间)", config.Port)
 	}
-	log.Printf("✓ 端口配置有效: %d", GlobalConfig.Port)
+	log.Printf("✓ 端口配置有效: %d", config.Port)
 	log.Println("✓ 环境验证通过")
 	return nil
 }
 
-func printDebugInfo() {
+func printDebugInfo(config *ProxyConfig) {
 	fmt.Println()
 	fmt.Println("=== 调试信息 ===")
 	fmt.Println("配置文件路径:", *configPath)
-	fmt.Println("绑定主机:", GlobalConfig.Host)
-	fmt.Println("监听端口:", GlobalConfig.Port)
-	fmt.Println("DeepSeek 端点:", GlobalConfig.Endpoint)
-	fmt.Println("默认模型:", GlobalConfig.DeepSeekModel)
-	fmt.Println("API 密钥:", maskAPIKey(GlobalConfig.DeepSeekAPIKey))
+	fmt.Println("绑定主机:", config.Host)
+	fmt.Println("监听端口:", config.Port)
+	fmt.Println("DeepSeek 端点:", config.Endpoint)
+	fmt.Println("默认模型:", config.DeepSeekModel)
+	fmt.Println("API 密钥:", maskAPIKey(config.DeepSeekAPIKey))
+	fmt.Println("模拟上游:", config.MockUpstream)
 	fmt.Println()
 	fmt.Println("支持的模型:")
 
@@ -193,31 +251,60 @@ func printDebugInfo() {
 		{"服务器信息", "/"},
 	}
 
-	host := GlobalConfig.Host
+	host := config.Host
 	if host == "" {
 		host = "localhost"
 	}
 	for _, endpoint := range endpoints {
 		fmt.Printf("  - %s: http://%s:%d%s",
-			endpoint.name, host, GlobalConfig.Port, endpoint.path)
+			endpoint.name, host, config.Port, endpoint.path)
 		fmt.Println()
 	}
 	fmt.Println("================")
 	fmt.Println()
 }
 
-func setupGracefulShutdown(server *ProxyServer) {
+func setupGracefulShutdown(server *ProxyServer) <-chan struct{} {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if upgradeSignal != nil {
+		signal.Notify(sigChan, upgradeSignal)
+	}
+	done := make(chan struct{})
 
 	go func() {
-		sig := <-sigChan
-		fmt.Println()
-		log.Printf("收到信号: %v", sig)
+		var sig os.Signal
+		for {
+			sig = <-sigChan
+			fmt.Println()
+			log.Printf("收到信号: %v", sig)
+			if sig != upgradeSignal {
+				break
+			}
+
+			// SIGUSR2：把监听交给新启动的进程，成功后旧进程照常优雅停机
+			log.Println("正在热升级...")
+			if err := server.Upgrade(); err != nil {
+				log.Printf("热升级失败，继续运行当前进程: %v", err)
+				server.audit.Record(auditEntry{Event: "config_reload", Details: map[string]string{"result": "failed", "error": err.Error()}})
+				continue
+			}
+			server.audit.Record(auditEntry{Event: "config_reload", Details: map[string]string{"result": "handed_over"}})
+			break
+		}
 		log.Println("正在优雅关闭服务器...")
 		log.Printf("正在关闭服务器实例: %p", server)
-		log.Println("✅ 服务器已安全关闭")
+
+		ctx, cancel := context.WithTimeout(context.Background(), server.config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("优雅关闭超时，强制退出: %v", err)
+		} else {
+			log.Println("✅ 服务器已安全关闭")
+		}
 		log.Printf("👋 感谢使用 %s！", ProgramName)
-		os.Exit(0)
+		close(done)
 	}()
+
+	return done
 }
\ No newline at end of file
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// middlewareStage 中间件所处的阶段，决定在链中的先后顺序
+// 请求依次经过：请求ID和认证 → 限流 → 日志 → 指标 → 转换 → 处理器
+type middlewareStage int
+
+const (
+	stageAuth middlewareStage = iota
+	stageRateLimit
+	stageLogging
+	stageMetrics
+	stageTransform
+)
+
+// routeAuth 路由的认证方式
+type routeAuth int
+
+const (
+	authNone   routeAuth = iota
+	authAPIKey           // 客户端API密钥
+	authAdmin            // 管理密钥
+)
+
+// route 路由的元信息，中间件据此决定是否对该路由生效
+type route struct {
+	pattern string
+	name    string    // 请求日志中的请求类型，为空时不记录请求日志
+	auth    routeAuth // 认证方式
+	timeout bool      // 是否加上ROUTE_TIMEOUT整体超时，流式和长时间的路由不加
+}
+
+// middleware 为路由包装一层处理逻辑，不适用于该路由时直接返回next
+type middleware func(rt route, next http.Handler) http.Handler
+
+type middlewareEntry struct {
+	name  string
+	stage middlewareStage
+	wrap  middleware
+}
+
+// middlewareChain 按阶段排列的中间件，同一阶段内按注册顺序执行
+type middlewareChain struct {
+	entries []middlewareEntry
+}
+
+// Use 注册一个中间件，必须在setupRoutes之前调用
+func (c *middlewareChain) Use(stage middlewareStage, name string, wrap middleware) {
+	c.entries = append(c.entries, middlewareEntry{name: name, stage: stage, wrap: wrap})
+	sort.SliceStable(c.entries, func(i, j int) bool {
+		return c.entries[i].stage < c.entries[j].stage
+	})
+}
+
+// Then 用整条链包装处理器，先注册（阶段靠前）的中间件在最外层
+func (c *middlewareChain) Then(rt route, handler http.Handler) http.Handler {
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		handler = c.entries[i].wrap(rt, handler)
+	}
+	return handler
+}
+
+// Names 按执行顺序返回已注册的中间件名称
+func (c *middlewareChain) Names() []string {
+	names := make([]string, len(c.entries))
+	for i, entry := range c.entries {
+		names[i] = entry.name
+	}
+	return names
+}
+
+// setupMiddleware 注册内置中间件
+// 新增横切功能时在这里注册，不需要修改各个处理器
+func (ps *ProxyServer) setupMiddleware() {
+	ps.middleware.Use(stageAuth, "request-id", requestIDMiddleware)
+	ps.middleware.Use(stageAuth, "log-sampling", logSamplingMiddleware)
+	ps.middleware.Use(stageAuth, "trace-context", traceContextMiddleware)
+	ps.middleware.Use(stageAuth, "client-profile", ps.clientProfileMiddleware)
+	ps.middleware.Use(stageAuth, "auth", ps.authMiddleware)
+	ps.middleware.Use(stageRateLimit, "tenant-limit", ps.tenantLimitMiddleware)
+	ps.middleware.Use(stageRateLimit, "quota", ps.quotaMiddleware)
+	ps.middleware.Use(stageRateLimit, "priority", ps.priorityMiddleware)
+	ps.middleware.Use(stageLogging, "request-log", requestLogMiddleware)
+	ps.middleware.Use(stageMetrics, "stats", func(rt route, next http.Handler) http.Handler {
+		return ps.withStats(rt.pattern, next)
+	})
+	ps.middleware.Use(stageTransform, "compression", func(rt route, next http.Handler) http.Handler {
+		return ps.withCompression(next)
+	})
+	// 输出整形在压缩之内，按明文的SSE数据估算token数
+	ps.middleware.Use(stageTransform, "token-shaping", ps.tokenShapingMiddleware)
+	ps.middleware.Use(stageTransform, "idempotency", ps.idempotencyMiddleware)
+	ps.middleware.Use(stageTransform, "hooks", ps.hooksMiddleware)
+	ps.middleware.Use(stageTransform, "script", ps.scriptMiddleware)
+	ps.middleware.Use(stageTransform, "semantic-cache", ps.semanticCacheMiddleware)
+
+	log.Printf("✓ 中间件链: %s", strings.Join(ps.middleware.Names(), " → "))
+}
+
+// handle 注册一个经过中间件链的路由
+func (ps *ProxyServer) handle(rt route, handler http.HandlerFunc) {
+	var h http.Handler = handler
+	if rt.timeout {
+		h = ps.withRouteTimeout(handler)
+	}
+	ps.mux.Handle(rt.pattern, ps.middleware.Then(rt, h))
+}
+
+// authMiddleware 按路由的认证方式校验客户端密钥或管理密钥
+func (ps *ProxyServer) authMiddleware(rt route, next http.Handler) http.Handler {
+	switch rt.auth {
+	case authAPIKey:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// CORS预检请求不携带密钥
+			if r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// 租户密钥：把租户保存到请求context中，后续按租户选择上游密钥、模型映射和限额
+			if t := ps.tenants.Match(clientAPIKey(r)); t != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+				return
+			}
+			if err := validateAPIKey(r, ps.config.DeepSeekAPIKey); err != nil {
+				details := map[string]string{"method": r.Method, "path": r.URL.Path, "reason": err.Error()}
+				if key := clientAPIKey(r); key != "" {
+					details["key"] = keyHash(key)
+				}
+				ps.audit.Record(requestAuditEntry("auth_failure", r, details))
+				ps.handleCORS(w, r)
+				ps.handleClientError(w, r, err, http.StatusUnauthorized, "API密钥验证")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	case authAdmin:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ps.checkAdminAuth(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	default:
+		return next
+	}
+}
+
+// requestLogMiddleware 为设置了名称的路由记录请求信息
+func requestLogMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.name == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r, rt.name)
+		next.ServeHTTP(w, r)
+	})
+}
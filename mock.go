@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 模拟上游：MOCK_UPSTREAM=true或-mock启动时，所有出站请求由进程内的mockTransport应答，
+// 返回固定格式的对话、补全、模型列表和向量，代理自身的转换、流式和统计逻辑照常执行。
+// 客户端集成测试和CI不需要DeepSeek API密钥，也不会产生费用。
+// 最后一条用户消息以 mock:status=429 这样的前缀开头时返回对应的错误，便于测试错误处理
+
+// mockAPIKey 模拟模式下未配置DEEPSEEK_API_KEY时使用的密钥，客户端用它认证
+const mockAPIKey = "sk-mock"
+
+// mockChunkRunes 模拟流式响应时每个数据块的字符数
+const mockChunkRunes = 8
+
+// mockTransport 模拟DeepSeek API的RoundTripper
+type mockTransport struct {
+	latency time.Duration
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if t.latency > 0 {
+		timer := time.NewTimer(t.latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return mockChatCompletion(req)
+	case strings.HasSuffix(path, "/completions"):
+		return mockFIMCompletion(req)
+	case strings.HasSuffix(path, "/models"):
+		return mockResponse(req, http.StatusOK, map[string]interface{}{
+			"object": "list",
+			"data": []map[string]interface{}{
+				{"id": "deepseek-chat", "object": "model", "owned_by": "deepseek"},
+				{"id": "deepseek-reasoner", "object": "model", "owned_by": "deepseek"},
+			},
+		}), nil
+	case strings.HasSuffix(path, "/embeddings"):
+		return mockEmbeddings(req)
+	}
+	return mockError(req, http.StatusNotFound, fmt.Sprintf("模拟上游不支持 %s", path)), nil
+}
+
+// mockRequest 模拟应答需要的请求字段
+type mockRequest struct {
+	Model         string      `json:"model"`
+	Messages      []Message   `json:"messages"`
+	Stream        bool        `json:"stream"`
+	Tools         []Tool      `json:"tools"`
+	ToolChoice    interface{} `json:"tool_choice"`
+	Prompt        string      `json:"prompt"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// lastUserMessage 最后一条用户消息的内容
+func (m *mockRequest) lastUserMessage() string {
+	for i := len(m.Messages) - 1; i >= 0; i-- {
+		if m.Messages[i].Role == "user" {
+			return m.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// mockStatus 解析 mock:status=NNN 前缀，没有时返回0
+func mockStatus(text string) int {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(text), "mock:status=")
+	if !ok {
+		return 0
+	}
+	code, _ := strconv.Atoi(strings.Fields(rest + " ")[0])
+	if code < 400 || code > 599 {
+		return 0
+	}
+	return code
+}
+
+// mockToolCall 请求要求调用工具（tool_choice为required或指定函数），或消息中包含mock:tool时，返回对第一个工具的调用
+func (m *mockRequest) mockToolCall() map[string]interface{} {
+	if len(m.Tools) == 0 || m.ToolChoice == "none" {
+		return nil
+	}
+	name := namedToolChoice(m.ToolChoice)
+	if name == "" {
+		if m.ToolChoice != "required" && !strings.Contains(m.lastUserMessage(), "mock:tool") {
+			return nil
+		}
+		name = m.Tools[0].Function.Name
+	}
+	return map[string]interface{}{
+		"index": 0,
+		"id":    "call_mock_" + name,
+		"type":  "function",
+		"function": map[string]interface{}{
+			"name":      name,
+			"arguments": "{}",
+		},
+	}
+}
+
+// mockChatCompletion 应答对话请求，推理模型额外返回推理内容
+func mockChatCompletion(req *http.Request) (*http.Response, error) {
+	var body mockRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return mockError(req, http.StatusBadRequest, "请求体不是有效的JSON"), nil
+	}
+	text := body.lastUserMessage()
+	if status := mockStatus(text); status != 0 {
+		return mockError(req, status, fmt.Sprintf("模拟的 %d 错误", status)), nil
+	}
+
+	reasoning := ""
+	if body.Model == "deepseek-reasoner" {
+		reasoning = "这是模拟的推理过程。"
+	}
+	content := "这是模拟响应：" + truncateString(text, 200)
+	toolCall := body.mockToolCall()
+	finishReason := "stop"
+	if toolCall != nil {
+		content, finishReason = "", "tool_calls"
+	}
+	usage := Usage{
+		PromptTokens:     countPromptTokens(body.Messages, body.Tools),
+		CompletionTokens: estimateTokens(reasoning) + estimateTokens(content),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	usage.PromptCacheMissTokens = usage.PromptTokens
+	id := fmt.Sprintf("mock-%d", time.Now().UnixNano())
+
+	if !body.Stream {
+		message := map[string]interface{}{"role": "assistant", "content": content}
+		if reasoning != "" {
+			message["reasoning_content"] = reasoning
+		}
+		if toolCall != nil {
+			delete(toolCall, "index")
+			message["tool_calls"] = []interface{}{toolCall}
+		}
+		return mockResponse(req, http.StatusOK, map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   body.Model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "message": message, "finish_reason": finishReason}},
+			"usage":   usage,
+		}), nil
+	}
+
+	var sse bytes.Buffer
+	writeChunk := func(delta map[string]interface{}, finish interface{}) {
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   body.Model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finish}},
+		})
+		fmt.Fprintf(&sse, "data: %s\n\n", data)
+	}
+	writeChunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+	for _, piece := range splitRunes(reasoning, mockChunkRunes) {
+		writeChunk(map[string]interface{}{"reasoning_content": piece}, nil)
+	}
+	for _, piece := range splitRunes(content, mockChunkRunes) {
+		writeChunk(map[string]interface{}{"content": piece}, nil)
+	}
+	if toolCall != nil {
+		writeChunk(map[string]interface{}{"tool_calls": []interface{}{toolCall}}, nil)
+	}
+	writeChunk(map[string]interface{}{}, finishReason)
+	if body.StreamOptions != nil && body.StreamOptions.IncludeUsage {
+		data, _ := json.Marshal(map[string]interface{}{
+			"id": id, "object": "chat.completion.chunk", "created": time.Now().Unix(),
+			"model": body.Model, "choices": []interface{}{}, "usage": usage,
+		})
+		fmt.Fprintf(&sse, "data: %s\n\n", data)
+	}
+	sse.WriteString("data: [DONE]\n\n")
+
+	resp := mockResponse(req, http.StatusOK, nil)
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Body = io.NopCloser(&sse)
+	resp.ContentLength = int64(sse.Len())
+	return resp, nil
+}
+
+// mockFIMCompletion 应答beta补全（FIM）请求
+func mockFIMCompletion(req *http.Request) (*http.Response, error) {
+	var body mockRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return mockError(req, http.StatusBadRequest, "请求体不是有效的JSON"), nil
+	}
+	text := "/* mock */"
+	usage := Usage{PromptTokens: estimateTokens(body.Prompt), CompletionTokens: estimateTokens(text)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	id := fmt.Sprintf("mock-%d", time.Now().UnixNano())
+	result := map[string]interface{}{
+		"id":      id,
+		"object":  "text_completion",
+		"created": time.Now().Unix(),
+		"model":   body.Model,
+		"choices": []interface{}{map[string]interface{}{"index": 0, "text": text, "finish_reason": "stop"}},
+		"usage":   usage,
+	}
+	if !body.Stream {
+		return mockResponse(req, http.StatusOK, result), nil
+	}
+	data, _ := json.Marshal(result)
+	sse := fmt.Sprintf("data: %s\n\ndata: [DONE]\n\n", data)
+	resp := mockResponse(req, http.StatusOK, nil)
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Body = io.NopCloser(strings.NewReader(sse))
+	resp.ContentLength = int64(len(sse))
+	return resp, nil
+}
+
+// mockEmbeddings 按文本哈希生成确定的向量，相同的文本得到相同的向量
+func mockEmbeddings(req *http.Request) (*http.Response, error) {
+	var body struct {
+		Input interface{} `json:"input"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return mockError(req, http.StatusBadRequest, "请求体不是有效的JSON"), nil
+	}
+	var inputs []string
+	switch v := body.Input.(type) {
+	case string:
+		inputs = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, _ := item.(string)
+			inputs = append(inputs, s)
+		}
+	}
+	data := make([]interface{}, len(inputs))
+	for i, input := range inputs {
+		vector := make([]float64, 16)
+		for j := range vector {
+			h := fnv.New32a()
+			fmt.Fprintf(h, "%d:%s", j, input)
+			vector[j] = float64(h.Sum32())/float64(1<<32) - 0.5
+		}
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": vector}
+	}
+	return mockResponse(req, http.StatusOK, map[string]interface{}{"object": "list", "data": data}), nil
+}
+
+// mockResponse 构造JSON响应，body为nil时响应体为空
+func mockResponse(req *http.Request, status int, body interface{}) *http.Response {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
+
+// mockError 构造DeepSeek格式的错误响应，429时附带Retry-After
+func mockError(req *http.Request, status int, message string) *http.Response {
+	resp := mockResponse(req, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": openAIErrorType(status)},
+	})
+	if status == http.StatusTooManyRequests {
+		resp.Header.Set("Retry-After", "1")
+	}
+	return resp
+}
+
+// splitRunes 把文本按字符数切分
+func splitRunes(text string, size int) []string {
+	runes := []rune(text)
+	var pieces []string
+	for start := 0; start < len(runes); start += size {
+		pieces = append(pieces, string(runes[start:min(start+size, len(runes))]))
+	}
+	return pieces
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 模型A/B分流：MODEL_SPLITS按比例把同一个客户端模型分到不同的DeepSeek模型，
+// 例如 gpt-4o=deepseek-chat:90|deepseek-reasoner:10。同一个用户、会话或客户端密钥总是分到同一组，
+// 每组单独统计请求数、错误数、延迟和token用量，便于在切换模型前比较效果
+
+// splitArm 分流规则中的一组
+type splitArm struct {
+	Model  string
+	Weight int
+}
+
+// splitArmStats 一组的累计指标
+type splitArmStats struct {
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	MaxLatencyMs int64   `json:"max_latency_ms"`
+	Usage        Usage   `json:"usage"`
+	latencyMs    int64
+}
+
+// modelSplits 按客户端模型名索引的分流规则和各组指标
+type modelSplits struct {
+	rules map[string][]splitArm
+
+	mu    sync.Mutex
+	stats map[string]map[string]*splitArmStats
+}
+
+// newModelSplits 解析MODEL_SPLITS，未配置时返回nil
+func newModelSplits(config *ProxyConfig) (*modelSplits, error) {
+	if len(config.ModelSplits) == 0 {
+		return nil, nil
+	}
+	s := &modelSplits{
+		rules: make(map[string][]splitArm),
+		stats: make(map[string]map[string]*splitArmStats),
+	}
+	for _, rule := range config.ModelSplits {
+		model, arms, ok := strings.Cut(rule, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("MODEL_SPLITS 中的 '%s' 格式错误，应为 模型=目标:权重|目标:权重", rule)
+		}
+		if _, exists := s.rules[model]; exists {
+			return nil, fmt.Errorf("MODEL_SPLITS 中模型 %s 重复配置", model)
+		}
+		s.stats[model] = make(map[string]*splitArmStats)
+		for _, arm := range strings.Split(arms, "|") {
+			target, raw, ok := strings.Cut(arm, ":")
+			target = strings.TrimSpace(target)
+			weight, err := strconv.Atoi(strings.TrimSpace(raw))
+			if !ok || target == "" || err != nil || weight < 0 {
+				return nil, fmt.Errorf("MODEL_SPLITS 中模型 %s 的分组 '%s' 格式错误，应为 目标:权重", model, arm)
+			}
+			if _, exists := s.stats[model][target]; exists {
+				return nil, fmt.Errorf("MODEL_SPLITS 中模型 %s 的目标 %s 重复", model, target)
+			}
+			s.rules[model] = append(s.rules[model], splitArm{Model: target, Weight: weight})
+			s.stats[model][target] = &splitArmStats{}
+		}
+		total := 0
+		for _, arm := range s.rules[model] {
+			total += arm.Weight
+		}
+		if total <= 0 {
+			return nil, fmt.Errorf("MODEL_SPLITS 中模型 %s 的权重之和必须大于0", model)
+		}
+	}
+	return s, nil
+}
+
+// splitKey 分流依据：请求的user字段、会话ID、客户端密钥，都没有时按客户端IP
+func splitKey(r *http.Request, req *ChatRequest) string {
+	if req.User != "" {
+		return "user:" + req.User
+	}
+	if id := req.SessionID; id != "" {
+		return "session:" + id
+	}
+	if id := r.Header.Get("X-Session-ID"); id != "" {
+		return "session:" + id
+	}
+	if clientAPIKey(r) != "" {
+		return "key:" + clientKeyHash(r)
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// Assign 为请求的模型选择分组，没有对应规则时返回空字符串
+func (s *modelSplits) Assign(r *http.Request, req *ChatRequest, requestID string) string {
+	if s == nil {
+		return ""
+	}
+	arms, ok := s.rules[req.Model]
+	if !ok {
+		return ""
+	}
+	total := 0
+	for _, arm := range arms {
+		total += arm.Weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(req.Model + "\x00" + splitKey(r, req)))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, arm := range arms {
+		if bucket < arm.Weight {
+			log.Printf("[%s] A/B分流: %s -> %s", requestID, req.Model, arm.Model)
+			return arm.Model
+		}
+		bucket -= arm.Weight
+	}
+	return ""
+}
+
+// Record 汇总一个分流请求的结果
+func (s *modelSplits) Record(model, arm string, status int, duration time.Duration, usage Usage) {
+	if s == nil || arm == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.stats[model][arm]
+	if !ok {
+		return
+	}
+	latency := duration.Milliseconds()
+	stats.Requests++
+	if status >= 400 {
+		stats.Errors++
+	}
+	stats.latencyMs += latency
+	stats.MaxLatencyMs = max(stats.MaxLatencyMs, latency)
+	stats.Usage = addUsage(stats.Usage, usage)
+}
+
+// Snapshot 各规则的分组、权重和指标，用于统计接口
+func (s *modelSplits) Snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]interface{}, len(s.rules))
+	for model, arms := range s.rules {
+		result := make(map[string]interface{}, len(arms))
+		for _, arm := range arms {
+			stats := *s.stats[model][arm.Model]
+			if stats.Requests > 0 {
+				stats.AvgLatencyMs = float64(stats.latencyMs) / float64(stats.Requests)
+			}
+			result[arm.Model] = map[string]interface{}{"weight": arm.Weight, "stats": stats}
+		}
+		snapshot[model] = result
+	}
+	return snapshot
+}
+
+// recordSplitArm 在请求的统计记录中登记分到的组
+func recordSplitArm(ctx context.Context, arm string) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.arm = arm
+		record.mu.Unlock()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// moderationCategories OpenAI审核接口的标准类别，本地规则没有配置的类别始终返回false
+var moderationCategories = []string{
+	"harassment", "harassment/threatening",
+	"hate", "hate/threatening",
+	"illicit", "illicit/violent",
+	"self-harm", "self-harm/intent", "self-harm/instructions",
+	"sexual", "sexual/minors",
+	"violence", "violence/graphic",
+}
+
+// moderationCategory 本地审核规则中的一个类别
+type moderationCategory struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns,omitempty"` // 正则表达式
+	Words    []string `json:"words,omitempty"`    // 词表，不区分大小写
+
+	pattern *regexp.Regexp
+}
+
+// moderationRules 基于规则的本地审核分类器，文本命中某个类别的任一规则即标记该类别
+type moderationRules struct {
+	Categories []*moderationCategory `json:"categories"`
+}
+
+func loadModerationRules(path string) (*moderationRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取审核规则失败: %w", err)
+	}
+	m := &moderationRules{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("解析审核规则失败: %w", err)
+	}
+
+	for i, category := range m.Categories {
+		if category.Name == "" {
+			return nil, fmt.Errorf("第 %d 个审核类别缺少name", i+1)
+		}
+		pattern, err := compileRulePattern(category.Name, category.Patterns, category.Words)
+		if err != nil {
+			return nil, err
+		}
+		category.pattern = pattern
+	}
+	return m, nil
+}
+
+// classify 对一段文本分类，返回OpenAI格式的单个审核结果，命中的类别得分为1
+func (m *moderationRules) classify(text string) map[string]interface{} {
+	categories := make(map[string]bool, len(moderationCategories))
+	scores := make(map[string]float64, len(moderationCategories))
+	for _, name := range moderationCategories {
+		categories[name], scores[name] = false, 0
+	}
+
+	flagged := false
+	if m != nil {
+		for _, category := range m.Categories {
+			if category.pattern.MatchString(text) {
+				categories[category.Name], scores[category.Name] = true, 1
+				flagged = true
+			} else if _, ok := categories[category.Name]; !ok {
+				categories[category.Name], scores[category.Name] = false, 0
+			}
+		}
+	}
+	return map[string]interface{}{
+		"flagged":         flagged,
+		"categories":      categories,
+		"category_scores": scores,
+	}
+}
+
+// ModerationRequest OpenAI /v1/moderations 请求
+type ModerationRequest struct {
+	Input json.RawMessage `json:"input"` // 字符串、字符串数组或多模态内容数组
+	Model string          `json:"model,omitempty"`
+}
+
+// texts 解析待审核的文本：字符串数组每项对应一个结果，多模态内容数组合并为一个结果，图片不参与本地审核
+func (req *ModerationRequest) texts() ([]string, error) {
+	var input string
+	if err := json.Unmarshal(req.Input, &input); err == nil {
+		return []string{input}, nil
+	}
+	var inputs []string
+	if err := json.Unmarshal(req.Input, &inputs); err == nil && len(inputs) > 0 {
+		return inputs, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(req.Input, &parts); err == nil && len(parts) > 0 {
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if part.Type == "text" {
+				texts = append(texts, part.Text)
+			}
+		}
+		return []string{strings.Join(texts, "\n")}, nil
+	}
+	apiErr := newAPIError(http.StatusBadRequest, "input必须是字符串、非空的字符串数组或多模态内容数组")
+	apiErr.Param = "input"
+	return nil, apiErr
+}
+
+// handleModerations 处理内容审核请求：POST /v1/moderations
+// 配置了MODERATION_URL时转发给外部审核服务，否则使用本地规则分类
+func (ps *ProxyServer) handleModerations(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	requestID := requestIDFor(r)
+	var req ModerationRequest
+	if err := readJSONRequest(r, &req); err != nil {
+		handleError(w, fmt.Errorf("解析请求失败: %w", err), http.StatusBadRequest, "请求解析")
+		return
+	}
+	texts, err := req.texts()
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest, "请求检查")
+		return
+	}
+
+	if ps.config.ModerationURL != "" {
+		ps.forwardModeration(w, r, &req, requestID)
+		return
+	}
+
+	model := req.Model
+	if model == "" {
+		model = "proxy-rules"
+	}
+	results := make([]map[string]interface{}, len(texts))
+	flagged := 0
+	for i, text := range texts {
+		results[i] = ps.moderation.classify(text)
+		if results[i]["flagged"] == true {
+			flagged++
+		}
+	}
+	log.Printf("[%s] 本地审核完成：%d 条输入，%d 条被标记", requestID, len(texts), flagged)
+
+	if err := writeJSONResponse(w, map[string]interface{}{
+		"id":      "modr-" + requestID,
+		"model":   model,
+		"results": results,
+	}); err != nil {
+		log.Printf("[%s] 写入响应失败: %v", requestID, err)
+	}
+}
+
+// forwardModeration 把审核请求转发给外部审核服务，响应原样返回
+func (ps *ProxyServer) forwardModeration(w http.ResponseWriter, r *http.Request, req *ModerationRequest, requestID string) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		handleError(w, fmt.Errorf("序列化请求失败: %w", err), http.StatusInternalServerError, "请求转换")
+		return
+	}
+	httpReq, err := http.NewRequestWithContext(r.Context(), "POST", ps.config.ModerationURL, bytes.NewReader(body))
+	if err != nil {
+		handleError(w, fmt.Errorf("创建HTTP请求失败: %w", err), http.StatusInternalServerError, "请求转换")
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if ps.config.ModerationAPIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+ps.config.ModerationAPIKey)
+	}
+	injectTraceContext(r.Context(), httpReq)
+
+	resp, err := ps.httpClient.Do(httpReq)
+	if err != nil {
+		handleError(w, fmt.Errorf("外部审核服务请求失败: %w", err), http.StatusBadGateway, "内容审核")
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Printf("[%s] 外部审核服务返回状态码 %d", requestID, resp.StatusCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("[%s] 写入响应失败: %v", requestID, err)
+	}
+}
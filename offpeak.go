@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 错峰调度：DeepSeek在夜间优惠时段降价，按OFF_PEAK_WINDOWS配置的时间表把批处理任务推迟到优惠时段执行，
+// 高峰期的bulk优先级请求可以按OFF_PEAK_PEAK_MODELS换用更便宜的模型，并在统计中报告优惠时段节省的费用
+
+// offPeakWindow 一个优惠时段，start和end为一天中的分钟数，end小于start时跨越午夜
+type offPeakWindow struct {
+	start, end int
+}
+
+func (w offPeakWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// contains 一天中的第minute分钟是否在时段内
+func (w offPeakWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// parseOffPeakWindow 解析 HH:MM-HH:MM 格式的时段
+func parseOffPeakWindow(value string) (offPeakWindow, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(value), "-")
+	if !ok {
+		return offPeakWindow{}, fmt.Errorf("优惠时段 '%s' 格式错误，应为 HH:MM-HH:MM", value)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return offPeakWindow{}, fmt.Errorf("优惠时段 '%s' 的开始时间无效", value)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return offPeakWindow{}, fmt.Errorf("优惠时段 '%s' 的结束时间无效", value)
+	}
+	w := offPeakWindow{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute()}
+	if w.start == w.end {
+		return offPeakWindow{}, fmt.Errorf("优惠时段 '%s' 的开始和结束时间相同", value)
+	}
+	return w, nil
+}
+
+// offPeakStats 错峰调度的累计统计
+type offPeakStats struct {
+	Requests         int64   `json:"requests"`          // 在优惠时段内完成的请求数
+	Usage            Usage   `json:"usage"`             // 优惠时段内的token用量
+	Cost             float64 `json:"cost"`              // 按优惠价估算的费用（美元）
+	Savings          float64 `json:"savings"`           // 相比原价节省的费用（美元）
+	DeferredBatches  int64   `json:"deferred_batches"`  // 被推迟到优惠时段的批处理任务数
+	SwitchedRequests int64   `json:"switched_requests"` // 高峰期换用其他模型的请求数
+}
+
+// offPeakSchedule 优惠时段的时间表、调度策略和节省费用的统计
+type offPeakSchedule struct {
+	windows        []offPeakWindow
+	location       *time.Location
+	deferBatches   bool
+	peakModels     map[string]string // 高峰期bulk请求的模型替换
+	discount       float64           // 默认折扣比例，0.5表示优惠时段便宜一半
+	modelDiscounts map[string]float64
+	prices         usagePrices
+
+	mu    sync.Mutex
+	stats offPeakStats
+}
+
+// newOffPeakSchedule 按配置创建错峰调度，未设置OFF_PEAK_WINDOWS时返回nil
+func newOffPeakSchedule(config *ProxyConfig) (*offPeakSchedule, error) {
+	if len(config.OffPeakWindows) == 0 {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(config.OffPeakTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("OFF_PEAK_TIMEZONE 无效: %w", err)
+	}
+	s := &offPeakSchedule{
+		location:       location,
+		deferBatches:   config.OffPeakDeferBatches,
+		peakModels:     make(map[string]string),
+		discount:       config.OffPeakDiscount,
+		modelDiscounts: config.OffPeakModelDiscounts,
+		prices: usagePrices{
+			PromptCacheHit:  config.UsagePricePromptCacheHit,
+			PromptCacheMiss: config.UsagePricePromptCacheMiss,
+			Completion:      config.UsagePriceCompletion,
+		},
+	}
+	for _, value := range config.OffPeakWindows {
+		w, err := parseOffPeakWindow(value)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	for _, pair := range config.OffPeakPeakModels {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("OFF_PEAK_PEAK_MODELS 中的 '%s' 格式错误，应为 原模型=替换模型", pair)
+		}
+		s.peakModels[from] = to
+	}
+	if s.discount < 0 || s.discount > 1 {
+		return nil, fmt.Errorf("OFF_PEAK_DISCOUNT 必须在0到1之间: %v", s.discount)
+	}
+	for model, discount := range s.modelDiscounts {
+		if discount < 0 || discount > 1 {
+			return nil, fmt.Errorf("OFF_PEAK_MODEL_DISCOUNTS 中 %s 的折扣必须在0到1之间: %v", model, discount)
+		}
+	}
+	return s, nil
+}
+
+// active 时间t是否在优惠时段内
+func (s *offPeakSchedule) active(t time.Time) bool {
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range s.windows {
+		if w.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStart 时间t之后最近的优惠时段开始时间
+func (s *offPeakSchedule) nextStart(t time.Time) time.Time {
+	local := t.In(s.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+	var next time.Time
+	for _, w := range s.windows {
+		start := midnight.Add(time.Duration(w.start) * time.Minute)
+		if !start.After(t) {
+			start = midnight.AddDate(0, 0, 1).Add(time.Duration(w.start) * time.Minute)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// batchDelay 批处理任务还需等待多久才能进入优惠时段；已在时段内、未启用推迟，
+// 或等到时段开始会超过任务的完成时限时返回0，立即执行
+func (s *offPeakSchedule) batchDelay(now time.Time, expiresAt int64) time.Duration {
+	if s == nil || !s.deferBatches || s.active(now) {
+		return 0
+	}
+	next := s.nextStart(now)
+	if next.Unix() >= expiresAt {
+		return 0
+	}
+	return next.Sub(now)
+}
+
+// recordDeferred 记录一个被推迟的批处理任务
+func (s *offPeakSchedule) recordDeferred() {
+	s.mu.Lock()
+	s.stats.DeferredBatches++
+	s.mu.Unlock()
+}
+
+// switchModel 高峰期的bulk优先级请求按OFF_PEAK_PEAK_MODELS换用其他模型，返回请求的副本
+func (s *offPeakSchedule) switchModel(ctx context.Context, req *DeepSeekRequest, requestID string) *DeepSeekRequest {
+	if s == nil || priorityFor(ctx) != priorityBulk || s.active(time.Now()) {
+		return req
+	}
+	model, ok := s.peakModels[req.Model]
+	if !ok {
+		return req
+	}
+	log.Printf("[%s] 高峰期bulk请求换用模型: %s -> %s", requestID, req.Model, model)
+	s.mu.Lock()
+	s.stats.SwitchedRequests++
+	s.mu.Unlock()
+	switched := *req
+	switched.Model = model
+	return &switched
+}
+
+// Record 统计一个在优惠时段内完成的请求，按原价和折扣估算节省的费用
+func (s *offPeakSchedule) Record(model string, usage Usage, at time.Time) {
+	if s == nil || usage.TotalTokens == 0 || !s.active(at) {
+		return
+	}
+	discount, ok := s.modelDiscounts[model]
+	if !ok {
+		discount = s.discount
+	}
+	cost := s.prices.cost(usage)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Requests++
+	s.stats.Usage = addUsage(s.stats.Usage, usage)
+	s.stats.Cost += cost * (1 - discount)
+	s.stats.Savings += cost * discount
+}
+
+// Snapshot 时间表、当前是否处于优惠时段和累计统计，用于统计接口
+func (s *offPeakSchedule) Snapshot() map[string]interface{} {
+	windows := make([]string, len(s.windows))
+	for i, w := range s.windows {
+		windows[i] = w.String()
+	}
+	now := time.Now()
+	s.mu.Lock()
+	stats := s.stats
+	s.mu.Unlock()
+
+	snapshot := map[string]interface{}{
+		"windows":  windows,
+		"timezone": s.location.String(),
+		"active":   s.active(now),
+		"stats":    stats,
+	}
+	if !s.active(now) {
+		snapshot["next_window"] = s.nextStart(now).Format(time.RFC3339)
+	}
+	return snapshot
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// parallel_tool_calls为false时，模型一次返回多个工具调用只交给客户端第一个：
+// drop模式丢弃其余调用；queue模式把其余调用暂存，客户端提交上一个调用的结果后
+// 直接返回下一个调用而不请求上游，直到队列为空。流式响应只能丢弃
+
+// 暂存的工具调用保留多久
+const toolCallQueueTTL = 10 * time.Minute
+
+// serialToolCalls 客户端是否要求每轮最多一个工具调用
+func (req *DeepSeekRequest) serialToolCalls() bool {
+	return req.ParallelToolCalls != nil && !*req.ParallelToolCalls
+}
+
+// queuedToolCalls 一次响应中尚未交给客户端的工具调用
+type queuedToolCalls struct {
+	resp    DeepSeekResponse
+	pending []ToolCall
+	expires time.Time
+}
+
+// toolCallQueue 按客户端密钥和上一个调用的id保存暂存的工具调用
+type toolCallQueue struct {
+	mu      sync.Mutex
+	entries map[string]*queuedToolCalls
+}
+
+func newToolCallQueue() *toolCallQueue {
+	return &toolCallQueue{entries: make(map[string]*queuedToolCalls)}
+}
+
+func (q *toolCallQueue) put(key string, entry *queuedToolCalls) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for k, e := range q.entries {
+		if now.After(e.expires) {
+			delete(q.entries, k)
+		}
+	}
+	entry.expires = now.Add(toolCallQueueTTL)
+	q.entries[key] = entry
+}
+
+func (q *toolCallQueue) take(key string) *queuedToolCalls {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(q.entries, key)
+	if time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// limitToolCalls 客户端关闭并行工具调用时，只保留第一个选项中的第一个工具调用，
+// queue模式下把其余调用暂存起来
+func (ps *ProxyServer) limitToolCalls(r *http.Request, req *DeepSeekRequest, resp *DeepSeekResponse, requestID string) *DeepSeekResponse {
+	if !req.serialToolCalls() || len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) <= 1 {
+		return resp
+	}
+
+	toolCalls := resp.Choices[0].Message.ToolCalls
+	limited := *resp
+	limited.Choices = append([]DeepSeekChoice{}, resp.Choices...)
+	limited.Choices[0].Message.ToolCalls = toolCalls[:1]
+
+	if ps.toolCallQueue == nil {
+		log.Printf("[%s] parallel_tool_calls为false，丢弃 %d 个多余的工具调用", requestID, len(toolCalls)-1)
+		return &limited
+	}
+	queued := *resp
+	queued.Usage = Usage{}
+	ps.toolCallQueue.put(clientKeyHash(r)+"/"+toolCalls[0].ID, &queuedToolCalls{
+		resp:    queued,
+		pending: append([]ToolCall{}, toolCalls[1:]...),
+	})
+	log.Printf("[%s] parallel_tool_calls为false，暂存 %d 个工具调用", requestID, len(toolCalls)-1)
+	return &limited
+}
+
+// nextQueuedToolCall 对话以暂存调用之前那个调用的结果结尾时，返回下一个暂存的工具调用
+func (ps *ProxyServer) nextQueuedToolCall(r *http.Request, req *DeepSeekRequest, requestID string) *DeepSeekResponse {
+	if ps.toolCallQueue == nil || len(req.Messages) == 0 {
+		return nil
+	}
+	last := req.Messages[len(req.Messages)-1]
+	if last.Role != "tool" || last.ToolCallID == "" {
+		return nil
+	}
+	entry := ps.toolCallQueue.take(clientKeyHash(r) + "/" + last.ToolCallID)
+	if entry == nil {
+		return nil
+	}
+
+	next := entry.pending[0]
+	resp := entry.resp
+	resp.Choices = []DeepSeekChoice{{
+		Index:        0,
+		Message:      Message{Role: "assistant", ToolCalls: []ToolCall{next}},
+		FinishReason: "tool_calls",
+	}}
+	if len(entry.pending) > 1 {
+		ps.toolCallQueue.put(clientKeyHash(r)+"/"+next.ID, &queuedToolCalls{resp: entry.resp, pending: entry.pending[1:]})
+	}
+	log.Printf("[%s] 返回暂存的工具调用 %s，剩余 %d 个", requestID, next.Function.Name, len(entry.pending)-1)
+	return &resp
+}
+
+// writeQueuedToolCall 把暂存的工具调用按客户端请求的方式写出
+func (ps *ProxyServer) writeQueuedToolCall(w http.ResponseWriter, r *http.Request, resp *DeepSeekResponse, originalModel, requestID string, stream bool) {
+	w.Header().Set("X-Proxy-Tool-Call-Queue", "hit")
+	if !stream {
+		if err := writeJSONResponse(w, ps.convertToOpenAIResponse(r.Context(), resp, originalModel, requestID)); err != nil {
+			log.Printf("[%s] 写入响应失败: %v", requestID, err)
+		}
+		return
+	}
+	setSSEHeaders(w)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleError(w, fmt.Errorf("服务器不支持流式响应"), http.StatusInternalServerError, "流式响应检查")
+		return
+	}
+	ps.streamCompleteResponse(r.Context(), w, flusher, resp, originalModel, requestID)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// 参数约束：在转换请求时检查采样参数和max_tokens的取值范围。
+// clamp模式把越界的值调整到边界内，reject模式返回指明参数名的invalid_request_error，
+// 避免把上游含糊的400错误转给客户端；off不检查
+
+// defaultModelMaxOutputTokens 各模型默认的最大输出长度，可通过MODEL_MAX_OUTPUT_TOKENS覆盖
+var defaultModelMaxOutputTokens = map[string]int{
+	"deepseek-chat":     8192,
+	"deepseek-reasoner": 65536,
+}
+
+// extraParamRanges 透传字段中需要检查范围的数值参数
+var extraParamRanges = map[string][2]float64{
+	"top_p":             {0, 1},
+	"presence_penalty":  {-2, 2},
+	"frequency_penalty": {-2, 2},
+	"top_logprobs":      {0, 20},
+}
+
+// invalidParamError 参数越界时返回给客户端的错误
+func invalidParamError(param string, value interface{}, min, max interface{}) error {
+	return &apiError{
+		StatusCode: http.StatusBadRequest,
+		Type:       errTypeInvalidRequest,
+		Message:    fmt.Sprintf("参数 %s 的值 %v 超出允许的范围 [%v, %v]", param, value, min, max),
+		Param:      param,
+		Code:       "invalid_value",
+	}
+}
+
+// enforceParamPolicy 按PARAM_POLICY检查并修正请求参数
+func (ps *ProxyServer) enforceParamPolicy(req *DeepSeekRequest, requestID string) error {
+	policy := ps.config.ParamPolicy
+	if policy == "off" {
+		return nil
+	}
+
+	// 推理模型不使用temperature，转换时已经置零
+	if req.Model != "deepseek-reasoner" {
+		minTemp, maxTemp := ps.config.TemperatureMin, ps.config.TemperatureMax
+		if req.Temperature < minTemp || req.Temperature > maxTemp {
+			if policy == "reject" {
+				return invalidParamError("temperature", req.Temperature, minTemp, maxTemp)
+			}
+			clamped := min(max(req.Temperature, minTemp), maxTemp)
+			log.Printf("[%s] temperature %.2f 超出范围，调整为 %.2f", requestID, req.Temperature, clamped)
+			req.Temperature = clamped
+		}
+	}
+
+	limit, ok := ps.config.ModelMaxOutputTokens[req.Model]
+	if !ok {
+		limit = defaultModelMaxOutputTokens[req.Model]
+	}
+	if req.MaxTokens < 0 || (limit > 0 && req.MaxTokens > limit) {
+		if policy == "reject" {
+			return invalidParamError("max_tokens", req.MaxTokens, 1, limit)
+		}
+		clamped := limit
+		if req.MaxTokens < 0 {
+			clamped = 0 // 不设置，由上游使用默认值
+		}
+		log.Printf("[%s] max_tokens %d 超出范围，调整为 %d", requestID, req.MaxTokens, clamped)
+		req.MaxTokens = clamped
+	}
+
+	for param, bounds := range extraParamRanges {
+		raw, ok := req.extra[param]
+		if !ok {
+			continue
+		}
+		var value float64
+		if json.Unmarshal(raw, &value) != nil {
+			return &apiError{
+				StatusCode: http.StatusBadRequest,
+				Type:       errTypeInvalidRequest,
+				Message:    fmt.Sprintf("参数 %s 必须是数字", param),
+				Param:      param,
+				Code:       "invalid_type",
+			}
+		}
+		if value >= bounds[0] && value <= bounds[1] {
+			continue
+		}
+		if policy == "reject" {
+			return invalidParamError(param, value, bounds[0], bounds[1])
+		}
+		clamped := min(max(value, bounds[0]), bounds[1])
+		log.Printf("[%s] %s %v 超出范围，调整为 %v", requestID, param, value, clamped)
+		// extra可能与客户端请求共用，修改前复制一份
+		extra := make(map[string]json.RawMessage, len(req.extra))
+		for name, v := range req.extra {
+			extra[name] = v
+		}
+		extra[param] = json.RawMessage(strconv.FormatFloat(clamped, 'f', -1, 64))
+		req.extra = extra
+	}
+	return nil
+}
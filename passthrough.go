@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// canPassthrough 判断流式响应能否原样透传
+// 客户端请求的就是DeepSeek原生模型且映射后模型名不变时，逐块解析再序列化没有任何作用，
+// 直接转发可以降低延迟和CPU占用
+func (ps *ProxyServer) canPassthrough(ctx context.Context, originalModel string, deepseekReq *DeepSeekRequest) bool {
+	// 出站内容过滤需要解析每个数据块
+	if !ps.config.StreamPassthrough || (ps.guardrails != nil && ps.guardrails.hasOutput) {
+		return false
+	}
+	// 工具调用增量需要整理为OpenAI的格式
+	if len(deepseekReq.Tools) > 0 {
+		return false
+	}
+	// 客户端配置要求改写推理内容
+	if clientProfileFor(ctx).reasoningMode(true) != reasoningSeparate {
+		return false
+	}
+	return strings.HasPrefix(originalModel, "deepseek-") && originalModel == deepseekReq.Model
+}
+
+// passthroughStreamingData 把上游SSE响应体原样复制给客户端
+// 仍然保留心跳、首token超时以及异常结束时补发错误事件和[DONE]的行为，
+// 并从复制的数据中取出最后一个数据块的用量，计入配额、预算和统计
+func (ps *ProxyServer) passthroughStreamingData(w io.Writer, reader io.ReadCloser,
+	flusher http.Flusher, requestID string, ctx context.Context) {
+
+	log.Printf("[%s] 原样透传流式数据", requestID)
+
+	firstTokenTimer := startFirstTokenTimer(ps.config.FirstTokenTimeout, reader)
+	defer firstTokenTimer.Stop()
+
+	heartbeat := startStreamHeartbeat(w, flusher, ps.config.StreamKeepAliveInterval, requestID)
+	defer heartbeat.Stop()
+
+	usage := &sseUsageScanner{ctx: ctx, max: ps.config.StreamMaxLineBytes}
+
+	// 保留最近写出的一小段数据，用于判断上游是否发送了结束标记
+	doneMarker := []byte("data: [DONE]")
+	var tail []byte
+	buf := make([]byte, 32*1024)
+	var readErr error
+
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			heartbeat.Stop()
+			if bytes.Contains(buf[:n], []byte("data:")) {
+				firstTokenTimer.Stop()
+			}
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				log.Printf("[%s] 写入客户端失败: %v", requestID, writeErr)
+				return
+			}
+			flusher.Flush()
+			usage.Write(buf[:n])
+
+			tail = append(tail, buf[:n]...)
+			if len(tail) > 2*len(doneMarker) {
+				tail = tail[len(tail)-2*len(doneMarker):]
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+
+	if bytes.Contains(tail, doneMarker) {
+		log.Printf("[%s] 流式数据透传完成", requestID)
+		return
+	}
+	if streamErr := ps.abnormalStreamError(ctx, firstTokenTimer.Expired(), readErr, requestID); streamErr != nil {
+		writeStreamError(w, flusher, streamErr, requestID)
+	}
+}
+
+// sseUsageScanner 把透传的字节按行拆开，对data行调用recordStreamUsage。
+// 超过max字节的行（大段正文）直接跳过，带用量的数据块很短
+type sseUsageScanner struct {
+	ctx      context.Context
+	max      int
+	line     []byte
+	overflow bool
+}
+
+func (s *sseUsageScanner) Write(p []byte) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.append(p)
+			return
+		}
+		s.append(p[:i])
+		if !s.overflow {
+			line := bytes.TrimSuffix(s.line, []byte("\r"))
+			if data, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+				recordStreamUsage(s.ctx, string(data))
+			}
+		}
+		s.line, s.overflow = s.line[:0], false
+		p = p[i+1:]
+	}
+}
+
+func (s *sseUsageScanner) append(p []byte) {
+	if s.overflow {
+		return
+	}
+	if s.max > 0 && len(s.line)+len(p) > s.max {
+		s.line, s.overflow = s.line[:0], true
+		return
+	}
+	s.line = append(s.line, p...)
+}
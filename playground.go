@@ -0,0 +1,36 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
+
+// playgroundAssets Playground页面的静态资源，编译进二进制文件
+//
+//go:embed web/playground
+var playgroundAssets embed.FS
+
+// handlePlayground 提供内置的对话测试页面
+// 页面直接调用本代理的/v1/chat/completions，用户无需配置外部客户端即可验证密钥和模型
+func (ps *ProxyServer) handlePlayground(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+		return
+	}
+
+	if r.URL.Path == "/playground" || r.URL.Path == "/playground/" {
+		page, err := playgroundAssets.ReadFile("web/playground/index.html")
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError, "Playground")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+		return
+	}
+
+	assets, _ := fs.Sub(playgroundAssets, "web/playground")
+	http.StripPrefix("/playground/", http.FileServer(http.FS(assets))).ServeHTTP(w, r)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 请求优先级：上游并发达到UPSTREAM_MAX_CONCURRENCY时，等待的请求按优先级排队，
+// 空出的名额按权重在各优先级之间轮流分配，编辑器的交互请求优先于批量任务，批量任务也不会饿死。
+// 优先级来自X-Priority头部或PRIORITY_KEYS中的密钥配置，批处理接口的请求默认为bulk，
+// 创建者的密钥在PRIORITY_KEYS中固定了优先级时以配置为准
+
+// 优先级，数值越小越优先
+type requestPriority int
+
+const (
+	priorityInteractive requestPriority = iota
+	priorityNormal
+	priorityBulk
+	priorityCount
+)
+
+var priorityNames = [priorityCount]string{"interactive", "normal", "bulk"}
+
+func (p requestPriority) String() string {
+	return priorityNames[p]
+}
+
+// parsePriority 解析优先级名称，high和low分别作为interactive和bulk的别名
+func parsePriority(name string) (requestPriority, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "interactive", "high":
+		return priorityInteractive, true
+	case "normal", "":
+		return priorityNormal, true
+	case "bulk", "low", "batch":
+		return priorityBulk, true
+	}
+	return priorityNormal, false
+}
+
+// defaultPriorityWeights 各优先级分配名额的默认权重
+var defaultPriorityWeights = [priorityCount]int{6, 3, 1}
+
+type priorityKey struct{}
+
+// withPriority 在context中记录请求的优先级
+func withPriority(ctx context.Context, p requestPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFor 返回context中的优先级，没有设置时为normal
+func priorityFor(ctx context.Context) requestPriority {
+	if p, ok := ctx.Value(priorityKey{}).(requestPriority); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// priorityMiddleware 按X-Priority头部或密钥配置确定请求的优先级
+// 密钥配置了优先级时以配置为准，客户端不能自行提升
+func (ps *ProxyServer) priorityMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || (ps.scheduler == nil && ps.offPeak == nil) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority, ok := ps.config.keyPriority(clientAPIKey(r))
+		if !ok {
+			priority = ps.config.defaultPriority
+			if header := r.Header.Get("X-Priority"); header != "" {
+				if p, valid := parsePriority(header); valid {
+					priority = p
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(withPriority(r.Context(), priority)))
+	})
+}
+
+// keyPriority PRIORITY_KEYS为密钥固定的优先级，可以用完整的密钥或keyHash匹配
+func (c *ProxyConfig) keyPriority(key string) (requestPriority, bool) {
+	if p, ok := c.priorityKeys[key]; ok {
+		return p, true
+	}
+	p, ok := c.priorityKeys[keyHash(key)]
+	return p, ok
+}
+
+// loadPriorityConfig 解析PRIORITY_KEYS、PRIORITY_DEFAULT和PRIORITY_WEIGHTS
+func loadPriorityConfig(config *ProxyConfig) error {
+	var ok bool
+	if config.defaultPriority, ok = parsePriority(config.PriorityDefault); !ok {
+		return fmt.Errorf("PRIORITY_DEFAULT 无效: %s（可选 interactive、normal、bulk）", config.PriorityDefault)
+	}
+	config.priorityKeys = make(map[string]requestPriority)
+	for _, pair := range config.PriorityKeys {
+		key, name, found := strings.Cut(pair, "=")
+		p, valid := parsePriority(name)
+		if !found || !valid || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("PRIORITY_KEYS 中的 '%s' 格式错误，应为 密钥=interactive|normal|bulk", maskAPIKey(pair))
+		}
+		config.priorityKeys[strings.TrimSpace(key)] = p
+	}
+	config.priorityWeights = defaultPriorityWeights
+	for name, weight := range config.PriorityWeights {
+		p, valid := parsePriority(name)
+		if !valid || name == "" || weight <= 0 {
+			return fmt.Errorf("PRIORITY_WEIGHTS 中的 %s=%d 无效，权重必须大于0", name, weight)
+		}
+		config.priorityWeights[p] = weight
+	}
+	return nil
+}
+
+// schedulerWaiter 一个排队等待上游名额的请求
+type schedulerWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// upstreamScheduler 限制同时进行的上游请求数，名额不足时按优先级加权轮转分配
+type upstreamScheduler struct {
+	mu         sync.Mutex
+	limit      int
+	maxQueue   int           // 排队请求数上限，0表示不限制
+	maxWait    time.Duration // 排队的最长时间，0表示一直等到名额或客户端断开
+	retryAfter time.Duration // 拒绝请求时建议客户端等待的时间
+	active     int
+	queues     [priorityCount][]*schedulerWaiter
+	weights    [priorityCount]int
+	current    [priorityCount]int // 平滑加权轮转的当前值
+}
+
+func newUpstreamScheduler(config *ProxyConfig) *upstreamScheduler {
+	return &upstreamScheduler{
+		limit:      config.UpstreamMaxConcurrency,
+		maxQueue:   config.UpstreamMaxQueue,
+		maxWait:    config.UpstreamQueueTimeout,
+		retryAfter: config.BackpressureRetryAfter,
+		weights:    config.priorityWeights,
+	}
+}
+
+// Acquire 获取一个上游名额，context结束时放弃排队
+// 排队已满或排队超时时返回*saturatedError
+func (s *upstreamScheduler) Acquire(ctx context.Context, priority requestPriority, requestID string) error {
+	s.mu.Lock()
+	if s.active < s.limit && s.queued() == 0 {
+		s.active++
+		s.mu.Unlock()
+		return nil
+	}
+	if s.maxQueue > 0 && s.queued() >= s.maxQueue {
+		err := s.newQueueSaturatedError("排队已满")
+		s.mu.Unlock()
+		log.Printf("[%s] 上游排队已满（%d 个等待），拒绝请求", requestID, s.maxQueue)
+		return err
+	}
+	waiter := &schedulerWaiter{ready: make(chan struct{})}
+	s.queues[priority] = append(s.queues[priority], waiter)
+	queued := s.queued()
+	s.mu.Unlock()
+	log.Printf("[%s] 上游并发已满，按 %s 优先级排队（共 %d 个等待）", requestID, priority, queued)
+
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		timer := time.NewTimer(s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.abandon(waiter, priority) {
+			// 放弃时名额刚好分配给了自己，转交给下一个
+			s.handOff()
+		}
+		return ctx.Err()
+	case <-timeout:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.abandon(waiter, priority) {
+			// 超时的同时拿到了名额，照常使用
+			return nil
+		}
+		log.Printf("[%s] 排队超过 %v 仍未获得上游名额，拒绝请求", requestID, s.maxWait)
+		return s.newQueueSaturatedError(fmt.Sprintf("排队超过 %v", s.maxWait))
+	}
+}
+
+// abandon 把放弃等待的请求移出队列，名额刚好已经分配给它时返回true，调用方需持有锁
+func (s *upstreamScheduler) abandon(waiter *schedulerWaiter, priority requestPriority) bool {
+	if waiter.granted {
+		return true
+	}
+	queue := s.queues[priority]
+	for i, w := range queue {
+		if w == waiter {
+			s.queues[priority] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// Release 归还名额，有请求排队时直接转交
+func (s *upstreamScheduler) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handOff()
+}
+
+// handOff 把一个名额交给按权重选出的排队请求，没有排队时释放名额，调用方需持有锁
+func (s *upstreamScheduler) handOff() {
+	total, next := 0, requestPriority(-1)
+	for p := requestPriority(0); p < priorityCount; p++ {
+		if len(s.queues[p]) == 0 {
+			s.current[p] = 0
+			continue
+		}
+		total += s.weights[p]
+		s.current[p] += s.weights[p]
+		if next < 0 || s.current[p] > s.current[next] {
+			next = p
+		}
+	}
+	if next < 0 {
+		s.active--
+		return
+	}
+	s.current[next] -= total
+	waiter := s.queues[next][0]
+	s.queues[next] = s.queues[next][1:]
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+// queued 排队中的请求数，调用方需持有锁
+func (s *upstreamScheduler) queued() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Snapshot 各优先级的排队数和进行中的请求数，用于统计接口
+func (s *upstreamScheduler) Snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+// snapshot 同Snapshot，调用方需持有锁
+func (s *upstreamScheduler) snapshot() map[string]interface{} {
+	queued := make(map[string]int, priorityCount)
+	for p := requestPriority(0); p < priorityCount; p++ {
+		queued[p.String()] = len(s.queues[p])
+	}
+	return map[string]interface{}{"limit": s.limit, "active": s.active, "queued": queued}
+}
+
+// releaseOnClose 响应体关闭时归还上游名额，流式响应在读完之前一直占用名额
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (rc *releaseOnClose) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 配额：QUOTAS_FILE为客户端密钥设置每个周期的请求数和token数上限，周期按daily、weekly（周一开始）、
+// monthly在QUOTA_TIMEZONE的零点重置。用量按密钥哈希保存在QUOTA_STATE_FILE中，重启后继续累计。
+// 每个经过认证的API请求计1次请求，token数在请求结束后按上游返回的用量累加，
+// 因此最后一个请求可能让token用量略超出上限，之后的请求被拒绝直到下一个周期
+
+// quotaSaveInterval 用量有变化时写入状态文件的间隔
+const quotaSaveInterval = 30 * time.Second
+
+// 配额重置周期
+const (
+	quotaDaily   = "daily"
+	quotaWeekly  = "weekly"
+	quotaMonthly = "monthly"
+)
+
+// quotaLimit 一个密钥在每个周期内的额度
+type quotaLimit struct {
+	Requests int64  `json:"requests,omitempty"` // 每个周期的请求数，0表示不限制
+	Tokens   int64  `json:"tokens,omitempty"`   // 每个周期的token数（输入加输出），0表示不限制
+	Reset    string `json:"reset,omitempty"`    // daily（默认）、weekly或monthly
+}
+
+// quotaCounter 一个密钥在当前周期的用量
+type quotaCounter struct {
+	Key         string    `json:"key"` // 脱敏后的密钥，便于在统计中辨认
+	PeriodStart time.Time `json:"period_start"`
+	Requests    int64     `json:"requests"`
+	Tokens      int64     `json:"tokens"`
+}
+
+// quotaManager 配额配置和各密钥的用量
+type quotaManager struct {
+	defaultLimit *quotaLimit           // 未单独配置的密钥使用的额度，为nil时不限制
+	keys         map[string]quotaLimit // 按密钥单独配置的额度
+	location     *time.Location
+	stateFile    string
+
+	mu       sync.Mutex
+	counters map[string]*quotaCounter // 按密钥哈希
+	dirty    bool
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// newQuotaManager 加载配额配置和保存的用量，QUOTAS_FILE为空时返回nil
+func newQuotaManager(config *ProxyConfig) (*quotaManager, error) {
+	if config.QuotasFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(config.QuotasFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取配额配置文件失败: %w", err)
+	}
+	var file struct {
+		Default *quotaLimit           `json:"default"`
+		Keys    map[string]quotaLimit `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("解析配额配置文件失败: %w", err)
+	}
+	location, err := time.LoadLocation(config.QuotaTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("QUOTA_TIMEZONE 无效: %w", err)
+	}
+
+	m := &quotaManager{
+		defaultLimit: file.Default,
+		keys:         make(map[string]quotaLimit, len(file.Keys)),
+		location:     location,
+		stateFile:    config.QuotaStateFile,
+		counters:     make(map[string]*quotaCounter),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	if m.defaultLimit != nil {
+		if err := normalizeQuotaLimit(m.defaultLimit); err != nil {
+			return nil, fmt.Errorf("默认配额: %w", err)
+		}
+	}
+	for key, limit := range file.Keys {
+		if err := normalizeQuotaLimit(&limit); err != nil {
+			return nil, fmt.Errorf("密钥 %s 的配额: %w", maskAPIKey(key), err)
+		}
+		m.keys[key] = limit
+	}
+
+	if m.stateFile != "" {
+		data, err := os.ReadFile(m.stateFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("读取配额状态文件失败: %w", err)
+		default:
+			if err := json.Unmarshal(data, &m.counters); err != nil {
+				return nil, fmt.Errorf("解析配额状态文件失败: %w", err)
+			}
+		}
+		go m.saveLoop()
+	} else {
+		close(m.stopped)
+	}
+	return m, nil
+}
+
+func normalizeQuotaLimit(limit *quotaLimit) error {
+	if limit.Reset == "" {
+		limit.Reset = quotaDaily
+	}
+	switch limit.Reset {
+	case quotaDaily, quotaWeekly, quotaMonthly:
+	default:
+		return fmt.Errorf("reset只能是 daily、weekly 或 monthly，当前为 %q", limit.Reset)
+	}
+	if limit.Requests < 0 || limit.Tokens < 0 {
+		return fmt.Errorf("requests和tokens不能为负数")
+	}
+	return nil
+}
+
+// limitFor 密钥的额度，没有配置时返回false
+func (m *quotaManager) limitFor(key string) (quotaLimit, bool) {
+	if limit, ok := m.keys[key]; ok {
+		return limit, true
+	}
+	if m.defaultLimit != nil {
+		return *m.defaultLimit, true
+	}
+	return quotaLimit{}, false
+}
+
+// period 包含now的周期的开始和结束时间
+func (m *quotaManager) period(reset string, now time.Time) (time.Time, time.Time) {
+	now = now.In(m.location)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, m.location)
+	switch reset {
+	case quotaWeekly:
+		start = start.AddDate(0, 0, -int((now.Weekday()+6)%7))
+		return start, start.AddDate(0, 0, 7)
+	case quotaMonthly:
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, m.location)
+		return start, start.AddDate(0, 1, 0)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// counter 返回密钥当前周期的用量，进入新周期时清零，调用方持有m.mu
+func (m *quotaManager) counter(key string, limit quotaLimit, now time.Time) (*quotaCounter, time.Time) {
+	start, end := m.period(limit.Reset, now)
+	hash := keyHash(key)
+	counter := m.counters[hash]
+	if counter == nil {
+		counter = &quotaCounter{Key: maskAPIKey(key)}
+		m.counters[hash] = counter
+	}
+	if !counter.PeriodStart.Equal(start) {
+		counter.PeriodStart, counter.Requests, counter.Tokens = start, 0, 0
+		m.dirty = true
+	}
+	return counter, end
+}
+
+// quotaUsage 一项额度的使用情况
+type quotaUsage struct {
+	Limit     int64 `json:"limit"`
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+}
+
+// quotaStatus 密钥在当前周期的配额状态，用于响应头部和 /v1/usage
+type quotaStatus struct {
+	Reset       string      `json:"reset"`
+	PeriodStart time.Time   `json:"period_start"`
+	ResetsAt    time.Time   `json:"resets_at"`
+	Requests    *quotaUsage `json:"requests,omitempty"`
+	Tokens      *quotaUsage `json:"tokens,omitempty"`
+}
+
+func newQuotaUsage(limit, used int64) *quotaUsage {
+	if limit <= 0 {
+		return nil
+	}
+	return &quotaUsage{Limit: limit, Used: used, Remaining: max(limit-used, 0)}
+}
+
+// exhausted 是否已用完任一额度
+func (s *quotaStatus) exhausted() bool {
+	return (s.Requests != nil && s.Requests.Remaining == 0) || (s.Tokens != nil && s.Tokens.Remaining == 0)
+}
+
+// setHeaders 在响应头部中返回配额状态
+func (s *quotaStatus) setHeaders(header http.Header) {
+	header.Set("X-Quota-Reset", s.ResetsAt.Format(time.RFC3339))
+	if s.Requests != nil {
+		header.Set("X-Quota-Requests-Limit", strconv.FormatInt(s.Requests.Limit, 10))
+		header.Set("X-Quota-Requests-Remaining", strconv.FormatInt(s.Requests.Remaining, 10))
+	}
+	if s.Tokens != nil {
+		header.Set("X-Quota-Tokens-Limit", strconv.FormatInt(s.Tokens.Limit, 10))
+		header.Set("X-Quota-Tokens-Remaining", strconv.FormatInt(s.Tokens.Remaining, 10))
+	}
+}
+
+// status 由用量生成配额状态，调用方持有m.mu
+func (m *quotaManager) status(limit quotaLimit, counter *quotaCounter, end time.Time) *quotaStatus {
+	return &quotaStatus{
+		Reset:       limit.Reset,
+		PeriodStart: counter.PeriodStart,
+		ResetsAt:    end,
+		Requests:    newQuotaUsage(limit.Requests, counter.Requests),
+		Tokens:      newQuotaUsage(limit.Tokens, counter.Tokens),
+	}
+}
+
+// Admit 检查密钥的配额，未用完时计入本次请求；密钥没有配额时返回nil
+func (m *quotaManager) Admit(key string, now time.Time) (*quotaStatus, bool) {
+	if m == nil || key == "" {
+		return nil, true
+	}
+	limit, ok := m.limitFor(key)
+	if !ok {
+		return nil, true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counter, end := m.counter(key, limit, now)
+	if status := m.status(limit, counter, end); status.exhausted() {
+		return status, false
+	}
+	counter.Requests++
+	m.dirty = true
+	return m.status(limit, counter, end), true
+}
+
+// Record 把请求结束时的token用量计入密钥的配额，只记录已经通过Admit的密钥
+func (m *quotaManager) Record(key string, usage Usage) {
+	if m == nil || key == "" || usage.TotalTokens == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if counter := m.counters[keyHash(key)]; counter != nil {
+		counter.Tokens += int64(usage.TotalTokens)
+		m.dirty = true
+	}
+}
+
+// Status 密钥当前的配额状态，不计入请求；密钥没有配额时返回nil
+func (m *quotaManager) Status(key string, now time.Time) *quotaStatus {
+	if m == nil || key == "" {
+		return nil
+	}
+	limit, ok := m.limitFor(key)
+	if !ok {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counter, end := m.counter(key, limit, now)
+	return m.status(limit, counter, end)
+}
+
+// quotaMiddleware 拒绝配额已用完的请求，并在响应头部中返回配额状态
+func (ps *ProxyServer) quotaMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || ps.quotas == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		status, ok := ps.quotas.Admit(clientAPIKey(r), time.Now())
+		if status != nil {
+			status.setHeaders(w.Header())
+		}
+		if !ok {
+			log.Printf("[%s] 密钥 %s 的配额已用完，%s 重置", requestIDFor(r), maskAPIKey(clientAPIKey(r)), status.ResetsAt.Format(time.RFC3339))
+			ps.handleCORS(w, r)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(status.ResetsAt).Seconds())+1))
+			apiErr := newAPIError(http.StatusTooManyRequests, fmt.Sprintf("配额已用完，将于 %s 重置", status.ResetsAt.Format(time.RFC3339)))
+			apiErr.Code = "insufficient_quota"
+			writeAPIError(w, apiErr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isClientKey 密钥是否可以访问代理，用于不需要认证的路由判断是否返回与密钥相关的信息
+func (ps *ProxyServer) isClientKey(key string) bool {
+	return key != "" && (key == ps.config.DeepSeekAPIKey || ps.tenants.Match(key) != nil)
+}
+
+// Stats 各密钥当前周期的用量，用于统计接口
+func (m *quotaManager) Stats() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := make([]quotaCounter, 0, len(m.counters))
+	for _, counter := range m.counters {
+		counters = append(counters, *counter)
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Key < counters[j].Key })
+	return map[string]interface{}{
+		"timezone":   m.location.String(),
+		"keys":       len(m.keys),
+		"default":    m.defaultLimit,
+		"usage":      counters,
+		"state_file": m.stateFile,
+	}
+}
+
+// saveLoop 定期把有变化的用量写入状态文件
+func (m *quotaManager) saveLoop() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.save()
+		case <-m.done:
+			m.save()
+			return
+		}
+	}
+}
+
+// save 用量有变化时写入状态文件
+func (m *quotaManager) save() {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(m.counters, "", "  ")
+	m.dirty = false
+	m.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(m.stateFile, data)
+	}
+	if err != nil {
+		log.Printf("保存配额状态失败: %v", err)
+	}
+}
+
+// Close 停止定期保存并写入最后的用量
+func (m *quotaManager) Close() {
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	<-m.stopped
+}
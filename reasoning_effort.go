@@ -0,0 +1,44 @@
+package main
+
+import "log"
+
+// reasoning_effort映射：o系列客户端用reasoning_effort控制思考的投入，DeepSeek没有对应参数，
+// 对deepseek-reasoner按档位设置输出上限（思考过程和回答共用max_tokens），
+// 让为o3调好的客户端得到大致成比例的行为
+
+// defaultReasoningEffortTokens 各档位默认的max_tokens，可通过REASONING_EFFORT_MAX_TOKENS覆盖
+var defaultReasoningEffortTokens = map[string]int{
+	"minimal": 2048,
+	"low":     4096,
+	"medium":  16384,
+	"high":    32768,
+}
+
+// applyReasoningEffort 按reasoning_effort为推理模型设置max_tokens，客户端明确设置了max_tokens时以客户端为准
+func (ps *ProxyServer) applyReasoningEffort(openaiReq ChatRequest, deepseekReq *DeepSeekRequest, requestID string) {
+	effort := openaiReq.ReasoningEffort
+	if effort == "" {
+		return
+	}
+	if deepseekReq.Model != "deepseek-reasoner" {
+		log.Printf("[%s] 非推理模型忽略reasoning_effort: %s", requestID, effort)
+		return
+	}
+	if openaiReq.MaxTokens != nil {
+		log.Printf("[%s] 客户端已设置max_tokens，忽略reasoning_effort: %s", requestID, effort)
+		return
+	}
+
+	budget, ok := ps.config.ReasoningEffortMaxTokens[effort]
+	if !ok {
+		budget, ok = defaultReasoningEffortTokens[effort]
+	}
+	if !ok {
+		log.Printf("[%s] 未知的reasoning_effort: %s，按默认设置处理", requestID, effort)
+		return
+	}
+	if budget > 0 {
+		deepseekReq.MaxTokens = budget
+	}
+	log.Printf("[%s] reasoning_effort=%s，设置最大令牌数: %d", requestID, effort, budget)
+}
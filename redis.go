@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis存储：实现RESP协议中用到的少量命令，连接按需建立并放回空闲池复用。
+// REDIS_URL格式为 redis://[用户名:密码@]主机:端口[/数据库]，rediss:// 使用TLS
+
+// redisMaxIdleConns 空闲连接池的大小
+const redisMaxIdleConns = 16
+
+// redisIncrScript 原子地增加计数，键第一次创建时设置过期时间
+const redisIncrScript = `local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if n == tonumber(ARGV[1]) and tonumber(ARGV[2]) > 0 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return n`
+
+// errRedisNil Redis返回的空值（键不存在）
+var errRedisNil = errors.New("redis: nil")
+
+// redisError Redis返回的错误回复
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisStore 通过Redis在多个实例之间共享状态
+type redisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	prefix   string
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// redisConn 一个Redis连接
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// newRedisStore 解析REDIS_URL并确认能连接到Redis
+func newRedisStore(rawURL, prefix string) (*redisStore, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("STATE_STORE=redis 需要设置 REDIS_URL")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL 无效: %w", err)
+	}
+	store := &redisStore{addr: u.Host, prefix: prefix}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		store.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("REDIS_URL 只支持 redis:// 或 rediss://，当前为 %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		store.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		store.username = u.User.Username()
+		store.password, _ = u.User.Password()
+		if _, ok := u.User.Password(); !ok {
+			// redis://密码@主机 的写法
+			store.username, store.password = "", store.username
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if store.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("REDIS_URL 中的数据库编号无效: %q", db)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := store.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("无法连接Redis %s: %w", store.addr, err)
+	}
+	return store, nil
+}
+
+// dial 建立新连接并完成认证和选择数据库
+func (s *redisStore) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tls}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := rc.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Redis认证失败: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do 取一个连接执行命令；网络错误时关闭连接，Redis的错误回复不影响连接复用
+func (s *redisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	s.mu.Lock()
+	var rc *redisConn
+	if n := len(s.idle); n > 0 {
+		rc, s.idle = s.idle[n-1], s.idle[:n-1]
+	}
+	s.mu.Unlock()
+
+	if rc == nil {
+		var err error
+		if rc, err = s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.idle) < redisMaxIdleConns {
+		s.idle = append(s.idle, rc)
+		rc = nil
+	}
+	s.mu.Unlock()
+	if rc != nil {
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// do 发送一条命令并读取回复
+func (rc *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(stateStoreTimeout)
+	}
+	rc.conn.SetDeadline(deadline)
+
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply 读取一个RESP回复：简单字符串、错误、整数、批量字符串或数组
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: 空回复")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: 无效的回复 %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: 无效的回复 %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := rc.readReply()
+			if err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: 无效的回复 %q", line)
+	}
+}
+
+func ttlMillis(ttl time.Duration) string {
+	return strconv.FormatInt(ttl.Milliseconds(), 10)
+}
+
+// Ping 检查Redis是否可用
+func (s *redisStore) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", s.prefix+key)
+	if errors.Is(err, errRedisNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value, _ := reply.([]byte)
+	return value, true, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", s.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", ttlMillis(ttl))
+	}
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+func (s *redisStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", s.prefix + key, string(value), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", ttlMillis(ttl))
+	}
+	_, err := s.do(ctx, args...)
+	if errors.Is(err, errRedisNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", s.prefix+key)
+	return err
+}
+
+// DeletePrefix 用SCAN遍历匹配的键分批删除，不阻塞Redis
+func (s *redisStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	pattern := redisGlobEscape(s.prefix+prefix) + "*"
+	cursor := "0"
+	count := 0
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			return count, err
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 2 {
+			return count, fmt.Errorf("redis: SCAN回复格式无效")
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if b, ok := key.([]byte); ok {
+					args = append(args, string(b))
+				}
+			}
+			deleted, err := s.do(ctx, args...)
+			if err != nil {
+				return count, err
+			}
+			n, _ := deleted.(int64)
+			count += int(n)
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return count, nil
+		}
+	}
+}
+
+// redisGlobEscape 转义SCAN MATCH模式中的特殊字符
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *redisStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := s.do(ctx, "EVAL", redisIncrScript, "1", s.prefix+key, strconv.FormatInt(delta, 10), ttlMillis(ttl))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: INCRBY回复格式无效")
+	}
+	return n, nil
+}
+
+func (s *redisStore) Shared() bool { return true }
+
+// Close 关闭空闲连接
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rc := range s.idle {
+		rc.conn.Close()
+	}
+	s.idle = nil
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 定期用量报告：按REPORT_SCHEDULE每天或每周（周一）在REPORT_AT发送一份汇总，
+// 包括请求数、错误率、token用量、估算费用和用量最多的模型，发送到REPORT_WEBHOOK_URL（POST JSON）
+// 或通过SMTP发邮件给REPORT_EMAIL_TO。汇总来自统计模块，每次发送后开始新的统计周期
+
+// reportTopModels 报告中列出的模型数
+const reportTopModels = 5
+
+// modelReport 一个模型在报告周期内的用量
+type modelReport struct {
+	Model     string  `json:"model"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Usage     Usage   `json:"usage"`
+	Cost      float64 `json:"cost"`
+}
+
+// reportPeriod 统计模块中当前报告周期的累计值
+type reportPeriod struct {
+	start    time.Time
+	requests int64
+	errors   int64
+	usage    Usage
+	cost     float64
+	models   map[string]*modelReport
+}
+
+func newReportPeriod(start time.Time) reportPeriod {
+	return reportPeriod{start: start, models: make(map[string]*modelReport)}
+}
+
+// recordReport 把一个已结束的请求计入当前报告周期，调用方持有s.mu
+func (s *proxyStats) recordReport(entry requestLog, usage Usage) {
+	period := &s.period
+	period.requests++
+	failed := entry.Status >= 400
+	if failed {
+		period.errors++
+	}
+	cost := s.prices.cost(usage)
+	period.usage = addUsage(period.usage, usage)
+	period.cost += cost
+	if entry.Model == "" {
+		return
+	}
+	model := period.models[entry.Model]
+	if model == nil {
+		model = &modelReport{Model: entry.Model}
+		period.models[entry.Model] = model
+	}
+	model.Requests++
+	if failed {
+		model.Errors++
+	}
+	model.Usage = addUsage(model.Usage, usage)
+	model.Cost += cost
+}
+
+// usageReport 一份用量汇总报告
+type usageReport struct {
+	Schedule  string        `json:"schedule"`
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Requests  int64         `json:"requests"`
+	Errors    int64         `json:"errors"`
+	ErrorRate float64       `json:"error_rate"`
+	Usage     Usage         `json:"usage"`
+	Cost      float64       `json:"cost"` // 按USAGE_PRICE_*估算的费用（美元）
+	TopModels []modelReport `json:"top_models"`
+}
+
+// Report 生成当前报告周期的汇总，reset为true时同时开始新的周期
+func (s *proxyStats) Report(now time.Time, reset bool) usageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	period := s.period
+	report := usageReport{
+		From:      period.start,
+		To:        now,
+		Requests:  period.requests,
+		Errors:    period.errors,
+		ErrorRate: errorRate(period.errors, period.requests),
+		Usage:     period.usage,
+		Cost:      period.cost,
+		TopModels: make([]modelReport, 0, len(period.models)),
+	}
+	for _, model := range period.models {
+		entry := *model
+		entry.ErrorRate = errorRate(entry.Errors, entry.Requests)
+		report.TopModels = append(report.TopModels, entry)
+	}
+	sort.Slice(report.TopModels, func(i, j int) bool {
+		a, b := report.TopModels[i], report.TopModels[j]
+		if a.Usage.TotalTokens != b.Usage.TotalTokens {
+			return a.Usage.TotalTokens > b.Usage.TotalTokens
+		}
+		return a.Requests > b.Requests
+	})
+	if len(report.TopModels) > reportTopModels {
+		report.TopModels = report.TopModels[:reportTopModels]
+	}
+	if reset {
+		s.period = newReportPeriod(now)
+	}
+	return report
+}
+
+func errorRate(errors, requests int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
+
+// Text 报告的纯文本形式，用于邮件正文
+func (r usageReport) Text(location *time.Location) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "时间范围: %s 至 %s\n", r.From.In(location).Format("2006-01-02 15:04"), r.To.In(location).Format("2006-01-02 15:04 MST"))
+	fmt.Fprintf(&b, "请求数: %d，错误: %d（%.2f%%）\n", r.Requests, r.Errors, r.ErrorRate*100)
+	fmt.Fprintf(&b, "token: 输入 %d（缓存命中 %d），输出 %d，合计 %d\n",
+		r.Usage.PromptTokens, r.Usage.PromptCacheHitTokens, r.Usage.CompletionTokens, r.Usage.TotalTokens)
+	fmt.Fprintf(&b, "估算费用: $%.4f\n", r.Cost)
+	if len(r.TopModels) > 0 {
+		b.WriteString("\n用量最多的模型:\n")
+		for i, model := range r.TopModels {
+			fmt.Fprintf(&b, "  %d. %s  请求 %d  token %d  费用 $%.4f  错误率 %.2f%%\n",
+				i+1, model.Model, model.Requests, model.Usage.TotalTokens, model.Cost, model.ErrorRate*100)
+		}
+	}
+	return b.String()
+}
+
+// reportScheduler 按计划生成并发送报告
+type reportScheduler struct {
+	config   *ProxyConfig
+	stats    *proxyStats
+	client   *http.Client
+	location *time.Location
+	hour     int
+	minute   int
+	done     chan struct{}
+}
+
+// newReportScheduler 创建报告计划，REPORT_SCHEDULE为off时返回nil
+func newReportScheduler(config *ProxyConfig, stats *proxyStats, client *http.Client) *reportScheduler {
+	if config.ReportSchedule == "off" {
+		return nil
+	}
+	// 配置已由checkConfig校验
+	at, _ := time.Parse("15:04", config.ReportAt)
+	location, _ := time.LoadLocation(config.ReportTimezone)
+	return &reportScheduler{
+		config:   config,
+		stats:    stats,
+		client:   client,
+		location: location,
+		hour:     at.Hour(),
+		minute:   at.Minute(),
+		done:     make(chan struct{}),
+	}
+}
+
+// next 下一次发送报告的时间
+func (rs *reportScheduler) next(now time.Time) time.Time {
+	local := now.In(rs.location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), rs.hour, rs.minute, 0, 0, rs.location)
+	if rs.config.ReportSchedule == "weekly" {
+		next = next.AddDate(0, 0, (int(time.Monday)-int(local.Weekday())+7)%7)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	}
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Run 等到计划时间发送报告，直到Close
+func (rs *reportScheduler) Run() {
+	for {
+		next := rs.next(time.Now())
+		log.Printf("下一次用量报告: %s", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			rs.Send(rs.stats.Report(time.Now(), true))
+		case <-rs.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close 停止发送报告
+func (rs *reportScheduler) Close() {
+	close(rs.done)
+}
+
+// Send 把报告发送到所有配置的目标，失败时只记录日志
+func (rs *reportScheduler) Send(report usageReport) {
+	report.Schedule = rs.config.ReportSchedule
+	if rs.config.ReportWebhookURL != "" {
+		if err := rs.postWebhook(report); err != nil {
+			log.Printf("发送用量报告到webhook失败: %v", err)
+		} else {
+			log.Printf("✓ 用量报告已发送到webhook")
+		}
+	}
+	if len(rs.config.ReportEmailTo) > 0 {
+		if err := rs.sendEmail(report); err != nil {
+			log.Printf("发送用量报告邮件失败: %v", err)
+		} else {
+			log.Printf("✓ 用量报告已发送给 %s", strings.Join(rs.config.ReportEmailTo, ", "))
+		}
+	}
+}
+
+func (rs *reportScheduler) postWebhook(report usageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", rs.config.ReportWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (rs *reportScheduler) sendEmail(report usageReport) error {
+	title := "每日"
+	if report.Schedule == "weekly" {
+		title = "每周"
+	}
+	subject := fmt.Sprintf("DeepSeek代理%s用量报告 %s", title, report.To.In(rs.location).Format("2006-01-02"))
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", rs.config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(rs.config.ReportEmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: =?UTF-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject)))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(report.Text(rs.location), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if rs.config.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(rs.config.SMTPAddr)
+		auth = smtp.PlainAuth("", rs.config.SMTPUsername, rs.config.SMTPPassword, host)
+	}
+	return smtp.SendMail(rs.config.SMTPAddr, auth, rs.config.SMTPFrom, rs.config.ReportEmailTo, msg.Bytes())
+}
+
+// handleAdminReport 预览当前报告周期的汇总，不开始新的周期；POST时立即发送并开始新的周期
+func (ps *ProxyServer) handleAdminReport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		report := ps.stats.Report(time.Now(), false)
+		report.Schedule = ps.config.ReportSchedule
+		if err := writeJSONResponse(w, report); err != nil {
+			log.Printf("写入用量报告失败: %v", err)
+		}
+	case "POST":
+		if ps.reports == nil {
+			writeAPIError(w, newAPIError(http.StatusNotFound, "未启用定期用量报告（REPORT_SCHEDULE=off）"))
+			return
+		}
+		report := ps.stats.Report(time.Now(), true)
+		ps.reports.Send(report)
+		report.Schedule = ps.config.ReportSchedule
+		if err := writeJSONResponse(w, report); err != nil {
+			log.Printf("写入用量报告失败: %v", err)
+		}
+	default:
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// 请求ID：代理为每个请求生成内部请求ID，用于日志、统计、流缓冲等按请求区分的数据，并转发给上游。
+// 客户端通过X-Request-ID头部提供的ID只原样写回响应头和错误响应体，并以X-Client-Request-ID转发给上游，
+// 不作为内部ID：
+// 客户端可以任意指定它，相同的值会让不同请求的数据相互覆盖。请求日志中记录两者的对应关系，
+// 方便用户把自己的日志和代理日志对应起来
+
+// 客户端提供的请求ID的最大长度，超出或含有不可见字符时忽略
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+type clientRequestIDKey struct{}
+
+// requestIDMiddleware 生成内部请求ID并写入响应头，客户端提供了请求ID时响应头写回客户端的值。
+// 处理器通过requestIDFor取得内部ID，通过clientRequestIDFor取得客户端的ID
+func requestIDMiddleware(rt route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := generateRequestID()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		if clientID := r.Header.Get("X-Request-ID"); validRequestID(clientID) {
+			ctx = context.WithValue(ctx, clientRequestIDKey{}, clientID)
+			w.Header().Set("X-Request-ID", clientID)
+		} else {
+			w.Header().Set("X-Request-ID", requestID)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFor 返回当前请求的内部ID，不经过中间件时生成一个新的
+func requestIDFor(r *http.Request) string {
+	if requestID, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return requestID
+	}
+	return generateRequestID()
+}
+
+// clientRequestIDFor 返回客户端通过X-Request-ID提供的请求ID，没有提供时为空
+func clientRequestIDFor(r *http.Request) string {
+	clientID, _ := r.Context().Value(clientRequestIDKey{}).(string)
+	return clientID
+}
+
+// forwardClientRequestID 把context中客户端提供的请求ID以X-Client-Request-ID附加到发出的请求上
+func forwardClientRequestID(ctx context.Context, req *http.Request) {
+	if clientID, ok := ctx.Value(clientRequestIDKey{}).(string); ok {
+		req.Header.Set("X-Client-Request-ID", clientID)
+	}
+}
+
+// validRequestID 只接受长度合适的可打印ASCII字符，避免日志注入和头部注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
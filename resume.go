@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamStore 保存最近的流式响应，支持客户端携带Last-Event-ID断线重连
+// 启用后上游读取与客户端连接解耦：客户端断开时生成继续进行，
+// 重连的客户端从断点继续接收剩余的数据块。
+// 缓冲区以随机生成的流ID为键，只有发起请求的客户端密钥和租户可以重连
+type streamStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	streams map[string]*streamBuffer
+}
+
+// streamBuffer 单个流式响应的事件缓冲区
+// 每次Write写入的是一个完整的SSE事件块
+type streamBuffer struct {
+	owner  string // 发起请求的客户端密钥的短哈希
+	tenant string // 发起请求的租户，不属于任何租户时为空
+
+	mu       sync.Mutex
+	events   [][]byte
+	done     bool
+	doneAt   time.Time
+	notifyCh chan struct{}
+}
+
+// newStreamStore 创建流缓冲存储，ttl为流结束后保留多久
+func newStreamStore(ttl time.Duration) *streamStore {
+	return &streamStore{
+		ttl:     ttl,
+		streams: make(map[string]*streamBuffer),
+	}
+}
+
+// newStreamID 生成流ID。请求ID可以由客户端指定，也容易猜到，不能作为重连的凭据
+func newStreamID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return "stream_" + hex.EncodeToString(b[:])
+}
+
+// Create 为请求创建新的缓冲区并返回流ID，同时清理已过期的缓冲区
+func (s *streamStore) Create(owner, tenant string) (string, *streamBuffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, buf := range s.streams {
+		if buf.expired(s.ttl) {
+			delete(s.streams, id)
+		}
+	}
+
+	id := newStreamID()
+	buf := &streamBuffer{owner: owner, tenant: tenant, notifyCh: make(chan struct{})}
+	s.streams[id] = buf
+	return id, buf
+}
+
+// Get 查找流ID对应的缓冲区
+func (s *streamStore) Get(streamID string) (*streamBuffer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, ok := s.streams[streamID]
+	if !ok || buf.expired(s.ttl) {
+		return nil, false
+	}
+	return buf, true
+}
+
+// Write 追加一个SSE事件块并唤醒等待中的读取者
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	event := make([]byte, len(p))
+	copy(event, p)
+
+	b.mu.Lock()
+	b.events = append(b.events, event)
+	close(b.notifyCh)
+	b.notifyCh = make(chan struct{})
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+// Flush 实现http.Flusher，事件在Write时已经可见
+func (b *streamBuffer) Flush() {}
+
+// Close 标记流已结束
+func (b *streamBuffer) Close() {
+	b.mu.Lock()
+	b.done = true
+	b.doneAt = time.Now()
+	close(b.notifyCh)
+	b.notifyCh = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *streamBuffer) expired(ttl time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done && time.Since(b.doneAt) > ttl
+}
+
+// Tail 从第from个事件开始把缓冲区内容写给客户端，直到流结束或客户端断开
+// 每个事件带上 "id: <流ID>:<序号>"，客户端重连时通过Last-Event-ID回传
+func (b *streamBuffer) Tail(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, requestID, streamID string, from int) {
+	next := from
+	for {
+		b.mu.Lock()
+		var pending [][]byte
+		if next < len(b.events) {
+			pending = b.events[next:]
+		}
+		done := b.done
+		notify := b.notifyCh
+		b.mu.Unlock()
+
+		for _, event := range pending {
+			fmt.Fprintf(w, "id: %s:%d\n%s", streamID, next, event)
+			next++
+		}
+		if len(pending) > 0 {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[%s] 客户端连接已断开，上游生成继续，可通过Last-Event-ID重连", requestID)
+			return
+		case <-notify:
+		}
+	}
+}
+
+// parseLastEventID 解析 "<流ID>:<序号>" 格式的Last-Event-ID
+func parseLastEventID(lastEventID string) (string, int, bool) {
+	sep := strings.LastIndex(lastEventID, ":")
+	if sep <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(lastEventID[sep+1:])
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return lastEventID[:sep], seq, true
+}
+
+// handleResumableStream 以可恢复模式处理流式响应
+// 上游读取在独立的协程中进行并写入缓冲区，当前连接只负责从缓冲区读取
+func (ps *ProxyServer) handleResumableStream(w http.ResponseWriter, r *http.Request, flusher http.Flusher,
+	deepseekReq *DeepSeekRequest, originalModel, requestID string) {
+
+	// 上游上下文不继承客户端连接的取消（保留其中的值，如链路上下文），只受最长流时长限制
+	var upstreamCtx context.Context
+	var cancel context.CancelFunc
+	if ps.config.StreamTimeout > 0 {
+		upstreamCtx, cancel = context.WithTimeout(context.WithoutCancel(r.Context()), ps.config.StreamTimeout)
+	} else {
+		upstreamCtx, cancel = context.WithCancel(context.WithoutCancel(r.Context()))
+	}
+
+	resp, err := ps.sendStreamingRequestToDeepSeek(upstreamCtx, deepseekReq, requestID)
+	if err != nil {
+		cancel()
+		ps.handleUpstreamError(w, fmt.Errorf("DeepSeek流式请求失败: %w", err), "DeepSeek流式通信")
+		return
+	}
+
+	streamID, buf := ps.streams.Create(clientKeyHash(r), tenantFor(r.Context()).tenantName())
+	go func() {
+		defer cancel()
+		defer resp.Body.Close()
+		defer buf.Close()
+		ps.processStreamingData(buf, resp.Body, buf, deepseekReq, originalModel, requestID, upstreamCtx)
+	}()
+
+	buf.Tail(r.Context(), w, flusher, requestID, streamID, 0)
+	log.Printf("[%s] 流式响应处理完成", requestID)
+}
+
+// resumeStream 处理携带Last-Event-ID的重连请求
+// 找到对应的缓冲区时从断点之后继续发送并返回true，否则返回false按新请求处理。
+// 缓冲区属于其他客户端密钥或租户时同样按新请求处理，不透露缓冲区是否存在
+func (ps *ProxyServer) resumeStream(w http.ResponseWriter, r *http.Request, requestID, lastEventID string) bool {
+	streamID, seq, ok := parseLastEventID(lastEventID)
+	if !ok {
+		log.Printf("[%s] 无法解析Last-Event-ID: %s，按新请求处理", requestID, lastEventID)
+		return false
+	}
+	buf, ok := ps.streams.Get(streamID)
+	if !ok {
+		log.Printf("[%s] 流缓冲区 %s 不存在或已过期，按新请求处理", requestID, streamID)
+		return false
+	}
+	if buf.owner != clientKeyHash(r) || buf.tenant != tenantFor(r.Context()).tenantName() {
+		log.Printf("[%s] 流缓冲区 %s 属于其他客户端，按新请求处理", requestID, streamID)
+		return false
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return false
+	}
+
+	log.Printf("[%s] 客户端重连流 %s，从事件 %d 之后继续发送", requestID, streamID, seq)
+	setSSEHeaders(w)
+	buf.Tail(r.Context(), w, flusher, requestID, streamID, seq+1)
+	return true
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// 单次脚本调用的最长执行时间，防止死循环拖住请求
+const scriptTimeout = time.Second
+
+// scriptEngine 加载SCRIPT_FILE中的Lua脚本，在每个请求和非流式响应上执行
+// 脚本可以定义两个全局函数，都是可选的：
+//
+//	function on_request(req, ctx)   -- 返回修改后的请求表，返回nil表示不修改，返回nil, "原因"表示拒绝
+//	function on_response(resp, ctx) -- 同上，作用于非流式响应
+//
+// ctx包含path、method、client_ip和headers。脚本文件修改后自动重新加载
+type scriptEngine struct {
+	path string
+
+	mu         sync.RWMutex
+	proto      *lua.FunctionProto
+	modTime    time.Time
+	generation atomic.Int64 // 每次重新加载后递增，旧版本的Lua状态不再复用
+	states     sync.Pool
+}
+
+// scriptState 一个已执行过脚本顶层代码的Lua状态，Lua状态不能并发使用
+type scriptState struct {
+	L          *lua.LState
+	generation int64
+}
+
+// jsonArrayMeta 标记由JSON数组转换来的表，转换回JSON时空表仍然输出为[]
+var jsonArrayMeta = &lua.LTable{}
+
+func newScriptEngine(path string) (*scriptEngine, error) {
+	engine := &scriptEngine{path: path}
+	if err := engine.load(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// load 编译脚本，编译失败时保留当前版本
+func (e *scriptEngine) load() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return fmt.Errorf("读取脚本失败: %w", err)
+	}
+	source, err := os.ReadFile(e.path)
+	if err != nil {
+		return fmt.Errorf("读取脚本失败: %w", err)
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), e.path)
+	if err != nil {
+		return fmt.Errorf("解析脚本失败: %w", err)
+	}
+	proto, err := lua.Compile(chunk, e.path)
+	if err != nil {
+		return fmt.Errorf("编译脚本失败: %w", err)
+	}
+
+	e.mu.Lock()
+	e.proto = proto
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+	e.generation.Add(1)
+	return nil
+}
+
+// watch 定期检查脚本文件的修改时间，有变化时重新加载
+func (e *scriptEngine) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(e.path)
+		if err != nil {
+			continue
+		}
+		e.mu.RLock()
+		changed := !info.ModTime().Equal(e.modTime)
+		e.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := e.load(); err != nil {
+			log.Printf("警告：重新加载脚本失败，继续使用旧版本: %v", err)
+			// 记录修改时间，避免对同一个错误版本反复报错
+			e.mu.Lock()
+			e.modTime = info.ModTime()
+			e.mu.Unlock()
+			continue
+		}
+		log.Printf("✓ 脚本已重新加载: %s", e.path)
+	}
+}
+
+// acquire 取一个当前版本的Lua状态，没有可复用的时新建
+func (e *scriptEngine) acquire() (*scriptState, error) {
+	generation := e.generation.Load()
+	for {
+		state, ok := e.states.Get().(*scriptState)
+		if !ok {
+			break
+		}
+		if state.generation == generation {
+			return state, nil
+		}
+		state.L.Close()
+	}
+
+	e.mu.RLock()
+	proto := e.proto
+	e.mu.RUnlock()
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	// 只开放基础库，不提供文件和系统调用
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		log.Printf("[脚本] %s", L.CheckString(1))
+		return 0
+	}))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("执行脚本失败: %w", err)
+	}
+	return &scriptState{L: L, generation: generation}, nil
+}
+
+// Run 调用脚本中的函数处理一个JSON文档，不是JSON时原样放行
+// 返回替换后的JSON（nil表示不修改）和拒绝原因（为空表示放行）
+func (e *scriptEngine) Run(ctx context.Context, function string, body []byte, info map[string]interface{}) ([]byte, string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, "", nil
+	}
+
+	state, err := e.acquire()
+	if err != nil {
+		return nil, "", err
+	}
+	L := state.L
+	fn := L.GetGlobal(function)
+	if fn.Type() != lua.LTFunction {
+		e.states.Put(state)
+		return nil, "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, toLua(L, doc), toLua(L, info))
+	L.RemoveContext()
+	if err != nil {
+		// 出错（包括超时）后Lua状态可能不完整，直接丢弃
+		L.Close()
+		return nil, "", fmt.Errorf("%s执行失败: %w", function, err)
+	}
+
+	result, reason := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	e.states.Put(state)
+
+	if reason != lua.LNil {
+		return nil, lua.LVAsString(reason), nil
+	}
+	if result == lua.LNil {
+		return nil, "", nil
+	}
+	replaced, err := json.Marshal(fromLua(result))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s返回值无法转换为JSON: %w", function, err)
+	}
+	return replaced, "", nil
+}
+
+// toLua 将JSON解码后的值转换为Lua值
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+		L.SetMetatable(table, jsonArrayMeta)
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	case map[string]string:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, lua.LString(item))
+		}
+		return table
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// fromLua 将Lua值转换回可以JSON编码的值
+// 由JSON数组转换来的表或键为1..n的非空表输出为数组，其他表输出为对象
+func fromLua(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		n := v.MaxN()
+		isArray := v.Metatable == jsonArrayMeta || n > 0
+		if isArray {
+			v.ForEach(func(key, _ lua.LValue) {
+				if number, ok := key.(lua.LNumber); !ok || int(number) < 1 || int(number) > n {
+					isArray = false
+				}
+			})
+		}
+		if isArray {
+			items := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				items = append(items, fromLua(v.RawGetInt(i)))
+			}
+			return items
+		}
+		object := make(map[string]interface{})
+		v.ForEach(func(key, item lua.LValue) {
+			object[lua.LVAsString(key)] = fromLua(item)
+		})
+		return object
+	default:
+		return nil
+	}
+}
+
+// scriptMiddleware 对客户端API路由的请求体和非流式响应执行脚本
+func (ps *ProxyServer) scriptMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || ps.script == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			handleError(w, fmt.Errorf("读取请求体失败: %w", err), http.StatusBadRequest, "脚本过滤")
+			return
+		}
+		info := scriptContext(r)
+		replaced, reason, err := ps.script.Run(r.Context(), "on_request", body, info)
+		if !ps.applyScriptResult(w, err, reason) {
+			return
+		}
+		if replaced != nil {
+			body = replaced
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		hw := &hookResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r)
+		if hw.passthrough {
+			return
+		}
+
+		respBody := hw.buf.Bytes()
+		replaced, reason, err = ps.script.Run(r.Context(), "on_response", respBody, info)
+		if !ps.applyScriptResult(w, err, reason) {
+			return
+		}
+		if replaced != nil {
+			respBody = replaced
+		}
+		if hw.status == 0 {
+			hw.status = http.StatusOK
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(hw.status)
+		if _, err := w.Write(respBody); err != nil {
+			log.Printf("写入响应失败: %v", err)
+		}
+	})
+}
+
+// applyScriptResult 处理脚本出错或拒绝的情况，需要继续处理时返回true
+func (ps *ProxyServer) applyScriptResult(w http.ResponseWriter, err error, reason string) bool {
+	if err != nil {
+		log.Printf("脚本%v", err)
+		writeAPIError(w, newAPIError(http.StatusInternalServerError, "请求过滤脚本执行失败"))
+		return false
+	}
+	if reason != "" {
+		apiErr := newAPIError(http.StatusForbidden, reason)
+		apiErr.Code = "rejected_by_script"
+		writeAPIError(w, apiErr)
+		return false
+	}
+	return true
+}
+
+// scriptContext 传给脚本的请求信息，不包含Authorization和Cookie
+func scriptContext(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"path":      r.URL.Path,
+		"method":    r.Method,
+		"client_ip": getClientIP(r),
+		"headers":   forwardableHeaders(r),
+	}
+}
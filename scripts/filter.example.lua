@@ -0,0 +1,38 @@
+-- 过滤脚本示例：复制为 scripts/filter.lua 并设置 SCRIPT_FILE=scripts/filter.lua
+-- 两个函数都是可选的，返回修改后的表、nil（不修改）或 nil, "原因"（拒绝请求）
+
+-- 请求进入代理前执行，req 为客户端发送的 OpenAI 格式请求体
+function on_request(req, ctx)
+    -- 拒绝包含敏感词的请求
+    for _, message in ipairs(req.messages or {}) do
+        if type(message.content) == "string" and string.find(message.content, "内部资料", 1, true) then
+            return nil, "请求包含不允许发送的内容"
+        end
+    end
+
+    -- 为没有系统提示词的请求补充一条
+    if req.messages and req.messages[1] and req.messages[1].role ~= "system" then
+        table.insert(req.messages, 1, { role = "system", content = "请使用中文回答。" })
+    end
+
+    -- 按来源改变路由：来自内网的请求使用 deepseek-chat
+    if string.sub(ctx.client_ip, 1, 3) == "10." then
+        req.model = "deepseek-chat"
+    end
+
+    return req
+end
+
+-- 非流式响应返回客户端前执行，resp 为 OpenAI 格式响应体
+function on_response(resp, ctx)
+    if not resp.choices then
+        return nil
+    end
+    -- 脱敏：隐藏回答中的手机号
+    for _, choice in ipairs(resp.choices) do
+        if choice.message and type(choice.message.content) == "string" then
+            choice.message.content = string.gsub(choice.message.content, "1%d%d%d%d%d%d%d%d%d%d", "***********")
+        end
+    end
+    return resp
+end
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretPattern 一类凭据的识别规则
+type secretPattern struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// secretPatterns 内置的凭据识别规则，尽量只匹配格式明确的凭据以减少误报
+var secretPatterns = []secretPattern{
+	{"私钥", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY( BLOCK)?-----|$)`)},
+	{"OpenAI/DeepSeek API密钥", regexp.MustCompile(`\bsk-(?:proj-|ant-)?[A-Za-z0-9_-]{20,}`)},
+	{"AWS访问密钥ID", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS秘密访问密钥", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{"GitHub令牌", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{"Slack令牌", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"Google API密钥", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe密钥", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}`)},
+}
+
+// scanSecrets 检查消息内容和工具调用参数中的凭据
+// mode为redact时就地替换为占位符；返回发现的凭据类型
+func scanSecrets(messages []Message, mode string) []string {
+	found := make(map[string]bool)
+	scan := func(text string) string {
+		for _, secret := range secretPatterns {
+			if !secret.pattern.MatchString(text) {
+				continue
+			}
+			found[secret.name] = true
+			if mode == "redact" {
+				text = secret.pattern.ReplaceAllLiteralString(text, "[已移除的"+secret.name+"]")
+			}
+		}
+		return text
+	}
+
+	for i := range messages {
+		messages[i].Content = scan(messages[i].Content)
+		for j := range messages[i].ToolCalls {
+			messages[i].ToolCalls[j].Function.Arguments = scan(messages[i].ToolCalls[j].Function.Arguments)
+		}
+	}
+
+	kinds := make([]string, 0, len(found))
+	for kind := range found {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// checkSecrets 按SECRET_SCANNING处理请求中的凭据，请求需要拒绝时返回错误
+func (ps *ProxyServer) checkSecrets(req *ChatRequest, requestID string) error {
+	mode := ps.config.SecretScanning
+	if mode != "block" && mode != "redact" {
+		return nil
+	}
+	kinds := scanSecrets(req.Messages, mode)
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	if mode == "redact" {
+		log.Printf("[%s] 已从请求中移除疑似凭据: %s", requestID, strings.Join(kinds, "、"))
+		return nil
+	}
+	log.Printf("[%s] 请求包含疑似凭据，已拒绝: %s", requestID, strings.Join(kinds, "、"))
+	return &apiError{
+		StatusCode: http.StatusBadRequest,
+		Type:       errTypeInvalidRequest,
+		Message: fmt.Sprintf("请求中包含疑似凭据（%s），为避免泄露已拒绝发送。请删除后重试；如确认不是真实凭据，请联系管理员调整 SECRET_SCANNING",
+			strings.Join(kinds, "、")),
+		Param: "messages",
+		Code:  "secret_detected",
+	}
+}
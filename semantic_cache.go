@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// semanticCache 基于向量相似度的响应缓存
+// 提示词通过可配置的embeddings接口向量化，与已缓存提示词的余弦相似度超过阈值时直接返回缓存结果，
+// 适合FAQ类的高重复度负载。模型、工具和采样参数必须完全一致才会参与比较
+type semanticCache struct {
+	config *ProxyConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	entries []*semanticEntry
+	hits    int64
+	misses  int64
+}
+
+type semanticEntry struct {
+	scope     string
+	embedding []float64
+	resp      *DeepSeekResponse
+	expiresAt time.Time
+}
+
+// newSemanticCache 创建语义缓存
+func newSemanticCache(config *ProxyConfig, client *http.Client) *semanticCache {
+	return &semanticCache{config: config, client: client}
+}
+
+// semanticScope 计算除消息以外的请求特征，只有特征相同的请求之间才比较相似度
+func semanticScope(req *DeepSeekRequest) (string, error) {
+	scoped := *req
+	scoped.Stream = false
+	scoped.Messages = nil
+
+	data, err := json.Marshal(scoped)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// promptText 把对话拼接成用于向量化的文本
+func promptText(messages []Message) string {
+	var builder strings.Builder
+	for _, msg := range messages {
+		builder.WriteString(msg.Role)
+		builder.WriteString(": ")
+		builder.WriteString(msg.Content)
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+type semanticThresholdKey struct{}
+
+// semanticCacheMiddleware 把客户端密钥覆盖的相似度阈值保存到请求context中
+// SEMANTIC_CACHE_KEY_THRESHOLDS可以用完整的密钥或clientKeyHash匹配
+func (ps *ProxyServer) semanticCacheMiddleware(rt route, next http.Handler) http.Handler {
+	if ps.semanticCache == nil || rt.auth != authAPIKey || len(ps.config.SemanticCacheKeyThresholds) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := ps.config.SemanticCacheKeyThresholds[clientAPIKey(r)]
+		if !ok {
+			value, ok = ps.config.SemanticCacheKeyThresholds[clientKeyHash(r)]
+		}
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), semanticThresholdKey{}, value))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// threshold 返回相似度阈值，客户端密钥的覆盖优先于模型的覆盖
+func (c *semanticCache) threshold(ctx context.Context, model string) float64 {
+	if value, ok := ctx.Value(semanticThresholdKey{}).(float64); ok {
+		return value
+	}
+	if value, ok := c.config.SemanticCacheModelThresholds[model]; ok {
+		return value
+	}
+	return c.config.SemanticCacheThreshold
+}
+
+// Lookup 查找相似度最高且超过阈值的缓存响应
+func (c *semanticCache) Lookup(ctx context.Context, scope, model string, embedding []float64) (*DeepSeekResponse, float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var best *semanticEntry
+	bestScore := -1.0
+	live := c.entries[:0]
+	for _, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			continue
+		}
+		live = append(live, entry)
+		if entry.scope != scope {
+			continue
+		}
+		if score := cosineSimilarity(embedding, entry.embedding); score > bestScore {
+			best, bestScore = entry, score
+		}
+	}
+	c.entries = live
+
+	if best == nil || bestScore < c.threshold(ctx, model) {
+		c.misses++
+		return nil, bestScore, false
+	}
+	c.hits++
+	return best.resp, bestScore, true
+}
+
+// Put 写入缓存，超过容量时淘汰最早写入的条目
+func (c *semanticCache) Put(scope string, embedding []float64, resp *DeepSeekResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.config.SemanticCacheMaxEntries {
+		c.entries = c.entries[1:]
+	}
+	c.entries = append(c.entries, &semanticEntry{
+		scope:     scope,
+		embedding: embedding,
+		resp:      resp,
+		expiresAt: time.Now().Add(c.config.SemanticCacheTTL),
+	})
+}
+
+// Flush 清空缓存，返回清除的条目数
+func (c *semanticCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := len(c.entries)
+	c.entries = nil
+	return count
+}
+
+// Stats 返回语义缓存命中统计
+func (c *semanticCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]interface{}{
+		"entries": len(c.entries),
+		"hits":    c.hits,
+		"misses":  c.misses,
+	}
+}
+
+// Embed 调用OpenAI兼容的embeddings接口获取文本向量
+func (c *semanticCache) Embed(ctx context.Context, text string) ([]float64, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model": c.config.SemanticCacheEmbeddingsModel,
+		"input": text,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("序列化embeddings请求失败: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.config.SemanticCacheEmbeddingsURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("创建embeddings请求失败: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.config.SemanticCacheEmbeddingsKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.config.SemanticCacheEmbeddingsKey)
+	}
+	injectTraceContext(ctx, httpReq)
+
+	client := *c.client
+	client.Timeout = c.config.SemanticCacheEmbeddingsTimeout
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings接口返回 %d: %s", resp.StatusCode, string(body))
+	}
+
+	var embeddingResp struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&embeddingResp); err != nil {
+		return nil, fmt.Errorf("解析embeddings响应失败: %w", err)
+	}
+	if len(embeddingResp.Data) == 0 || len(embeddingResp.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("embeddings响应中没有向量")
+	}
+	return embeddingResp.Data[0].Embedding, nil
+}
+
+// cosineSimilarity 计算两个向量的余弦相似度，维度不同时返回0
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
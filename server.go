@@ -1,29 +1,360 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 )
 
 type ProxyServer struct {
-	config     *ProxyConfig
-	httpServer *http.Server
-	mux        *http.ServeMux
+	config        *ProxyConfig
+	httpServer    *http.Server
+	httpClient    *http.Client // 所有出站请求共用，复用连接池
+	mux           *http.ServeMux
+	breaker       *circuitBreaker
+	prober        *upstreamProber
+	draining      atomic.Bool
+	// 上游拒绝过指定函数的tool_choice，之后直接改用回退方式
+	namedToolChoiceRejected atomic.Bool
+	// 上游返回429后按上游密钥哈希记录的限流解除时间，此前使用该密钥的请求直接返回429
+	rateLimitMu      sync.Mutex
+	rateLimitedUntil map[string]time.Time
+	// 流式输出整形按客户端密钥共用的令牌桶
+	shapingBuckets tokenBuckets
+	stats         *proxyStats
+	state         sharedStore        // 限流计数、响应缓存和幂等记录的共享状态
+	keyBudget     *upstreamBudget    // 为nil时不限制每个上游密钥的用量
+	upstreams     *upstreamPool      // 为nil时只使用DEEPSEEK_API_KEY和DEEPSEEK_ENDPOINT
+	streams       *streamStore       // 为nil时不支持断线重连
+	cache         *responseCache     // 为nil时不启用响应缓存
+	semanticCache *semanticCache     // 为nil时不启用语义缓存
+	coalescer     *requestCoalescer  // 为nil时不合并并发的相同请求
+	script        *scriptEngine      // 为nil时不执行过滤脚本
+	templates     *promptTemplates   // 为nil时不套用提示词模板
+	systemPrompts *systemPrompts     // 为nil时不注入系统提示词
+	guardrails    *guardrails        // 为nil时不做内容过滤
+	serverTools   *serverTools       // 为nil时不执行服务端工具
+	toolCallQueue *toolCallQueue     // 为nil时丢弃parallel_tool_calls为false时多余的工具调用
+	idempotency   *idempotencyStore  // 为nil时忽略Idempotency-Key
+	profiles      *clientProfiles    // 按User-Agent识别的客户端兼容配置
+	scheduler     *upstreamScheduler // 为nil时不限制上游并发
+	offPeak       *offPeakSchedule   // 为nil时不做错峰调度
+	modelSplits   *modelSplits       // 为nil时不做A/B分流
+	shadow        *shadowMirror      // 为nil时不复制影子流量
+	canary        *canaryRollouts    // 通过管理接口控制的金丝雀发布
+	chaos         *chaosInjector     // 为nil时不注入故障
+	cassettes     *cassetteDeck      // 为nil时不录制或回放上游响应
+	tenants       *tenantRegistry    // 为nil时不启用多租户
+	quotas        *quotaManager      // 为nil时不启用配额
+	usageLog      *usageLedger       // 为nil时不记录用量日志
+	audit         *auditLog          // 为nil时不记录审计日志
+	reports       *reportScheduler   // 为nil时不发送定期用量报告
+	statsd        *statsdSink        // 为nil时不发送StatsD指标
+	moderation    *moderationRules   // 本地审核规则，为nil时不标记任何输入
+	batches       *batchStore        // 为nil时不启用批处理接口
+	files         *fileStore         // 为nil时不启用文件接口
+	assistants    *assistantStore    // 为nil时不启用Assistants接口
+	sessions      sessionStore       // 为nil时不支持服务端会话
+	middleware    middlewareChain
+
+	challengeServer *http.Server  // ACME的HTTP-01验证监听，未启用ACME时为nil
+	http3Server     *http3.Server // HTTP/3监听，未启用时为nil
+
+	listenersMu sync.Mutex
+	listeners   map[string]fileListener // 热升级时交给新进程的监听
 }
 
 func NewProxyServer(config *ProxyConfig) *ProxyServer {
 	log.Printf("正在创建代理服务器，端口: %d", config.Port)
 
 	mux := http.NewServeMux()
+	client := newHTTPClient(config)
 	proxy := &ProxyServer{
-		config: config,
-		mux:    mux,
+		config:     config,
+		mux:        mux,
+		httpClient: client,
+		breaker:    newCircuitBreaker(config),
+		prober:     newUpstreamProber(config, client),
+		stats:      newProxyStats(),
+	}
+	proxy.stats.configureUsers(config)
+
+	state, err := newSharedStore(config)
+	if err != nil {
+		log.Fatalf("错误：无法配置共享状态: %v", err)
+	}
+	proxy.state = state
+	if state.Shared() {
+		log.Printf("✓ 共享状态: Redis（键前缀 %s）", config.RedisKeyPrefix)
+	}
+
+	// 录制在故障注入的内层，录下的是上游的真实响应
+	cassettes, err := newCassetteDeck(config)
+	if err != nil {
+		log.Fatalf("错误：无法配置录制与回放: %v", err)
+	}
+	if cassettes != nil {
+		proxy.cassettes = cassettes
+		client.Transport = cassettes.wrap(client.Transport)
+		log.Printf("✓ 录制与回放：%s 模式，目录 %s", config.CassetteMode, config.CassetteDir)
+	}
+
+	chaos, err := newChaosInjector(config)
+	if err != nil {
+		log.Fatalf("错误：无法配置混沌测试: %v", err)
+	}
+	if chaos != nil {
+		proxy.chaos = chaos
+		client.Transport = chaos.wrap(client.Transport)
+		log.Printf("⚠ 已启用混沌测试：延迟 %v（抖动 %v），错误率 %.0f%%，流式断开率 %.0f%%，不要在生产环境使用",
+			config.ChaosLatency, config.ChaosLatencyJitter, config.ChaosErrorRate*100, config.ChaosDisconnectRate*100)
+	}
+
+	tenants, err := loadTenants(config)
+	if err != nil {
+		log.Fatalf("错误：无法加载租户配置: %v", err)
+	}
+	if tenants != nil {
+		proxy.tenants = tenants
+		log.Printf("✓ 已加载 %d 个租户", len(tenants.tenants))
+	}
+
+	quotas, err := newQuotaManager(config)
+	if err != nil {
+		log.Fatalf("错误：无法加载配额配置: %v", err)
+	}
+	if quotas != nil {
+		proxy.quotas = quotas
+		log.Printf("✓ 已启用配额：%d 个密钥单独配置，时区 %s", len(quotas.keys), config.QuotaTimezone)
+	}
+
+	usageLog, err := newUsageLedger(config)
+	if err != nil {
+		log.Fatalf("错误：%v", err)
+	}
+	if usageLog != nil {
+		proxy.usageLog = usageLog
+		log.Printf("✓ 用量日志: %s", config.UsageLogFile)
+	}
+
+	audit, err := openAuditLog(config)
+	if err != nil {
+		log.Fatalf("错误：%v", err)
+	}
+	if audit != nil {
+		proxy.audit = audit
+		log.Printf("✓ 审计日志: %s", config.AuditLogFile)
+	}
+
+	if reports := newReportScheduler(config, proxy.stats, proxy.httpClient); reports != nil {
+		proxy.reports = reports
+		go reports.Run()
+		log.Printf("✓ 已启用定期用量报告: %s %s (%s)", config.ReportSchedule, config.ReportAt, config.ReportTimezone)
+	}
+
+	statsd, err := newStatsdSink(config)
+	if err != nil {
+		log.Fatalf("错误：%v", err)
+	}
+	if statsd != nil {
+		proxy.statsd = statsd
+		go statsd.Run(proxy.emitGauges)
+		log.Printf("✓ StatsD指标: %s（前缀 %s）", config.StatsdAddr, config.StatsdPrefix)
+	}
+
+	if config.StreamResume {
+		proxy.streams = newStreamStore(config.StreamResumeTTL)
+	}
+	if config.ResponseCache {
+		proxy.cache = newResponseCache(config.ResponseCacheTTL, config.ResponseCacheMaxEntries)
+		if state.Shared() {
+			proxy.cache.shared = state
+		}
+	}
+	if config.SemanticCache {
+		proxy.semanticCache = newSemanticCache(config, client)
+	}
+	if config.RequestCoalescing {
+		proxy.coalescer = newRequestCoalescer()
+	}
+
+	if config.ScriptFile != "" {
+		script, err := newScriptEngine(config.ScriptFile)
+		if err != nil {
+			log.Fatalf("错误：无法加载过滤脚本: %v", err)
+		}
+		proxy.script = script
+		if config.ScriptReloadInterval > 0 {
+			go script.watch(config.ScriptReloadInterval)
+		}
+		log.Printf("✓ 已加载过滤脚本: %s", config.ScriptFile)
+	}
+
+	if config.PromptTemplatesFile != "" {
+		templates, err := loadPromptTemplates(config.PromptTemplatesFile)
+		if err != nil {
+			log.Fatalf("错误：无法加载提示词模板: %v", err)
+		}
+		proxy.templates = templates
+		log.Printf("✓ 已加载 %d 个提示词模板", len(templates.Templates))
+	}
+
+	if config.SystemPrompt != "" || config.SystemPromptsFile != "" {
+		prompts, err := loadSystemPrompts(config)
+		if err != nil {
+			log.Fatalf("错误：无法加载系统提示词: %v", err)
+		}
+		proxy.systemPrompts = prompts
+		log.Printf("✓ 已启用系统提示词注入（模型规则 %d 条，密钥规则 %d 条）", len(prompts.Models), len(prompts.Keys))
+	}
+
+	if config.GuardrailsFile != "" {
+		rules, err := loadGuardrails(config.GuardrailsFile)
+		if err != nil {
+			log.Fatalf("错误：无法加载内容过滤规则: %v", err)
+		}
+		rules.audit = proxy.audit
+		proxy.guardrails = rules
+		log.Printf("✓ 已加载 %d 条内容过滤规则", len(rules.Rules))
+	}
+
+	if config.ServerToolsFile != "" || config.BuiltinTools != "" {
+		tools, err := loadServerTools(config, client)
+		if err != nil {
+			log.Fatalf("错误：无法加载服务端工具: %v", err)
+		}
+		proxy.serverTools = tools
+		log.Printf("✓ 已登记 %d 个服务端工具（最多 %d 轮调用）", len(tools.Tools), config.ServerToolsMaxRounds)
+	}
+
+	if config.ParallelToolCallsMode == "queue" {
+		proxy.toolCallQueue = newToolCallQueue()
+	}
+	if config.IdempotencyTTL > 0 {
+		proxy.idempotency = newIdempotencyStore(config.IdempotencyTTL, config.IdempotencyMaxEntries)
+		if state.Shared() {
+			proxy.idempotency.shared = state
+		}
+	}
+
+	upstreams, err := newUpstreamPool(config)
+	if err != nil {
+		log.Fatalf("错误：无法配置上游池: %v", err)
+	}
+	if upstreams != nil {
+		proxy.upstreams = upstreams
+		log.Printf("✓ 上游池：%d 个上游，按会话粘性路由", len(upstreams.members))
+	}
+
+	if budget := newUpstreamBudget(config, state); budget != nil {
+		proxy.keyBudget = budget
+		log.Printf("✓ 上游密钥预算：每分钟 %d 个请求，%d 个token（0为不限制）", config.UpstreamKeyRPM, config.UpstreamKeyTPM)
+	}
+
+	if config.UpstreamMaxConcurrency > 0 {
+		proxy.scheduler = newUpstreamScheduler(config)
+		log.Printf("✓ 上游并发上限 %d，按优先级排队（权重 %v）", config.UpstreamMaxConcurrency, config.priorityWeights)
+		if config.UpstreamMaxQueue > 0 || config.UpstreamQueueTimeout > 0 {
+			log.Printf("✓ 上游排队上限 %d，最长等待 %v，超出时返回503", config.UpstreamMaxQueue, config.UpstreamQueueTimeout)
+		}
+	}
+
+	offPeak, err := newOffPeakSchedule(config)
+	if err != nil {
+		log.Fatalf("错误：无法配置错峰调度: %v", err)
+	}
+	if offPeak != nil {
+		proxy.offPeak = offPeak
+		log.Printf("✓ 错峰调度已启用，优惠时段 %v（%s）", config.OffPeakWindows, config.OffPeakTimezone)
+	}
+
+	splits, err := newModelSplits(config)
+	if err != nil {
+		log.Fatalf("错误：无法解析A/B分流规则: %v", err)
+	}
+	if splits != nil {
+		proxy.modelSplits = splits
+		log.Printf("✓ 已启用A/B分流：%d 条规则", len(splits.rules))
+	}
+
+	shadow, err := newShadowMirror(config, client)
+	if err != nil {
+		log.Fatalf("错误：无法配置影子流量: %v", err)
+	}
+	if shadow != nil {
+		proxy.shadow = shadow
+		log.Printf("✓ 已启用影子流量：抽样 %.0f%% 的请求复制到 %s", config.ShadowSampleRate*100, shadow.endpoint)
 	}
 
+	canary, err := newCanaryRollouts(config)
+	if err != nil {
+		log.Fatalf("错误：无法加载金丝雀发布: %v", err)
+	}
+	proxy.canary = canary
+
+	profiles, err := loadClientProfiles(config)
+	if err != nil {
+		log.Fatalf("错误：无法加载客户端兼容配置: %v", err)
+	}
+	proxy.profiles = profiles
+	log.Printf("✓ 已加载 %d 个客户端兼容配置", len(profiles.Profiles))
+
+	if config.ModerationRulesFile != "" {
+		rules, err := loadModerationRules(config.ModerationRulesFile)
+		if err != nil {
+			log.Fatalf("错误：无法加载审核规则: %v", err)
+		}
+		proxy.moderation = rules
+		log.Printf("✓ 已加载 %d 个审核类别", len(rules.Categories))
+	}
+
+	sessions, err := newSessionStore(config)
+	if err != nil {
+		log.Fatalf("错误：无法创建会话存储: %v", err)
+	}
+	if sessions != nil {
+		proxy.sessions = sessions
+		log.Printf("✓ 已启用服务端会话（%s，保留 %v）", config.SessionStore, config.SessionTTL)
+	}
+
+	if config.FilesDir != "" {
+		files, err := newFileStore(config)
+		if err != nil {
+			log.Fatalf("错误：无法创建文件存储: %v", err)
+		}
+		proxy.files = files
+		log.Printf("✓ 已启用文件接口（目录 %s）", config.FilesDir)
+	}
+
+	if config.BatchDir != "" {
+		batches, err := newBatchStore(proxy, config)
+		if err != nil {
+			log.Fatalf("错误：无法创建批处理存储: %v", err)
+		}
+		proxy.batches = batches
+		log.Printf("✓ 已启用批处理接口（目录 %s，每分钟 %d 个请求）", config.BatchDir, config.BatchRequestsPerMinute)
+	}
+
+	if config.AssistantsDir != "" {
+		assistants, err := newAssistantStore(config)
+		if err != nil {
+			log.Fatalf("错误：无法创建助手存储: %v", err)
+		}
+		proxy.assistants = assistants
+		log.Printf("✓ 已启用Assistants接口（目录 %s）", config.AssistantsDir)
+	}
+
+	proxy.recordStartup()
+	proxy.setupMiddleware()
 	proxy.setupRoutes()
 
 	// 构建监听地址
@@ -32,16 +363,26 @@ func NewProxyServer(config *ProxyConfig) *ProxyServer {
 		addr = fmt.Sprintf(":%d", config.Port) // 默认localhost
 	}
 
+	// 不设置WriteTimeout：流式响应可能持续数分钟，写超时由各路由自行控制
 	proxy.httpServer = &http.Server{
 		Addr:              addr,
 		Handler:           proxy.mux,
 		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       120 * time.Second,
 		MaxHeaderBytes:    1 << 20,
 	}
 
+	if config.ACMEEnabled() {
+		proxy.setupACME()
+	}
+
+	if config.HTTP3 {
+		if err := proxy.setupHTTP3(); err != nil {
+			log.Fatalf("错误：无法启用HTTP/3: %v", err)
+		}
+	}
+
 	if err := http2.ConfigureServer(proxy.httpServer, &http2.Server{}); err != nil {
 		log.Printf("警告：无法启用HTTP/2支持: %v", err)
 	}
@@ -53,15 +394,61 @@ func NewProxyServer(config *ProxyConfig) *ProxyServer {
 func (ps *ProxyServer) setupRoutes() {
 	log.Printf("正在设置API路由...")
 
-	ps.mux.HandleFunc("/health", ps.handleHealth)
-	ps.mux.HandleFunc("/v1/chat/completions", ps.handleChatCompletions)
-	ps.mux.HandleFunc("/v1/models", ps.handleModels)
-	ps.mux.HandleFunc("/v1/usage", ps.handleUsage)
-	ps.mux.HandleFunc("/", ps.handleRoot)
+	ps.handle(route{pattern: "/health", timeout: true}, ps.handleHealth)
+	ps.handle(route{pattern: "/healthz", timeout: true}, ps.handleLiveness)
+	ps.handle(route{pattern: "/readyz", timeout: true}, ps.handleReadiness)
+	// 流式响应需要长连接，超时在处理器内控制
+	ps.handle(route{pattern: "/v1/chat/completions", name: "聊天完成", auth: authAPIKey}, ps.handleChatCompletions)
+	ps.handle(route{pattern: "/v1/chat/ws", name: "WebSocket聊天", auth: authAPIKey}, ps.handleChatWebSocket)
+	ps.handle(route{pattern: "/v1/completions", name: "文本补全", auth: authAPIKey}, ps.handleCompletions)
+	ps.handle(route{pattern: "/v1/messages", name: "Anthropic消息", auth: authAPIKey}, ps.handleAnthropicMessages)
+	ps.handle(route{pattern: "/v1/messages/count_tokens", name: "Anthropic token计数", auth: authAPIKey, timeout: true}, ps.handleAnthropicCountTokens)
+	ps.handle(route{pattern: "/v1beta/models/", name: "Gemini生成", auth: authAPIKey}, ps.handleGemini)
+	ps.handle(route{pattern: "/v1/debug/transform", name: "请求转换预览", auth: authAPIKey, timeout: true}, ps.handleDebugTransform)
+	ps.handle(route{pattern: "/v1/moderations", name: "内容审核", auth: authAPIKey, timeout: true}, ps.handleModerations)
+	ps.handle(route{pattern: "/v1/models", name: "模型列表", timeout: true}, ps.handleModels)
+	ps.handle(route{pattern: "/v1/usage", name: "使用情况查询", timeout: true}, ps.handleUsage)
+	ps.handle(route{pattern: "/version", timeout: true}, ps.handleVersion)
+	if ps.sessions != nil {
+		ps.handle(route{pattern: "/v1/sessions/", name: "会话管理", auth: authAPIKey, timeout: true}, ps.handleSessions)
+	}
+	if ps.files != nil {
+		// 上传大文件可能超过路由超时，不设置整体超时
+		ps.handle(route{pattern: "/v1/files", name: "文件", auth: authAPIKey}, ps.handleFiles)
+		ps.handle(route{pattern: "/v1/files/", name: "文件", auth: authAPIKey}, ps.handleFiles)
+	}
+	if ps.batches != nil {
+		ps.handle(route{pattern: "/v1/batches", name: "批处理", auth: authAPIKey, timeout: true}, ps.handleBatches)
+		ps.handle(route{pattern: "/v1/batches/", name: "批处理", auth: authAPIKey, timeout: true}, ps.handleBatches)
+	}
+	if ps.assistants != nil {
+		ps.handle(route{pattern: "/v1/assistants", name: "助手", auth: authAPIKey, timeout: true}, ps.handleAssistants)
+		ps.handle(route{pattern: "/v1/assistants/", name: "助手", auth: authAPIKey, timeout: true}, ps.handleAssistants)
+		// 流式运行需要长连接，不设置整体超时
+		ps.handle(route{pattern: "/v1/threads", name: "线程", auth: authAPIKey}, ps.handleThreads)
+		ps.handle(route{pattern: "/v1/threads/", name: "线程", auth: authAPIKey}, ps.handleThreads)
+	}
+	ps.handle(route{pattern: "/", timeout: true}, ps.handleRoot)
+	if ps.config.Playground {
+		ps.handle(route{pattern: "/playground", timeout: true}, ps.handlePlayground)
+		ps.handle(route{pattern: "/playground/", timeout: true}, ps.handlePlayground)
+	}
+	ps.setupAdminRoutes()
+	ps.setupDebugRoutes()
 
 	log.Printf("✓ API路由设置完成")
 }
 
+// withRouteTimeout 为非流式路由加上整体超时
+// 超时后返回OpenAI格式的503错误
+func (ps *ProxyServer) withRouteTimeout(handler http.HandlerFunc) http.Handler {
+	if ps.config.RouteTimeout <= 0 {
+		return handler
+	}
+	message := `{"error":{"message":"请求处理超时","type":"server_error","param":null,"code":"timeout"}}`
+	return http.TimeoutHandler(handler, ps.config.RouteTimeout, message)
+}
+
 func (ps *ProxyServer) Start() error {
 	log.Printf("🚀 启动代理服务器...")
 	
@@ -70,19 +457,107 @@ func (ps *ProxyServer) Start() error {
 	if host == "" {
 		host = "localhost"
 	}
-	log.Printf("📡 监听地址: http://%s:%d", host, ps.config.Port)
-	log.Printf("🔧 API端点: http://%s:%d/v1/chat/completions", host, ps.config.Port)
-	log.Printf("📋 模型列表: http://%s:%d/v1/models", host, ps.config.Port)
-	log.Printf("❤️  健康检查: http://%s:%d/health", host, ps.config.Port)
+	scheme := "http"
+	if ps.config.TLSEnabled() {
+		scheme = "https"
+	}
+	if ps.config.ListenSocket != "" {
+		log.Printf("📡 监听地址: unix:%s (%s, 权限 %04o)", ps.config.ListenSocket, scheme, ps.config.ListenSocketMode)
+	} else {
+		log.Printf("📡 监听地址: %s://%s:%d", scheme, host, ps.config.Port)
+		log.Printf("🔧 API端点: %s://%s:%d/v1/chat/completions", scheme, host, ps.config.Port)
+		log.Printf("📋 模型列表: %s://%s:%d/v1/models", scheme, host, ps.config.Port)
+		log.Printf("❤️  健康检查: %s://%s:%d/health", scheme, host, ps.config.Port)
+	}
+
+	if ps.config.HealthProbeInterval > 0 {
+		go ps.prober.Run(ps.config.HealthProbeInterval)
+	}
 
-	return ps.httpServer.ListenAndServe()
+	// 先建立所有监听，再通知热升级的父进程，保证交接期间不丢连接
+	listener, err := ps.listen()
+	if err != nil {
+		return err
+	}
+	if ps.http3Server != nil {
+		conn, err := ps.inheritOrListenPacket("http3", ps.http3Server.Addr)
+		if err != nil {
+			return fmt.Errorf("HTTP/3监听失败: %w", err)
+		}
+		go ps.runHTTP3Server(conn)
+	}
+	if ps.challengeServer != nil {
+		challengeListener, err := ps.inheritOrListen("acme", func() (net.Listener, error) {
+			return net.Listen("tcp", ps.challengeServer.Addr)
+		})
+		if err != nil {
+			return fmt.Errorf("ACME验证监听失败: %w", err)
+		}
+		go ps.runChallengeServer(challengeListener)
+	}
+	notifyUpgradeReady()
+	writePIDFile(ps.config.PIDFile)
+
+	if ps.config.ACMEEnabled() {
+		// 证书由ACME管理器的GetCertificate提供，无需证书文件
+		err = ps.httpServer.ServeTLS(listener, "", "")
+	} else if ps.config.TLSEnabled() {
+		log.Printf("🔒 已启用HTTPS，证书: %s", ps.config.TLSCertFile)
+		err = ps.httpServer.ServeTLS(listener, ps.config.TLSCertFile, ps.config.TLSKeyFile)
+	} else {
+		err = ps.httpServer.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown 优雅停机
+// 先将就绪检查标记为失败，等待负载均衡器摘除流量，再等待进行中的请求完成
+func (ps *ProxyServer) Shutdown(ctx context.Context) error {
+	ps.draining.Store(true)
+
+	if delay := ps.config.ShutdownDrainDelay; delay > 0 {
+		log.Printf("就绪检查已标记为停机，等待 %v 后关闭监听", delay)
+		time.Sleep(delay)
+	}
+
+	if ps.challengeServer != nil {
+		ps.challengeServer.Shutdown(ctx)
+	}
+	if ps.http3Server != nil {
+		ps.http3Server.Shutdown(ctx)
+	}
+	err := ps.httpServer.Shutdown(ctx)
+	if ps.batches != nil {
+		ps.batches.Close()
+	}
+	if ps.quotas != nil {
+		ps.quotas.Close()
+	}
+	if ps.usageLog != nil {
+		ps.usageLog.Close()
+	}
+	if ps.audit != nil {
+		ps.audit.Record(auditEntry{Event: "shutdown"})
+		ps.audit.Close()
+	}
+	if ps.reports != nil {
+		ps.reports.Close()
+	}
+	if ps.statsd != nil {
+		ps.statsd.Close()
+	}
+	ps.state.Close()
+	return err
 }
 
 func (ps *ProxyServer) handleCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Api-Key, Anthropic-Version, X-Goog-Api-Key, Idempotency-Key, X-Request-ID, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Idempotent-Replayed, X-Request-ID, X-Quota-Reset, X-Quota-Requests-Limit, X-Quota-Requests-Remaining, X-Quota-Tokens-Limit, X-Quota-Tokens-Remaining")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 	if r.Method == "OPTIONS" {
@@ -97,17 +572,35 @@ func (ps *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("收到健康检查请求")
+	deep := r.URL.Query().Get("deep") == "1"
+	log.Printf("收到健康检查请求 (deep=%v)", deep)
+
+	// 深度检查会实际调用一次上游（复用deepProbeMaxAge内的结果），否则只返回后台探测的最近结果
+	var upstream map[string]interface{}
+	if deep {
+		upstream = ps.prober.ProbeIfStale(deepProbeMaxAge)
+	} else {
+		upstream = ps.prober.Status()
+	}
+
+	status := "healthy"
+	statusCode := http.StatusOK
+	if deep && !ps.prober.Healthy() {
+		status = "unhealthy"
+		statusCode = http.StatusServiceUnavailable
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 
 	healthInfo := map[string]interface{}{
-		"status":    "healthy",
+		"status":    status,
 		"timestamp": time.Now().Unix(),
-		"version":   "1.0.0",
+		"version":   Version,
 		"service":   "deepseek-proxy",
 		"uptime":    time.Since(startTime).Seconds(),
+		"breaker":   ps.breaker.Snapshot(),
+		"upstream":  upstream,
 	}
 
 	if err := writeJSONResponse(w, healthInfo); err != nil {
@@ -122,12 +615,20 @@ func (ps *ProxyServer) handleRoot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		handleError(w, fmt.Errorf("未知的API路径: %s", r.URL.Path), http.StatusNotFound, "路由")
 		return
 	}
 
 	log.Printf("收到根路径访问请求")
 
+	// 启用管理接口时根路径显示仪表盘，否则显示静态说明页
+	if ps.config.AdminAPIKey != "" {
+		if ps.checkAdminAuth(w, r) {
+			ps.serveDashboard(w, r)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
@@ -175,6 +676,12 @@ func (ps *ProxyServer) handleRoot(w http.ResponseWriter, r *http.Request) {
             检查服务器运行状态
         </div>
         
+        <div class="endpoint">
+            <strong>版本信息：</strong><br>
+            <code>GET /version</code><br>
+            查看版本和构建信息
+        </div>
+        
         <h2>🔧 使用方法：</h2>
         <p>将你的OpenAI客户端基础URL设置为：</p>
         <code>http://` + host + `:` + fmt.Sprintf("%d", ps.config.Port) + `/v1</code>
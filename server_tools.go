@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 服务端工具：运维在配置文件中登记HTTP工具，代理把工具定义加入请求，模型返回的工具调用由代理
+// 请求对应的HTTP接口执行，结果作为工具消息发回模型，直到模型给出最终回复，客户端无需自己实现工具循环
+
+// 单个工具返回内容的最大字节数，超出部分截断
+const serverToolMaxResultBytes = 64 << 10
+
+// serverTool 一个登记的HTTP工具
+type serverTool struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Parameters  interface{}       `json:"parameters"`
+	URL         string            `json:"url"`
+	Method      string            `json:"method,omitempty"`  // POST（默认）以JSON请求体发送参数，GET把参数作为查询参数
+	Headers     map[string]string `json:"headers,omitempty"` // 调用工具时附加的请求头，如工具自身的认证
+	Timeout     string            `json:"timeout,omitempty"` // 单次调用超时，默认使用文件中的timeout
+	Keys        []string          `json:"keys,omitempty"`    // 允许使用该工具的客户端API密钥，为空表示所有客户端
+
+	timeout time.Duration
+	client  *http.Client
+	run     func(ctx context.Context, args map[string]interface{}, requestID string) (string, error) // 内置工具的实现，为nil时调用url
+}
+
+// serverTools 服务端工具配置文件
+type serverTools struct {
+	AllowedHosts []string      `json:"allowed_hosts"` // 工具URL允许的主机（含端口时需完全一致）
+	Timeout      string        `json:"timeout,omitempty"`
+	Tools        []*serverTool `json:"tools"`
+
+	byName map[string]*serverTool
+}
+
+// loadServerTools 读取SERVER_TOOLS_FILE登记的工具，并加入BUILTIN_TOOLS启用的内置工具
+func loadServerTools(config *ProxyConfig, client *http.Client) (*serverTools, error) {
+	st := &serverTools{}
+	if config.ServerToolsFile != "" {
+		data, err := os.ReadFile(config.ServerToolsFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取服务端工具文件失败: %w", err)
+		}
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, fmt.Errorf("解析服务端工具文件失败: %w", err)
+		}
+	}
+
+	var err error
+	defaultTimeout := 10 * time.Second
+	if st.Timeout != "" {
+		if defaultTimeout, err = time.ParseDuration(st.Timeout); err != nil {
+			return nil, fmt.Errorf("无效的工具超时 %q: %w", st.Timeout, err)
+		}
+	}
+	allowed := make(map[string]bool, len(st.AllowedHosts))
+	for _, host := range st.AllowedHosts {
+		allowed[strings.ToLower(host)] = true
+	}
+
+	st.byName = make(map[string]*serverTool, len(st.Tools))
+	for i, tool := range st.Tools {
+		if tool.Name == "" {
+			return nil, fmt.Errorf("第 %d 个工具缺少name", i+1)
+		}
+		if st.byName[tool.Name] != nil {
+			return nil, fmt.Errorf("工具 %s 重复定义", tool.Name)
+		}
+		target, err := url.Parse(tool.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			return nil, fmt.Errorf("工具 %s 的url无效: %q", tool.Name, tool.URL)
+		}
+		if !allowed[strings.ToLower(target.Host)] && !allowed[strings.ToLower(target.Hostname())] {
+			return nil, fmt.Errorf("工具 %s 的主机 %s 不在allowed_hosts中", tool.Name, target.Host)
+		}
+		switch tool.Method = strings.ToUpper(tool.Method); tool.Method {
+		case "":
+			tool.Method = "POST"
+		case "POST", "GET":
+		default:
+			return nil, fmt.Errorf("工具 %s 的method只能是GET或POST", tool.Name)
+		}
+		tool.timeout = defaultTimeout
+		if tool.Timeout != "" {
+			if tool.timeout, err = time.ParseDuration(tool.Timeout); err != nil {
+				return nil, fmt.Errorf("工具 %s 的超时无效: %w", tool.Name, err)
+			}
+		}
+		if tool.Parameters == nil {
+			tool.Parameters = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		tool.client = client
+		st.byName[tool.Name] = tool
+	}
+
+	builtins, err := builtinTools(config, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, tool := range builtins {
+		if st.byName[tool.Name] != nil {
+			return nil, fmt.Errorf("工具 %s 与内置工具重名", tool.Name)
+		}
+		st.Tools = append(st.Tools, tool)
+		st.byName[tool.Name] = tool
+	}
+	return st, nil
+}
+
+// allowed 该客户端密钥能否使用工具
+func (t *serverTool) allowed(apiKey string) bool {
+	if len(t.Keys) == 0 {
+		return true
+	}
+	for _, key := range t.Keys {
+		if key == apiKey && apiKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// inject 把客户端可用的服务端工具加入请求，与客户端自带工具同名的不加入，客户端要求不调用工具时不加入
+// 返回本次请求可由代理执行的工具
+func (st *serverTools) inject(req *DeepSeekRequest, toolChoice interface{}, apiKey string) map[string]*serverTool {
+	if st == nil || toolChoice == "none" {
+		return nil
+	}
+	defined := make(map[string]bool, len(req.Tools))
+	for _, tool := range req.Tools {
+		defined[tool.Function.Name] = true
+	}
+	available := make(map[string]*serverTool)
+	for _, tool := range st.Tools {
+		if defined[tool.Name] || !tool.allowed(apiKey) {
+			continue
+		}
+		req.Tools = append(req.Tools, Tool{Type: "function", Function: Function{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  tool.Parameters,
+		}})
+		available[tool.Name] = tool
+	}
+	return available
+}
+
+// call 执行一次工具调用，失败时返回给模型的错误说明，让模型自行决定如何继续
+func (t *serverTool) call(ctx context.Context, arguments, requestID string) string {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	var args map[string]interface{}
+	if strings.TrimSpace(arguments) != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return toolErrorResult(fmt.Sprintf("参数不是合法的JSON对象: %v", err))
+		}
+	}
+
+	if t.run != nil {
+		start := time.Now()
+		result, err := t.run(ctx, args, requestID)
+		if err != nil {
+			log.Printf("[%s] 内置工具 %s 执行失败: %v", requestID, t.Name, err)
+			return toolErrorResult(err.Error())
+		}
+		log.Printf("[%s] 内置工具 %s 返回 %d 字节，耗时 %v", requestID, t.Name, len(result), time.Since(start))
+		return result
+	}
+
+	var httpReq *http.Request
+	var err error
+	if t.Method == "GET" {
+		target, _ := url.Parse(t.URL)
+		query := target.Query()
+		for key, value := range args {
+			if s, ok := value.(string); ok {
+				query.Set(key, s)
+			} else {
+				encoded, _ := json.Marshal(value)
+				query.Set(key, string(encoded))
+			}
+		}
+		target.RawQuery = query.Encode()
+		httpReq, err = http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	} else {
+		body, _ := json.Marshal(args)
+		if args == nil {
+			body = []byte("{}")
+		}
+		httpReq, err = http.NewRequestWithContext(ctx, "POST", t.URL, bytes.NewReader(body))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return toolErrorResult(fmt.Sprintf("创建请求失败: %v", err))
+	}
+	for key, value := range t.Headers {
+		httpReq.Header.Set(key, value)
+	}
+	httpReq.Header.Set("X-Request-ID", requestID)
+	forwardClientRequestID(ctx, httpReq)
+	injectTraceContext(ctx, httpReq)
+
+	start := time.Now()
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		log.Printf("[%s] 工具 %s 调用失败: %v", requestID, t.Name, err)
+		return toolErrorResult(fmt.Sprintf("工具调用失败: %v", err))
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(io.LimitReader(resp.Body, serverToolMaxResultBytes))
+	if err != nil {
+		return toolErrorResult(fmt.Sprintf("读取工具结果失败: %v", err))
+	}
+	log.Printf("[%s] 工具 %s 返回状态码 %d，%d 字节，耗时 %v", requestID, t.Name, resp.StatusCode, len(result), time.Since(start))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return toolErrorResult(fmt.Sprintf("工具返回状态码 %d: %s", resp.StatusCode, strings.TrimSpace(string(result))))
+	}
+	return string(result)
+}
+
+func toolErrorResult(message string) string {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	return string(data)
+}
+
+// serverToolCalls 回复中的工具调用是否全部是服务端工具；包含客户端自己的工具时交给客户端处理
+func serverToolCalls(resp *DeepSeekResponse, available map[string]*serverTool) bool {
+	if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+		return false
+	}
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		if available[toolCall.Function.Name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// handleServerToolLoop 以非流式请求上游并执行服务端工具调用，直到模型不再调用服务端工具；
+// 达到SERVER_TOOLS_MAX_ROUNDS轮后以tool_choice=none要求模型直接回答。
+// 各轮用量累加到最终响应，流式请求把最终响应以伪流式发送
+func (ps *ProxyServer) handleServerToolLoop(w http.ResponseWriter, r *http.Request, deepseekReq *DeepSeekRequest,
+	available map[string]*serverTool, originalModel, requestID string, stream bool) {
+
+	ctx := r.Context()
+	if stream {
+		var cancel context.CancelFunc
+		ctx, cancel = ps.newStreamContext(ctx)
+		defer cancel()
+	}
+
+	upstreamReq := *deepseekReq
+	upstreamReq.Stream = false
+	upstreamReq.Messages = append([]Message{}, deepseekReq.Messages...)
+	var total Usage
+	var deepseekResp *DeepSeekResponse
+	for round := 0; ; round++ {
+		if round == ps.config.ServerToolsMaxRounds {
+			log.Printf("[%s] 工具调用达到 %d 轮上限，要求模型直接回答", requestID, round)
+			upstreamReq.ToolChoice = "none"
+		}
+
+		var err error
+		deepseekResp, err = ps.sendRequestToDeepSeek(ctx, &upstreamReq, requestID)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("[%s] 客户端已断开，取消上游请求: %v", requestID, err)
+				return
+			}
+			ps.handleUpstreamError(w, fmt.Errorf("DeepSeek请求失败: %w", err), "DeepSeek通信")
+			return
+		}
+		deepseekResp = ps.checkToolCalls(ctx, &upstreamReq, deepseekResp, requestID)
+		total = addUsage(total, deepseekResp.Usage)
+		if upstreamReq.ToolChoice == "none" || !serverToolCalls(deepseekResp, available) {
+			break
+		}
+
+		message := deepseekResp.Choices[0].Message
+		upstreamReq.Messages = append(upstreamReq.Messages, message)
+		for _, toolCall := range message.ToolCalls {
+			log.Printf("[%s] 第 %d 轮：执行工具 %s", requestID, round+1, toolCall.Function.Name)
+			result := available[toolCall.Function.Name].call(ctx, toolCall.Function.Arguments, requestID)
+			upstreamReq.Messages = append(upstreamReq.Messages, Message{Role: "tool", ToolCallID: toolCall.ID, Content: result})
+		}
+	}
+	deepseekResp = ps.limitToolCalls(r, &upstreamReq, deepseekResp, requestID)
+	deepseekResp = legacyFunctionCallResponse(&upstreamReq, deepseekResp, requestID)
+	deepseekResp.Usage = total
+
+	if stream {
+		setSSEHeaders(w)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			handleError(w, fmt.Errorf("服务器不支持流式响应"), http.StatusInternalServerError, "流式响应检查")
+			return
+		}
+		ps.streamCompleteResponse(ctx, w, flusher, deepseekResp, originalModel, requestID)
+		return
+	}
+
+	recordUsage(ctx, deepseekResp.Usage)
+	deepseekResp = ps.guardrails.FilterResponse(deepseekResp, requestID)
+	if err := writeJSONResponse(w, ps.convertToOpenAIResponse(ctx, deepseekResp, originalModel, requestID)); err != nil {
+		log.Printf("[%s] 写入响应失败: %v", requestID, err)
+	}
+}
+
+// addUsage 累加两次调用的用量
+func addUsage(a, b Usage) Usage {
+	a.PromptTokens += b.PromptTokens
+	a.CompletionTokens += b.CompletionTokens
+	a.TotalTokens += b.TotalTokens
+	a.PromptCacheHitTokens += b.PromptCacheHitTokens
+	a.PromptCacheMissTokens += b.PromptCacheMissTokens
+	if b.CompletionTokensDetails != nil {
+		if a.CompletionTokensDetails == nil {
+			a.CompletionTokensDetails = &CompletionTokensDetails{}
+		}
+		a.CompletionTokensDetails.ReasoningTokens += b.CompletionTokensDetails.ReasoningTokens
+	}
+	return a
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 会话ID只允许常见的安全字符，文件存储时不会拼出意外的路径
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// sessionStore 保存服务端会话的对话历史
+// 客户端携带session_id时只需发送新消息，代理把历史和新消息拼接后发往上游，
+// 响应完成后把本轮的新消息和助手回复写回会话
+type sessionStore interface {
+	// Load 读取会话历史，会话不存在或已过期时返回nil
+	Load(key string) ([]Message, error)
+	// Save 覆盖保存会话历史
+	Save(key string, messages []Message) error
+	// Delete 删除会话，会话不存在时不报错
+	Delete(key string) error
+}
+
+// newSessionStore 按SESSION_STORE创建会话存储，未启用时返回nil
+func newSessionStore(config *ProxyConfig) (sessionStore, error) {
+	switch config.SessionStore {
+	case "":
+		return nil, nil
+	case "memory":
+		return &memorySessionStore{ttl: config.SessionTTL, sessions: make(map[string]*sessionEntry)}, nil
+	case "file":
+		if err := os.MkdirAll(config.SessionDir, 0o700); err != nil {
+			return nil, fmt.Errorf("创建会话目录失败: %w", err)
+		}
+		return &fileSessionStore{dir: config.SessionDir, ttl: config.SessionTTL}, nil
+	default:
+		return nil, fmt.Errorf("不支持的会话存储: %q（可选 memory 或 file）", config.SessionStore)
+	}
+}
+
+// sessionEntry 内存中的一个会话
+type sessionEntry struct {
+	messages  []Message
+	updatedAt time.Time
+}
+
+// memorySessionStore 进程内的会话存储，重启后丢失
+type memorySessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*sessionEntry
+}
+
+func (s *memorySessionStore) Load(key string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.sessions[key]
+	if !ok || s.expired(entry.updatedAt) {
+		return nil, nil
+	}
+	return append([]Message{}, entry.messages...), nil
+}
+
+// Save 保存会话，同时清理已过期的会话
+func (s *memorySessionStore) Save(key string, messages []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, entry := range s.sessions {
+		if s.expired(entry.updatedAt) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[key] = &sessionEntry{messages: messages, updatedAt: time.Now()}
+	return nil
+}
+
+func (s *memorySessionStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.sessions, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) expired(updatedAt time.Time) bool {
+	return s.ttl > 0 && time.Since(updatedAt) > s.ttl
+}
+
+// fileSessionStore 每个会话一个JSON文件，重启后保留
+type fileSessionStore struct {
+	mu  sync.Mutex
+	dir string
+	ttl time.Duration
+}
+
+// path 会话文件路径，文件名取键的哈希，不暴露客户端密钥
+func (s *fileSessionStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *fileSessionStore) Load(key string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取会话失败: %w", err)
+	}
+	if s.ttl > 0 && time.Since(info.ModTime()) > s.ttl {
+		os.Remove(path)
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取会话失败: %w", err)
+	}
+	var messages []Message
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("解析会话失败: %w", err)
+	}
+	return messages, nil
+}
+
+// Save 原子地写入会话，避免进程中途退出留下不完整的会话
+func (s *fileSessionStore) Save(key string, messages []Message) error {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return fmt.Errorf("序列化会话失败: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFileAtomic(s.path(key), data); err != nil {
+		return fmt.Errorf("写入会话失败: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSessionStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("删除会话失败: %w", err)
+	}
+	return nil
+}
+
+// requestSessionID 从请求体的session_id或X-Session-ID头部取会话ID
+func requestSessionID(r *http.Request, req *ChatRequest) (string, error) {
+	id := req.SessionID
+	if id == "" {
+		id = r.Header.Get("X-Session-ID")
+	}
+	if id != "" && !sessionIDPattern.MatchString(id) {
+		apiErr := newAPIError(http.StatusBadRequest, "session_id只能包含字母、数字和 _ . : -，且不超过128个字符")
+		apiErr.Param = "session_id"
+		return "", apiErr
+	}
+	return id, nil
+}
+
+// sessionKey 会话按客户端密钥隔离，不同密钥使用相同的session_id也互不可见
+func sessionKey(r *http.Request, id string) string {
+	return clientKeyHash(r) + "/" + id
+}
+
+// clientKeyHash 客户端密钥的短哈希，用于按密钥隔离保存在服务端的数据
+func clientKeyHash(r *http.Request) string {
+	return keyHash(clientAPIKey(r))
+}
+
+// keyHash 密钥的短哈希，保存或展示与密钥相关的数据时代替原始密钥
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// mergeSessionHistory 把新消息接在会话历史之后
+// 新消息以系统消息开头时替换历史中的系统消息
+func mergeSessionHistory(history, incoming []Message) []Message {
+	merged := make([]Message, 0, len(history)+len(incoming))
+	if system := leadingSystemCount(incoming); system > 0 {
+		merged = append(merged, incoming[:system]...)
+		merged = append(merged, history[leadingSystemCount(history):]...)
+		return append(merged, incoming[system:]...)
+	}
+	merged = append(merged, history...)
+	return append(merged, incoming...)
+}
+
+// saveSessionTurn 响应成功完成后把本轮对话写回会话
+// 上游出错、流式响应中断或回复被内容过滤拦截时不保存，客户端可以直接重试
+func (ps *ProxyServer) saveSessionTurn(key string, messages []Message, rec *sessionRecorder, requestID string) {
+	reply, ok := rec.Reply()
+	if !ok {
+		log.Printf("[%s] 响应未成功完成，不更新会话", requestID)
+		return
+	}
+	messages = keepLastMessages(append(messages, reply), ps.config.SessionMaxMessages)
+	if err := ps.sessions.Save(key, messages); err != nil {
+		log.Printf("[%s] 警告：保存会话失败: %v", requestID, err)
+		return
+	}
+	debugf("[%s] 会话已更新，共 %d 条消息", requestID, len(messages))
+}
+
+// sessionRecorder 在响应写给客户端的同时记录助手回复，流式和非流式响应都适用
+type sessionRecorder struct {
+	http.ResponseWriter
+	status int
+	stream bool
+	done   bool         // 流式响应收到了[DONE]
+	body   bytes.Buffer // 非流式响应体
+	line   []byte       // 流式响应中尚未结束的一行
+
+	content   strings.Builder
+	toolCalls []ToolCall
+}
+
+func (sr *sessionRecorder) WriteHeader(statusCode int) {
+	if sr.status == 0 {
+		sr.status = statusCode
+		sr.stream = strings.HasPrefix(sr.Header().Get("Content-Type"), "text/event-stream")
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *sessionRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.WriteHeader(http.StatusOK)
+	}
+	if sr.status == http.StatusOK {
+		if sr.stream {
+			sr.scan(p)
+		} else {
+			sr.body.Write(p)
+		}
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *sessionRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// scan 按行解析流式响应，累计第一个choice的内容和工具调用
+func (sr *sessionRecorder) scan(p []byte) {
+	sr.line = append(sr.line, p...)
+	for {
+		end := bytes.IndexByte(sr.line, '\n')
+		if end < 0 {
+			return
+		}
+		line := strings.TrimSpace(string(sr.line[:end]))
+		sr.line = sr.line[end+1:]
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			sr.done = true
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Index int `json:"index"`
+						ToolCall
+					} `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason == "content_filter" {
+				sr.status = 0
+				return
+			}
+			sr.content.WriteString(choice.Delta.Content)
+			for _, delta := range choice.Delta.ToolCalls {
+				for len(sr.toolCalls) <= delta.Index {
+					sr.toolCalls = append(sr.toolCalls, ToolCall{Type: "function"})
+				}
+				call := &sr.toolCalls[delta.Index]
+				if delta.ID != "" {
+					call.ID = delta.ID
+				}
+				call.Function.Name += delta.Function.Name
+				call.Function.Arguments += delta.Function.Arguments
+			}
+		}
+	}
+}
+
+// Reply 返回记录到的助手回复，响应没有成功完成时返回false
+func (sr *sessionRecorder) Reply() (Message, bool) {
+	reply := Message{Role: "assistant"}
+	switch {
+	case sr.status != http.StatusOK:
+		return reply, false
+	case sr.stream:
+		if !sr.done {
+			return reply, false
+		}
+		reply.Content = sr.content.String()
+		reply.ToolCalls = sr.toolCalls
+	default:
+		var resp struct {
+			Choices []struct {
+				Message      Message `json:"message"`
+				FinishReason string  `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(sr.body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 ||
+			resp.Choices[0].FinishReason == "content_filter" {
+			return reply, false
+		}
+		reply.Content = resp.Choices[0].Message.Content
+		reply.ToolCalls = resp.Choices[0].Message.ToolCalls
+	}
+	return reply, reply.Content != "" || len(reply.ToolCalls) > 0
+}
+
+// handleSessions 查看或删除会话：GET/DELETE /v1/sessions/{session_id}
+func (ps *ProxyServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	ps.handleCORS(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/sessions/")
+	if !sessionIDPattern.MatchString(id) {
+		writeAPIError(w, newAPIError(http.StatusNotFound, "会话不存在"))
+		return
+	}
+	key := sessionKey(r, id)
+
+	switch r.Method {
+	case "GET":
+		messages, err := ps.sessions.Load(key)
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError, "读取会话")
+			return
+		}
+		if messages == nil {
+			writeAPIError(w, newAPIError(http.StatusNotFound, "会话不存在或已过期"))
+			return
+		}
+		writeJSONResponse(w, map[string]interface{}{
+			"id":       id,
+			"object":   "session",
+			"messages": messages,
+		})
+	case "DELETE":
+		if err := ps.sessions.Delete(key); err != nil {
+			handleError(w, err, http.StatusInternalServerError, "删除会话")
+			return
+		}
+		log.Printf("会话已删除: %s", id)
+		writeJSONResponse(w, map[string]interface{}{
+			"id":      id,
+			"object":  "session.deleted",
+			"deleted": true,
+		})
+	default:
+		handleError(w, fmt.Errorf("不支持的请求方法: %s", r.Method), http.StatusMethodNotAllowed, "方法检查")
+	}
+}
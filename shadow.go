@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 影子流量：按SHADOW_SAMPLE_RATE抽样，把对话请求异步复制一份发往第二个模型或端点，
+// 影子响应不返回给客户端，只记录状态、延迟、用量和内容供对比。影子请求在后台执行，
+// 不经过上游并发调度和熔断器，名额用完时直接丢弃，不影响客户端的延迟
+
+// shadowLogEntry 影子日志中的一条记录
+type shadowLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Model     string    `json:"model"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Usage     *Usage    `json:"usage,omitempty"`
+	Content   string    `json:"content,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// shadowMirror 影子流量的配置、并发名额和计数
+type shadowMirror struct {
+	rate     float64
+	endpoint string
+	apiKey   string
+	model    string
+	client   *http.Client
+	slots    chan struct{}
+	config   *ProxyConfig
+
+	logMu   sync.Mutex
+	logFile *os.File
+
+	mirrored atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// newShadowMirror 按配置创建影子流量，抽样比例为0时返回nil
+func newShadowMirror(config *ProxyConfig, client *http.Client) (*shadowMirror, error) {
+	if config.ShadowSampleRate <= 0 {
+		return nil, nil
+	}
+	if config.ShadowSampleRate > 1 {
+		return nil, fmt.Errorf("SHADOW_SAMPLE_RATE 必须在0到1之间: %v", config.ShadowSampleRate)
+	}
+	m := &shadowMirror{
+		rate:     config.ShadowSampleRate,
+		endpoint: config.ShadowEndpoint,
+		apiKey:   config.ShadowAPIKey,
+		model:    config.ShadowModel,
+		slots:    make(chan struct{}, max(config.ShadowMaxConcurrency, 1)),
+		config:   config,
+	}
+	if m.endpoint == "" {
+		m.endpoint = config.Endpoint
+	}
+	if m.apiKey == "" {
+		m.apiKey = config.DeepSeekAPIKey
+	}
+	shadowClient := *client
+	shadowClient.Timeout = config.ShadowTimeout
+	m.client = &shadowClient
+
+	if config.ShadowLogFile != "" {
+		file, err := os.OpenFile(config.ShadowLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("打开影子日志失败: %w", err)
+		}
+		m.logFile = file
+	}
+	return m, nil
+}
+
+// Mirror 按抽样比例在后台复制一份请求，影子请求总是非流式的
+func (m *shadowMirror) Mirror(ctx context.Context, req *DeepSeekRequest, requestID string) {
+	if m == nil || rand.Float64() >= m.rate {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		debugf("[%s] 影子请求名额已满，跳过", requestID)
+		return
+	}
+
+	shadow := *req
+	shadow.Stream = false
+	if m.model != "" {
+		shadow.Model = m.model
+	}
+	if _, ok := shadow.extra["stream_options"]; ok {
+		shadow.extra = make(map[string]json.RawMessage, len(req.extra))
+		for key, value := range req.extra {
+			if key != "stream_options" {
+				shadow.extra[key] = value
+			}
+		}
+	}
+	m.mirrored.Add(1)
+
+	// 客户端断开不影响影子请求，保留context中的追踪信息
+	go func() {
+		defer func() { <-m.slots }()
+		m.send(context.WithoutCancel(ctx), &shadow, requestID)
+	}()
+}
+
+// send 发送影子请求并记录结果
+func (m *shadowMirror) send(ctx context.Context, req *DeepSeekRequest, requestID string) {
+	entry := shadowLogEntry{Time: time.Now(), RequestID: requestID, Model: req.Model}
+	defer func() {
+		entry.LatencyMs = time.Since(entry.Time).Milliseconds()
+		if entry.Error != "" {
+			m.failed.Add(1)
+		}
+		m.record(entry)
+	}()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", m.endpoint+req.chatCompletionsPath(), bytes.NewReader(body))
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+m.apiKey)
+	httpReq.Header.Set("X-Request-ID", requestID)
+	forwardClientRequestID(ctx, httpReq)
+	httpReq.Header.Set("X-Shadow-Request", "1")
+	setUpstreamHeaders(httpReq, m.config)
+	injectTraceContext(ctx, httpReq)
+
+	resp, err := m.client.Do(httpReq)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	entry.Status = resp.StatusCode
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		entry.Error = string(data)
+		return
+	}
+	var result DeepSeekResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		entry.Error = fmt.Sprintf("解析影子响应失败: %v", err)
+		return
+	}
+	entry.Usage = &result.Usage
+	if len(result.Choices) > 0 {
+		entry.Content = result.Choices[0].Message.Content
+	}
+}
+
+// record 把结果写入影子日志，未配置日志文件时只输出摘要
+func (m *shadowMirror) record(entry shadowLogEntry) {
+	if m.logFile == nil {
+		tokens := 0
+		if entry.Usage != nil {
+			tokens = entry.Usage.TotalTokens
+		}
+		if entry.Error != "" {
+			log.Printf("[%s] 影子请求 %s 失败（%dms）: %s", entry.RequestID, entry.Model, entry.LatencyMs, truncateString(entry.Error, 200))
+		} else {
+			log.Printf("[%s] 影子请求 %s 完成：%dms，%d tokens", entry.RequestID, entry.Model, entry.LatencyMs, tokens)
+		}
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	if _, err := m.logFile.Write(append(line, '\n')); err != nil {
+		log.Printf("写入影子日志失败: %v", err)
+	}
+}
+
+// Stats 影子流量的计数，用于统计接口
+func (m *shadowMirror) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"sample_rate": m.rate,
+		"endpoint":    m.endpoint,
+		"model":       m.model,
+		"mirrored":    m.mirrored.Load(),
+		"dropped":     m.dropped.Load(),
+		"failed":      m.failed.Load(),
+		"in_flight":   len(m.slots),
+	}
+}
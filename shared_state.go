@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 共享状态：多个代理实例部署在负载均衡之后时，限流计数、响应缓存和幂等记录需要在实例之间共享。
+// STATE_STORE=memory（默认）时状态只保存在本进程中；STATE_STORE=redis时保存在REDIS_URL指向的Redis中，
+// 所有键带REDIS_KEY_PREFIX前缀，多个部署可以共用一个Redis
+
+// sharedStore 带过期时间的键值存储
+type sharedStore interface {
+	// Get 读取键的值，键不存在或已过期时返回false
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set 写入键的值，ttl为0时不过期
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX 只在键不存在时写入，返回是否写入
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete 删除键，键不存在时不报错
+	Delete(ctx context.Context, key string) error
+	// DeletePrefix 删除所有以prefix开头的键，返回删除的键数
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// IncrBy 把键的整数值增加delta并返回新值，键不存在时从0开始并设置过期时间ttl
+	IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Ping 检查存储是否可用
+	Ping(ctx context.Context) error
+	// Shared 存储是否在多个实例之间共享
+	Shared() bool
+	Close() error
+}
+
+// stateStoreTimeout 单次访问共享状态的超时，超时后按未命中或放行处理，不影响请求本身
+const stateStoreTimeout = 2 * time.Second
+
+// newSharedStore 按STATE_STORE创建共享状态存储
+func newSharedStore(config *ProxyConfig) (sharedStore, error) {
+	switch config.StateStore {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "redis":
+		return newRedisStore(config.RedisURL, config.RedisKeyPrefix)
+	default:
+		return nil, fmt.Errorf("STATE_STORE 只能是 memory 或 redis，当前为 %q", config.StateStore)
+	}
+}
+
+// memoryEntry 内存存储中的一个键
+type memoryEntry struct {
+	value   []byte
+	expires time.Time // 为零值时不过期
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// memoryStore 只在本进程内有效的存储，单实例部署的默认实现
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	writes  int // 上次清理过期键之后的写入次数
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+// memoryStoreSweepEvery 每写入这么多次清理一遍过期键，避免只写不读的键一直占用内存
+const memoryStoreSweepEvery = 1024
+
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// lookup 取出未过期的键，调用方持有m.mu
+func (m *memoryStore) lookup(key string, now time.Time) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(now) {
+		delete(m.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// put 写入键，调用方持有m.mu
+func (m *memoryStore) put(key string, entry *memoryEntry, now time.Time) {
+	m.entries[key] = entry
+	m.writes++
+	if m.writes < memoryStoreSweepEvery {
+		return
+	}
+	m.writes = 0
+	for k, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, k)
+		}
+	}
+}
+
+func (m *memoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key, time.Now())
+	if entry == nil {
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.put(key, &memoryEntry{value: value, expires: expiresAt(now, ttl)}, now)
+	return nil
+}
+
+func (m *memoryStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.lookup(key, now) != nil {
+		return false, nil
+	}
+	m.put(key, &memoryEntry{value: value, expires: expiresAt(now, ttl)}, now)
+	return true, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memoryStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.entries, key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	entry := m.lookup(key, now)
+	if entry == nil {
+		entry = &memoryEntry{value: []byte("0"), expires: expiresAt(now, ttl)}
+	}
+	value, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("键 %s 的值不是整数", key)
+	}
+	value += delta
+	entry.value = strconv.AppendInt(nil, value, 10)
+	m.put(key, entry, now)
+	return value, nil
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryStore) Shared() bool { return false }
+
+func (m *memoryStore) Close() error { return nil }
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal 触发零停机热升级的信号
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// upgradeSignal Windows不支持交接监听的文件描述符，因此没有热升级信号
+var upgradeSignal os.Signal
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 仪表盘保留的时间序列长度和最近请求条数
+const (
+	statsMinutes       = 60
+	statsRecentEntries = 100
+)
+
+// proxyStats 运行时统计：请求数、状态码分布、模型分布、token用量和进行中的流式响应
+type proxyStats struct {
+	mu             sync.Mutex
+	totalRequests  int64
+	activeRequests int64
+	statusCodes    map[int]int64
+	models         map[string]int64
+	tokens         map[string]*Usage
+	streams        map[string]*activeStream
+	users          map[string]*userStats
+
+	maxUsers int
+	prices   usagePrices
+
+	minutes [statsMinutes]minuteBucket
+	recent  []requestLog
+	period  reportPeriod // 定期用量报告的当前周期
+}
+
+// minuteBucket 每分钟的请求数和错误数
+type minuteBucket struct {
+	Minute   int64 `json:"minute"` // Unix时间戳（秒），按分钟对齐
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
+// requestLog 最近请求记录
+type requestLog struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Model      string    `json:"model,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	Tokens     int       `json:"total_tokens,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	User       string    `json:"user,omitempty"`
+	Arm        string    `json:"arm,omitempty"`      // A/B分流分到的模型
+	Canary     string    `json:"canary,omitempty"`   // 金丝雀发布中所在的组
+	Tenant     string    `json:"tenant,omitempty"`   // 请求所属的租户
+	Upstream   string    `json:"upstream,omitempty"` // 上游池中选择的上游
+	Route      string    `json:"-"`                  // 路由注册的路径模式，作为指标标签时代替含资源ID的路径
+}
+
+// requestRecord 随请求context传递，处理器在其中补充模型和用量，请求结束时汇总到统计
+type requestRecord struct {
+	mu        sync.Mutex
+	requestID string
+	model     string
+	user      string
+	arm       string
+	canary    string
+	session   string // 会话ID，用于会话粘性路由
+	upstream  string // 上游池中选择的上游
+	usage     Usage
+}
+
+type requestRecordKey struct{}
+
+// recordFromContext 取出当前请求的统计记录，不存在时返回nil
+func recordFromContext(ctx context.Context) *requestRecord {
+	record, _ := ctx.Value(requestRecordKey{}).(*requestRecord)
+	return record
+}
+
+// recordRequest 登记请求ID、模型和客户端通过user字段标识的终端用户
+func recordRequest(ctx context.Context, requestID, model, user string) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.requestID, record.model, record.user = requestID, model, user
+		record.mu.Unlock()
+	}
+}
+
+// recordUsage 累加本次请求的token用量
+func recordUsage(ctx context.Context, usage Usage) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.usage = addUsage(record.usage, usage)
+		record.mu.Unlock()
+	}
+}
+
+// recordStreamUsage 从流式数据块中提取用量，只有最后一个数据块带有usage
+func recordStreamUsage(ctx context.Context, dataContent string) {
+	if !strings.Contains(dataContent, `"usage"`) {
+		return
+	}
+	var chunk struct {
+		Usage *Usage `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err == nil && chunk.Usage != nil {
+		recordUsage(ctx, *chunk.Usage)
+	}
+}
+
+// activeStream 一个进行中的流式响应
+type activeStream struct {
+	RequestID  string    `json:"request_id"`
+	Model      string    `json:"model"`
+	ClientIP   string    `json:"client_ip"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{
+		statusCodes: make(map[int]int64),
+		models:      make(map[string]int64),
+		tokens:      make(map[string]*Usage),
+		streams:     make(map[string]*activeStream),
+		users:       make(map[string]*userStats),
+		period:      newReportPeriod(time.Now()),
+	}
+}
+
+// statusRecorder 记录处理器写出的状态码，同时保留流式响应需要的Flush能力
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.status == 0 {
+		sr.status = statusCode
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack WebSocket升级需要接管底层连接
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return hijack(sr.ResponseWriter)
+}
+
+// withStats 统计经过的每个请求，pattern为路由注册的路径模式
+func (ps *ProxyServer) withStats(pattern string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps.stats.mu.Lock()
+		ps.stats.totalRequests++
+		ps.stats.activeRequests++
+		ps.stats.mu.Unlock()
+
+		start := time.Now()
+		record := &requestRecord{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			record.mu.Lock()
+			entry := requestLog{
+				Time:       start,
+				RequestID:  record.requestID,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Model:      record.model,
+				Status:     status,
+				DurationMs: time.Since(start).Milliseconds(),
+				Tokens:     record.usage.TotalTokens,
+				ClientIP:   getClientIP(r),
+				User:       record.user,
+				Arm:        record.arm,
+				Canary:     record.canary,
+				Tenant:     tenantFor(r.Context()).tenantName(),
+				Upstream:   record.upstream,
+				Route:      pattern,
+			}
+			usage := record.usage
+			record.mu.Unlock()
+			ps.stats.finish(entry, usage)
+			ps.statsd.RecordRequest(entry, usage, time.Since(start))
+			ps.offPeak.Record(entry.Model, usage, entry.Time)
+			ps.tenants.Record(r.Context(), usage)
+			ps.quotas.Record(clientAPIKey(r), usage)
+			ps.keyBudget.Record(ps.upstreamAPIKey(context.WithValue(r.Context(), requestRecordKey{}, record)), usage)
+			ps.usageLog.Record(entry, clientAPIKey(r), usage)
+			ps.modelSplits.Record(entry.Model, entry.Arm, entry.Status, time.Since(start), usage)
+			ps.canary.Record(entry.Model, entry.Canary, entry.Status, time.Since(start))
+		}()
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, record)))
+	})
+}
+
+// serveInternal 执行代理自己发起的请求：批处理的每一行和WebSocket连接上的每条消息。
+// 它们不经过路由的中间件链，这里逐个检查租户限流和客户端密钥的配额，并像其他请求一样统计用量和计费，
+// 否则一次HTTP请求就能发起任意多次上游调用
+func (ps *ProxyServer) serveInternal(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	// 内部请求的路径只会是批处理支持的端点和/v1/chat/completions
+	rt := route{pattern: r.URL.Path, auth: authAPIKey}
+	handler = ps.withStats(rt.pattern, ps.semanticCacheMiddleware(rt, handler))
+	handler = ps.tenantLimitMiddleware(rt, ps.quotaMiddleware(rt, handler))
+	handler.ServeHTTP(w, r)
+}
+
+// finish 汇总一个已结束的请求
+func (s *proxyStats) finish(entry requestLog, usage Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.activeRequests--
+	s.statusCodes[entry.Status]++
+
+	minute := entry.Time.Unix() / 60 * 60
+	bucket := &s.minutes[(minute/60)%statsMinutes]
+	if bucket.Minute != minute {
+		*bucket = minuteBucket{Minute: minute}
+	}
+	bucket.Requests++
+	if entry.Status >= 400 {
+		bucket.Errors++
+	}
+
+	if entry.Model != "" && usage.TotalTokens > 0 {
+		total, ok := s.tokens[entry.Model]
+		if !ok {
+			total = &Usage{}
+			s.tokens[entry.Model] = total
+		}
+		total.PromptTokens += usage.PromptTokens
+		total.CompletionTokens += usage.CompletionTokens
+		total.TotalTokens += usage.TotalTokens
+	}
+	s.recordUser(entry.User, usage, entry.Time)
+	s.recordReport(entry, usage)
+
+	if len(s.recent) >= statsRecentEntries {
+		s.recent = s.recent[1:]
+	}
+	s.recent = append(s.recent, entry)
+}
+
+// RecordModel 统计客户端请求的模型
+func (s *proxyStats) RecordModel(model string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models[model]++
+}
+
+// BeginStream 登记一个流式响应，返回的函数在响应结束时调用
+func (s *proxyStats) BeginStream(requestID, model, clientIP string) func() {
+	s.mu.Lock()
+	s.streams[requestID] = &activeStream{
+		RequestID: requestID,
+		Model:     model,
+		ClientIP:  clientIP,
+		StartedAt: time.Now(),
+	}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.streams, requestID)
+		s.mu.Unlock()
+	}
+}
+
+// Streams 返回进行中的流式响应，按开始时间排序
+func (s *proxyStats) Streams() []activeStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	streams := make([]activeStream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		snapshot := *stream
+		snapshot.DurationMs = now.Sub(stream.StartedAt).Milliseconds()
+		streams = append(streams, snapshot)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StartedAt.Before(streams[j].StartedAt)
+	})
+	return streams
+}
+
+// Snapshot 返回统计快照
+func (s *proxyStats) Snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statusCodes := make(map[int]int64, len(s.statusCodes))
+	for code, count := range s.statusCodes {
+		statusCodes[code] = count
+	}
+	models := make(map[string]int64, len(s.models))
+	for model, count := range s.models {
+		models[model] = count
+	}
+	return map[string]interface{}{
+		"requests_total":     s.totalRequests,
+		"requests_in_flight": s.activeRequests,
+		"active_streams":     len(s.streams),
+		"status_codes":       statusCodes,
+		"models":             models,
+	}
+}
+
+// Series 返回最近一小时每分钟的请求数和错误数，没有请求的分钟补零
+func (s *proxyStats) Series() []minuteBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := time.Now().Unix() / 60 * 60
+	series := make([]minuteBucket, statsMinutes)
+	for i := range series {
+		minute := current - int64(statsMinutes-1-i)*60
+		bucket := s.minutes[(minute/60)%statsMinutes]
+		if bucket.Minute != minute {
+			bucket = minuteBucket{Minute: minute}
+		}
+		series[i] = bucket
+	}
+	return series
+}
+
+// Tokens 返回各模型的累计token用量
+func (s *proxyStats) Tokens() map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make(map[string]Usage, len(s.tokens))
+	for model, usage := range s.tokens {
+		tokens[model] = *usage
+	}
+	return tokens
+}
+
+// Recent 返回最近的请求记录，最新的在前
+func (s *proxyStats) Recent() []requestLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := make([]requestLog, len(s.recent))
+	for i, entry := range s.recent {
+		recent[len(s.recent)-1-i] = entry
+	}
+	return recent
+}
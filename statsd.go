@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsD指标：STATSD_ADDR设置后，通过UDP把统计模块的指标发送到StatsD或Datadog Agent（DogStatsD）。
+// 每个请求发送请求数、耗时和token用量，定期发送进行中的请求、活跃流、熔断器和排队情况等状态值。
+// STATSD_DOGSTATSD开启时以DogStatsD的 |#标签 格式附带模型、路由、状态码和租户，否则不带标签。
+// 发送不阻塞请求处理，缓冲区满时丢弃指标
+
+// statsdMaxPacket 单个UDP包的最大字节数，避开常见以太网MTU下的分片
+const statsdMaxPacket = 1432
+
+// statsdSink 缓冲并批量发送StatsD指标
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string // 附加在每个指标上的全局标签
+	dogstatsd bool
+	interval  time.Duration
+
+	lines   chan string
+	dropped atomic.Int64
+	done    chan struct{}
+}
+
+// newStatsdSink 连接StatsD，STATSD_ADDR为空时返回nil
+func newStatsdSink(config *ProxyConfig) (*statsdSink, error) {
+	if config.StatsdAddr == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", config.StatsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("无法连接StatsD %s: %w", config.StatsdAddr, err)
+	}
+	prefix := config.StatsdPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdSink{
+		conn:      conn,
+		prefix:    prefix,
+		tags:      config.StatsdTags,
+		dogstatsd: config.StatsdDogStatsD,
+		interval:  config.StatsdInterval,
+		lines:     make(chan string, 4096),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// statsdTagValue 替换标签值中会破坏DogStatsD格式的字符
+func statsdTagValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n', '\r', ' ':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// send 格式化一条指标放入发送队列，tags为 名称, 值 交替的列表
+func (s *statsdSink) send(name, value, kind string, tags ...string) {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if s.dogstatsd && (len(s.tags) > 0 || len(tags) > 0) {
+		b.WriteString("|#")
+		first := true
+		for _, tag := range s.tags {
+			if !first {
+				b.WriteByte(',')
+			}
+			b.WriteString(tag)
+			first = false
+		}
+		for i := 0; i+1 < len(tags); i += 2 {
+			if tags[i+1] == "" {
+				continue
+			}
+			if !first {
+				b.WriteByte(',')
+			}
+			b.WriteString(tags[i])
+			b.WriteByte(':')
+			b.WriteString(statsdTagValue(tags[i+1]))
+			first = false
+		}
+	}
+	select {
+	case s.lines <- b.String():
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Count 计数器
+func (s *statsdSink) Count(name string, value int64, tags ...string) {
+	s.send(name, strconv.FormatInt(value, 10), "c", tags...)
+}
+
+// Timing 耗时（毫秒）
+func (s *statsdSink) Timing(name string, d time.Duration, tags ...string) {
+	s.send(name, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64), "ms", tags...)
+}
+
+// Gauge 状态值
+func (s *statsdSink) Gauge(name string, value float64, tags ...string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags...)
+}
+
+// statsdModels 可以作为标签值的模型名。请求中的模型名由客户端任意填写，其他模型统一记为other，
+// 与路由模式代替实际路径一样，避免标签的取值数量不受控制地增长
+var statsdModels = func() map[string]bool {
+	models := make(map[string]bool)
+	for _, model := range GetSupportedModels() {
+		models[model] = true
+	}
+	return models
+}()
+
+// statsdModel 模型的标签值
+func statsdModel(model string) string {
+	if model == "" || statsdModels[model] {
+		return model
+	}
+	return "other"
+}
+
+// RecordRequest 发送一个已结束请求的指标，path标签为路由模式而不是实际路径
+func (s *statsdSink) RecordRequest(entry requestLog, usage Usage, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	model := statsdModel(entry.Model)
+	tags := []string{
+		"path", entry.Route,
+		"status", strconv.Itoa(entry.Status),
+		"model", model,
+		"tenant", entry.Tenant,
+	}
+	s.Count("requests", 1, tags...)
+	if entry.Status >= 400 {
+		s.Count("errors", 1, tags...)
+	}
+	s.Timing("request.duration", duration, tags...)
+	if usage.TotalTokens > 0 {
+		tags := []string{"model", model, "tenant", entry.Tenant}
+		s.Count("tokens.prompt", int64(usage.PromptTokens), tags...)
+		s.Count("tokens.completion", int64(usage.CompletionTokens), tags...)
+		s.Count("tokens.prompt_cache_hit", int64(usage.PromptCacheHitTokens), tags...)
+	}
+}
+
+// Run 把队列中的指标打包成UDP包发送，并按STATSD_INTERVAL发送状态值，直到Close
+func (s *statsdSink) Run(gauges func()) {
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	gaugeTicker := time.NewTicker(s.interval)
+	defer gaugeTicker.Stop()
+
+	var packet []byte
+	write := func() {
+		if len(packet) == 0 {
+			return
+		}
+		// UDP发送失败（Agent未启动等）不影响代理，下一批继续发送
+		s.conn.Write(packet)
+		packet = packet[:0]
+	}
+	for {
+		select {
+		case line := <-s.lines:
+			if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+				write()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		case <-flush.C:
+			write()
+		case <-gaugeTicker.C:
+			gauges()
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				log.Printf("StatsD发送队列已满，丢弃了 %d 个指标", dropped)
+			}
+		case <-s.done:
+			write()
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// Close 发送剩余的指标并关闭连接
+func (s *statsdSink) Close() {
+	close(s.done)
+}
+
+// emitGauges 发送统计模块中的状态值
+func (ps *ProxyServer) emitGauges() {
+	ps.stats.mu.Lock()
+	active := ps.stats.activeRequests
+	streams := len(ps.stats.streams)
+	ps.stats.mu.Unlock()
+	ps.statsd.Gauge("requests.in_flight", float64(active))
+	ps.statsd.Gauge("streams.active", float64(streams))
+
+	open := 0.0
+	if ps.breaker.State() == breakerOpen {
+		open = 1
+	}
+	ps.statsd.Gauge("breaker.open", open)
+
+	if ps.scheduler != nil {
+		ps.scheduler.mu.Lock()
+		ps.statsd.Gauge("upstream.active", float64(ps.scheduler.active))
+		for p := requestPriority(0); p < priorityCount; p++ {
+			ps.statsd.Gauge("upstream.queued", float64(len(ps.scheduler.queues[p])), "priority", p.String())
+		}
+		ps.scheduler.mu.Unlock()
+	}
+	if ps.cache != nil {
+		ps.cache.mu.Lock()
+		entries, hits, misses := len(ps.cache.entries), ps.cache.hits, ps.cache.misses
+		ps.cache.mu.Unlock()
+		ps.statsd.Gauge("cache.entries", float64(entries))
+		ps.statsd.Gauge("cache.hits", float64(hits))
+		ps.statsd.Gauge("cache.misses", float64(misses))
+	}
+}
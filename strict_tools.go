@@ -0,0 +1,36 @@
+package main
+
+import "log"
+
+// 严格函数调用：工具定义带strict:true时保证生成的参数符合声明的schema。
+// beta模式把strict原样交给DeepSeek的beta接口，由上游约束生成；
+// validate模式去掉strict标记走普通接口，由代理按schema校验参数，
+// 不合法时要求模型重新调用（不受TOOL_ARGS_VALIDATION影响），流式请求改为伪流式以便校验
+
+// applyStrictTools 按STRICT_TOOLS_MODE处理带strict标记的工具
+func (ps *ProxyServer) applyStrictTools(req *DeepSeekRequest, requestID string) {
+	strict := 0
+	for _, tool := range req.Tools {
+		if tool.Function.Strict {
+			strict++
+		}
+	}
+	if strict == 0 {
+		return
+	}
+
+	if ps.config.StrictToolsMode == "beta" {
+		req.beta = true
+		log.Printf("[%s] %d 个工具要求严格参数，使用beta接口", requestID, strict)
+		return
+	}
+
+	tools := make([]Tool, len(req.Tools))
+	for i, tool := range req.Tools {
+		tool.Function.Strict = false
+		tools[i] = tool
+	}
+	req.Tools = tools
+	req.strictTools = true
+	log.Printf("[%s] %d 个工具要求严格参数，由代理校验", requestID, strict)
+}
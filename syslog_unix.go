@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog 连接syslog：local为本机syslog守护进程，udp://主机:端口 或 tcp://主机:端口 为远程服务器
+func dialSyslog(target, tag string) (io.Writer, error) {
+	if target == "local" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("LOG_SYSLOG 只能是 local、udp://主机:端口 或 tcp://主机:端口，当前为 %q", target)
+	}
+	return syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
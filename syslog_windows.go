@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// dialSyslog Windows没有syslog，使用LOG_FILE或事件日志收集工具
+func dialSyslog(target, tag string) (io.Writer, error) {
+	return nil, fmt.Errorf("Windows不支持syslog输出，请改用 LOG_FILE")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// systemPromptRule 一条注入规则
+type systemPromptRule struct {
+	Prompt   string `json:"prompt"`
+	Position string `json:"position,omitempty"` // prepend（默认）：放在对话开头的系统提示词之前；append：作为系统消息追加在对话末尾
+}
+
+// systemPrompts 代理强制注入的系统提示词
+// 默认规则、模型规则和密钥规则依次叠加，适用于统一回答语言或公司风格要求等场景
+type systemPrompts struct {
+	Default *systemPromptRule           `json:"default,omitempty"`
+	Models  map[string]systemPromptRule `json:"models,omitempty"` // 按客户端请求的模型名或映射后的DeepSeek模型名匹配
+	Keys    map[string]systemPromptRule `json:"keys,omitempty"`   // 按客户端的API密钥匹配
+}
+
+// loadSystemPrompts 读取SYSTEM_PROMPTS_FILE，并合并SYSTEM_PROMPT设置的默认规则
+func loadSystemPrompts(config *ProxyConfig) (*systemPrompts, error) {
+	prompts := &systemPrompts{}
+	if config.SystemPromptsFile != "" {
+		data, err := os.ReadFile(config.SystemPromptsFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取系统提示词文件失败: %w", err)
+		}
+		if err := json.Unmarshal(data, prompts); err != nil {
+			return nil, fmt.Errorf("解析系统提示词文件失败: %w", err)
+		}
+	}
+	if config.SystemPrompt != "" {
+		prompts.Default = &systemPromptRule{Prompt: config.SystemPrompt, Position: config.SystemPromptPosition}
+	}
+
+	rules := []*systemPromptRule{prompts.Default}
+	for _, rule := range prompts.Models {
+		rules = append(rules, &rule)
+	}
+	for _, rule := range prompts.Keys {
+		rules = append(rules, &rule)
+	}
+	for _, rule := range rules {
+		if rule != nil && rule.Position != "" && rule.Position != "prepend" && rule.Position != "append" {
+			return nil, fmt.Errorf("无效的系统提示词位置: %s（可选 prepend 或 append）", rule.Position)
+		}
+	}
+	return prompts, nil
+}
+
+// Resolve 返回适用于该密钥和模型的规则，按默认、模型、密钥的顺序
+func (p *systemPrompts) Resolve(apiKey, model, deepseekModel string) []systemPromptRule {
+	if p == nil {
+		return nil
+	}
+	var rules []systemPromptRule
+	if p.Default != nil {
+		rules = append(rules, *p.Default)
+	}
+	if rule, ok := p.Models[model]; ok {
+		rules = append(rules, rule)
+	} else if rule, ok := p.Models[deepseekModel]; ok {
+		rules = append(rules, rule)
+	}
+	if rule, ok := p.Keys[apiKey]; ok && apiKey != "" {
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// injectSystemPrompts 按规则把系统提示词注入到消息中
+func injectSystemPrompts(messages []Message, rules []systemPromptRule) []Message {
+	var prepend, appendPrompts []string
+	for _, rule := range rules {
+		if rule.Prompt == "" {
+			continue
+		}
+		if rule.Position == "append" {
+			appendPrompts = append(appendPrompts, rule.Prompt)
+		} else {
+			prepend = append(prepend, rule.Prompt)
+		}
+	}
+
+	if len(prepend) > 0 {
+		system := strings.Join(prepend, "\n\n")
+		if len(messages) > 0 && messages[0].Role == "system" {
+			messages[0].Content = system + "\n\n" + messages[0].Content
+		} else {
+			messages = append([]Message{{Role: "system", Content: system}}, messages...)
+		}
+	}
+	if len(appendPrompts) > 0 {
+		messages = append(messages, Message{Role: "system", Content: strings.Join(appendPrompts, "\n\n")})
+	}
+	return messages
+}
+
+// clientAPIKey 取出客户端请求携带的API密钥
+// 除Authorization外，Anthropic格式的客户端使用x-api-key头部，
+// Gemini格式的客户端使用x-goog-api-key头部或/v1beta/路径上的key查询参数
+func clientAPIKey(r *http.Request) string {
+	switch {
+	case r.Header.Get("Authorization") != "":
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	case r.Header.Get("X-Api-Key") != "":
+		return r.Header.Get("X-Api-Key")
+	case r.Header.Get("X-Goog-Api-Key") != "":
+		return r.Header.Get("X-Goog-Api-Key")
+	case strings.HasPrefix(r.URL.Path, "/v1beta/"), r.URL.Path == "/v1/chat/ws":
+		return r.URL.Query().Get("key")
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// promptTemplate 一个命名模板：系统提示词和few-shot示例
+type promptTemplate struct {
+	System   string    `json:"system,omitempty"`   // 放在客户端系统提示词之前，客户端没有系统消息时单独插入
+	Messages []Message `json:"messages,omitempty"` // few-shot示例，插入在系统消息之后、客户端消息之前
+}
+
+// promptTemplates PROMPT_TEMPLATES_FILE的内容
+// 请求的metadata.template指定模板名时优先使用，否则按请求的模型名选择，"*"为所有模型的默认模板
+type promptTemplates struct {
+	Templates map[string]promptTemplate `json:"templates"`
+	Models    map[string]string         `json:"models,omitempty"` // 模型名 → 模板名
+}
+
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+func loadPromptTemplates(path string) (*promptTemplates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取模板文件失败: %w", err)
+	}
+	templates := &promptTemplates{}
+	if err := json.Unmarshal(data, templates); err != nil {
+		return nil, fmt.Errorf("解析模板文件失败: %w", err)
+	}
+	for model, name := range templates.Models {
+		if _, ok := templates.Templates[name]; !ok {
+			return nil, fmt.Errorf("模型 %s 引用了不存在的模板 %s", model, name)
+		}
+	}
+	return templates, nil
+}
+
+// Apply 为请求套用模板，metadata指定了不存在的模板时返回错误
+func (t *promptTemplates) Apply(req *ChatRequest, requestID string) error {
+	name := req.Metadata["template"]
+	if name == "" {
+		name = t.Models[req.Model]
+	}
+	if name == "" {
+		name = t.Models["*"]
+	}
+	if name == "" {
+		return nil
+	}
+	tmpl, ok := t.Templates[name]
+	if !ok {
+		return newAPIError(http.StatusBadRequest, fmt.Sprintf("提示词模板不存在: %s", name))
+	}
+
+	vars := templateVariables(req)
+	messages := make([]Message, 0, len(req.Messages)+len(tmpl.Messages)+1)
+	clientMessages := req.Messages
+	if tmpl.System != "" {
+		system := expandTemplate(tmpl.System, vars)
+		if len(clientMessages) > 0 && clientMessages[0].Role == "system" {
+			merged := clientMessages[0]
+			merged.Content = system + "\n\n" + merged.Content
+			messages = append(messages, merged)
+			clientMessages = clientMessages[1:]
+		} else {
+			messages = append(messages, Message{Role: "system", Content: system})
+		}
+	}
+	for _, msg := range tmpl.Messages {
+		msg.Content = expandTemplate(msg.Content, vars)
+		messages = append(messages, msg)
+	}
+	req.Messages = append(messages, clientMessages...)
+
+	log.Printf("[%s] 套用提示词模板: %s", requestID, name)
+	return nil
+}
+
+// templateVariables 模板中可用的变量：请求的model、user，当前date、datetime，以及metadata中的所有字段
+func templateVariables(req *ChatRequest) map[string]string {
+	now := time.Now()
+	vars := map[string]string{
+		"model":    req.Model,
+		"user":     req.User,
+		"date":     now.Format("2006-01-02"),
+		"datetime": now.Format("2006-01-02 15:04:05"),
+	}
+	for key, value := range req.Metadata {
+		vars[key] = value
+		vars["metadata."+key] = value
+	}
+	return vars
+}
+
+// expandTemplate 替换{{变量}}，未定义的变量替换为空字符串
+func expandTemplate(text string, vars map[string]string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	return templateVariablePattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := templateVariablePattern.FindStringSubmatch(match)[1]
+		return vars[name]
+	})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 多租户：TENANTS_FILE中定义多个租户，每个租户有自己的客户端密钥、DeepSeek密钥、模型映射和限额，
+// 一个代理实例可以同时服务多个团队，上游费用记在各自的DeepSeek账户上，用量也分别统计。
+// 使用租户密钥的请求按租户处理；DEEPSEEK_API_KEY仍然可以访问代理，不属于任何租户
+
+// tenant 一个租户的配置和运行时状态
+type tenant struct {
+	Name              string            `json:"name"`
+	Keys              []string          `json:"keys"`                           // 访问代理的客户端密钥
+	DeepSeekAPIKey    string            `json:"deepseek_api_key,omitempty"`     // 调用DeepSeek使用的密钥，为空时使用DEEPSEEK_API_KEY
+	DeepSeekAPIKeyEnv string            `json:"deepseek_api_key_env,omitempty"` // 从环境变量读取DeepSeek密钥，避免写在文件里
+	Models            map[string]string `json:"models,omitempty"`               // 请求的模型名到DeepSeek模型的映射，优先于内置映射
+	AllowedModels     []string          `json:"allowed_models,omitempty"`       // 允许使用的DeepSeek模型，为空时不限制
+	RequestsPerMinute int               `json:"requests_per_minute,omitempty"`  // 每分钟请求数上限，0表示不限制
+	MaxTokens         int               `json:"max_tokens,omitempty"`           // max_tokens上限，客户端未设置或超过时使用该值
+
+	mu          sync.Mutex
+	requests    int64
+	rateLimited int64
+	usage       Usage
+	cost        float64
+	lastSeen    time.Time
+}
+
+// tenantRegistry 按客户端密钥查找租户
+type tenantRegistry struct {
+	tenants []*tenant
+	byKey   map[string]*tenant
+	prices  usagePrices
+}
+
+// loadTenants 读取TENANTS_FILE，未配置时返回nil
+func loadTenants(config *ProxyConfig) (*tenantRegistry, error) {
+	if config.TenantsFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(config.TenantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取租户配置文件失败: %w", err)
+	}
+	var file struct {
+		Tenants []*tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("解析租户配置文件失败: %w", err)
+	}
+
+	registry := &tenantRegistry{
+		byKey: make(map[string]*tenant),
+		prices: usagePrices{
+			PromptCacheHit:  config.UsagePricePromptCacheHit,
+			PromptCacheMiss: config.UsagePricePromptCacheMiss,
+			Completion:      config.UsagePriceCompletion,
+		},
+	}
+	names := make(map[string]bool)
+	for _, t := range file.Tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("租户配置缺少name")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("租户 %s 重复定义", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Keys) == 0 {
+			return nil, fmt.Errorf("租户 %s 没有配置keys", t.Name)
+		}
+		for _, key := range t.Keys {
+			switch {
+			case key == "":
+				return nil, fmt.Errorf("租户 %s 的keys中有空密钥", t.Name)
+			case key == config.DeepSeekAPIKey:
+				return nil, fmt.Errorf("租户 %s 的客户端密钥不能与DEEPSEEK_API_KEY相同", t.Name)
+			case registry.byKey[key] != nil:
+				return nil, fmt.Errorf("租户 %s 和 %s 使用了相同的客户端密钥", registry.byKey[key].Name, t.Name)
+			}
+			registry.byKey[key] = t
+		}
+		if t.DeepSeekAPIKeyEnv != "" {
+			t.DeepSeekAPIKey = os.Getenv(t.DeepSeekAPIKeyEnv)
+			if t.DeepSeekAPIKey == "" {
+				return nil, fmt.Errorf("租户 %s 的DeepSeek密钥环境变量 %s 未设置", t.Name, t.DeepSeekAPIKeyEnv)
+			}
+		}
+		for model, target := range t.Models {
+			if target == "" {
+				return nil, fmt.Errorf("租户 %s 的模型 %s 没有映射目标", t.Name, model)
+			}
+		}
+		if t.RequestsPerMinute < 0 || t.MaxTokens < 0 {
+			return nil, fmt.Errorf("租户 %s 的requests_per_minute和max_tokens不能为负数", t.Name)
+		}
+		registry.tenants = append(registry.tenants, t)
+	}
+	return registry, nil
+}
+
+// Match 按客户端密钥返回租户，不属于任何租户时返回nil
+func (reg *tenantRegistry) Match(key string) *tenant {
+	if reg == nil || key == "" {
+		return nil
+	}
+	return reg.byKey[key]
+}
+
+// Named 按名称返回租户，用于恢复后台任务创建者的租户
+func (reg *tenantRegistry) Named(name string) *tenant {
+	if reg == nil || name == "" {
+		return nil
+	}
+	for _, t := range reg.tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// tenantFor 返回请求context中的租户，没有时为nil
+func tenantFor(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// tenantName 租户名称，不属于任何租户时为空
+func (t *tenant) tenantName() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// tenantScope 缓存和请求合并键的前缀，不同租户的相同请求互不共享结果，上游费用各自承担
+func tenantScope(ctx context.Context) string {
+	if t := tenantFor(ctx); t != nil {
+		return "tenant:" + t.Name + "/"
+	}
+	return ""
+}
+
+// upstreamAPIKey 请求调用DeepSeek使用的密钥，启用上游池时为路由选择的密钥
+func (ps *ProxyServer) upstreamAPIKey(ctx context.Context) string {
+	if t := tenantFor(ctx); t != nil && t.DeepSeekAPIKey != "" {
+		return t.DeepSeekAPIKey
+	}
+	if record := recordFromContext(ctx); record != nil && ps.upstreams != nil {
+		record.mu.Lock()
+		member := ps.upstreams.byName[record.upstream]
+		record.mu.Unlock()
+		if member != nil {
+			return member.apiKey
+		}
+	}
+	return ps.config.DeepSeekAPIKey
+}
+
+// mapModel 租户为请求的模型名配置的DeepSeek模型，没有配置时返回空
+func (t *tenant) mapModel(model string) string {
+	if t == nil {
+		return ""
+	}
+	return t.Models[model]
+}
+
+// applyLimits 检查模型白名单并限制max_tokens
+func (t *tenant) applyLimits(req *DeepSeekRequest, requestID string) error {
+	if t == nil {
+		return nil
+	}
+	if len(t.AllowedModels) > 0 && !t.allowsModel(req.Model) {
+		apiErr := newAPIError(http.StatusForbidden, fmt.Sprintf("租户 %s 不允许使用模型 %s", t.Name, req.Model))
+		apiErr.Code = "model_not_allowed"
+		return apiErr
+	}
+	if t.MaxTokens > 0 && (req.MaxTokens == 0 || req.MaxTokens > t.MaxTokens) {
+		log.Printf("[%s] 租户 %s 的max_tokens上限为 %d", requestID, t.Name, t.MaxTokens)
+		req.MaxTokens = t.MaxTokens
+	}
+	return nil
+}
+
+func (t *tenant) allowsModel(model string) bool {
+	for _, allowed := range t.AllowedModels {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// allow 按每分钟请求数限流，超出时返回需要等待的时间。
+// 计数保存在共享状态中，多个实例合计不超过上限；共享状态不可用时放行
+func (t *tenant) allow(store sharedStore, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	t.lastSeen = now
+	t.mu.Unlock()
+	if t.RequestsPerMinute <= 0 {
+		return true, 0
+	}
+	minute := now.Unix() / 60
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+	count, err := store.IncrBy(ctx, fmt.Sprintf("ratelimit:tenant:%s:%d", t.Name, minute), 1, 2*time.Minute)
+	if err != nil {
+		log.Printf("读取租户 %s 的限流计数失败，放行: %v", t.Name, err)
+		return true, 0
+	}
+	if count > int64(t.RequestsPerMinute) {
+		t.mu.Lock()
+		t.rateLimited++
+		t.mu.Unlock()
+		return false, time.Unix((minute+1)*60, 0).Sub(now)
+	}
+	return true, 0
+}
+
+// record 汇总一个请求的用量
+func (t *tenant) record(usage Usage, prices usagePrices) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.usage = addUsage(t.usage, usage)
+	t.cost += prices.cost(usage)
+}
+
+// Record 把请求的用量记到所属租户
+func (reg *tenantRegistry) Record(ctx context.Context, usage Usage) {
+	if t := tenantFor(ctx); reg != nil && t != nil {
+		t.record(usage, reg.prices)
+	}
+}
+
+// tenantLimitMiddleware 按租户的每分钟请求数限流
+func (ps *ProxyServer) tenantLimitMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || ps.tenants == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := tenantFor(r.Context())
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := t.allow(ps.state, time.Now()); !ok {
+			log.Printf("[%s] 租户 %s 超过每分钟 %d 个请求的限制", requestIDFor(r), t.Name, t.RequestsPerMinute)
+			ps.handleCORS(w, r)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			apiErr := newAPIError(http.StatusTooManyRequests, fmt.Sprintf("租户 %s 超过每分钟 %d 个请求的限制", t.Name, t.RequestsPerMinute))
+			apiErr.Code = "rate_limit_exceeded"
+			writeAPIError(w, apiErr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantStats 一个租户的累计用量
+type tenantStats struct {
+	Name              string    `json:"name"`
+	Keys              int       `json:"keys"`
+	OwnUpstreamKey    bool      `json:"own_upstream_key"`
+	RequestsPerMinute int       `json:"requests_per_minute,omitempty"`
+	Requests          int64     `json:"requests"`
+	RateLimited       int64     `json:"rate_limited"`
+	Usage             Usage     `json:"usage"`
+	Cost              float64   `json:"cost,omitempty"` // 按USAGE_PRICE_*估算的费用（美元）
+	LastSeen          time.Time `json:"last_seen,omitempty"`
+}
+
+// Stats 各租户的用量，按名称排序
+func (reg *tenantRegistry) Stats() []tenantStats {
+	stats := make([]tenantStats, 0, len(reg.tenants))
+	for _, t := range reg.tenants {
+		t.mu.Lock()
+		stats = append(stats, tenantStats{
+			Name:              t.Name,
+			Keys:              len(t.Keys),
+			OwnUpstreamKey:    t.DeepSeekAPIKey != "",
+			RequestsPerMinute: t.RequestsPerMinute,
+			Requests:          t.requests,
+			RateLimited:       t.rateLimited,
+			Usage:             t.usage,
+			Cost:              t.cost,
+			LastSeen:          t.lastSeen,
+		})
+		t.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
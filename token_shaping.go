@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 流式输出整形：按客户端密钥限制流式响应每秒输出的token数，低优先级的密钥被放慢，
+// 交互式使用的密钥保持全速，负载高时把上游吞吐留给更需要的客户端。
+// 整形作用于写给客户端的SSE数据，OpenAI、Anthropic和Gemini格式的流式响应都适用。
+// 同一密钥的所有流共用一个令牌桶，并发多个流时合计不超过设定的速率；整形在压缩之前进行，
+// 按明文估算token数
+
+// shapedTextFields SSE数据块中计入token数的文本字段
+var shapedTextFields = map[string]bool{
+	"content":           true,
+	"reasoning_content": true,
+	"text":              true,
+	"arguments":         true,
+	"partial_json":      true,
+	"thinking":          true,
+}
+
+// tokenBucket 按每秒rate个token补充、最多积累一秒的令牌桶，可以被多个流同时使用
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Wait 取走n个token，不足时等待补充；context结束时返回其错误。
+// 先在锁内预留token再在锁外等待，并发的流依次排在后面
+func (b *tokenBucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tokenBuckets 按客户端密钥哈希保存的令牌桶
+type tokenBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// get 返回密钥的令牌桶，速率在配置重新加载后变化时重新创建
+func (tb *tokenBuckets) get(hash string, rate int) *tokenBucket {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if bucket := tb.buckets[hash]; bucket != nil && bucket.rate == float64(rate) {
+		return bucket
+	}
+	if tb.buckets == nil {
+		tb.buckets = make(map[string]*tokenBucket)
+	}
+	bucket := newTokenBucket(rate)
+	tb.buckets[hash] = bucket
+	return bucket
+}
+
+// shapingWriter 在写出SSE数据前按其中的文本估算token数并等待令牌
+type shapingWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (sw *shapingWriter) Write(p []byte) (int, error) {
+	if strings.HasPrefix(sw.Header().Get("Content-Type"), "text/event-stream") {
+		if tokens := sseTokens(p); tokens > 0 {
+			if err := sw.bucket.Wait(sw.ctx, tokens); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *shapingWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack WebSocket升级需要接管底层连接，升级后不再整形
+func (sw *shapingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(sw.ResponseWriter)
+}
+
+// sseTokens 估算一段SSE数据中文本字段的token数
+func sseTokens(p []byte) int {
+	var text strings.Builder
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		data, ok := bytes.CutPrefix(line, []byte("data: "))
+		if !ok {
+			continue
+		}
+		var chunk interface{}
+		if json.Unmarshal(data, &chunk) == nil {
+			collectShapedText(chunk, &text)
+		}
+	}
+	return estimateTokens(text.String())
+}
+
+// collectShapedText 递归收集JSON中计入token数的文本字段
+func collectShapedText(value interface{}, text *strings.Builder) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s, ok := field.(string); ok && shapedTextFields[key] {
+				text.WriteString(s)
+			} else {
+				collectShapedText(field, text)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectShapedText(item, text)
+		}
+	}
+}
+
+// streamTokenRate 该客户端密钥的流式输出速率（token/秒），0表示不限制
+// STREAM_TOKEN_RATE_KEYS可以用完整的密钥或clientKeyHash匹配
+func (ps *ProxyServer) streamTokenRate(r *http.Request) int {
+	if rate, ok := ps.config.StreamTokenRateKeys[clientAPIKey(r)]; ok {
+		return rate
+	}
+	if rate, ok := ps.config.StreamTokenRateKeys[clientKeyHash(r)]; ok {
+		return rate
+	}
+	return ps.config.StreamTokenRate
+}
+
+// tokenShapingMiddleware 为需要限速的客户端密钥包装响应
+func (ps *ProxyServer) tokenShapingMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.auth != authAPIKey || (ps.config.StreamTokenRate <= 0 && len(ps.config.StreamTokenRateKeys) == 0) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rate := ps.streamTokenRate(r)
+		if rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		debugf("[%s] 流式输出限速: %d token/秒", requestIDFor(r), rate)
+		bucket := ps.shapingBuckets.get(clientKeyHash(r), rate)
+		next.ServeHTTP(&shapingWriter{ResponseWriter: w, ctx: r.Context(), bucket: bucket}, r)
+	})
+}
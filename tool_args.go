@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 工具调用参数校验：按工具声明的JSON Schema检查模型生成的参数，格式错误时尝试修复，
+// 仍不合法时把错误告诉模型并要求重新调用，避免参数损坏导致Agent客户端崩溃
+
+// checkToolCalls 校验响应中的工具调用参数，必要时修复或重新询问模型
+// 返回的响应可能是修复后的副本或重新询问得到的新响应，不修改传入的响应（它可能来自缓存）
+func (ps *ProxyServer) checkToolCalls(ctx context.Context, req *DeepSeekRequest, resp *DeepSeekResponse, requestID string) *DeepSeekResponse {
+	mode, maxReasks := ps.config.ToolArgsValidation, ps.config.ToolArgsMaxReasks
+	if req.strictTools {
+		// strict工具必须保证参数合法，至少重新询问一次
+		mode, maxReasks = "reask", max(maxReasks, 1)
+	}
+	if mode == "off" || len(req.Tools) == 0 {
+		return resp
+	}
+	// 服务端工具的定义是Go值，统一经过一次JSON编解码再按通用结构读取
+	schemas := make(map[string]interface{}, len(req.Tools))
+	for _, tool := range req.Tools {
+		var schema interface{}
+		if data, err := json.Marshal(tool.Function.Parameters); err == nil {
+			json.Unmarshal(data, &schema)
+		}
+		schemas[tool.Function.Name] = schema
+	}
+
+	for attempt := 0; ; attempt++ {
+		repaired, problems := repairToolCalls(resp, schemas, requestID)
+		if len(problems) == 0 || mode != "reask" || attempt >= maxReasks {
+			if len(problems) > 0 {
+				log.Printf("[%s] 工具调用参数仍不合法，原样返回: %s", requestID, strings.Join(problems, "; "))
+			}
+			return repaired
+		}
+
+		// 把有问题的调用和错误说明发回模型，要求重新生成
+		log.Printf("[%s] 工具调用参数不合法，第 %d 次要求模型重新调用: %s", requestID, attempt+1, strings.Join(problems, "; "))
+		retry := *req
+		retry.Stream = false
+		message := resp.Choices[0].Message
+		retry.Messages = append(append([]Message{}, req.Messages...), message)
+		for _, toolCall := range message.ToolCalls {
+			retry.Messages = append(retry.Messages, Message{
+				Role:       "tool",
+				ToolCallID: toolCall.ID,
+				Content: toolErrorResult("工具调用未执行，参数不合法: " + strings.Join(problems, "; ") +
+					"。请按照工具的参数定义修正后重新调用"),
+			})
+		}
+		next, err := ps.sendRequestToDeepSeek(ctx, &retry, requestID)
+		if err != nil {
+			log.Printf("[%s] 重新询问模型失败，返回修复后的结果: %v", requestID, err)
+			return repaired
+		}
+		next.Usage = addUsage(resp.Usage, next.Usage)
+		resp = next
+	}
+}
+
+// repairToolCalls 修复并校验第一个选项中的工具调用，返回修复后的响应副本和无法修复的问题
+func repairToolCalls(resp *DeepSeekResponse, schemas map[string]interface{}, requestID string) (*DeepSeekResponse, []string) {
+	if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+		return resp, nil
+	}
+
+	copied := *resp
+	copied.Choices = append([]DeepSeekChoice{}, resp.Choices...)
+	toolCalls := append([]ToolCall{}, resp.Choices[0].Message.ToolCalls...)
+	copied.Choices[0].Message.ToolCalls = toolCalls
+
+	var problems []string
+	for i := range toolCalls {
+		name := toolCalls[i].Function.Name
+		schema, ok := schemas[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("不存在名为 %s 的工具", name))
+			continue
+		}
+		arguments, changed, errs := repairArguments(toolCalls[i].Function.Arguments, schema)
+		if changed {
+			log.Printf("[%s] 已修复工具 %s 的参数", requestID, name)
+			toolCalls[i].Function.Arguments = arguments
+		}
+		for _, err := range errs {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	return &copied, problems
+}
+
+// repairArguments 解析参数JSON，格式错误时修复，再按schema校验并把可以转换的值转换为声明的类型
+func repairArguments(arguments string, schema interface{}) (string, bool, []string) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(arguments), &value); err != nil {
+		fixed := repairJSON(arguments)
+		if err := json.Unmarshal([]byte(fixed), &value); err != nil {
+			return arguments, false, []string{fmt.Sprintf("参数不是合法的JSON: %v", err)}
+		}
+	}
+
+	schemaMap, _ := schema.(map[string]interface{})
+	value, errs := validateSchema(value, schemaMap, "参数")
+	data, err := json.Marshal(value)
+	if err != nil {
+		return arguments, false, errs
+	}
+	if fixed := string(data); !jsonEqual(fixed, arguments) {
+		return fixed, true, errs
+	}
+	return arguments, false, errs
+}
+
+// jsonEqual 两段JSON是否等价（忽略空白和键的顺序）
+func jsonEqual(a, b string) bool {
+	var va, vb interface{}
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	da, _ := json.Marshal(va)
+	db, _ := json.Marshal(vb)
+	return string(da) == string(db)
+}
+
+// repairJSON 修复模型常见的JSON格式错误：代码块包裹、首尾多余文字、Python字面量、
+// 多余的逗号、未闭合的字符串和括号；空参数视为空对象
+func repairJSON(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "```json")
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimSuffix(s, "```")
+	s = strings.TrimSpace(s)
+	if start := strings.IndexAny(s, "{["); start > 0 {
+		s = s[start:]
+	}
+	if s == "" {
+		return "{}"
+	}
+
+	var out strings.Builder
+	var stack []byte
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+			out.WriteByte(c)
+		case '{', '[':
+			stack = append(stack, c)
+			out.WriteByte(c)
+		case '}', ']':
+			if len(stack) == 0 {
+				// 闭合括号之后的内容是多余的文字
+				return closeJSON(out.String(), nil, false)
+			}
+			trimTrailingComma(&out)
+			stack = stack[:len(stack)-1]
+			out.WriteByte(c)
+			if len(stack) == 0 {
+				return out.String()
+			}
+		default:
+			if word, literal := pythonLiteral(s[i:]); word != "" {
+				out.WriteString(literal)
+				i += len(word) - 1
+				continue
+			}
+			out.WriteByte(c)
+		}
+	}
+	return closeJSON(out.String(), stack, inString)
+}
+
+// closeJSON 补全未闭合的字符串和括号
+func closeJSON(s string, stack []byte, inString bool) string {
+	var out strings.Builder
+	out.WriteString(s)
+	if inString {
+		out.WriteByte('"')
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		trimTrailingComma(&out)
+		if stack[i] == '{' {
+			if text := strings.TrimRight(out.String(), " \t\r\n"); strings.HasSuffix(text, ":") {
+				out.Reset()
+				out.WriteString(text + "null")
+			}
+			out.WriteByte('}')
+		} else {
+			out.WriteByte(']')
+		}
+	}
+	return out.String()
+}
+
+// trimTrailingComma 删除末尾的逗号
+func trimTrailingComma(out *strings.Builder) {
+	text := strings.TrimRight(out.String(), " \t\r\n")
+	if strings.HasSuffix(text, ",") {
+		out.Reset()
+		out.WriteString(strings.TrimSuffix(text, ","))
+	}
+}
+
+// pythonLiteral 识别Python风格的True、False和None
+func pythonLiteral(s string) (string, string) {
+	for word, literal := range map[string]string{"True": "true", "False": "false", "None": "null"} {
+		if strings.HasPrefix(s, word) && (len(s) == len(word) || !isIdentByte(s[len(word)])) {
+			return word, literal
+		}
+	}
+	return "", ""
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// validateSchema 按JSON Schema的常用子集（type、properties、required、additionalProperties、
+// items、enum）校验值，把字符串形式的数字和布尔值转换为声明的类型，返回转换后的值和错误
+func validateSchema(value interface{}, schema map[string]interface{}, path string) (interface{}, []string) {
+	if schema == nil {
+		return value, nil
+	}
+	var errs []string
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		converted, ok := coerceType(value, types)
+		if !ok {
+			return value, []string{fmt.Sprintf("%s 应为 %s 类型", path, strings.Join(types, "或"))}
+		}
+		value = converted
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, option := range enum {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, fmt.Sprintf("%s 必须是 %v 之一", path, enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						errs = append(errs, fmt.Sprintf("缺少必填字段 %s.%s", path, key))
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propSchema, declared := properties[key].(map[string]interface{})
+			if !declared {
+				if schema["additionalProperties"] == false {
+					errs = append(errs, fmt.Sprintf("%s 不允许字段 %s", path, key))
+				}
+				continue
+			}
+			var fieldErrs []string
+			v[key], fieldErrs = validateSchema(v[key], propSchema, path+"."+key)
+			errs = append(errs, fieldErrs...)
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i := range v {
+				var itemErrs []string
+				v[i], itemErrs = validateSchema(v[i], items, fmt.Sprintf("%s[%d]", path, i))
+				errs = append(errs, itemErrs...)
+			}
+		}
+	}
+	return value, errs
+}
+
+// schemaTypes 读取type字段，可以是字符串或字符串数组
+func schemaTypes(value interface{}) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// coerceType 检查值是否符合其中一个类型，不符合时尝试从字符串转换
+func coerceType(value interface{}, types []string) (interface{}, bool) {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return value, true
+		}
+	}
+	s, isString := value.(string)
+	if !isString {
+		return value, false
+	}
+	s = strings.TrimSpace(s)
+	for _, t := range types {
+		switch t {
+		case "integer", "number":
+			if f, err := strconv.ParseFloat(s, 64); err == nil && (t == "number" || f == math.Trunc(f)) {
+				return f, true
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b, true
+			}
+		case "object", "array":
+			var parsed interface{}
+			if json.Unmarshal([]byte(s), &parsed) == nil && matchesType(parsed, t) {
+				return parsed, true
+			}
+		}
+	}
+	return value, false
+}
+
+func matchesType(value interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// namedToolChoice 返回指定函数的tool_choice中的函数名，不是指定函数时返回空字符串
+func namedToolChoice(choice interface{}) string {
+	choiceMap, ok := choice.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	function, _ := choiceMap["function"].(map[string]interface{})
+	name, _ := function["name"].(string)
+	return name
+}
+
+// forceToolByPrompt 在上游不接受指定函数的tool_choice时改用的请求：
+// 只保留指定的工具并要求必须调用工具，同时在系统消息中说明要调用的函数
+func (req *DeepSeekRequest) forceToolByPrompt(name string) *DeepSeekRequest {
+	forced := *req
+	forced.Tools = nil
+	for _, tool := range req.Tools {
+		if tool.Function.Name == name {
+			forced.Tools = append(forced.Tools, tool)
+		}
+	}
+	if len(forced.Tools) == 0 {
+		forced.Tools = req.Tools
+	}
+	forced.ToolChoice = "required"
+	forced.Messages = append(append([]Message{}, req.Messages...), Message{
+		Role:    "system",
+		Content: fmt.Sprintf("你必须调用函数 %s 来回应，不要直接回答。", name),
+	})
+	return &forced
+}
+
+// postChatCompletion 发送聊天完成请求；指定函数的tool_choice被上游以400拒绝（错误信息提到tool_choice）时，
+// 改为按提示词强制调用并重试一次，之后的请求直接使用回退方式
+func (ps *ProxyServer) postChatCompletion(ctx context.Context, req *DeepSeekRequest, stream bool, requestID string) (*http.Response, error) {
+	req = ps.offPeak.switchModel(ctx, req, requestID)
+	ps.shadow.Mirror(ctx, req, requestID)
+	name := namedToolChoice(req.ToolChoice)
+	if name != "" && ps.namedToolChoiceRejected.Load() {
+		req = req.forceToolByPrompt(name)
+	}
+
+	resp, err := ps.postUpstream(ctx, req.chatCompletionsPath(), req, stream, requestID)
+	var upstreamErr *upstreamError
+	if err == nil || namedToolChoice(req.ToolChoice) == "" ||
+		!errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(strings.ToLower(upstreamErr.Body), "tool_choice") {
+		return resp, err
+	}
+
+	log.Printf("[%s] 上游不接受指定函数 %s 的tool_choice，改为按提示词强制调用: %s", requestID, name, upstreamErr.Body)
+	ps.namedToolChoiceRejected.Store(true)
+	return ps.postUpstream(ctx, req.chatCompletionsPath(), req.forceToolByPrompt(name), stream, requestID)
+}
@@ -0,0 +1,126 @@
+package main
+
+import "fmt"
+
+// toolCallStream 在一个流式响应内整理工具调用的增量，使其符合OpenAI的格式：
+// 每个工具调用的第一个增量带index、id、type和function.name（arguments为空字符串或第一段参数），
+// 之后的增量只带index和function.arguments。上游缺少index或id、重复发送id和name、
+// 或者多个调用共用同一个index时，在这里按调用重新编号。
+// 客户端设置parallel_tool_calls为false时只保留每个选项的第一个调用；
+// 客户端使用旧版functions字段时改写为function_call增量
+type toolCallStream struct {
+	requestID string
+	single    bool
+	legacy    bool
+	choices   map[int]*choiceToolCalls
+}
+
+// choiceToolCalls 一个选项中已经出现的工具调用
+type choiceToolCalls struct {
+	ids     map[int]string // 上游index -> 当前调用的id
+	indexes map[int]int    // 上游index -> 发给客户端的index
+	last    int            // 最近一个增量对应的上游index
+	next    int            // 下一个新调用的客户端index
+}
+
+func newToolCallStream(requestID string, req *DeepSeekRequest) *toolCallStream {
+	return &toolCallStream{
+		requestID: requestID,
+		single:    req.serialToolCalls() || req.legacyFunctions,
+		legacy:    req.legacyFunctions,
+		choices:   make(map[int]*choiceToolCalls),
+	}
+}
+
+// Rewrite 改写数据块中的tool_calls增量，工具调用结束的选项把finish_reason改为tool_calls（旧版格式为function_call）
+func (s *toolCallStream) Rewrite(chunk map[string]interface{}) {
+	choices, _ := chunk["choices"].([]interface{})
+	for _, item := range choices {
+		choice, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := jsonInt(choice["index"], 0)
+		state := s.choices[index]
+
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+				if state == nil {
+					state = &choiceToolCalls{ids: make(map[int]string), indexes: make(map[int]int), last: -1}
+					s.choices[index] = state
+				}
+				rewritten := make([]interface{}, 0, len(toolCalls))
+				for _, raw := range toolCalls {
+					if call, ok := raw.(map[string]interface{}); ok {
+						if out := s.rewriteCall(state, call, index); !s.single || out["index"] == 0 {
+							rewritten = append(rewritten, out)
+						}
+					}
+				}
+				switch {
+				case len(rewritten) > 0 && s.legacy:
+					delete(delta, "tool_calls")
+					delta["function_call"] = legacyFunctionCallDelta(rewritten[0].(map[string]interface{}))
+				case len(rewritten) > 0:
+					delta["tool_calls"] = rewritten
+				default:
+					delete(delta, "tool_calls")
+				}
+			}
+		}
+
+		// 有工具调用时客户端依赖finish_reason判断需要执行工具
+		if reason := choice["finish_reason"]; state != nil && (reason == "stop" || reason == "tool_calls") {
+			if s.legacy {
+				choice["finish_reason"] = "function_call"
+			} else {
+				choice["finish_reason"] = "tool_calls"
+			}
+		}
+	}
+}
+
+// rewriteCall 改写单个工具调用增量
+func (s *toolCallStream) rewriteCall(state *choiceToolCalls, call map[string]interface{}, choiceIndex int) map[string]interface{} {
+	upstreamIndex := jsonInt(call["index"], state.last)
+	if upstreamIndex < 0 {
+		upstreamIndex = 0
+	}
+	id, _ := call["id"].(string)
+	function, _ := call["function"].(map[string]interface{})
+	name, _ := function["name"].(string)
+	arguments, _ := function["arguments"].(string)
+
+	// 同一个index上出现了新的id，或者没有index时出现了新的函数名，说明是一个新的调用，
+	// 之后这个index上的增量都属于新的调用
+	_, known := state.indexes[upstreamIndex]
+	isNew := !known || (id != "" && id != state.ids[upstreamIndex]) ||
+		(call["index"] == nil && id == "" && name != "")
+	if isNew {
+		if id == "" {
+			id = fmt.Sprintf("call_%s_%d_%d", s.requestID, choiceIndex, state.next)
+		}
+		state.ids[upstreamIndex] = id
+		state.indexes[upstreamIndex] = state.next
+		state.next++
+	}
+	state.last = upstreamIndex
+
+	out := map[string]interface{}{"index": state.indexes[upstreamIndex]}
+	if isNew {
+		out["id"] = id
+		out["type"] = "function"
+		out["function"] = map[string]interface{}{"name": name, "arguments": arguments}
+	} else {
+		out["function"] = map[string]interface{}{"arguments": arguments}
+	}
+	return out
+}
+
+// jsonInt 读取JSON解码得到的数字，不存在时返回默认值
+func jsonInt(value interface{}, defaultValue int) int {
+	if f, ok := value.(float64); ok {
+		return int(f)
+	}
+	return defaultValue
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// W3C Trace Context透传：客户端请求带有traceparent/tracestate头部时，原样附加到发给DeepSeek、
+// 钩子、服务端工具等的请求上，代理本身不产生span，但上下游的span可以串进同一条链路
+
+// tracestate的最大长度（W3C建议至少支持512个字符）
+const maxTraceStateLength = 512
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// traceContext 客户端传入的链路上下文
+type traceContext struct {
+	traceparent string
+	tracestate  string
+}
+
+type traceContextKey struct{}
+
+// traceContextMiddleware 读取并校验客户端的traceparent，保存到请求context中
+func traceContextMiddleware(rt route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent := strings.ToLower(strings.TrimSpace(r.Header.Get("traceparent")))
+		if !validTraceparent(traceparent) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tc := traceContext{traceparent: traceparent}
+		if tracestate := strings.TrimSpace(strings.Join(r.Header.Values("tracestate"), ",")); len(tracestate) <= maxTraceStateLength {
+			tc.tracestate = tracestate
+		}
+		if rt.name != "" {
+			log.Printf("[%s] trace-id: %s", requestIDFor(r), traceparent[3:35])
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, tc)))
+	})
+}
+
+// validTraceparent 校验traceparent的格式：版本ff无效，trace-id和parent-id不能全为0
+func validTraceparent(traceparent string) bool {
+	if !traceparentPattern.MatchString(traceparent) {
+		return false
+	}
+	return traceparent[:2] != "ff" &&
+		traceparent[3:35] != strings.Repeat("0", 32) &&
+		traceparent[36:52] != strings.Repeat("0", 16)
+}
+
+// injectTraceContext 把context中的链路上下文附加到发出的请求上
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+	if !ok {
+		return
+	}
+	req.Header.Set("traceparent", tc.traceparent)
+	if tc.tracestate != "" {
+		req.Header.Set("tracestate", tc.tracestate)
+	}
+}
@@ -1,5 +1,13 @@
 package main
 
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
 // === OpenAI兼容的请求结构 ===
 type ChatRequest struct {
 	Model       string      `json:"model"`
@@ -10,16 +18,30 @@ type ChatRequest struct {
 	Tools       []Tool      `json:"tools,omitempty"`
 	ToolChoice  interface{} `json:"tool_choice,omitempty"`
 	Functions   []Function  `json:"functions,omitempty"`
+
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
+	FunctionCall interface{} `json:"function_call,omitempty"` // 旧版的工具选择字段，与functions一起使用
+
+	ReasoningEffort string `json:"reasoning_effort,omitempty"` // o系列的思考投入：minimal、low、medium或high
+
+	User      string            `json:"user,omitempty"`
+	SessionID string            `json:"session_id,omitempty"` // 服务端会话ID，也可以通过X-Session-ID头部传递
+	Metadata  map[string]string `json:"metadata,omitempty"`   // metadata.template可指定提示词模板
+
+	Extra map[string]json.RawMessage `json:"-"` // 未定义的顶层字段，透传给DeepSeek
 }
 
 // === 消息结构 ===
 type Message struct {
-	Role             string     `json:"role"`
-	Content          string     `json:"content"`
-	ReasoningContent string     `json:"reasoning_content,omitempty"`
-	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID       string     `json:"tool_call_id,omitempty"`
-	Name             string     `json:"name,omitempty"`
+	Role             string        `json:"role"`
+	Content          string        `json:"content"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID       string        `json:"tool_call_id,omitempty"`
+	Name             string        `json:"name,omitempty"`
+	Prefix           bool          `json:"prefix,omitempty"`        // 对话前缀续写：最后一条助手消息作为回复的开头
+	FunctionCall     *FunctionCall `json:"function_call,omitempty"` // 旧版函数调用格式
 }
 
 // === 工具相关结构 ===
@@ -32,6 +54,7 @@ type Function struct {
 	Name        string      `json:"name"`
 	Description string      `json:"description"`
 	Parameters  interface{} `json:"parameters"`
+	Strict      bool        `json:"strict,omitempty"` // 要求生成的参数严格符合parameters
 }
 
 type ToolCall struct {
@@ -51,24 +74,55 @@ type DeepSeekRequest struct {
 	Temperature float64   `json:"temperature,omitempty"`
 	MaxTokens   int       `json:"max_tokens,omitempty"`
 	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
+	ToolChoice  interface{} `json:"tool_choice,omitempty"` // auto、none、required或指定函数的对象
+
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"` // 为false时每轮最多返回一个工具调用
+
+	User string `json:"user,omitempty"` // 终端用户标识，原样转发给DeepSeek
+
+	beta            bool // 需要使用DeepSeek的beta接口（对话前缀续写）
+	legacyFunctions bool // 客户端使用旧版functions字段，响应按function_call格式返回
+	strictTools     bool // 有strict工具且由代理校验参数
+
+	extra map[string]json.RawMessage // 透传的额外字段，序列化时附加在顶层
 }
 
 type DeepSeekResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index        int     `json:"index"`
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	ID      string           `json:"id"`
+	Object  string           `json:"object"`
+	Created int64            `json:"created"`
+	Model   string           `json:"model"`
+	Choices []DeepSeekChoice `json:"choices"`
+	Usage   Usage            `json:"usage"`
+}
+
+type DeepSeekChoice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	// DeepSeek上下文硬盘缓存的命中情况
+	PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens,omitempty"`
+	PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
+
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails OpenAI格式的提示词用量明细
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// CompletionTokensDetails OpenAI格式的生成用量明细
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 // === 模型列表相关结构 ===
@@ -92,6 +146,344 @@ type ProxyConfig struct {
 	DeepSeekModel  string `json:"deepseek_model"`
 	Endpoint       string `json:"endpoint"`
 	ProxyURL       string `json:"proxy_url,omitempty"`
+
+	// 上游熔断器配置
+	BreakerWindow       int           `json:"breaker_window"`        // 统计最近多少次上游调用
+	BreakerMinRequests  int           `json:"breaker_min_requests"`  // 窗口内至少多少次调用才判断失败率
+	BreakerFailureRatio float64       `json:"breaker_failure_ratio"` // 失败率达到该值时熔断
+	BreakerOpenTimeout  time.Duration `json:"breaker_open_timeout"`  // 熔断后多久进入半开探测
+
+	// 上游健康探测配置
+	HealthProbeInterval time.Duration `json:"health_probe_interval"` // 后台探测间隔，0表示不启用
+	HealthProbeTimeout  time.Duration `json:"health_probe_timeout"`  // 单次探测超时
+
+	// 优雅停机配置
+	ShutdownDrainDelay time.Duration `json:"shutdown_drain_delay"` // 就绪检查失败后等待多久再关闭监听
+	ShutdownTimeout    time.Duration `json:"shutdown_timeout"`     // 等待进行中请求完成的最长时间
+
+	// 流式响应配置
+	StreamMaxLineBytes      int           `json:"stream_max_line_bytes"`     // 上游SSE单行的最大字节数
+	StreamKeepAliveInterval time.Duration `json:"stream_keepalive_interval"` // 首个数据块到达前的心跳间隔，0表示关闭
+	StreamTimeout           time.Duration `json:"stream_timeout"`            // 单个流式响应的最长持续时间，0表示不限制
+	StreamResume            bool          `json:"stream_resume"`             // 是否支持通过Last-Event-ID断线重连
+	StreamResumeTTL         time.Duration `json:"stream_resume_ttl"`         // 流结束后缓冲区保留多久
+	FakeStream              bool          `json:"fake_stream"`               // 以非流式请求上游，再把完整响应拆成数据块发送
+	FakeStreamChunkSize     int           `json:"fake_stream_chunk_size"`    // 伪流式每个数据块的字符数
+	FakeStreamInterval      time.Duration `json:"fake_stream_interval"`      // 伪流式数据块之间的间隔
+	Destream                bool          `json:"destream"`                  // 非流式请求也以流式请求上游，再拼装成完整响应
+	StreamPassthrough       bool          `json:"stream_passthrough"`        // 原生DeepSeek模型的流式响应原样透传
+
+	// 上游超时配置
+	UpstreamTimeout   time.Duration `json:"upstream_timeout"`    // 单次上游调用（含读取完整响应）的最长时间
+	FirstTokenTimeout time.Duration `json:"first_token_timeout"` // 流式响应等待首个数据块的最长时间，0表示不限制
+
+	// 响应压缩配置
+	ResponseCompression bool `json:"response_compression"` // 按Accept-Encoding压缩返回给客户端的响应
+	CompressSSE         bool `json:"compress_sse"`         // 是否同时压缩流式响应
+
+	// 响应缓存配置
+	ResponseCache           bool          `json:"response_cache"`             // 是否启用精确匹配的响应缓存
+	ResponseCacheTTL        time.Duration `json:"response_cache_ttl"`         // 缓存条目的有效期
+	ResponseCacheMaxEntries int           `json:"response_cache_max_entries"` // 最多缓存多少条响应
+
+	// 语义缓存配置
+	SemanticCache                  bool               `json:"semantic_cache"`                    // 是否启用基于向量相似度的缓存
+	SemanticCacheEmbeddingsURL     string             `json:"semantic_cache_embeddings_url"`     // OpenAI兼容的embeddings接口地址
+	SemanticCacheEmbeddingsKey     string             `json:"-"`                                 // embeddings接口的API密钥
+	SemanticCacheEmbeddingsModel   string             `json:"semantic_cache_embeddings_model"`   // embeddings模型名
+	SemanticCacheEmbeddingsTimeout time.Duration      `json:"semantic_cache_embeddings_timeout"` // 单次向量化的超时
+	SemanticCacheThreshold         float64            `json:"semantic_cache_threshold"`          // 默认相似度阈值
+	SemanticCacheModelThresholds   map[string]float64 `json:"semantic_cache_model_thresholds"`   // 按DeepSeek模型覆盖阈值
+	SemanticCacheKeyThresholds     map[string]float64 `json:"-"`                                 // 按客户端密钥或其哈希覆盖阈值
+	SemanticCacheTTL               time.Duration      `json:"semantic_cache_ttl"`                // 缓存条目的有效期
+	SemanticCacheMaxEntries        int                `json:"semantic_cache_max_entries"`        // 最多缓存多少条响应
+
+	// 请求合并配置
+	RequestCoalescing bool `json:"request_coalescing"` // 是否把并发的相同非流式请求合并为一次上游调用
+
+	// TLS配置
+	TLSCertFile string `json:"tls_cert_file"` // 证书文件路径，与TLSKeyFile同时设置时启用HTTPS
+	TLSKeyFile  string `json:"tls_key_file"`  // 私钥文件路径
+
+	// ACME自动证书配置
+	ACMEDomains  []string `json:"acme_domains"`   // 申请证书的域名，设置后启用ACME
+	ACMEEmail    string   `json:"acme_email"`     // 证书到期提醒邮箱
+	ACMECacheDir string   `json:"acme_cache_dir"` // 证书缓存目录
+	ACMEHTTPPort int      `json:"acme_http_port"` // HTTP-01验证监听端口
+
+	// HTTP/3配置
+	HTTP3     bool `json:"http3"`      // 是否启用HTTP/3（QUIC）监听，需要启用TLS
+	HTTP3Port int  `json:"http3_port"` // HTTP/3监听的UDP端口
+
+	// Unix域套接字配置
+	ListenSocket     string      `json:"listen_socket"`      // 设置后监听Unix域套接字而不是TCP端口
+	ListenSocketMode os.FileMode `json:"listen_socket_mode"` // 套接字文件权限
+
+	// 热升级配置
+	UpgradeTimeout time.Duration `json:"upgrade_timeout"` // 等待新进程就绪的最长时间
+	PIDFile        string        `json:"pid_file"`        // 写入当前进程号的文件
+
+	// 管理接口配置
+	AdminAPIKey string `json:"-"`          // 管理接口的独立密钥，未设置时不启用/admin
+	Playground  bool   `json:"playground"` // 是否提供/playground对话测试页面
+
+	// 调试接口配置
+	DebugEndpoints bool `json:"debug_endpoints"` // 未设置管理密钥时也开放/debug/pprof和/debug/vars
+
+	// 外部钩子配置
+	PreRequestHookURL   string        `json:"pre_request_hook_url"`   // 前置钩子，可改写或拒绝客户端请求
+	PostResponseHookURL string        `json:"post_response_hook_url"` // 后置钩子，可改写或拒绝非流式响应
+	HookTimeout         time.Duration `json:"hook_timeout"`           // 单次钩子调用超时
+	HookFailOpen        bool          `json:"hook_fail_open"`         // 钩子调用失败时是否放行
+	HookSecret          string        `json:"-"`                      // 调用钩子时携带的Bearer令牌
+
+	// 过滤脚本配置
+	ScriptFile           string        `json:"script_file"`            // Lua过滤脚本路径，为空时不启用
+	ScriptReloadInterval time.Duration `json:"script_reload_interval"` // 检查脚本修改的间隔，0表示不自动重新加载
+
+	// 提示词模板配置
+	PromptTemplatesFile string `json:"prompt_templates_file"` // 模板定义文件（JSON），为空时不启用
+
+	// 系统提示词注入配置
+	SystemPrompt         string `json:"system_prompt"`          // 注入到所有对话的系统提示词
+	SystemPromptPosition string `json:"system_prompt_position"` // prepend或append
+	SystemPromptsFile    string `json:"system_prompts_file"`    // 按模型和密钥配置的系统提示词（JSON）
+
+	// 内容过滤配置
+	GuardrailsFile string `json:"guardrails_file"` // 过滤规则文件（JSON），为空时不启用
+	SecretScanning string `json:"secret_scanning"` // 请求中的凭据：off、block（拒绝）或redact（移除）
+
+	// 上下文长度配置
+	ContextLimitStrategy string         `json:"context_limit_strategy"` // off、reject、drop_oldest或keep_last
+	ContextKeepLastN     int            `json:"context_keep_last_n"`    // keep_last保留的非系统消息条数
+	ModelContextWindows  map[string]int `json:"model_context_windows"`  // 覆盖各模型的上下文长度
+	SlidingWindowTokens  int            `json:"sliding_window_tokens"`  // 滑动窗口的token预算（含max_tokens），0表示不启用
+
+	// 历史摘要配置
+	HistorySummarization     bool   `json:"history_summarization"`       // 滑动窗口丢弃较多消息时是否总结为系统消息
+	HistorySummaryModel      string `json:"history_summary_model"`       // 生成摘要使用的模型
+	HistorySummaryMinDropped int    `json:"history_summary_min_dropped"` // 丢弃的消息达到该条数时才总结
+	HistorySummaryMaxTokens  int    `json:"history_summary_max_tokens"`  // 摘要的最大token数
+
+	// 服务端会话配置
+	SessionStore       string        `json:"session_store"`        // 为空不启用，memory或file
+	SessionDir         string        `json:"session_dir"`          // file存储的目录
+	SessionTTL         time.Duration `json:"session_ttl"`          // 会话在最后一次更新后保留多久
+	SessionMaxMessages int           `json:"session_max_messages"` // 每个会话最多保存的非系统消息条数
+
+	// 文本补全配置
+	ChatPrefixCompletion bool   `json:"chat_prefix_completion"` // 对话以助手消息结尾时使用beta前缀续写
+	FIMModel             string `json:"fim_model"`              // 请求DeepSeek beta补全接口使用的模型
+	CompletionsBeta      bool   `json:"completions_beta"`       // 不带suffix的文本补全也走beta补全接口
+
+	// 内容审核配置
+	ModerationURL       string `json:"moderation_url"`        // 外部审核服务地址，为空时使用本地规则
+	ModerationAPIKey    string `json:"-"`                     // 外部审核服务的密钥
+	ModerationRulesFile string `json:"moderation_rules_file"` // 本地审核规则文件
+
+	// 文件接口配置
+	FilesDir      string `json:"files_dir"`       // 上传文件的存储目录，为空不启用
+	FilesMaxBytes int64  `json:"files_max_bytes"` // 单个文件的大小上限
+
+	// 批处理配置
+	BatchDir               string `json:"batch_dir"`                 // 批处理任务的存储目录，为空不启用
+	BatchRequestsPerMinute int    `json:"batch_requests_per_minute"` // 后台执行批处理请求的速率，0表示不限速
+
+	// Assistants接口配置
+	AssistantsDir string `json:"assistants_dir"` // 助手和线程的存储目录，为空不启用
+
+	// 服务端工具配置
+	ServerToolsFile      string `json:"server_tools_file"`       // 登记HTTP工具的文件（JSON），为空不启用
+	ServerToolsMaxRounds int    `json:"server_tools_max_rounds"` // 单个请求最多执行多少轮工具调用
+
+	// 内置工具配置
+	BuiltinTools         string        `json:"builtin_tools"`           // 启用的内置工具，逗号分隔：web_search、fetch_url
+	BuiltinToolsTimeout  time.Duration `json:"builtin_tools_timeout"`   // 单次内置工具调用超时
+	WebSearchProvider    string        `json:"web_search_provider"`     // 搜索服务：searxng、brave或tavily
+	WebSearchURL         string        `json:"web_search_url"`          // 搜索API地址，brave和tavily可省略
+	WebSearchAPIKey      string        `json:"-"`                       // 搜索API的密钥
+	WebSearchResults     int           `json:"web_search_results"`      // 返回给模型的搜索结果条数
+	FetchURLMaxBytes     int64         `json:"fetch_url_max_bytes"`     // fetch_url最多读取的字节数
+	FetchURLAllowPrivate bool          `json:"fetch_url_allow_private"` // 是否允许fetch_url访问内网地址
+
+	// 工具调用参数校验配置
+	ToolArgsValidation string `json:"tool_args_validation"` // off、repair（修复格式和类型）或reask（仍不合法时要求模型重新调用）
+	ToolArgsMaxReasks  int    `json:"tool_args_max_reasks"` // reask模式下最多重新询问的次数
+
+	// parallel_tool_calls为false时多余工具调用的处理方式：drop丢弃，queue暂存后依次返回
+	ParallelToolCallsMode string `json:"parallel_tool_calls_mode"`
+
+	// strict工具的处理方式：beta使用DeepSeek的严格模式beta接口，validate由代理校验并重新询问
+	StrictToolsMode string `json:"strict_tools_mode"`
+
+	// 按终端用户统计配置
+	UserStatsMaxUsers         int     `json:"user_stats_max_users"`          // 单独统计的终端用户数上限，超出后合并为(other)，0为不统计
+	UsagePricePromptCacheHit  float64 `json:"usage_price_prompt_cache_hit"`  // 缓存命中的输入token价格（美元/百万token）
+	UsagePricePromptCacheMiss float64 `json:"usage_price_prompt_cache_miss"` // 缓存未命中的输入token价格（美元/百万token）
+	UsagePriceCompletion      float64 `json:"usage_price_completion"`        // 输出token价格（美元/百万token）
+
+	// 幂等请求配置
+	IdempotencyTTL        time.Duration `json:"idempotency_ttl"`         // Idempotency-Key对应的响应保存多久，0为不启用
+	IdempotencyMaxEntries int           `json:"idempotency_max_entries"` // 最多保存的响应数
+
+	// 额外字段透传配置
+	PassthroughExtraFields bool     `json:"passthrough_extra_fields"` // 是否把请求中未定义的顶层字段转发给DeepSeek
+	DropExtraFields        []string `json:"drop_extra_fields"`        // 不转发的额外字段
+
+	// reasoning_effort各档位对应的推理模型max_tokens，未设置的档位使用默认值，0表示不限制
+	ReasoningEffortMaxTokens map[string]int `json:"reasoning_effort_max_tokens"`
+
+	// 参数约束配置
+	ParamPolicy          string         `json:"param_policy"`            // off、clamp（调整到范围内）或reject（返回400）
+	TemperatureMin       float64        `json:"temperature_min"`         // temperature的下限
+	TemperatureMax       float64        `json:"temperature_max"`         // temperature的上限
+	ModelMaxOutputTokens map[string]int `json:"model_max_output_tokens"` // 覆盖各模型的最大输出长度
+
+	// 客户端兼容配置
+	ClientProfilesFile   string `json:"client_profiles_file"`    // 覆盖或追加客户端配置的文件（JSON），为空只使用内置配置
+	CursorMaxTokensClamp bool   `json:"cursor_max_tokens_clamp"` // 是否对Cursor客户端限制max_tokens
+
+	// 上游请求头部配置
+	UpstreamBrowserHeaders bool   `json:"upstream_browser_headers"` // 是否在发往DeepSeek的请求上附加浏览器伪装头部
+	UpstreamUserAgent      string `json:"upstream_user_agent"`      // 自定义User-Agent，为空时按是否伪装选择默认值
+	UpstreamHeaders        string `json:"-"`                        // 附加的头部，格式如 X-Org=team-a,X-Gateway-Token=env:GATEWAY_TOKEN
+	UpstreamHeadersFile    string `json:"upstream_headers_file"`    // 附加头部的文件（JSON对象），值同样支持env:和file:
+	upstreamHeaders        http.Header
+
+	// 出站TLS配置
+	CAFile             string `json:"ca_file"`              // 额外信任的CA证书（PEM），用于TLS拦截网关或自签名的上游
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // 跳过出站请求的证书校验
+	upstreamTLS        *tls.Config
+
+	// 出站连接池配置
+	HTTPMaxIdleConns        int           `json:"http_max_idle_conns"`          // 所有主机的最大空闲连接数
+	HTTPMaxIdleConnsPerHost int           `json:"http_max_idle_conns_per_host"` // 每个主机的最大空闲连接数
+	HTTPIdleConnTimeout     time.Duration `json:"http_idle_conn_timeout"`       // 空闲连接保留的时间
+	HTTPDialTimeout         time.Duration `json:"http_dial_timeout"`            // 建立TCP连接的超时
+	HTTP2Enabled            bool          `json:"http2_enabled"`                // 是否对HTTPS上游使用HTTP/2
+
+	// 出站DNS配置
+	UpstreamHosts    []string `json:"upstream_hosts"` // 固定的域名到IP，格式如 api.deepseek.com=1.2.3.4，同一域名可以出现多次
+	DNSServer        string   `json:"dns_server"`     // 自定义DNS服务器，如 1.1.1.1:53
+	DNSDoHURL        string   `json:"dns_doh_url"`    // DoH的JSON查询地址，如 https://1.1.1.1/dns-query
+	upstreamResolver *upstreamResolver
+
+	// 流式输出整形配置
+	StreamTokenRate     int            `json:"stream_token_rate"` // 流式响应每秒最多输出的token数，0表示不限制
+	StreamTokenRateKeys map[string]int `json:"-"`                 // 按客户端密钥或其哈希覆盖的速率
+
+	// 请求优先级配置
+	UpstreamMaxConcurrency int            `json:"upstream_max_concurrency"` // 同时进行的上游请求数上限，0表示不限制
+	PriorityDefault        string         `json:"priority_default"`         // 没有指定优先级的请求使用的优先级
+	PriorityKeys           []string       `json:"-"`                        // 按客户端密钥或其哈希固定优先级，格式如 密钥=bulk
+	PriorityWeights        map[string]int `json:"priority_weights"`         // 各优先级分配名额的权重
+	defaultPriority        requestPriority
+	priorityKeys           map[string]requestPriority
+	priorityWeights        [priorityCount]int
+
+	// 背压配置
+	UpstreamMaxQueue       int           `json:"upstream_max_queue"`       // 等待上游名额的请求数上限，超出时返回503，0表示不限制
+	UpstreamQueueTimeout   time.Duration `json:"upstream_queue_timeout"`   // 排队的最长时间，超时返回503，0表示不限制
+	BackpressureRetryAfter time.Duration `json:"backpressure_retry_after"` // 排队已满或超时时返回的Retry-After
+	UpstreamRateLimitHold  bool          `json:"upstream_rate_limit_hold"` // 上游返回429后，在其Retry-After期间直接拒绝新请求
+
+	// 上游池配置
+	UpstreamPool []string `json:"-"` // 额外的上游，每项为 密钥 或 端点=密钥，按会话粘性路由
+
+	// 上游密钥预算配置
+	UpstreamKeyRPM int `json:"upstream_key_rpm"` // 每个上游密钥每分钟的请求数预算（所有实例合计），0表示不限制
+	UpstreamKeyTPM int `json:"upstream_key_tpm"` // 每个上游密钥每分钟的token数预算（所有实例合计），0表示不限制
+
+	// 错峰调度配置
+	OffPeakWindows        []string           `json:"off_peak_windows"`         // 优惠时段，格式如 16:30-00:30
+	OffPeakTimezone       string             `json:"off_peak_timezone"`        // 优惠时段使用的时区
+	OffPeakDeferBatches   bool               `json:"off_peak_defer_batches"`   // 把批处理任务推迟到优惠时段执行
+	OffPeakPeakModels     []string           `json:"off_peak_peak_models"`     // 高峰期bulk请求的模型替换，格式如 deepseek-reasoner=deepseek-chat
+	OffPeakDiscount       float64            `json:"off_peak_discount"`        // 优惠时段的默认折扣比例
+	OffPeakModelDiscounts map[string]float64 `json:"off_peak_model_discounts"` // 按模型覆盖的折扣比例
+
+	// A/B分流配置
+	ModelSplits []string `json:"model_splits"` // 格式如 gpt-4o=deepseek-chat:90|deepseek-reasoner:10
+
+	// 影子流量配置
+	ShadowSampleRate     float64       `json:"shadow_sample_rate"`     // 复制到影子端点的请求比例，0表示不启用
+	ShadowEndpoint       string        `json:"shadow_endpoint"`        // 影子请求的端点，为空时使用DEEPSEEK_ENDPOINT
+	ShadowAPIKey         string        `json:"-"`                      // 影子端点的API密钥，为空时使用DEEPSEEK_API_KEY
+	ShadowModel          string        `json:"shadow_model"`           // 影子请求使用的模型，为空时与原请求相同
+	ShadowLogFile        string        `json:"shadow_log_file"`        // 影子响应的JSONL日志，为空时只输出摘要
+	ShadowMaxConcurrency int           `json:"shadow_max_concurrency"` // 同时进行的影子请求数上限，超出时丢弃
+	ShadowTimeout        time.Duration `json:"shadow_timeout"`         // 影子请求的超时
+
+	// 金丝雀发布配置
+	CanaryStateFile         string  `json:"canary_state_file"`           // 保存金丝雀发布的文件，为空时只保存在内存中
+	CanaryMinRequests       int     `json:"canary_min_requests"`         // 两组都达到该请求数后才判断是否回滚
+	CanaryMaxErrorRateDelta float64 `json:"canary_max_error_rate_delta"` // 切换组错误率比原映射组高出该值时回滚
+	CanaryMaxLatencyRatio   float64 `json:"canary_max_latency_ratio"`    // 切换组平均延迟超过原映射组的该倍数时回滚
+
+	// 模拟上游配置
+	MockUpstream bool          // 不调用DeepSeek，由进程内的模拟上游返回固定响应
+	MockLatency  time.Duration // 模拟上游每个请求的延迟
+
+	// 混沌测试配置
+	ChaosLatency        time.Duration // 每个上游请求注入的固定延迟
+	ChaosLatencyJitter  time.Duration // 在固定延迟之上再增加的随机延迟上限
+	ChaosErrorRate      float64       // 随机返回5xx错误的比例
+	ChaosDisconnectRate float64       // 流式响应中途断开的比例
+
+	// 录制与回放配置
+	CassetteMode string // off、record（录制上游响应）或 replay（回放录制，不调用上游）
+	CassetteDir  string // 录制文件目录
+
+	// 多租户配置
+	TenantsFile string `json:"tenants_file"` // 租户定义文件（JSON），为空时不启用多租户
+
+	// 配额配置
+	QuotasFile     string `json:"quotas_file"`      // 按密钥的配额定义文件（JSON），为空时不启用配额
+	QuotaStateFile string `json:"quota_state_file"` // 保存各密钥当前周期用量的文件，为空时重启后用量清零
+	QuotaTimezone  string `json:"quota_timezone"`   // 计算每日、每周和每月重置时间的时区
+
+	// 用量日志配置
+	UsageLogFile string `json:"usage_log_file"` // 按行记录每个请求用量的文件（JSONL），为空时不记录
+
+	// 审计日志配置
+	AuditLogFile string `json:"audit_log_file"` // 管理操作、认证失败等事件的审计日志（JSONL，哈希链），为空时不记录
+
+	// 日志输出配置
+	LogStdout         bool          `json:"log_stdout"`           // 日志是否写标准错误
+	LogFile           string        `json:"log_file"`             // 日志文件，为空时不写文件
+	LogFileMaxSize    int64         `json:"log_file_max_size"`    // 日志文件超过该大小（MB）时轮转，0表示不按大小轮转
+	LogFileMaxAge     time.Duration `json:"log_file_max_age"`     // 日志文件打开超过该时间后轮转，0表示不按时间轮转
+	LogFileMaxBackups int           `json:"log_file_max_backups"` // 保留的旧日志文件数，0表示全部保留
+	LogSyslog         string        `json:"log_syslog"`           // syslog目标：local、udp://主机:端口 或 tcp://主机:端口，为空时不写syslog
+	LogSyslogTag      string        `json:"log_syslog_tag"`       // syslog消息的标签
+	LogSampleRate     int           `json:"log_sample_rate"`      // 每N个成功请求记录一个请求的日志，1表示全部记录
+	LogSampleSlow     time.Duration `json:"log_sample_slow"`      // 超过该耗时的请求总是记录日志，0表示不按耗时
+
+	// StatsD指标配置
+	StatsdAddr      string        `json:"statsd_addr"`      // StatsD或Datadog Agent的UDP地址，为空时不发送
+	StatsdPrefix    string        `json:"statsd_prefix"`    // 指标名前缀
+	StatsdTags      []string      `json:"statsd_tags"`      // 附加在每个指标上的DogStatsD标签，如 env:prod
+	StatsdDogStatsD bool          `json:"statsd_dogstatsd"` // 使用DogStatsD的标签格式
+	StatsdInterval  time.Duration `json:"statsd_interval"`  // 发送状态值的间隔
+
+	// 共享状态配置
+	StateStore     string `json:"state_store"`      // memory（默认，只在本进程内）或 redis（多个实例共享）
+	RedisURL       string `json:"-"`                // Redis地址，可能带有密码
+	RedisKeyPrefix string `json:"redis_key_prefix"` // 所有键的前缀
+
+	// 定期用量报告配置
+	ReportSchedule   string   `json:"report_schedule"` // off、daily 或 weekly（每周一）
+	ReportAt         string   `json:"report_at"`       // 发送报告的时刻，格式 HH:MM
+	ReportTimezone   string   `json:"report_timezone"` // 计算发送时刻的时区
+	ReportWebhookURL string   `json:"-"`               // 以JSON POST报告的地址，可能带有令牌
+	ReportEmailTo    []string `json:"report_email_to"` // 报告邮件的收件人
+	SMTPAddr         string   `json:"smtp_addr"`       // 发送报告邮件的SMTP服务器，格式 host:port
+	SMTPUsername     string   `json:"smtp_username"`   // SMTP认证用户名，为空时不认证
+	SMTPPassword     string   `json:"-"`               // SMTP认证密码
+	SMTPFrom         string   `json:"smtp_from"`       // 发件人地址
+
+	// 非流式路由（健康检查、模型列表等）的整体超时
+	RouteTimeout time.Duration `json:"route_timeout"`
 }
 
 // === 流式响应结构 ===
@@ -108,4 +500,4 @@ type StreamChunk struct {
 		} `json:"delta"`
 		FinishReason *string `json:"finish_reason"`
 	} `json:"choices"`
-}
\ No newline at end of file
+}
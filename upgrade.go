@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 热升级时父进程通过环境变量告诉新进程继承的监听和就绪通知管道
+const (
+	envInheritedFDs = "DEEPSEEK_PROXY_INHERITED_FDS" // 格式: main=3,http3=4
+	envReadyFD      = "DEEPSEEK_PROXY_READY_FD"
+)
+
+// fileListener 可以导出文件描述符的监听（TCP、Unix域套接字和UDP）
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+var (
+	inheritOnce    sync.Once
+	inheritedFiles map[string]*os.File
+)
+
+// inheritedFile 返回父进程传下来的同名监听，没有时返回nil
+func inheritedFile(name string) *os.File {
+	inheritOnce.Do(func() {
+		inheritedFiles = make(map[string]*os.File)
+		for _, pair := range strings.Split(os.Getenv(envInheritedFDs), ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			fd, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			inheritedFiles[key] = os.NewFile(uintptr(fd), key)
+		}
+	})
+	return inheritedFiles[name]
+}
+
+// inheritOrListen 优先使用继承的监听，否则新建，并记录下来供下一次热升级使用
+func (ps *ProxyServer) inheritOrListen(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if file := inheritedFile(name); file != nil {
+		log.Printf("继承父进程的监听: %s", name)
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		listener, err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps.trackListener(name, listener)
+	return listener, nil
+}
+
+// inheritOrListenPacket 与inheritOrListen相同，用于HTTP/3的UDP监听
+func (ps *ProxyServer) inheritOrListenPacket(name, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+	if file := inheritedFile(name); file != nil {
+		log.Printf("继承父进程的监听: %s", name)
+		conn, err = net.FilePacketConn(file)
+		file.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps.trackListener(name, conn)
+	return conn, nil
+}
+
+func (ps *ProxyServer) trackListener(name string, listener interface{}) {
+	fl, ok := listener.(fileListener)
+	if !ok {
+		return
+	}
+	ps.listenersMu.Lock()
+	defer ps.listenersMu.Unlock()
+	if ps.listeners == nil {
+		ps.listeners = make(map[string]fileListener)
+	}
+	ps.listeners[name] = fl
+}
+
+// notifyUpgradeReady 作为热升级启动的新进程时，通知父进程所有监听已就绪
+func notifyUpgradeReady() {
+	value := os.Getenv(envReadyFD)
+	if value == "" {
+		return
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "upgrade-ready")
+	pipe.Write([]byte{1})
+	pipe.Close()
+	log.Printf("✓ 已通知旧进程：新进程就绪")
+}
+
+// Upgrade 零停机热升级
+// 以当前可执行文件（可能已被替换为新版本）启动新进程并把所有监听的文件描述符交给它，
+// 新进程就绪后返回nil，调用方随后优雅停机：旧进程不再接受新连接，但会等进行中的流式响应完成
+func (ps *ProxyServer) Upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("无法定位可执行文件: %w", err)
+	}
+
+	ps.listenersMu.Lock()
+	names := make([]string, 0, len(ps.listeners))
+	for name := range ps.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var extraFiles []*os.File
+	var fds []string
+	for _, name := range names {
+		file, err := ps.listeners[name].File()
+		if err != nil {
+			ps.listenersMu.Unlock()
+			return fmt.Errorf("导出监听 %s 失败: %w", name, err)
+		}
+		defer file.Close()
+		// ExtraFiles中第i个文件在子进程中的描述符为3+i
+		fds = append(fds, fmt.Sprintf("%s=%d", name, 3+len(extraFiles)))
+		extraFiles = append(extraFiles, file)
+	}
+	ps.listenersMu.Unlock()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("创建就绪通知管道失败: %w", err)
+	}
+	defer readyReader.Close()
+	readyFD := 3 + len(extraFiles)
+	extraFiles = append(extraFiles, readyWriter)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envInheritedFDs+"=") && !strings.HasPrefix(kv, envReadyFD+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envInheritedFDs+"="+strings.Join(fds, ","),
+		envReadyFD+"="+strconv.Itoa(readyFD),
+	)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	if err := cmd.Start(); err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("启动新进程失败: %w", err)
+	}
+	readyWriter.Close()
+	log.Printf("已启动新进程 (pid %d)，等待其就绪...", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("新进程未能就绪: %w", err)
+		}
+	case <-time.After(ps.config.UpgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("新进程在 %v 内没有就绪", ps.config.UpgradeTimeout)
+	}
+
+	// Unix域套接字文件此时由新进程使用，旧进程关闭监听时不能删除它
+	ps.listenersMu.Lock()
+	for _, listener := range ps.listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	ps.listenersMu.Unlock()
+
+	log.Printf("✓ 新进程 (pid %d) 已接管监听", cmd.Process.Pid)
+	return nil
+}
+
+// writePIDFile 写入当前进程号，热升级后新进程会覆盖它，便于进程管理器跟踪
+func writePIDFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.Printf("警告：写入PID文件失败: %v", err)
+	}
+}
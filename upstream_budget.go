@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 上游密钥预算：多个代理实例共用同一个DeepSeek密钥时，每个实例都以为自己可以用满上游的限额，
+// 合计起来就会触发DeepSeek限流。UPSTREAM_KEY_RPM / UPSTREAM_KEY_TPM为每个上游密钥设置每分钟的
+// 请求数和token数预算，计数保存在共享状态中（STATE_STORE=redis时整个集群共用），超出预算的请求
+// 在本地直接返回429，不发往上游。上游返回429后的暂停同样按密钥写入共享状态，所有实例一起退避
+
+// upstreamHoldKey 共享状态中上游密钥限流暂停截止时间的键
+func upstreamHoldKey(hash string) string {
+	return "upstream:hold:" + hash
+}
+
+// upstreamBudget 按上游密钥协调每分钟的请求数和token数
+type upstreamBudget struct {
+	store sharedStore
+	rpm   int64 // 每个密钥每分钟的请求数预算，0表示不限制
+	tpm   int64 // 每个密钥每分钟的token数预算，0表示不限制
+
+	mu       sync.Mutex
+	rejected map[string]int64 // 按密钥哈希统计本实例拒绝的请求数
+}
+
+// newUpstreamBudget 未设置任何预算时返回nil
+func newUpstreamBudget(config *ProxyConfig, store sharedStore) *upstreamBudget {
+	if config.UpstreamKeyRPM <= 0 && config.UpstreamKeyTPM <= 0 {
+		return nil
+	}
+	return &upstreamBudget{
+		store:    store,
+		rpm:      int64(config.UpstreamKeyRPM),
+		tpm:      int64(config.UpstreamKeyTPM),
+		rejected: make(map[string]int64),
+	}
+}
+
+func upstreamBudgetKey(hash, kind string, minute int64) string {
+	return fmt.Sprintf("upstream:budget:%s:%s:%d", hash, kind, minute)
+}
+
+// Acquire 占用一个请求名额；本分钟的请求数或token数预算已用完时返回429错误。
+// 共享状态不可用时放行，由上游自己的限流兜底
+func (b *upstreamBudget) Acquire(ctx context.Context, apiKey string) error {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	minute := now.Unix() / 60
+	hash := keyHash(apiKey)
+	ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+	defer cancel()
+
+	if b.tpm > 0 {
+		data, ok, err := b.store.Get(ctx, upstreamBudgetKey(hash, "tpm", minute))
+		if err != nil {
+			log.Printf("读取上游密钥 %s 的token预算失败，放行: %v", hash, err)
+		} else if ok {
+			if used, _ := strconv.ParseInt(string(data), 10, 64); used >= b.tpm {
+				return b.reject(hash, fmt.Sprintf("上游密钥本分钟的token预算（%d）已用完", b.tpm), now)
+			}
+		}
+	}
+	if b.rpm > 0 {
+		count, err := b.store.IncrBy(ctx, upstreamBudgetKey(hash, "rpm", minute), 1, 2*time.Minute)
+		if err != nil {
+			log.Printf("读取上游密钥 %s 的请求预算失败，放行: %v", hash, err)
+		} else if count > b.rpm {
+			return b.reject(hash, fmt.Sprintf("上游密钥本分钟的请求预算（%d）已用完", b.rpm), now)
+		}
+	}
+	return nil
+}
+
+// reject 统计并构造预算用完时的429错误，Retry-After为到下一分钟的时间
+func (b *upstreamBudget) reject(hash, message string, now time.Time) error {
+	b.mu.Lock()
+	b.rejected[hash]++
+	b.mu.Unlock()
+	remaining := time.Unix((now.Unix()/60+1)*60, 0).Sub(now)
+	return &saturatedError{
+		StatusCode: http.StatusTooManyRequests,
+		Code:       "upstream_budget_exhausted",
+		Message:    fmt.Sprintf("%s，%d 秒后重试", message, int(remaining.Seconds())+1),
+		RetryAfter: remaining,
+	}
+}
+
+// Record 请求结束后把上游返回的token用量计入所用密钥的预算
+func (b *upstreamBudget) Record(apiKey string, usage Usage) {
+	if b == nil || b.tpm <= 0 || usage.TotalTokens <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+	key := upstreamBudgetKey(keyHash(apiKey), "tpm", time.Now().Unix()/60)
+	if _, err := b.store.IncrBy(ctx, key, int64(usage.TotalTokens), 2*time.Minute); err != nil {
+		log.Printf("记录上游密钥的token用量失败: %v", err)
+	}
+}
+
+// upstreamBudgetStats 一个上游密钥本分钟的预算使用情况
+type upstreamBudgetStats struct {
+	Key      string `json:"key"` // 密钥的短哈希
+	Requests int64  `json:"requests"`
+	Tokens   int64  `json:"tokens"`
+	Rejected int64  `json:"rejected"` // 本实例累计拒绝的请求数
+}
+
+// Snapshot 预算配置和各密钥本分钟的用量（集群合计）
+func (b *upstreamBudget) Snapshot(ctx context.Context, apiKeys []string) map[string]interface{} {
+	minute := time.Now().Unix() / 60
+	ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+	defer cancel()
+	keys := make([]upstreamBudgetStats, 0, len(apiKeys))
+	seen := make(map[string]bool)
+	for _, apiKey := range apiKeys {
+		hash := keyHash(apiKey)
+		if apiKey == "" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		entry := upstreamBudgetStats{Key: hash}
+		if data, ok, err := b.store.Get(ctx, upstreamBudgetKey(hash, "rpm", minute)); err == nil && ok {
+			entry.Requests, _ = strconv.ParseInt(string(data), 10, 64)
+		}
+		if data, ok, err := b.store.Get(ctx, upstreamBudgetKey(hash, "tpm", minute)); err == nil && ok {
+			entry.Tokens, _ = strconv.ParseInt(string(data), 10, 64)
+		}
+		b.mu.Lock()
+		entry.Rejected = b.rejected[hash]
+		b.mu.Unlock()
+		keys = append(keys, entry)
+	}
+	return map[string]interface{}{
+		"requests_per_minute": b.rpm,
+		"tokens_per_minute":   b.tpm,
+		"shared":              b.store.Shared(),
+		"keys":                keys,
+	}
+}
+
+// upstreamKeys 代理使用的所有上游密钥：DEEPSEEK_API_KEY、上游池和租户自己的密钥
+func (ps *ProxyServer) upstreamKeys() []string {
+	keys := []string{ps.config.DeepSeekAPIKey}
+	if ps.upstreams != nil {
+		for _, member := range ps.upstreams.members {
+			keys = append(keys, member.apiKey)
+		}
+	}
+	if ps.tenants != nil {
+		for _, t := range ps.tenants.tenants {
+			keys = append(keys, t.DeepSeekAPIKey)
+		}
+	}
+	return keys
+}
+
+// sharedUpstreamHold 其他实例记录的上游密钥限流暂停截止时间，没有时为零值
+func (ps *ProxyServer) sharedUpstreamHold(hash string) time.Time {
+	if !ps.state.Shared() {
+		return time.Time{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+	data, ok, err := ps.state.Get(ctx, upstreamHoldKey(hash))
+	if err != nil || !ok {
+		return time.Time{}
+	}
+	until, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
+}
+
+// shareUpstreamHold 把上游密钥的限流暂停写入共享状态，其他实例在此期间同样直接拒绝使用该密钥的请求
+func (ps *ProxyServer) shareUpstreamHold(hash string, until time.Time) {
+	if !ps.state.Shared() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+	if err := ps.state.Set(ctx, upstreamHoldKey(hash), []byte(strconv.FormatInt(until.UnixNano(), 10)), time.Until(until)); err != nil {
+		log.Printf("共享上游限流暂停失败: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 出站DNS：在默认解析器不可用或被污染的环境中，UPSTREAM_HOSTS把域名固定到指定的IP，
+// DNS_SERVER使用自定义的DNS服务器，DNS_DOH_URL通过DoH的JSON接口解析。
+// 只替换建立连接时使用的IP，URL、TLS的SNI和证书校验仍按原域名进行
+
+// dohMinTTL DoH解析结果至少缓存的时间
+const dohMinTTL = 30 * time.Second
+
+// dohCacheEntry 一个域名的DoH解析结果
+type dohCacheEntry struct {
+	ips     []string
+	expires time.Time
+}
+
+// upstreamResolver 按配置解析出站请求的域名
+type upstreamResolver struct {
+	hosts    map[string][]string // 固定的域名到IP
+	resolver *net.Resolver       // DNS_SERVER指定的解析器，为nil时使用系统解析器
+	dohURL   string
+	dohTLS   *tls.Config // DoH查询与上游使用相同的TLS配置
+	dialer   *net.Dialer
+
+	mu       sync.Mutex
+	dohCache map[string]dohCacheEntry
+}
+
+// newUpstreamResolver 按配置创建解析器，都未设置时返回nil使用系统默认的拨号方式
+func newUpstreamResolver(config *ProxyConfig) (*upstreamResolver, error) {
+	if len(config.UpstreamHosts) == 0 && config.DNSServer == "" && config.DNSDoHURL == "" {
+		return nil, nil
+	}
+	r := &upstreamResolver{
+		hosts:    make(map[string][]string),
+		dohURL:   config.DNSDoHURL,
+		dohTLS:   config.upstreamTLS,
+		dialer:   &net.Dialer{Timeout: config.HTTPDialTimeout, KeepAlive: 30 * time.Second},
+		dohCache: make(map[string]dohCacheEntry),
+	}
+	for _, pair := range config.UpstreamHosts {
+		host, ip, ok := strings.Cut(pair, "=")
+		host, ip = strings.ToLower(strings.TrimSpace(host)), strings.TrimSpace(ip)
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("UPSTREAM_HOSTS 中的 '%s' 格式错误，应为 域名=IP", pair)
+		}
+		r.hosts[host] = append(r.hosts[host], ip)
+	}
+	if config.DNSServer != "" {
+		server := config.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return r.dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if r.dohURL != "" {
+		if u, err := url.Parse(r.dohURL); err != nil || u.Scheme != "https" {
+			return nil, fmt.Errorf("DNS_DOH_URL 必须是https地址: %s", r.dohURL)
+		}
+	}
+	return r, nil
+}
+
+// DialContext 解析域名后依次尝试连接各个IP，作为出站Transport的拨号函数
+func (r *upstreamResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, address)
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// lookup 按固定IP、DoH、自定义DNS服务器或系统解析器的顺序解析域名
+func (r *upstreamResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := r.hosts[strings.ToLower(host)]; ok {
+		return ips, nil
+	}
+	if r.dohURL != "" {
+		return r.lookupDoH(ctx, host)
+	}
+	resolver := r.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", host, err)
+	}
+	return ips, nil
+}
+
+// dohResponse DoH JSON接口的响应（Cloudflare和Google的格式）
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		TTL  int    `json:"TTL"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// lookupDoH 通过DoH查询A和AAAA记录，结果按TTL缓存
+func (r *upstreamResolver) lookupDoH(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	entry, ok := r.dohCache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	var ips []string
+	ttl := time.Hour
+	for _, recordType := range []string{"A", "AAAA"} {
+		resp, err := r.queryDoH(ctx, host, recordType)
+		if err != nil {
+			return nil, err
+		}
+		for _, answer := range resp.Answer {
+			// 只取A(1)和AAAA(28)记录，跳过CNAME等
+			if (answer.Type == 1 || answer.Type == 28) && net.ParseIP(answer.Data) != nil {
+				ips = append(ips, answer.Data)
+				ttl = min(ttl, time.Duration(answer.TTL)*time.Second)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("DoH没有返回 %s 的地址", host)
+	}
+
+	r.mu.Lock()
+	r.dohCache[host] = dohCacheEntry{ips: ips, expires: time.Now().Add(max(ttl, dohMinTTL))}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// queryDoH 发送一次DoH JSON查询，使用默认的拨号方式避免循环依赖
+func (r *upstreamResolver) queryDoH(ctx context.Context, host, recordType string) (*dohResponse, error) {
+	query := url.Values{"name": {host}, "type": {recordType}}
+	req, err := http.NewRequestWithContext(ctx, "GET", r.dohURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: r.dohTLS, DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH查询 %s 失败: %w", host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH查询 %s 返回 %d", host, resp.StatusCode)
+	}
+
+	var result dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析DoH响应失败: %w", err)
+	}
+	// Status为DNS的RCODE，3（NXDOMAIN）等非0值表示解析失败
+	if result.Status != 0 {
+		return nil, fmt.Errorf("DoH查询 %s 失败，RCODE=%d", host, result.Status)
+	}
+	return &result, nil
+}
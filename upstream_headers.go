@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 自定义上游头部：在发往DeepSeek的每个请求上附加固定的头部（公司网关的认证头部、X-Org标签等）。
+// 值以env:开头时读取对应的环境变量，以file:开头时读取文件内容（去掉首尾空白），其余按字面值使用
+
+// reservedUpstreamHeaders 由代理自己设置、不允许覆盖的头部
+var reservedUpstreamHeaders = map[string]bool{
+	"Authorization":     true,
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+}
+
+// loadUpstreamHeaders 合并UPSTREAM_HEADERS_FILE和UPSTREAM_HEADERS，后者优先
+func loadUpstreamHeaders(config *ProxyConfig) (http.Header, error) {
+	values := make(map[string]string)
+	if config.UpstreamHeadersFile != "" {
+		data, err := os.ReadFile(config.UpstreamHeadersFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取上游头部文件失败: %w", err)
+		}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("解析上游头部文件失败: %w", err)
+		}
+	}
+	for _, pair := range strings.Split(config.UpstreamHeaders, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("UPSTREAM_HEADERS 中的 '%s' 格式错误，应为 名称=值", pair)
+		}
+		values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+	headers := make(http.Header, len(values))
+	for name, raw := range values {
+		name = http.CanonicalHeaderKey(name)
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+			return nil, fmt.Errorf("无效的头部名称: %q", name)
+		}
+		if reservedUpstreamHeaders[name] {
+			return nil, fmt.Errorf("头部 %s 由代理设置，不能覆盖", name)
+		}
+		value, err := resolveHeaderValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("头部 %s: %w", name, err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("头部 %s 的值不能包含换行", name)
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+// resolveHeaderValue 按env:、file:前缀读取头部的值
+func resolveHeaderValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "env:"):
+		name := strings.TrimPrefix(raw, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("环境变量 %s 未设置", name)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(raw, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("读取文件失败: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// 会话粘性路由：UPSTREAM_POOL配置多个上游密钥或端点时，同一个对话的请求总是发往同一个上游。
+// DeepSeek的上下文缓存按账户和前缀命中，对话分散到不同密钥上时每个密钥都要重新缓存一遍前缀。
+// 路由依据依次为会话ID（session_id或X-Session-ID）、提示词前缀（系统提示词和第一条用户消息）的哈希，
+// 用最高随机权重（rendezvous）哈希选择上游，增减上游时只有落在变化的上游上的对话会改变去向
+
+// upstreamMember 上游池中的一个密钥和端点
+type upstreamMember struct {
+	Name     string // 端点主机名和密钥的短哈希
+	Endpoint string
+	apiKey   string
+	requests atomic.Int64
+}
+
+// upstreamPool 可供选择的上游，第一个是DEEPSEEK_ENDPOINT和DEEPSEEK_API_KEY
+type upstreamPool struct {
+	members []*upstreamMember
+	byName  map[string]*upstreamMember
+}
+
+// newUpstreamPool 解析UPSTREAM_POOL，未配置时返回nil。
+// 每项为 密钥 或 端点=密钥，密钥可以用env:、file:前缀从环境变量或文件读取
+func newUpstreamPool(config *ProxyConfig) (*upstreamPool, error) {
+	if len(config.UpstreamPool) == 0 {
+		return nil, nil
+	}
+	pool := &upstreamPool{byName: make(map[string]*upstreamMember)}
+	add := func(endpoint, apiKey string) error {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("UPSTREAM_POOL 中的端点 %q 无效", endpoint)
+		}
+		member := &upstreamMember{
+			Name:     u.Host + "/" + keyHash(apiKey),
+			Endpoint: strings.TrimRight(endpoint, "/"),
+			apiKey:   apiKey,
+		}
+		if pool.byName[member.Name] != nil {
+			return fmt.Errorf("UPSTREAM_POOL 中的 %s 重复", member.Name)
+		}
+		pool.members = append(pool.members, member)
+		pool.byName[member.Name] = member
+		return nil
+	}
+	if err := add(config.Endpoint, config.DeepSeekAPIKey); err != nil {
+		return nil, err
+	}
+	for _, entry := range config.UpstreamPool {
+		endpoint, rawKey := config.Endpoint, entry
+		if i := strings.LastIndex(entry, "="); i > 0 && strings.Contains(entry[:i], "://") {
+			endpoint, rawKey = entry[:i], entry[i+1:]
+		}
+		apiKey, err := resolveHeaderValue(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_POOL: %w", err)
+		}
+		if apiKey == "" {
+			return nil, fmt.Errorf("UPSTREAM_POOL 中 %s 的密钥为空", endpoint)
+		}
+		if err := add(endpoint, apiKey); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// Pick 按路由依据选择上游，相同的依据总是得到相同的上游
+func (p *upstreamPool) Pick(routingKey string) *upstreamMember {
+	var best *upstreamMember
+	var bestScore uint64
+	for _, member := range p.members {
+		h := fnv.New64a()
+		h.Write([]byte(routingKey))
+		h.Write([]byte{0})
+		h.Write([]byte(member.Name))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = member, score
+		}
+	}
+	return best
+}
+
+// Snapshot 各上游和经过的请求数
+func (p *upstreamPool) Snapshot() []map[string]interface{} {
+	members := make([]map[string]interface{}, len(p.members))
+	for i, member := range p.members {
+		members[i] = map[string]interface{}{
+			"name":     member.Name,
+			"endpoint": member.Endpoint,
+			"requests": member.requests.Load(),
+		}
+	}
+	return members
+}
+
+// routingKey 请求的路由依据：会话ID、提示词前缀的哈希，都没有时为请求ID（不粘性）
+func routingKey(ctx context.Context, payload interface{}, requestID string) string {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		session := record.session
+		record.mu.Unlock()
+		if session != "" {
+			return "session:" + session
+		}
+	}
+	if req, ok := payload.(*DeepSeekRequest); ok {
+		if prefix := promptPrefixHash(req); prefix != "" {
+			return "prefix:" + prefix
+		}
+	}
+	return "request:" + requestID
+}
+
+// promptPrefixHash 开头的系统消息和第一条非系统消息的哈希，同一个对话的后续轮次前缀相同
+func promptPrefixHash(req *DeepSeekRequest) string {
+	h := sha256.New()
+	found := false
+	for _, msg := range req.Messages {
+		h.Write([]byte(msg.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(msg.Content))
+		h.Write([]byte{0})
+		if msg.Role != "system" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// recordSession 登记请求的会话ID，用于选择上游
+func recordSession(ctx context.Context, sessionID string) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.session = sessionID
+		record.mu.Unlock()
+	}
+}
+
+// routeUpstream 选择请求使用的上游端点和密钥。使用自己DeepSeek密钥的租户不参与上游池
+func (ps *ProxyServer) routeUpstream(ctx context.Context, payload interface{}, requestID string) (string, string) {
+	if t := tenantFor(ctx); t != nil && t.DeepSeekAPIKey != "" {
+		return ps.config.Endpoint, t.DeepSeekAPIKey
+	}
+	if ps.upstreams == nil {
+		return ps.config.Endpoint, ps.config.DeepSeekAPIKey
+	}
+	member := ps.upstreams.Pick(routingKey(ctx, payload, requestID))
+	member.requests.Add(1)
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		record.upstream = member.Name
+		record.mu.Unlock()
+	}
+	if debugLogging.Load() {
+		log.Printf("[%s] 上游路由: %s", requestID, member.Name)
+	}
+	return member.Endpoint, member.apiKey
+}
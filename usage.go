@@ -0,0 +1,68 @@
+package main
+
+import "unicode/utf8"
+
+// toOpenAI 把DeepSeek的用量字段映射为OpenAI格式
+// DeepSeek通过prompt_cache_hit_tokens报告上下文缓存命中，OpenAI客户端和成本看板读取的是
+// prompt_tokens_details.cached_tokens；原始字段保留，方便直接对接DeepSeek的统计
+func (u Usage) toOpenAI() Usage {
+	if u.PromptTokensDetails == nil && (u.PromptCacheHitTokens > 0 || u.PromptCacheMissTokens > 0) {
+		u.PromptTokensDetails = &PromptTokensDetails{CachedTokens: u.PromptCacheHitTokens}
+	}
+	return u
+}
+
+// convertUsageMap 在流式数据块的usage对象上做同样的映射
+func convertUsageMap(usage map[string]interface{}) {
+	if _, exists := usage["prompt_tokens_details"]; exists {
+		return
+	}
+	hit, hasHit := usage["prompt_cache_hit_tokens"]
+	_, hasMiss := usage["prompt_cache_miss_tokens"]
+	if !hasHit && !hasMiss {
+		return
+	}
+	if !hasHit {
+		hit = 0
+	}
+	usage["prompt_tokens_details"] = map[string]interface{}{"cached_tokens": hit}
+}
+
+// openAIUsage 返回OpenAI格式的用量，上游没有报告推理token数时根据推理内容估算
+// o1系列的客户端通过completion_tokens_details.reasoning_tokens区分思考和回答的开销
+func (r *DeepSeekResponse) openAIUsage() Usage {
+	usage := r.Usage.toOpenAI()
+	if usage.CompletionTokensDetails != nil {
+		return usage
+	}
+
+	reasoningTokens := 0
+	for _, choice := range r.Choices {
+		reasoningTokens += estimateTokens(choice.Message.ReasoningContent)
+	}
+	if reasoningTokens == 0 {
+		return usage
+	}
+	if usage.CompletionTokens > 0 && reasoningTokens > usage.CompletionTokens {
+		reasoningTokens = usage.CompletionTokens
+	}
+	usage.CompletionTokensDetails = &CompletionTokensDetails{ReasoningTokens: reasoningTokens}
+	return usage
+}
+
+// estimateTokens 按DeepSeek文档给出的换算比例估算token数：
+// 1个英文字符约0.3个token，1个中文字符约0.6个token
+func estimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	var tokens float64
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			tokens += 0.3
+		} else {
+			tokens += 0.6
+		}
+	}
+	return int(tokens + 0.5)
+}
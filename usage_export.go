@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用量导出：USAGE_LOG_FILE按行追加每个请求的用量（JSONL），管理接口 /admin/usage/export 和
+// usage-export 子命令按时间范围导出逐条记录或按日期、模型、租户等汇总的用量，格式为CSV或JSONL，
+// 用于财务对账和内部结算。日志中只记录客户端密钥的短哈希，不保存原始密钥
+
+// usageEntry 用量日志中的一条记录
+type usageEntry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id,omitempty"`
+	Path             string    `json:"path"`
+	Model            string    `json:"model,omitempty"`
+	Status           int       `json:"status"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Key              string    `json:"key,omitempty"` // 客户端密钥的短哈希
+	User             string    `json:"user,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	CacheHitTokens   int       `json:"prompt_cache_hit_tokens"`
+	CacheMissTokens  int       `json:"prompt_cache_miss_tokens"`
+	Cost             float64   `json:"cost"` // 按USAGE_PRICE_*估算的费用（美元）
+}
+
+// usageLedger 追加写入用量日志
+type usageLedger struct {
+	path   string
+	prices usagePrices
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newUsageLedger 打开用量日志，USAGE_LOG_FILE为空时返回nil
+func newUsageLedger(config *ProxyConfig) (*usageLedger, error) {
+	if config.UsageLogFile == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(config.UsageLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("打开用量日志失败: %w", err)
+	}
+	return &usageLedger{
+		path: config.UsageLogFile,
+		prices: usagePrices{
+			PromptCacheHit:  config.UsagePricePromptCacheHit,
+			PromptCacheMiss: config.UsagePricePromptCacheMiss,
+			Completion:      config.UsagePriceCompletion,
+		},
+		file: file,
+	}, nil
+}
+
+// Record 追加一个请求的用量，没有调用模型的请求（健康检查、管理接口等）不记录
+func (l *usageLedger) Record(entry requestLog, key string, usage Usage) {
+	if l == nil || (entry.Model == "" && usage.TotalTokens == 0) {
+		return
+	}
+	record := usageEntry{
+		Time:             entry.Time,
+		RequestID:        entry.RequestID,
+		Path:             entry.Path,
+		Model:            entry.Model,
+		Status:           entry.Status,
+		Tenant:           entry.Tenant,
+		User:             entry.User,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		CacheHitTokens:   usage.PromptCacheHitTokens,
+		CacheMissTokens:  usage.PromptCacheMissTokens,
+		Cost:             l.prices.cost(usage),
+	}
+	if key != "" {
+		record.Key = keyHash(key)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Printf("写入用量日志失败: %v", err)
+	}
+}
+
+// Close 关闭用量日志
+func (l *usageLedger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// usageGroupFields 汇总导出支持的分组字段
+var usageGroupFields = map[string]func(usageEntry) string{
+	"day":    func(e usageEntry) string { return e.Time.Local().Format("2006-01-02") },
+	"month":  func(e usageEntry) string { return e.Time.Local().Format("2006-01") },
+	"model":  func(e usageEntry) string { return e.Model },
+	"tenant": func(e usageEntry) string { return e.Tenant },
+	"key":    func(e usageEntry) string { return e.Key },
+	"user":   func(e usageEntry) string { return e.User },
+	"path":   func(e usageEntry) string { return e.Path },
+}
+
+// usageExportOptions 导出的时间范围、分组和格式
+type usageExportOptions struct {
+	From    time.Time // 包含，为零值时不限制
+	To      time.Time // 不包含，为零值时不限制
+	GroupBy []string  // 为空时导出逐条记录
+	Format  string    // csv或jsonl
+}
+
+// parseUsageExportOptions 解析导出参数，时间可以是RFC3339或本地时区的日期（2006-01-02）
+func parseUsageExportOptions(from, to, groupBy, format string) (usageExportOptions, error) {
+	opts := usageExportOptions{Format: format}
+	if opts.Format == "" {
+		opts.Format = "csv"
+	}
+	if opts.Format != "csv" && opts.Format != "jsonl" {
+		return opts, fmt.Errorf("format只能是 csv 或 jsonl，当前为 %q", format)
+	}
+	var err error
+	if opts.From, err = parseUsageTime(from); err != nil {
+		return opts, fmt.Errorf("from无效: %w", err)
+	}
+	if opts.To, err = parseUsageTime(to); err != nil {
+		return opts, fmt.Errorf("to无效: %w", err)
+	}
+	if !opts.From.IsZero() && !opts.To.IsZero() && !opts.From.Before(opts.To) {
+		return opts, fmt.Errorf("from必须早于to")
+	}
+	for _, field := range strings.Split(groupBy, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if usageGroupFields[field] == nil {
+			return opts, fmt.Errorf("不支持按 %q 分组（可选 day、month、model、tenant、key、user、path）", field)
+		}
+		opts.GroupBy = append(opts.GroupBy, field)
+	}
+	return opts, nil
+}
+
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// usageColumns 逐条导出的CSV列
+var usageColumns = []string{"time", "request_id", "path", "model", "status", "tenant", "key", "user",
+	"prompt_tokens", "completion_tokens", "total_tokens", "prompt_cache_hit_tokens", "prompt_cache_miss_tokens", "cost"}
+
+// usageTotals 一个分组的汇总用量
+type usageTotals struct {
+	values   []string
+	requests int64
+	usage    Usage
+	cost     float64
+}
+
+// exportUsage 读取用量日志，把时间范围内的记录写成CSV或JSONL，返回输出的行数
+func exportUsage(path string, w io.Writer, opts usageExportOptions) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("打开用量日志失败: %w", err)
+	}
+	defer file.Close()
+
+	var csvWriter *csv.Writer
+	var header []string
+	if opts.Format == "csv" {
+		csvWriter = csv.NewWriter(w)
+		defer csvWriter.Flush()
+		header = usageColumns
+		if len(opts.GroupBy) > 0 {
+			header = append(append([]string(nil), opts.GroupBy...), "requests", "prompt_tokens", "completion_tokens",
+				"total_tokens", "prompt_cache_hit_tokens", "prompt_cache_miss_tokens", "cost")
+		}
+		if err := csvWriter.Write(header); err != nil {
+			return 0, err
+		}
+	}
+	encoder := json.NewEncoder(w)
+
+	rows := 0
+	groups := make(map[string]*usageTotals)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry usageEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if (!opts.From.IsZero() && entry.Time.Before(opts.From)) || (!opts.To.IsZero() && !entry.Time.Before(opts.To)) {
+			continue
+		}
+
+		if len(opts.GroupBy) > 0 {
+			values := make([]string, len(opts.GroupBy))
+			for i, field := range opts.GroupBy {
+				values[i] = usageGroupFields[field](entry)
+			}
+			groupKey := strings.Join(values, "\x00")
+			totals := groups[groupKey]
+			if totals == nil {
+				totals = &usageTotals{values: values}
+				groups[groupKey] = totals
+			}
+			totals.requests++
+			totals.usage = addUsage(totals.usage, Usage{
+				PromptTokens:          entry.PromptTokens,
+				CompletionTokens:      entry.CompletionTokens,
+				TotalTokens:           entry.TotalTokens,
+				PromptCacheHitTokens:  entry.CacheHitTokens,
+				PromptCacheMissTokens: entry.CacheMissTokens,
+			})
+			totals.cost += entry.Cost
+			continue
+		}
+
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{
+				entry.Time.Format(time.RFC3339), entry.RequestID, entry.Path, entry.Model, strconv.Itoa(entry.Status),
+				entry.Tenant, entry.Key, entry.User,
+				strconv.Itoa(entry.PromptTokens), strconv.Itoa(entry.CompletionTokens), strconv.Itoa(entry.TotalTokens),
+				strconv.Itoa(entry.CacheHitTokens), strconv.Itoa(entry.CacheMissTokens), formatCost(entry.Cost),
+			})
+		} else {
+			err = encoder.Encode(entry)
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return rows, fmt.Errorf("读取用量日志失败: %w", err)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		totals := groups[key]
+		if csvWriter != nil {
+			err = csvWriter.Write(append(append([]string(nil), totals.values...),
+				strconv.FormatInt(totals.requests, 10),
+				strconv.Itoa(totals.usage.PromptTokens), strconv.Itoa(totals.usage.CompletionTokens),
+				strconv.Itoa(totals.usage.TotalTokens), strconv.Itoa(totals.usage.PromptCacheHitTokens),
+				strconv.Itoa(totals.usage.PromptCacheMissTokens), formatCost(totals.cost)))
+		} else {
+			row := map[string]interface{}{
+				"requests":                 totals.requests,
+				"prompt_tokens":            totals.usage.PromptTokens,
+				"completion_tokens":        totals.usage.CompletionTokens,
+				"total_tokens":             totals.usage.TotalTokens,
+				"prompt_cache_hit_tokens":  totals.usage.PromptCacheHitTokens,
+				"prompt_cache_miss_tokens": totals.usage.PromptCacheMissTokens,
+				"cost":                     totals.cost,
+			}
+			for i, field := range opts.GroupBy {
+				row[field] = totals.values[i]
+			}
+			err = encoder.Encode(row)
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	return rows, nil
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 6, 64)
+}
+
+// handleAdminUsageExport 按查询参数from、to、group_by、format导出用量
+func (ps *ProxyServer) handleAdminUsageExport(w http.ResponseWriter, r *http.Request) {
+	if ps.usageLog == nil {
+		writeAPIError(w, newAPIError(http.StatusNotFound, "未配置USAGE_LOG_FILE，没有可导出的用量"))
+		return
+	}
+	query := r.URL.Query()
+	opts, err := parseUsageExportOptions(query.Get("from"), query.Get("to"), query.Get("group_by"), query.Get("format"))
+	if err != nil {
+		writeAPIError(w, newAPIError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if opts.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage.%s"`, opts.Format))
+	rows, err := exportUsage(ps.usageLog.path, w, opts)
+	if err != nil {
+		log.Printf("导出用量失败: %v", err)
+		return
+	}
+	log.Printf("已导出 %d 行用量记录", rows)
+}
+
+// runUsageExportCommand 从用量日志导出用量，默认写到标准输出
+func runUsageExportCommand(args []string) int {
+	fs := flag.NewFlagSet("usage-export", flag.ExitOnError)
+	configFile := fs.String("config", ".env", "配置文件路径")
+	logFile := fs.String("file", "", "用量日志路径（默认: USAGE_LOG_FILE）")
+	from := fs.String("from", "", "开始时间（包含），RFC3339或2006-01-02")
+	to := fs.String("to", "", "结束时间（不包含），RFC3339或2006-01-02")
+	groupBy := fs.String("group-by", "", "汇总字段，逗号分隔：day、month、model、tenant、key、user、path；为空时导出逐条记录")
+	format := fs.String("format", "csv", "输出格式：csv 或 jsonl")
+	output := fs.String("o", "", "输出文件（默认: 标准输出）")
+	fs.Parse(args)
+
+	if *logFile == "" {
+		config, err := readConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			return 2
+		}
+		*logFile = config.UsageLogFile
+	}
+	if *logFile == "" {
+		fmt.Fprintln(os.Stderr, "错误：未配置USAGE_LOG_FILE，请用 -file 指定用量日志")
+		return 2
+	}
+	opts, err := parseUsageExportOptions(*from, *to, *groupBy, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		return 2
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	rows, err := exportUsage(*logFile, out, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		return 1
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "已导出 %d 行到 %s\n", rows, *output)
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 按终端用户统计：客户端在请求中通过user字段标识终端用户时，
+// 按用户累计请求数、token用量和估算费用，便于多个用户共用一个代理密钥时分摊成本
+
+// 超过USER_STATS_MAX_USERS后，新出现的用户合并统计到这个键下
+const otherUsersKey = "(other)"
+
+// userStats 一个终端用户的累计用量
+type userStats struct {
+	User     string    `json:"user"`
+	Requests int64     `json:"requests"`
+	Usage    Usage     `json:"usage"`
+	Cost     float64   `json:"cost,omitempty"` // 按USAGE_PRICE_*估算的费用（美元）
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// usagePrices 每百万token的价格（美元）
+type usagePrices struct {
+	PromptCacheHit  float64
+	PromptCacheMiss float64
+	Completion      float64
+}
+
+// cost 估算一次用量的费用，上游没有报告缓存命中情况时按未命中计算
+func (p usagePrices) cost(usage Usage) float64 {
+	miss := usage.PromptCacheMissTokens
+	if usage.PromptCacheHitTokens == 0 && miss == 0 {
+		miss = usage.PromptTokens
+	}
+	return (float64(usage.PromptCacheHitTokens)*p.PromptCacheHit +
+		float64(miss)*p.PromptCacheMiss +
+		float64(usage.CompletionTokens)*p.Completion) / 1e6
+}
+
+// configureUsers 设置按用户统计的用户数上限和价格
+func (s *proxyStats) configureUsers(config *ProxyConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxUsers = config.UserStatsMaxUsers
+	s.prices = usagePrices{
+		PromptCacheHit:  config.UsagePricePromptCacheHit,
+		PromptCacheMiss: config.UsagePricePromptCacheMiss,
+		Completion:      config.UsagePriceCompletion,
+	}
+}
+
+// recordUser 汇总一个请求的终端用户用量，调用方持有s.mu
+func (s *proxyStats) recordUser(user string, usage Usage, at time.Time) {
+	if user == "" || s.maxUsers <= 0 {
+		return
+	}
+	stats, ok := s.users[user]
+	if !ok {
+		if len(s.users) >= s.maxUsers {
+			user = otherUsersKey
+			stats = s.users[user]
+		}
+		if stats == nil {
+			stats = &userStats{User: user}
+			s.users[user] = stats
+		}
+	}
+	stats.Requests++
+	stats.Usage = addUsage(stats.Usage, usage)
+	stats.Cost += s.prices.cost(usage)
+	stats.LastSeen = at
+}
+
+// Users 返回各终端用户的累计用量，按总token数从多到少排序
+func (s *proxyStats) Users() []userStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]userStats, 0, len(s.users))
+	for _, stats := range s.users {
+		users = append(users, *stats)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Usage.TotalTokens != users[j].Usage.TotalTokens {
+			return users[i].Usage.TotalTokens > users[j].Usage.TotalTokens
+		}
+		return users[i].User < users[j].User
+	})
+	return users
+}
+
+// handleAdminUsers 返回按终端用户统计的用量
+func (ps *ProxyServer) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users := ps.stats.Users()
+	if err := writeJSONResponse(w, map[string]interface{}{"object": "list", "data": users}); err != nil {
+		log.Printf("写入用户统计失败: %v", err)
+	}
+}
@@ -1,16 +1,31 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// debugLogging 是否输出调试日志（完整请求体、逐块流式日志等），可通过-debug参数或管理接口切换
+var debugLogging atomic.Bool
+
+// debugf 仅在开启调试日志时输出
+func debugf(format string, args ...interface{}) {
+	if debugLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
 // writeJSONResponse 将数据以JSON格式写入HTTP响应
 // 这个函数就像是一个智能的翻译官，把Go的数据结构转换成JSON格式发送给客户端
 func writeJSONResponse(w http.ResponseWriter, data interface{}) error {
@@ -45,7 +60,7 @@ func readJSONRequest(r *http.Request, target interface{}) error {
 	}
 
 	// 记录原始请求数据，便于调试
-	log.Printf("收到JSON请求: %s", string(body))
+	debugf("收到JSON请求: %s", string(body))
 
 	// 将JSON数据解析到目标结构体中
 	if err := json.Unmarshal(body, target); err != nil {
@@ -58,9 +73,15 @@ func readJSONRequest(r *http.Request, target interface{}) error {
 
 // validateAPIKey 验证API密钥的有效性
 // 这个函数就像是门卫，检查来访者是否有正确的通行证
-func validateAPIKey(r *http.Request) error {
+func validateAPIKey(r *http.Request, apiKey string) error {
 	// 从Authorization头部获取API密钥
 	authHeader := r.Header.Get("Authorization")
+	// Anthropic和Gemini格式的客户端通过各自的头部或查询参数传递密钥
+	if authHeader == "" {
+		if key := clientAPIKey(r); key != "" {
+			authHeader = "Bearer " + key
+		}
+	}
 	if authHeader == "" {
 		// 修复：错误字符串改为小写开头
 		return fmt.Errorf("缺少authorization头部")
@@ -81,7 +102,7 @@ func validateAPIKey(r *http.Request) error {
 
 	// 验证API密钥是否与配置中的密钥匹配
 	// 在实际应用中，你可能需要更复杂的验证逻辑
-	if providedKey != GlobalConfig.DeepSeekAPIKey {
+	if providedKey != apiKey {
 		// 修复：错误字符串改为小写开头
 		return fmt.Errorf("无效的api密钥")
 	}
@@ -90,11 +111,14 @@ func validateAPIKey(r *http.Request) error {
 }
 
 // convertMessagesFormat 转换消息格式以适配DeepSeek API
-// 这是翻译过程的核心函数，处理OpenAI和DeepSeek之间的格式差异
-func convertMessagesFormat(messages []Message) []Message {
+// 这是翻译过程的核心函数，处理OpenAI和DeepSeek之间的格式差异；
+// 转换完成后按systemRules注入代理配置的系统提示词
+func convertMessagesFormat(messages []Message, systemRules []systemPromptRule) []Message {
 	log.Printf("开始转换 %d 条消息格式", len(messages))
 
 	convertedMessages := make([]Message, 0, len(messages))
+	// 最近一个旧版函数调用的id，随后的function角色消息是它的结果
+	lastLegacyCallID := ""
 
 	for i, msg := range messages {
 		log.Printf("处理消息 %d: 角色=%s", i, msg.Role)
@@ -111,9 +135,18 @@ func convertMessagesFormat(messages []Message) []Message {
 		// OpenAI使用"function"角色，而DeepSeek使用"tool"角色
 		if msg.Role == "function" {
 			convertedMsg.Role = "tool"
+			if convertedMsg.ToolCallID == "" {
+				convertedMsg.ToolCallID = lastLegacyCallID
+			}
 			log.Printf("将function角色转换为tool角色")
 		}
 
+		// 旧版的function_call消息转换为只有一个调用的tool_calls
+		if msg.FunctionCall != nil && len(msg.ToolCalls) == 0 {
+			lastLegacyCallID = legacyCallID(i)
+			msg.ToolCalls = []ToolCall{{ID: lastLegacyCallID, Function: *msg.FunctionCall}}
+		}
+
 		// 处理工具调用
 		if len(msg.ToolCalls) > 0 {
 			log.Printf("处理 %d 个工具调用", len(msg.ToolCalls))
@@ -138,13 +171,18 @@ func convertMessagesFormat(messages []Message) []Message {
 		convertedMessages = append(convertedMessages, convertedMsg)
 	}
 
+	if len(systemRules) > 0 {
+		convertedMessages = injectSystemPrompts(convertedMessages, systemRules)
+		log.Printf("注入 %d 条系统提示词规则", len(systemRules))
+	}
+
 	log.Printf("消息格式转换完成，共处理 %d 条消息", len(convertedMessages))
 	return convertedMessages
 }
 
 // convertToolChoice 转换工具选择策略
 // 不同的API对工具选择有不同的表示方式，这个函数处理这些差异
-func convertToolChoice(choice interface{}) string {
+func convertToolChoice(choice interface{}) interface{} {
 	if choice == nil {
 		return "auto" // 默认策略
 	}
@@ -152,7 +190,7 @@ func convertToolChoice(choice interface{}) string {
 	// 如果是字符串类型（auto、none等）
 	if str, ok := choice.(string); ok {
 		switch str {
-		case "auto", "none":
+		case "auto", "none", "required":
 			return str
 		default:
 			log.Printf("未知的工具选择策略: %s，使用默认值auto", str)
@@ -163,9 +201,12 @@ func convertToolChoice(choice interface{}) string {
 	// 如果是复杂对象（指定特定函数）
 	if choiceMap, ok := choice.(map[string]interface{}); ok {
 		if choiceType, exists := choiceMap["type"]; exists && choiceType == "function" {
-			// DeepSeek可能不支持指定特定函数，转换为auto
-			log.Printf("指定函数的工具选择策略转换为auto")
-			return "auto"
+			// 指定函数原样转发给DeepSeek，上游不支持时在发送时回退
+			if function, ok := choiceMap["function"].(map[string]interface{}); ok {
+				if name, ok := function["name"].(string); ok && name != "" {
+					return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": name}}
+				}
+			}
 		}
 	}
 
@@ -178,17 +219,27 @@ func convertToolChoice(choice interface{}) string {
 func logRequest(r *http.Request, requestType string) {
 	// 获取客户端IP地址
 	clientIP := getClientIP(r)
+	// 带上请求ID，便于和处理器的日志对应，日志采样也据此归属到请求
+	requestID := requestIDFor(r)
 
 	// 记录请求的基本信息
-	log.Printf("=== %s 请求 ===", requestType)
-	log.Printf("客户端IP: %s", clientIP)
-	log.Printf("请求方法: %s", r.Method)
-	log.Printf("请求路径: %s", r.URL.Path)
-	log.Printf("User-Agent: %s", r.Header.Get("User-Agent"))
+	log.Printf("[%s] === %s 请求 ===", requestID, requestType)
+	log.Printf("[%s] 客户端IP: %s", requestID, clientIP)
+	log.Printf("[%s] 请求方法: %s", requestID, r.Method)
+	log.Printf("[%s] 请求路径: %s", requestID, r.URL.Path)
+	log.Printf("[%s] User-Agent: %s", requestID, r.Header.Get("User-Agent"))
+	if clientID := clientRequestIDFor(r); clientID != "" {
+		log.Printf("[%s] 客户端请求ID: %s", requestID, clientID)
+	}
 
 	// 如果有查询参数，也记录下来
 	if r.URL.RawQuery != "" {
-		log.Printf("查询参数: %s", r.URL.RawQuery)
+		// Gemini客户端可能通过key参数传递密钥，不能写入日志
+		query := r.URL.Query()
+		if query.Has("key") {
+			query.Set("key", "***")
+		}
+		log.Printf("[%s] 查询参数: %s", requestID, strings.ReplaceAll(query.Encode(), "%2A", "*"))
 	}
 }
 
@@ -221,14 +272,19 @@ func getClientIP(r *http.Request) string {
 	return "unknown"
 }
 
-// createHTTPClient 创建用于与DeepSeek API通信的HTTP客户端
-// 这个客户端配置了适当的超时和其他参数，确保可靠的通信
-func createHTTPClient() *http.Client {
+// newHTTPClient 创建所有出站请求共用的HTTP客户端
+// 每个ProxyServer只创建一次，连接池才能在请求之间复用TCP和TLS连接
+func newHTTPClient(config *ProxyConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: config.HTTPDialTimeout, KeepAlive: 30 * time.Second}
 	transport := &http.Transport{
-		// 连接配置
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
+		// 连接池配置
+		MaxIdleConns:        config.HTTPMaxIdleConns,
+		MaxIdleConnsPerHost: config.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:     config.HTTPIdleConnTimeout,
+		DialContext:         dialer.DialContext,
+
+		// 自定义了拨号和TLS配置时，需要显式开启HTTP/2
+		ForceAttemptHTTP2: config.HTTP2Enabled,
 
 		// 超时配置
 		TLSHandshakeTimeout:   10 * time.Second,
@@ -236,48 +292,78 @@ func createHTTPClient() *http.Client {
 
 		// 关键修复：禁用自动压缩，让我们手动处理
 		DisableCompression: false,
+
+		// 自定义CA证书和跳过证书校验
+		TLSClientConfig: config.upstreamTLS.Clone(),
+	}
+	if !config.HTTP2Enabled {
+		// 非nil的空映射会关闭HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if config.upstreamResolver != nil {
+		transport.DialContext = config.upstreamResolver.DialContext
 	}
 
-	if GlobalConfig.ProxyURL != "" {
-		proxyURL, err := url.Parse(GlobalConfig.ProxyURL)
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
 		if err != nil {
 			log.Printf("错误：解析代理URL失败: %v", err)
 		} else {
 			transport.Proxy = http.ProxyURL(proxyURL)
-			log.Printf("使用代理: %s", GlobalConfig.ProxyURL)
+			log.Printf("使用代理: %s", config.ProxyURL)
+		}
+	}
+
+	if config.MockUpstream {
+		log.Printf("模拟上游模式：所有出站请求由本地模拟响应，不会调用 %s", config.Endpoint)
+		return &http.Client{
+			Timeout:   config.UpstreamTimeout,
+			Transport: &mockTransport{latency: config.MockLatency},
 		}
 	}
 
 	return &http.Client{
-		Timeout:   60 * time.Second,
+		Timeout:   config.UpstreamTimeout,
 		Transport: transport,
 	}
 }
 
+// loadUpstreamTLSConfig 按DEEPSEEK_CA_FILE和INSECURE_SKIP_VERIFY生成出站请求的TLS配置
+// CA文件中的证书追加到系统证书池，两者都未设置时返回nil使用默认配置
+func loadUpstreamTLSConfig(config *ProxyConfig) (*tls.Config, error) {
+	if config.CAFile == "" && !config.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书文件失败: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA证书文件 %s 中没有有效的PEM证书", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
 // handleError 统一的错误处理函数
-// 这个函数确保所有的错误都以一致的格式返回给客户端
+// 这个函数确保所有的错误都以OpenAI的错误格式返回给客户端；
+// 如果错误链中已经带有apiError，则以其中的状态码和类型为准
 func handleError(w http.ResponseWriter, err error, statusCode int, context string) {
 	log.Printf("错误 [%s]: %v", context, err)
 
-	// 创建错误响应
-	errorResponse := map[string]interface{}{
-		"error": map[string]interface{}{
-			"message": err.Error(),
-			"type":    "api_error",
-			"code":    statusCode,
-		},
-		"timestamp": time.Now().Unix(),
-	}
-
-	// 设置错误状态码
-	w.WriteHeader(statusCode)
-
-	// 写入错误响应
-	if writeErr := writeJSONResponse(w, errorResponse); writeErr != nil {
-		log.Printf("写入错误响应失败: %v", writeErr)
-		// 如果连错误响应都写不了，只能返回简单的文本错误
-		http.Error(w, "内部服务器错误", http.StatusInternalServerError)
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		apiErr = newAPIError(statusCode, err.Error())
 	}
+	writeAPIError(w, apiErr)
 }
 
 // truncateString 截断字符串用于日志显示
@@ -297,3 +383,16 @@ func generateRequestID() string {
 	timestamp := time.Now().UnixNano()
 	return fmt.Sprintf("req_%d", timestamp)
 }
+
+// writeFileAtomic 先写临时文件再重命名，避免进程中途退出留下不完整的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
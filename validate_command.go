@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// validate 子命令：不启动服务器，逐项检查配置文件、API密钥、上游连通性、模型映射和TLS证书，
+// 输出所有问题和修改建议，有错误时以非零状态退出，适合在部署前或CI中运行
+
+// knownDeepSeekModels 无法从上游获取模型列表时用于检查模型名
+var knownDeepSeekModels = []string{"deepseek-chat", "deepseek-reasoner", "deepseek-coder"}
+
+// certExpiryWarning 证书在多久内过期时给出警告
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// 检查结果的级别
+const (
+	diagnosticOK    = "ok"
+	diagnosticWarn  = "warn"
+	diagnosticError = "error"
+)
+
+// configDiagnostic 一项检查结果
+type configDiagnostic struct {
+	level   string
+	subject string
+	message string
+	hint    string // 如何修改
+}
+
+// configReport 所有检查结果
+type configReport struct {
+	items []configDiagnostic
+}
+
+func (r *configReport) ok(subject, format string, args ...interface{}) {
+	r.items = append(r.items, configDiagnostic{level: diagnosticOK, subject: subject, message: fmt.Sprintf(format, args...)})
+}
+
+func (r *configReport) warn(subject, message, hint string) {
+	r.items = append(r.items, configDiagnostic{level: diagnosticWarn, subject: subject, message: message, hint: hint})
+}
+
+func (r *configReport) fail(subject, message, hint string) {
+	r.items = append(r.items, configDiagnostic{level: diagnosticError, subject: subject, message: message, hint: hint})
+}
+
+// count 某个级别的结果数
+func (r *configReport) count(level string) int {
+	n := 0
+	for _, item := range r.items {
+		if item.level == level {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *configReport) print() {
+	icons := map[string]string{diagnosticOK: "✓", diagnosticWarn: "⚠", diagnosticError: "✗"}
+	for _, item := range r.items {
+		fmt.Printf("%s [%s] %s\n", icons[item.level], item.subject, item.message)
+		if item.hint != "" {
+			fmt.Printf("    → %s\n", item.hint)
+		}
+	}
+	fmt.Println()
+	fmt.Printf("检查完成：%d 项错误，%d 项警告\n", r.count(diagnosticError), r.count(diagnosticWarn))
+}
+
+// runValidateCommand 检查配置并输出报告，有错误时返回1
+func runValidateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", ".env", "配置文件路径")
+	offline := fs.Bool("offline", false, "不检查DeepSeek端点的连通性")
+	timeout := fs.Duration("timeout", 10*time.Second, "连通性检查的超时")
+	fs.Parse(args)
+
+	report := &configReport{}
+	path := *configFile
+	if _, err := os.Stat(path); err != nil {
+		if flagPassed(fs, "config") {
+			report.fail("配置文件", fmt.Sprintf("无法读取 %s: %v", path, err), "检查 -config 指定的路径")
+		} else {
+			report.warn("配置文件", fmt.Sprintf("未找到 %s，只使用环境变量", path), "")
+		}
+		path = ""
+	}
+	// 与serve相同的方式读取：已设置的环境变量优先于配置文件
+	config, err := readConfig(path)
+	if err != nil {
+		report.fail("配置文件", err.Error(), "每行应为 KEY=VALUE 格式，参考 .env.example")
+		report.print()
+		return 1
+	}
+	if path != "" {
+		report.ok("配置文件", "已读取 %s", path)
+	}
+
+	for _, err := range checkConfig(config) {
+		report.fail("配置", err.Error(), "参考 .env.example 中对应配置项的说明")
+	}
+	if err := prepareConfig(config); err != nil {
+		report.fail("上游配置", err.Error(), "检查 UPSTREAM_HEADERS、DEEPSEEK_CA_FILE、DNS_SERVER / DNS_DOH_URL 和 PRIORITY_* 配置")
+	}
+
+	checkAPIKey(report, config)
+	models := checkEndpoint(report, config, *offline, *timeout)
+	checkModelMappings(report, config, models)
+	checkTLSFiles(report, config)
+	checkStateStore(report, config, *offline)
+
+	report.print()
+	if report.count(diagnosticError) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkAPIKey 检查DeepSeek API密钥的格式
+func checkAPIKey(report *configReport, config *ProxyConfig) {
+	key := config.DeepSeekAPIKey
+	switch {
+	case key == "":
+		// checkConfig已经报告
+	case config.MockUpstream || config.CassetteMode == cassetteReplay:
+		report.ok("API密钥", "不调用DeepSeek，使用 %s", maskAPIKey(key))
+	case strings.TrimSpace(key) != key:
+		report.fail("API密钥", "DEEPSEEK_API_KEY 首尾有空白字符", "删除密钥前后的空格或换行")
+	case !strings.HasPrefix(key, "sk-"):
+		report.warn("API密钥", "DEEPSEEK_API_KEY 不是以 sk- 开头", "确认填写的是 https://platform.deepseek.com 上创建的API密钥")
+	case len(key) < 20:
+		report.warn("API密钥", "DEEPSEEK_API_KEY 长度过短，可能不完整", "重新复制完整的API密钥")
+	default:
+		report.ok("API密钥", "格式正确 (%s)", maskAPIKey(key))
+	}
+}
+
+// checkEndpoint 请求上游的模型列表检查连通性和密钥是否有效，成功时返回上游支持的模型
+func checkEndpoint(report *configReport, config *ProxyConfig, offline bool, timeout time.Duration) []string {
+	switch {
+	case config.MockUpstream:
+		report.ok("上游连通性", "模拟上游模式，跳过检查")
+		return nil
+	case config.CassetteMode == cassetteReplay:
+		report.ok("上游连通性", "回放模式，跳过检查")
+		return nil
+	case offline:
+		report.warn("上游连通性", "已跳过 (-offline)", "")
+		return nil
+	case config.Endpoint == "" || config.DeepSeekAPIKey == "":
+		return nil
+	}
+
+	client := newHTTPClient(config)
+	client.Timeout = timeout
+	req, err := http.NewRequest("GET", strings.TrimRight(config.Endpoint, "/")+"/v1/models", nil)
+	if err != nil {
+		report.fail("上游连通性", fmt.Sprintf("DEEPSEEK_ENDPOINT 无效: %v", err), "应为 https://api.deepseek.com 这样的地址")
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+config.DeepSeekAPIKey)
+	setUpstreamHeaders(req, config)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		hint := "检查网络连接和 DEEPSEEK_ENDPOINT"
+		if config.ProxyURL != "" {
+			hint = "检查 PROXY_URL 指向的代理是否可用"
+		}
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			hint = "证书校验失败，内网端点可设置 DEEPSEEK_CA_FILE"
+		}
+		report.fail("上游连通性", fmt.Sprintf("无法连接 %s: %v", config.Endpoint, err), hint)
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	latency := time.Since(start).Round(time.Millisecond)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		report.fail("上游连通性", fmt.Sprintf("%s 拒绝了API密钥（%d）", config.Endpoint, resp.StatusCode), "确认 DEEPSEEK_API_KEY 未被删除或填错")
+		return nil
+	case http.StatusPaymentRequired:
+		report.warn("上游连通性", "账户余额不足（402）", "在 DeepSeek 平台充值后请求才能成功")
+		return nil
+	default:
+		report.warn("上游连通性", fmt.Sprintf("%s 返回 %d: %s", config.Endpoint, resp.StatusCode, truncateString(string(body), 200)), "确认 DEEPSEEK_ENDPOINT 是 OpenAI 兼容的 DeepSeek API 地址")
+		return nil
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil || len(list.Data) == 0 {
+		report.ok("上游连通性", "%s 可以访问（%v），但未返回模型列表", config.Endpoint, latency)
+		return nil
+	}
+	models := make([]string, len(list.Data))
+	for i, model := range list.Data {
+		models[i] = model.ID
+	}
+	sort.Strings(models)
+	report.ok("上游连通性", "%s 可以访问（%v），可用模型: %s", config.Endpoint, latency, strings.Join(models, ", "))
+	return models
+}
+
+// checkModelMappings 检查默认模型和各项模型映射的目标是否是上游支持的模型
+func checkModelMappings(report *configReport, config *ProxyConfig, models []string) {
+	if len(models) == 0 {
+		models = knownDeepSeekModels
+	}
+	available := make(map[string]bool, len(models))
+	for _, model := range models {
+		available[model] = true
+	}
+	hint := fmt.Sprintf("可用的模型: %s", strings.Join(models, ", "))
+	problems := 0
+	checkTarget := func(source, model string) {
+		if model != "" && !available[model] {
+			problems++
+			report.warn("模型映射", fmt.Sprintf("%s 中的 %s 不是DeepSeek支持的模型", source, model), hint)
+		}
+	}
+
+	checkTarget("DEEPSEEK_MODEL", config.DeepSeekModel)
+	checkTarget("SHADOW_MODEL", config.ShadowModel)
+
+	if splits, err := newModelSplits(config); err != nil {
+		problems++
+		report.fail("模型映射", err.Error(), "格式为 模型=目标:权重|目标:权重，多条规则用逗号分隔")
+	} else if splits != nil {
+		names := make([]string, 0, len(splits.rules))
+		for model := range splits.rules {
+			names = append(names, model)
+		}
+		sort.Strings(names)
+		for _, model := range names {
+			for _, arm := range splits.rules[model] {
+				checkTarget("MODEL_SPLITS 的 "+model, arm.Model)
+			}
+		}
+	}
+
+	if schedule, err := newOffPeakSchedule(config); err != nil {
+		problems++
+		report.fail("模型映射", err.Error(), "参考 .env.example 中 OFF_PEAK_* 的说明")
+	} else if schedule != nil {
+		for from, to := range schedule.peakModels {
+			checkTarget("OFF_PEAK_PEAK_MODELS 的 "+from, to)
+		}
+	}
+
+	if tenants, err := loadTenants(config); err != nil {
+		problems++
+		report.fail("租户", err.Error(), "参考 tenants.example.json 检查 TENANTS_FILE")
+	} else if tenants != nil {
+		for _, t := range tenants.tenants {
+			names := make([]string, 0, len(t.Models))
+			for model := range t.Models {
+				names = append(names, model)
+			}
+			sort.Strings(names)
+			for _, model := range names {
+				checkTarget("租户 "+t.Name+" 的 "+model, t.Models[model])
+			}
+			for _, model := range t.AllowedModels {
+				checkTarget("租户 "+t.Name+" 的allowed_models", model)
+			}
+		}
+		report.ok("租户", "已加载 %d 个租户", len(tenants.tenants))
+	}
+
+	for _, model := range GetSupportedModels() {
+		if target := mapNewModelsToDeepSeek(model); !available[target] {
+			problems++
+			report.warn("模型映射", fmt.Sprintf("内置映射 %s -> %s 的目标不在上游模型列表中", model, target), hint)
+		}
+	}
+	if problems == 0 {
+		report.ok("模型映射", "默认模型 %s，所有映射目标都是可用的模型", config.DeepSeekModel)
+	}
+}
+
+// checkTLSFiles 检查HTTPS证书和私钥是否匹配、是否即将过期
+func checkTLSFiles(report *configReport, config *ProxyConfig) {
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		report.fail("TLS证书", fmt.Sprintf("无法加载证书和私钥: %v", err), "确认 TLS_CERT_FILE 是PEM格式的证书链，TLS_KEY_FILE 是与之匹配的私钥")
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		report.fail("TLS证书", fmt.Sprintf("无法解析证书: %v", err), "")
+		return
+	}
+	remaining := time.Until(leaf.NotAfter)
+	switch {
+	case remaining <= 0:
+		report.fail("TLS证书", fmt.Sprintf("证书已于 %s 过期", leaf.NotAfter.Format("2006-01-02")), "更新证书，或改用 ACME_DOMAIN 自动续期")
+	case remaining < certExpiryWarning:
+		report.warn("TLS证书", fmt.Sprintf("证书将于 %s 过期", leaf.NotAfter.Format("2006-01-02")), "尽快更新证书，或改用 ACME_DOMAIN 自动续期")
+	default:
+		report.ok("TLS证书", "%s，有效期至 %s", strings.Join(leaf.DNSNames, ", "), leaf.NotAfter.Format("2006-01-02"))
+	}
+}
+
+// checkStateStore 检查共享状态使用的Redis能否连接
+func checkStateStore(report *configReport, config *ProxyConfig, offline bool) {
+	if config.StateStore != "redis" || config.RedisURL == "" {
+		return
+	}
+	if offline {
+		report.warn("共享状态", "已跳过Redis连通性检查 (-offline)", "")
+		return
+	}
+	store, err := newRedisStore(config.RedisURL, config.RedisKeyPrefix)
+	if err != nil {
+		report.fail("共享状态", err.Error(), "检查 REDIS_URL 的地址、密码和数据库编号")
+		return
+	}
+	store.Close()
+	report.ok("共享状态", "Redis %s 可用", store.addr)
+}
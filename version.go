@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	runtimedebug "runtime/debug"
+)
+
+// 构建信息，发布时通过-ldflags注入：
+//
+//	go build -ldflags "-X main.Version=1.2.0 -X main.GitCommit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// 未注入时从Go工具链记录的VCS信息中补全
+var (
+	Version   = "1.0.0"
+	GitCommit = ""
+	BuildDate = ""
+)
+
+func init() {
+	info, ok := runtimedebug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if GitCommit == "" {
+				GitCommit = setting.Value
+				if len(GitCommit) > 12 {
+					GitCommit = GitCommit[:12]
+				}
+			}
+		case "vcs.time":
+			if BuildDate == "" {
+				BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified && GitCommit != "" {
+		GitCommit += "-dirty"
+	}
+}
+
+// buildInfo 版本和构建信息
+type buildInfo struct {
+	Version    string `json:"version"`
+	GitCommit  string `json:"git_commit"`
+	BuildDate  string `json:"build_date"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+	ConfigHash string `json:"config_hash,omitempty"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   Version,
+		GitCommit: valueOr(GitCommit, "unknown"),
+		BuildDate: valueOr(BuildDate, "unknown"),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// configHash 运行配置的摘要，用于确认多个实例或热升级前后加载的配置是否一致
+// 只输出哈希前缀，不会泄露密钥内容
+func configHash(config *ProxyConfig) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// handleVersion 返回版本、构建信息和当前配置哈希
+func (ps *ProxyServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := currentBuildInfo()
+	info.ConfigHash = configHash(ps.config)
+	if err := writeJSONResponse(w, info); err != nil {
+		log.Printf("写入版本信息失败: %v", err)
+	}
+}
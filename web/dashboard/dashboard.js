@@ -0,0 +1,164 @@
+// 仪表盘：每2秒轮询 /admin/dashboard 并刷新图表和表格
+// 页面本身通过HTTP Basic认证访问，浏览器会在同源请求中自动带上凭据
+(function () {
+    "use strict";
+
+    var REFRESH_INTERVAL = 2000;
+
+    function $(id) {
+        return document.getElementById(id);
+    }
+
+    function escapeHTML(value) {
+        return String(value === undefined || value === null ? "" : value)
+            .replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+    }
+
+    function formatDuration(ms) {
+        if (ms < 1000) return ms + "ms";
+        if (ms < 60000) return (ms / 1000).toFixed(1) + "s";
+        return Math.floor(ms / 60000) + "m" + Math.floor((ms % 60000) / 1000) + "s";
+    }
+
+    // 按设备像素比设置画布尺寸，避免高分屏模糊
+    function prepareCanvas(canvas) {
+        var ratio = window.devicePixelRatio || 1;
+        var width = canvas.clientWidth;
+        var height = canvas.clientHeight;
+        canvas.width = width * ratio;
+        canvas.height = height * ratio;
+        var ctx = canvas.getContext("2d");
+        ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+        ctx.clearRect(0, 0, width, height);
+        ctx.font = "11px sans-serif";
+        return { ctx: ctx, width: width, height: height };
+    }
+
+    function drawAxis(c, max, left, bottom) {
+        c.ctx.fillStyle = "#999";
+        c.ctx.strokeStyle = "#eee";
+        c.ctx.fillText(String(max), 0, 12);
+        c.ctx.fillText("0", 0, c.height - bottom);
+        c.ctx.beginPath();
+        c.ctx.moveTo(left, c.height - bottom);
+        c.ctx.lineTo(c.width, c.height - bottom);
+        c.ctx.stroke();
+    }
+
+    function drawRPMChart(series) {
+        var c = prepareCanvas($("rpm-chart"));
+        var left = 36, bottom = 18;
+        var max = 1;
+        series.forEach(function (point) { max = Math.max(max, point.requests); });
+        drawAxis(c, max, left, bottom);
+
+        var plotHeight = c.height - bottom - 8;
+        var step = (c.width - left) / series.length;
+        var barWidth = Math.max(1, step - 2);
+        series.forEach(function (point, i) {
+            var x = left + i * step;
+            var requestHeight = point.requests / max * plotHeight;
+            var errorHeight = point.errors / max * plotHeight;
+            c.ctx.fillStyle = "#007bff";
+            c.ctx.fillRect(x, c.height - bottom - requestHeight, barWidth, requestHeight);
+            c.ctx.fillStyle = "#dc3545";
+            c.ctx.fillRect(x, c.height - bottom - errorHeight, barWidth, errorHeight);
+        });
+
+        c.ctx.fillStyle = "#999";
+        if (series.length > 0) {
+            var first = new Date(series[0].minute * 1000);
+            c.ctx.fillText(first.toLocaleTimeString().slice(0, 5), left, c.height - 4);
+            c.ctx.fillText("现在", c.width - 24, c.height - 4);
+        }
+    }
+
+    function drawTokensChart(tokens) {
+        var c = prepareCanvas($("tokens-chart"));
+        var models = Object.keys(tokens).sort();
+        if (models.length === 0) {
+            c.ctx.fillStyle = "#999";
+            c.ctx.fillText("暂无数据", c.width / 2 - 20, c.height / 2);
+            return;
+        }
+
+        var labelWidth = 140;
+        var max = 1;
+        models.forEach(function (model) { max = Math.max(max, tokens[model].total_tokens); });
+        var rowHeight = Math.min(32, c.height / models.length);
+        models.forEach(function (model, i) {
+            var usage = tokens[model];
+            var y = i * rowHeight;
+            var scale = (c.width - labelWidth - 80) / max;
+            c.ctx.fillStyle = "#333";
+            c.ctx.fillText(model, 0, y + rowHeight / 2 + 4);
+            c.ctx.fillStyle = "#007bff";
+            c.ctx.fillRect(labelWidth, y + 4, usage.prompt_tokens * scale, rowHeight - 8);
+            c.ctx.fillStyle = "#28a745";
+            c.ctx.fillRect(labelWidth + usage.prompt_tokens * scale, y + 4, usage.completion_tokens * scale, rowHeight - 8);
+            c.ctx.fillStyle = "#666";
+            c.ctx.fillText(String(usage.total_tokens), labelWidth + usage.total_tokens * scale + 6, y + rowHeight / 2 + 4);
+        });
+    }
+
+    function renderRows(tbody, rows, columns, emptyText) {
+        if (rows.length === 0) {
+            tbody.innerHTML = '<tr><td class="empty" colspan="' + columns + '">' + emptyText + "</td></tr>";
+            return;
+        }
+        tbody.innerHTML = rows.join("");
+    }
+
+    function render(data) {
+        var summary = data.summary;
+        $("requests-total").textContent = summary.requests_total;
+        $("requests-in-flight").textContent = summary.requests_in_flight;
+        $("active-streams").textContent = summary.active_streams;
+        $("breaker").textContent = data.breaker.state;
+
+        var requests = 0, errors = 0;
+        data.series.forEach(function (point) {
+            requests += point.requests;
+            errors += point.errors;
+        });
+        $("error-rate").textContent = requests > 0 ? (errors / requests * 100).toFixed(1) + "%" : "-";
+
+        drawRPMChart(data.series);
+        drawTokensChart(data.tokens);
+
+        renderRows($("streams"), data.streams.map(function (stream) {
+            return "<tr><td>" + escapeHTML(stream.request_id) + "</td><td>" + escapeHTML(stream.model) +
+                "</td><td>" + escapeHTML(stream.client_ip) + "</td><td>" + formatDuration(stream.duration_ms) + "</td></tr>";
+        }), 4, "当前没有流式响应");
+
+        renderRows($("recent"), data.recent.map(function (entry) {
+            var statusClass = entry.status >= 400 ? ' class="status-error"' : "";
+            return "<tr><td>" + new Date(entry.time).toLocaleTimeString() + "</td><td>" + escapeHTML(entry.method) +
+                "</td><td>" + escapeHTML(entry.path) + "</td><td>" + escapeHTML(entry.model) +
+                "</td><td" + statusClass + ">" + entry.status + "</td><td>" + formatDuration(entry.duration_ms) +
+                "</td><td>" + (entry.total_tokens || "") + "</td><td>" + escapeHTML(entry.client_ip) + "</td></tr>";
+        }), 8, "暂无请求");
+    }
+
+    function refresh() {
+        fetch("/admin/dashboard", { credentials: "same-origin" })
+            .then(function (response) {
+                if (!response.ok) throw new Error("HTTP " + response.status);
+                return response.json();
+            })
+            .then(function (data) {
+                $("status").textContent = "运行中";
+                $("status").className = "badge ok";
+                render(data);
+            })
+            .catch(function (err) {
+                $("status").textContent = "连接失败: " + err.message;
+                $("status").className = "badge error";
+            })
+            .finally(function () {
+                setTimeout(refresh, REFRESH_INTERVAL);
+            });
+    }
+
+    refresh();
+})();
@@ -0,0 +1,188 @@
+// Playground：通过本代理的OpenAI兼容接口发起对话，支持流式输出和推理过程显示
+(function () {
+    "use strict";
+
+    var history = [];
+    var busy = false;
+
+    function $(id) {
+        return document.getElementById(id);
+    }
+
+    function apiKey() {
+        return $("api-key").value.trim();
+    }
+
+    function loadModels() {
+        fetch("/v1/models")
+            .then(function (response) { return response.json(); })
+            .then(function (data) {
+                var select = $("model");
+                var saved = localStorage.getItem("playground.model");
+                data.data.forEach(function (model) {
+                    var option = document.createElement("option");
+                    option.value = model.id;
+                    option.textContent = model.id;
+                    if (model.id === saved) option.selected = true;
+                    select.appendChild(option);
+                });
+            })
+            .catch(function (err) {
+                addMessage("error", "加载模型列表失败: " + err.message);
+            });
+    }
+
+    function addMessage(role, text) {
+        var element = document.createElement("div");
+        element.className = "message " + role;
+        var label = document.createElement("div");
+        label.className = "role";
+        label.textContent = role === "user" ? "你" : role === "error" ? "错误" : $("model").value;
+        var reasoning = document.createElement("div");
+        reasoning.className = "reasoning";
+        reasoning.hidden = true;
+        var content = document.createElement("div");
+        content.className = "content";
+        content.textContent = text || "";
+        var meta = document.createElement("div");
+        meta.className = "meta";
+        element.appendChild(label);
+        element.appendChild(reasoning);
+        element.appendChild(content);
+        element.appendChild(meta);
+        $("messages").appendChild(element);
+        element.scrollIntoView({ block: "end" });
+        return { reasoning: reasoning, content: content, meta: meta, element: element };
+    }
+
+    function appendText(target, text) {
+        if (!text) return;
+        target.hidden = false;
+        target.textContent += text;
+    }
+
+    function describeUsage(usage, startedAt) {
+        var parts = [((Date.now() - startedAt) / 1000).toFixed(1) + "s"];
+        if (usage) {
+            parts.push("提示词 " + usage.prompt_tokens + " / 生成 " + usage.completion_tokens + " tokens");
+            if (usage.completion_tokens_details && usage.completion_tokens_details.reasoning_tokens) {
+                parts.push("推理 " + usage.completion_tokens_details.reasoning_tokens);
+            }
+        }
+        return parts.join(" · ");
+    }
+
+    // 读取SSE流，逐块追加推理内容和正文
+    function readStream(response, view, startedAt) {
+        var reader = response.body.getReader();
+        var decoder = new TextDecoder();
+        var buffer = "";
+        var answer = "";
+        var usage = null;
+
+        function pump() {
+            return reader.read().then(function (result) {
+                if (result.done) return answer;
+                buffer += decoder.decode(result.value, { stream: true });
+                var lines = buffer.split("\n");
+                buffer = lines.pop();
+                lines.forEach(function (line) {
+                    if (line.indexOf("data: ") !== 0) return;
+                    var data = line.slice(6);
+                    if (data === "[DONE]") return;
+                    var chunk = JSON.parse(data);
+                    if (chunk.error) throw new Error(chunk.error.message);
+                    if (chunk.usage) usage = chunk.usage;
+                    (chunk.choices || []).forEach(function (choice) {
+                        var delta = choice.delta || {};
+                        appendText(view.reasoning, delta.reasoning_content);
+                        appendText(view.content, delta.content);
+                        answer += delta.content || "";
+                    });
+                    view.element.scrollIntoView({ block: "end" });
+                });
+                view.meta.textContent = describeUsage(usage, startedAt);
+                return pump();
+            });
+        }
+        return pump();
+    }
+
+    function send(text) {
+        if (busy || !text) return;
+        if (!apiKey()) {
+            addMessage("error", "请先填写 API Key");
+            return;
+        }
+        localStorage.setItem("playground.model", $("model").value);
+
+        busy = true;
+        $("send").disabled = true;
+        history.push({ role: "user", content: text });
+        addMessage("user", text);
+
+        var stream = $("stream").checked;
+        var view = addMessage("assistant", "");
+        var startedAt = Date.now();
+
+        fetch("/v1/chat/completions", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                "Authorization": "Bearer " + apiKey()
+            },
+            body: JSON.stringify({ model: $("model").value, messages: history, stream: stream })
+        })
+            .then(function (response) {
+                if (!response.ok) {
+                    return response.json().then(function (body) {
+                        throw new Error(body.error ? body.error.message : "HTTP " + response.status);
+                    });
+                }
+                if (stream) return readStream(response, view, startedAt);
+                return response.json().then(function (body) {
+                    var message = body.choices[0].message;
+                    view.content.textContent = message.content;
+                    view.meta.textContent = describeUsage(body.usage, startedAt);
+                    return message.content;
+                });
+            })
+            .then(function (answer) {
+                history.push({ role: "assistant", content: answer });
+            })
+            .catch(function (err) {
+                view.element.className = "message error";
+                view.content.textContent = err.message;
+                history.pop();
+            })
+            .finally(function () {
+                busy = false;
+                $("send").disabled = false;
+            });
+    }
+
+    $("api-key").value = localStorage.getItem("playground.apiKey") || "";
+    $("api-key").addEventListener("change", function () {
+        localStorage.setItem("playground.apiKey", apiKey());
+    });
+    $("show-reasoning").addEventListener("change", function () {
+        document.body.classList.toggle("hide-reasoning", !this.checked);
+    });
+    $("clear").addEventListener("click", function () {
+        history = [];
+        $("messages").innerHTML = "";
+    });
+    $("composer").addEventListener("submit", function (event) {
+        event.preventDefault();
+        var text = $("input").value.trim();
+        $("input").value = "";
+        send(text);
+    });
+    $("input").addEventListener("keydown", function (event) {
+        if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+            $("composer").requestSubmit();
+        }
+    });
+
+    loadModels();
+})();
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket单条消息的最大字节数
+const webSocketMaxMessageBytes = 32 << 20
+
+// handleChatWebSocket 处理WebSocket形式的聊天完成：GET /v1/chat/ws
+// 客户端每发送一条消息（与/v1/chat/completions相同的JSON请求体），代理按同样的流程处理，
+// 流式响应的每个数据块作为一条文本消息发回，最后发送[DONE]；非流式响应和错误作为一条JSON消息发回。
+// 同一连接上的请求依次处理，连接断开时取消进行中的请求。
+// 浏览器无法为WebSocket设置请求头，密钥可以通过key查询参数传递
+func (ps *ProxyServer) handleChatWebSocket(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		ps.serveChatWebSocket(conn, r)
+	}}
+	server.ServeHTTP(w, r)
+}
+
+// serveChatWebSocket 读取连接上的请求并依次处理
+func (ps *ProxyServer) serveChatWebSocket(conn *websocket.Conn, r *http.Request) {
+	defer conn.Close()
+	conn.MaxPayloadBytes = webSocketMaxMessageBytes
+	clientIP := getClientIP(r)
+	log.Printf("WebSocket连接已建立: %s", clientIP)
+
+	// 消息不随升级请求的context结束，但保留认证时确定的租户等请求级信息
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	// 在后台读取消息，这样连接断开时能及时取消进行中的请求
+	messages := make(chan []byte, 16)
+	go func() {
+		defer close(messages)
+		for {
+			var message []byte
+			if err := websocket.Message.Receive(conn, &message); err != nil {
+				cancel()
+				return
+			}
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	count := 0
+	for message := range messages {
+		count++
+		// 每条消息是一个独立的请求，使用新的内部请求ID
+		msgCtx := context.WithValue(ctx, requestIDKey{}, generateRequestID())
+		req, err := http.NewRequestWithContext(msgCtx, "POST", "/v1/chat/completions", bytes.NewReader(message))
+		if err != nil {
+			continue
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		if key := clientAPIKey(r); key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		req.RemoteAddr = r.RemoteAddr
+
+		ww := &webSocketResponseWriter{conn: conn, header: make(http.Header)}
+		// 每条消息单独计入配额和租户限流，并单独统计用量
+		ps.serveInternal(ww, req, http.HandlerFunc(ps.handleChatCompletions))
+		if err := ww.finish(); err != nil {
+			log.Printf("WebSocket发送响应失败: %v", err)
+			break
+		}
+	}
+	log.Printf("WebSocket连接已关闭: %s，共处理 %d 个请求", clientIP, count)
+}
+
+// webSocketResponseWriter 把处理器写出的HTTP响应转换为WebSocket消息
+// SSE响应的每个data字段作为一条消息发送，注释行（心跳）忽略；其他响应在处理结束后整体发送
+type webSocketResponseWriter struct {
+	conn   *websocket.Conn
+	header http.Header
+	status int
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	err error
+}
+
+func (ww *webSocketResponseWriter) Header() http.Header {
+	return ww.header
+}
+
+func (ww *webSocketResponseWriter) WriteHeader(statusCode int) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.status == 0 {
+		ww.status = statusCode
+	}
+}
+
+func (ww *webSocketResponseWriter) Write(p []byte) (int, error) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.status == 0 {
+		ww.status = http.StatusOK
+	}
+	if ww.err != nil {
+		return 0, ww.err
+	}
+	ww.buf.Write(p)
+	if ww.streaming() {
+		ww.sendEvents()
+	}
+	return len(p), ww.err
+}
+
+// Flush SSE数据在Write时已经按事件发送
+func (ww *webSocketResponseWriter) Flush() {}
+
+// streaming 处理器是否在写SSE流，调用方持有ww.mu
+func (ww *webSocketResponseWriter) streaming() bool {
+	return ww.status < http.StatusBadRequest && strings.HasPrefix(ww.header.Get("Content-Type"), "text/event-stream")
+}
+
+// sendEvents 发送缓冲区中完整的SSE事件，调用方持有ww.mu
+func (ww *webSocketResponseWriter) sendEvents() {
+	for ww.err == nil {
+		end := bytes.Index(ww.buf.Bytes(), []byte("\n\n"))
+		if end < 0 {
+			return
+		}
+		event := ww.buf.Next(end + 2)
+		for _, line := range strings.Split(string(event), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				ww.err = websocket.Message.Send(ww.conn, data)
+			}
+		}
+	}
+}
+
+// finish 处理器返回后发送非流式响应
+func (ww *webSocketResponseWriter) finish() error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.err != nil || ww.streaming() {
+		return ww.err
+	}
+	if body := bytes.TrimSpace(ww.buf.Bytes()); len(body) > 0 {
+		ww.err = websocket.Message.Send(ww.conn, string(body))
+	}
+	return ww.err
+}
+
+// hijack 从包装的ResponseWriter中取出底层连接，供WebSocket升级使用
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("响应不支持连接接管")
+	}
+	return hijacker.Hijack()
+}